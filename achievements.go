@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	badgeShutout   = "shutout"
+	badgeComeback  = "comeback"
+	badgeHatTrick  = "hat_trick"
+	badgeWinStreak = "win_streak_10"
+	badgeFirstGame = "first_game"
+	badgeGoals100  = "goals_100"
+)
+
+var badgeNames = map[string]string{
+	badgeShutout:   "Shutout",
+	badgeComeback:  "Comeback",
+	badgeHatTrick:  "Hat-trick",
+	badgeWinStreak: "10 Game Win Streak",
+	badgeFirstGame: "First Game",
+	badgeGoals100:  "100 Goals",
+}
+
+// badgeAward is a badge awarded to a player for the game that earned it.
+type badgeAward struct {
+	PlayerID  string `json:"player_id"`
+	Badge     string `json:"badge"`
+	Name      string `json:"name"`
+	GameID    int    `json:"game_id"`
+	Timestamp int64  `json:"awarded_timestamp,omitempty"`
+}
+
+// comebackBy reports whether side won after trailing 0 to one goal short of
+// the winning score.
+func (g finishedGame) comebackBy(side string, goalsToWin int) bool {
+	var own, other int
+	for _, scored := range g.timeline {
+		if scored == side {
+			own++
+		} else {
+			other++
+		}
+		if own == 0 && other == goalsToWin-1 {
+			return true
+		}
+	}
+	return false
+}
+
+// awardBadges evaluates a finished game and each player's history, and stores
+// the badges earned. Win streaks are kept per format, while milestone badges
+// count every game the player has played.
+func awardBadges(repo repository, rules matchRules, g finishedGame, log *slog.Logger) []badgeAward {
+	var awarded []badgeAward
+	winner, loserScore := "black", g.yellowScore
+	if g.yellowScore > g.blackScore {
+		winner, loserScore = "yellow", g.blackScore
+	}
+	sides := map[string][2]player{"black": g.blackSide, "yellow": g.yellowSide}
+	for _, side := range []string{"black", "yellow"} {
+		won := side == winner
+		comeback := won && g.comebackBy(side, rules.GoalsToWin)
+		for _, p := range sides[side] {
+			if p.Sub == "" {
+				continue
+			}
+			history, err := repo.PlayerHistory(p.Sub, g.format)
+			if err != nil {
+				log.Error("error loading player history", "player", p.Sub, "err", err)
+				continue
+			}
+			career, err := repo.PlayerHistory(p.Sub, "")
+			if err != nil {
+				log.Error("error loading player history", "player", p.Sub, "err", err)
+				continue
+			}
+			var earned []string
+			if won && loserScore == 0 {
+				earned = append(earned, badgeShutout)
+			}
+			if comeback {
+				earned = append(earned, badgeComeback)
+			}
+			if p.Goals >= 3 {
+				earned = append(earned, badgeHatTrick)
+			}
+			if won && history.WinStreak == 10 {
+				earned = append(earned, badgeWinStreak)
+			}
+			if career.Played == 1 {
+				earned = append(earned, badgeFirstGame)
+			}
+			if career.Goals >= 100 && career.Goals-p.Goals < 100 {
+				earned = append(earned, badgeGoals100)
+			}
+			for _, badge := range earned {
+				a := badgeAward{PlayerID: p.Sub, Badge: badge, Name: badgeNames[badge], GameID: g.id}
+				err := repo.AwardBadge(a)
+				if err != nil {
+					log.Error("error awarding badge", "player", p.Sub, "badge", badge, "err", err)
+					continue
+				}
+				log.Info("badge awarded", "player", p.Sub, "badge", badge)
+				badgesAwarded.inc(badge)
+				awarded = append(awarded, a)
+			}
+		}
+	}
+	return awarded
+}
+
+// badgesHandler lists the badges a player has been awarded.
+type badgesHandler struct {
+	repo repository
+}
+
+func (bh badgesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sub := mux.Vars(r)["sub"]
+	_, err := bh.repo.GetPlayer(sub)
+	if err == errNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logger.Error("error loading player", "player", sub, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	badges, err := bh.repo.Badges(sub)
+	if err != nil {
+		logger.Error("error loading badges", "player", sub, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(badges)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// expectBadges reads the Game Over broadcast on every client and checks the
+// badges announced with it, given as "player:badge".
+func (ts *testServer) expectBadges(want ...string) {
+	ts.t.Helper()
+	sort.Strings(want)
+	for _, c := range ts.clients {
+		b := c.next()
+		if b.message != "Game Over" {
+			ts.t.Fatalf("client %s: expected Game Over, got %+v", c.sub, b)
+		}
+		got := []string{}
+		for _, a := range b.badges {
+			got = append(got, a.PlayerID+":"+a.Badge)
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			ts.t.Fatalf("client %s: expected badges %v, got %v", c.sub, want, got)
+		}
+	}
+}
+
+func TestComebackBadges(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	b1, b2, y1, y2 := setUpMatch(ts)
+	for _, c := range []*testClient{b1, b2, b1, b2} {
+		c.goal()
+		ts.expectState()
+	}
+	// An undone goal is taken off the timeline, so yellow trails 0-3 only.
+	y1.goal()
+	ts.expectState()
+	y1.undoGoal()
+	ts.expectState()
+	for _, c := range []*testClient{y1, y2, y1, y1, y2} {
+		c.goal()
+		ts.expectState()
+	}
+	ts.expectBadges("1:first_game", "2:first_game", "3:first_game", "4:first_game",
+		"3:comeback", "4:comeback", "3:hat_trick")
+
+	var badges []badgeAward
+	if code := ts.get("/players/3/badges", &badges); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(badges) != 3 || badges[0].GameID != 1 || badges[0].Name == "" || badges[0].Timestamp == 0 {
+		t.Fatalf("unexpected badges %+v", badges)
+	}
+	if code := ts.get("/players/9/badges", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown player, got %d", code)
+	}
+}
+
+func TestHistoryBadges(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4", "5", "6", "7")
+	own, _ := ts.repo.CreateTeam("Vancouver", "Canucks", "1", "5")
+	other, _ := ts.repo.CreateTeam("Toronto", "Maple Leafs", "6", "7")
+	// Twenty losses, then nine wins, for 98 goals.
+	for i := 0; i < 20; i++ {
+		recordGame(t, ts.repo, other, own, 5, 4, map[string]int{"1": 4})
+	}
+	for i := 0; i < 9; i++ {
+		recordGame(t, ts.repo, own, other, 5, 2, map[string]int{"1": 2})
+	}
+
+	b1, _, _, _ := setUpMatch(ts)
+	for i := 0; i < 5; i++ {
+		b1.goal()
+		ts.expectState()
+	}
+	ts.expectBadges("1:shutout", "2:shutout", "1:hat_trick", "1:win_streak_10", "1:goals_100",
+		"2:first_game", "3:first_game", "4:first_game")
+}
+
+func TestHistoryBadgesByFormat(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	own, _ := ts.repo.CreateTeam("Chicago", "Blackhawks", "1", "2")
+	other, _ := ts.repo.CreateTeam("Boston", "Bruins", "3", "4")
+	// Nine doubles wins must not count towards a singles streak, but the
+	// singles game is nobody's first.
+	for i := 0; i < 9; i++ {
+		recordGame(t, ts.repo, own, other, 5, 2, map[string]int{"1": 5})
+	}
+
+	black := ts.connect("1")
+	yellow := ts.connect("3")
+	black.send(dcflMsg{Action: "set format", Format: "singles"})
+	ts.expectState()
+	black.register("black")
+	ts.expectState()
+	yellow.register("yellow")
+	ts.expectState()
+	black.confirm("black")
+	ts.expectState()
+	yellow.confirm("yellow")
+	ts.expectState()
+	black.registerTeam("black", "", "Detroit", "Lone Wolf")
+	ts.expectState()
+	yellow.registerTeam("yellow", "3", "Montreal", "Solo")
+	if state := ts.expectState(); !state.GameStarted {
+		t.Fatalf("expected the singles game to start, got %+v", state)
+	}
+	for i := 0; i < 5; i++ {
+		black.goal()
+		ts.expectState()
+	}
+	ts.expectBadges("1:shutout", "1:hat_trick")
+
+	singles, _ := ts.repo.PlayerHistory("1", formatSingles)
+	doubles, _ := ts.repo.PlayerHistory("1", formatDoubles)
+	all, _ := ts.repo.PlayerHistory("1", "")
+	if singles != (playerHistory{Played: 1, Goals: 5, WinStreak: 1}) || doubles.Played != 9 || doubles.Goals != 45 || all.WinStreak != 10 {
+		t.Fatalf("expected histories to be kept by format, got %+v %+v %+v", singles, doubles, all)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authError is returned by identity verifiers when a token is rejected. Reason
+// is used as the label of the auth failure metric.
+type authError struct {
+	reason string
+	err    error
+}
+
+func (e *authError) Error() string {
+	if e.err != nil {
+		return e.reason + ": " + e.err.Error()
+	}
+	return e.reason
+}
+
+func authFailure(reason string, err error) error {
+	return &authError{reason: reason, err: err}
+}
+
+// failureReason returns the metric label for an error returned by a verifier.
+func failureReason(err error) string {
+	var ae *authError
+	if errors.As(err, &ae) {
+		return ae.reason
+	}
+	return "unknown"
+}
+
+// identityVerifier turns the token a client presents into a verified identity.
+// Each identity provider players can sign in with has one.
+type identityVerifier interface {
+	Verify(token string) (*validatedID, error)
+}
+
+// How far the identity provider's clock may be ahead of or behind ours.
+const tokenClockSkew = time.Minute
+
+// newIdentityVerifier returns the verifier of the configured provider, and
+// the key set it checks signatures with, if any. Google checks its own
+// signatures through the tokeninfo endpoint, so only oidc has a key set. The
+// key set is not fetched yet.
+func newIdentityVerifier(cfg authConfig) (identityVerifier, *keySet, error) {
+	switch cfg.Provider {
+	case "google":
+		return tokeninfoVerifier{endpoint: cfg.TokeninfoEndpoint}, nil, nil
+	case "oidc":
+		keys := newKeySet(cfg.CertsEndpoint)
+		return oidcVerifier{issuer: cfg.OIDCIssuer, audience: cfg.Audience, keys: keys}, keys, nil
+	case "dev":
+		return newDevVerifier(cfg.DevUsers), nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown identity provider %q", cfg.Provider)
+}
+
+// tokeninfoVerifier asks Google's tokeninfo endpoint to validate ID tokens.
+type tokeninfoVerifier struct {
+	endpoint string
+}
+
+func (tv tokeninfoVerifier) Verify(idToken string) (*validatedID, error) {
+	resp, err := http.Get(tv.endpoint + idToken)
+	if err != nil {
+		return nil, authFailure("tokeninfo_unreachable", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, authFailure("tokeninfo_unreadable", err)
+	}
+
+	token := &validatedID{}
+	err = json.Unmarshal(body, token)
+	if err != nil {
+		return nil, authFailure("malformed_token", err)
+	}
+
+	if *token == (validatedID{}) {
+		return nil, authFailure("invalid_token", nil)
+	}
+	return token, nil
+}
+
+// oidcVerifier checks ID tokens from any OpenID Connect provider against the
+// provider's published keys, without calling it for every token. Only tokens
+// issued to one of audience are accepted.
+type oidcVerifier struct {
+	issuer   string
+	audience []string
+	keys     *keySet
+}
+
+func (ov oidcVerifier) Verify(idToken string) (*validatedID, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, authFailure("malformed_token", nil)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, authFailure("malformed_token", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, authFailure("unsupported_algorithm", nil)
+	}
+	key, ok := ov.keys.key(header.Kid)
+	if !ok {
+		return nil, authFailure("unknown_key", nil)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, authFailure("malformed_token", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	if err != nil {
+		return nil, authFailure("bad_signature", err)
+	}
+
+	var claims struct {
+		Iss        string          `json:"iss"`
+		Sub        string          `json:"sub"`
+		Azp        string          `json:"azp"`
+		Aud        json.RawMessage `json:"aud"`
+		Iat        int64           `json:"iat"`
+		Exp        int64           `json:"exp"`
+		Nbf        int64           `json:"nbf"`
+		Email      string          `json:"email"`
+		Name       string          `json:"name"`
+		Picture    string          `json:"picture"`
+		GivenName  string          `json:"given_name"`
+		FamilyName string          `json:"family_name"`
+	}
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, authFailure("malformed_token", err)
+	}
+	if claims.Iss != ov.issuer {
+		return nil, authFailure("wrong_issuer", nil)
+	}
+	aud := audience(claims.Aud, claims.Azp)
+	issuedToUs := false
+	for _, a := range ov.audience {
+		issuedToUs = issuedToUs || a == aud
+	}
+	if !issuedToUs {
+		return nil, authFailure("wrong_audience", nil)
+	}
+	now := time.Now()
+	if now.Add(-tokenClockSkew).Unix() >= claims.Exp {
+		return nil, authFailure("expired_token", nil)
+	}
+	if claims.Nbf != 0 && now.Add(tokenClockSkew).Unix() < claims.Nbf {
+		return nil, authFailure("token_not_yet_valid", nil)
+	}
+	if claims.Sub == "" {
+		return nil, authFailure("invalid_token", nil)
+	}
+
+	return &validatedID{
+		Iss:        claims.Iss,
+		Sub:        claims.Sub,
+		Azp:        claims.Azp,
+		Aud:        aud,
+		Iat:        strconv.FormatInt(claims.Iat, 10),
+		Exp:        strconv.FormatInt(claims.Exp, 10),
+		Email:      claims.Email,
+		Name:       claims.Name,
+		Picture:    claims.Picture,
+		GivenName:  claims.GivenName,
+		FamilyName: claims.FamilyName,
+	}, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audience returns the client a token was issued to. The aud claim may be a
+// single client or a list of them, in which case the authorized party is the
+// one that asked for the token.
+func audience(aud json.RawMessage, azp string) string {
+	var single string
+	if json.Unmarshal(aud, &single) == nil {
+		return single
+	}
+	var list []string
+	json.Unmarshal(aud, &list)
+	for _, a := range list {
+		if a == azp {
+			return a
+		}
+	}
+	if len(list) > 0 {
+		return list[0]
+	}
+	return ""
+}
+
+// devVerifier signs in a fixed set of test users without any identity
+// provider, for local development offline. The token is the user's name.
+type devVerifier struct {
+	users map[string]validatedID
+}
+
+func newDevVerifier(names []string) devVerifier {
+	dv := devVerifier{users: make(map[string]validatedID)}
+	for _, name := range names {
+		// Player ids stay the same across restarts.
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		dv.users[name] = validatedID{
+			Iss:   "dev",
+			Sub:   strconv.FormatUint(h.Sum64(), 10),
+			Name:  name,
+			Email: name + "@example.invalid",
+		}
+	}
+	return dv
+}
+
+func (dv devVerifier) Verify(name string) (*validatedID, error) {
+	id, ok := dv.users[name]
+	if !ok {
+		return nil, authFailure("unknown_dev_user", nil)
+	}
+	return &id, nil
+}
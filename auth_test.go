@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIssuer is an OIDC provider signing tokens with a single key.
+type testIssuer struct {
+	key *rsa.PrivateKey
+	srv *httptest.Server
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti := &testIssuer{key: key}
+	ti.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []jsonWebKey{{
+			Kid: "k1",
+			Kty: "RSA",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	t.Cleanup(ti.srv.Close)
+	return ti
+}
+
+func (ti *testIssuer) sign(kid string, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, ti.key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCVerifier(t *testing.T) {
+	ti := newTestIssuer(t)
+	verifier, keys, err := newIdentityVerifier(authConfig{Provider: "oidc", OIDCIssuer: "https://id.example", Audience: []string{"dcfl"}, CertsEndpoint: ti.srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = keys.refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(change func(map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss":     "https://id.example",
+			"sub":     "42",
+			"aud":     []string{"other", "dcfl"},
+			"azp":     "dcfl",
+			"exp":     time.Now().Add(time.Hour).Unix(),
+			"name":    "Player 42",
+			"picture": "https://example.com/42.png",
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	id, err := verifier.Verify(ti.sign("k1", claims(nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Sub != "42" || id.Name != "Player 42" || id.Aud != "dcfl" || id.Iss != "https://id.example" {
+		t.Fatalf("unexpected identity %+v", id)
+	}
+
+	valid := ti.sign("k1", claims(nil))
+	for reason, token := range map[string]string{
+		"wrong_issuer":        ti.sign("k1", claims(func(c map[string]any) { c["iss"] = "https://evil.example" })),
+		"wrong_audience":      ti.sign("k1", claims(func(c map[string]any) { c["aud"], c["azp"] = "other", "" })),
+		"expired_token":       ti.sign("k1", claims(func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() })),
+		"token_not_yet_valid": ti.sign("k1", claims(func(c map[string]any) { c["nbf"] = time.Now().Add(time.Hour).Unix() })),
+		"unknown_key":         ti.sign("k2", claims(nil)),
+		"bad_signature":       valid[:strings.LastIndex(valid, ".")] + "." + base64.RawURLEncoding.EncodeToString([]byte("forged")),
+		"malformed_token":     "not a token",
+	} {
+		_, err := verifier.Verify(token)
+		if failureReason(err) != reason {
+			t.Errorf("expected %s, got %v", reason, err)
+		}
+	}
+
+	open := oidcVerifier{issuer: "https://id.example", keys: keys}
+	if _, err := open.Verify(valid); failureReason(err) != "wrong_audience" {
+		t.Fatalf("expected a verifier without an audience to accept nothing, got %v", err)
+	}
+}
+
+// Players signed in with OpenID Connect keep the provider's sub, which need
+// not be a number.
+func TestOIDCPlayersPlay(t *testing.T) {
+	ti := newTestIssuer(t)
+	auth := authConfig{Provider: "oidc", OIDCIssuer: "https://id.example", Audience: []string{"dcfl"}, CertsEndpoint: ti.srv.URL,
+		SessionSecret: "test", SessionTTL: time.Minute, RefreshTTL: time.Hour}
+	verifier, keys, err := newIdentityVerifier(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = keys.refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := startTestServer(t, &config{
+		Match: matchRules{GoalsToWin: 5, RotationGoalsToWin: 3},
+		Auth:  auth,
+		CORS:  corsConfig{AllowedOrigins: []string{"*"}},
+		WS:    wsConfig{MaxMessageSize: 4096, ConnectionRate: 100, ConnectionBurst: 100, PlayerRate: 100, PlayerBurst: 100},
+	}, verifier)
+
+	subs := []string{"auth0|5f1c2a", "b3d9e0c4-7a61-4f0e-9c2d-8e5b1a6f3d27", "carol@example.com", "dave"}
+	var clients []*testClient
+	for _, sub := range subs {
+		ts.authenticateWith(sub, ti.sign("k1", map[string]any{
+			"iss": "https://id.example",
+			"sub": sub,
+			"aud": "dcfl",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}))
+		clients = append(clients, ts.connect(sub))
+	}
+	b1, b2, y1, y2 := clients[0], clients[1], clients[2], clients[3]
+
+	sides := []string{"black", "black", "yellow", "yellow"}
+	for i, c := range clients {
+		c.register(sides[i])
+		ts.expectState()
+	}
+	for i, c := range clients {
+		c.confirm(sides[i])
+		ts.expectState()
+	}
+	b1.registerTeam("black", b2.sub, "Chicago", "Blackhawks")
+	ts.expectState()
+	y1.registerTeam("yellow", y2.sub, "Boston", "Bruins")
+	state := ts.expectState()
+	if !state.GameStarted || state.BlackPlayer1.Sub != subs[0] || state.YellowPlayer1.Sub != subs[2] {
+		t.Fatalf("expected the game to start with the OIDC players, got %+v", state)
+	}
+	for i := 0; i < 5; i++ {
+		b1.goal()
+		ts.expectState()
+	}
+	ts.expectMessage("Game Over")
+
+	goals := make(map[string]int)
+	for _, gg := range ts.repo.goals {
+		goals[gg.playerID] = gg.goals
+	}
+	if len(ts.repo.games) != 1 || goals[subs[0]] != 5 || len(goals) != 4 {
+		t.Fatalf("expected a game recorded for the OIDC players, got %+v %v", ts.repo.games, goals)
+	}
+}
+
+func TestDevVerifier(t *testing.T) {
+	verifier, keys, err := newIdentityVerifier(authConfig{Provider: "dev", DevUsers: []string{"alice", "bob"}})
+	if err != nil || keys != nil {
+		t.Fatalf("expected a dev provider without keys, got %v %v", keys, err)
+	}
+	alice, err := verifier.Verify("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, _ := verifier.Verify("bob")
+	again, _ := newDevVerifier([]string{"alice"}).Verify("alice")
+	if alice.Name != "alice" || alice.Sub == bob.Sub || alice.Sub != again.Sub {
+		t.Fatalf("expected stable, distinct identities, got %+v %+v %+v", alice, bob, again)
+	}
+	if strings.Trim(alice.Sub, "0123456789") != "" {
+		t.Fatalf("expected a numeric player id, got %q", alice.Sub)
+	}
+	if _, err := verifier.Verify("mallory"); failureReason(err) != "unknown_dev_user" {
+		t.Fatalf("expected unknown users to be refused, got %v", err)
+	}
+}
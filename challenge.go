@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type challengeStatus string
+
+const (
+	challengePending  challengeStatus = "pending"
+	challengeAccepted challengeStatus = "accepted"
+	challengeDeclined challengeStatus = "declined"
+	// The accepted challenge has been played.
+	challengePlayed challengeStatus = "played"
+)
+
+// challenge is one team inviting another to a game.
+type challenge struct {
+	ID         int    `json:"id"`
+	Challenger team   `json:"challenger"`
+	Challenged team   `json:"challenged"`
+	Stakes     string `json:"stakes,omitempty"`
+	// The player who issued the challenge.
+	IssuedBy           string          `json:"issued_by"`
+	Status             challengeStatus `json:"status"`
+	CreatedTimestamp   int64           `json:"created_timestamp"`
+	RespondedTimestamp int64           `json:"responded_timestamp,omitempty"`
+	GameID             int             `json:"game_id,omitempty"`
+}
+
+// issueChallenge records a challenge from one team to another on behalf of a
+// player of the challenging team, and announces it at the table.
+func issueChallenge(repo repository, h *hub, issuer string, challengerID int, challengedID int, stakes string) (challenge, error) {
+	challenger, err := repo.GetTeam(challengerID)
+	if err == errNotFound {
+		return challenge{}, &requestError{http.StatusNotFound, "unknown challenging team"}
+	} else if err != nil {
+		return challenge{}, err
+	}
+	challenged, err := repo.GetTeam(challengedID)
+	if err == errNotFound {
+		return challenge{}, &requestError{http.StatusNotFound, "unknown challenged team"}
+	} else if err != nil {
+		return challenge{}, err
+	}
+	if !challenger.has(issuer) {
+		return challenge{}, &requestError{http.StatusForbidden, "only players of the challenging team can issue a challenge"}
+	}
+	if challenger.ID == challenged.ID {
+		return challenge{}, &requestError{http.StatusBadRequest, "a team cannot challenge itself"}
+	}
+	if challenger.format() != challenged.format() {
+		return challenge{}, &requestError{http.StatusBadRequest, fmt.Sprintf("a %s team cannot challenge a %s team", challenger.format(), challenged.format())}
+	}
+
+	c := challenge{Challenger: challenger.team, Challenged: challenged.team, Stakes: stakes, IssuedBy: issuer}
+	id, err := repo.CreateChallenge(c)
+	if err != nil {
+		return challenge{}, err
+	}
+	c, err = repo.GetChallenge(id)
+	if err != nil {
+		return challenge{}, err
+	}
+	logger.Info("challenge issued", "challenge", c.ID, "challenger", c.Challenger.ID, "challenged", c.Challenged.ID, "sub", issuer)
+	h.announce(c.announcement())
+	return c, nil
+}
+
+func (c challenge) announcement() string {
+	msg := fmt.Sprintf("The %s %s challenge the %s %s!", c.Challenger.City, c.Challenger.Name, c.Challenged.City, c.Challenged.Name)
+	if c.Stakes != "" {
+		msg += " Stakes: " + c.Stakes
+	}
+	return msg
+}
+
+// respondToChallenge accepts or declines a pending challenge on behalf of a
+// player of the challenged team. Accepted challenges are seated at the table
+// as soon as it is free.
+func respondToChallenge(repo repository, h *hub, responder string, id int, accept bool) (challenge, error) {
+	c, err := repo.GetChallenge(id)
+	if err == errNotFound {
+		return challenge{}, &requestError{http.StatusNotFound, "unknown challenge"}
+	} else if err != nil {
+		return challenge{}, err
+	}
+	challenged, err := repo.GetTeam(c.Challenged.ID)
+	if err != nil {
+		return challenge{}, err
+	}
+	if !challenged.has(responder) {
+		return challenge{}, &requestError{http.StatusForbidden, "only players of the challenged team can respond to a challenge"}
+	}
+
+	status := challengeDeclined
+	if accept {
+		status = challengeAccepted
+	}
+	err = repo.RespondToChallenge(id, status)
+	if err == errNotFound {
+		return challenge{}, &requestError{http.StatusConflict, "challenge is no longer pending"}
+	} else if err != nil {
+		return challenge{}, err
+	}
+	c.Status = status
+	logger.Info("challenge answered", "challenge", c.ID, "status", status, "sub", responder)
+
+	if !accept {
+		h.announce(fmt.Sprintf("The %s %s declined the challenge from the %s %s.", c.Challenged.City, c.Challenged.Name, c.Challenger.City, c.Challenger.Name))
+		return c, nil
+	}
+	m, err := newChallengeMatch(repo, c)
+	if err != nil {
+		return challenge{}, err
+	}
+	h.announce(fmt.Sprintf("The %s %s accepted the challenge from the %s %s!", c.Challenged.City, c.Challenged.Name, c.Challenger.City, c.Challenger.Name))
+	h.scheduleChallenge(m)
+	return c, nil
+}
+
+// challengeMatch is an accepted challenge waiting to be seated at the table.
+// The challenging team plays black.
+type challengeMatch struct {
+	id         int
+	format     matchFormat
+	blackTeam  team
+	yellowTeam team
+	blackSide  [2]player
+	yellowSide [2]player
+}
+
+func newChallengeMatch(repo repository, c challenge) (challengeMatch, error) {
+	m := challengeMatch{id: c.ID, blackTeam: c.Challenger, yellowTeam: c.Challenged}
+	black, err := repo.GetTeam(c.Challenger.ID)
+	if err != nil {
+		return m, err
+	}
+	yellow, err := repo.GetTeam(c.Challenged.ID)
+	if err != nil {
+		return m, err
+	}
+	m.format = black.format()
+	m.blackSide = black.side(nil)
+	m.yellowSide = yellow.side(nil)
+	for _, side := range []*[2]player{&m.blackSide, &m.yellowSide} {
+		for i := range side[:m.format.seats()] {
+			record, err := repo.GetPlayer(side[i].Sub)
+			if err == nil {
+				side[i] = record.seat()
+			} else if err != errNotFound {
+				return m, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// loadChallengeMatch rebuilds the match of an accepted challenge.
+func loadChallengeMatch(repo repository, id int) (challengeMatch, error) {
+	c, err := repo.GetChallenge(id)
+	if err != nil {
+		return challengeMatch{}, err
+	}
+	return newChallengeMatch(repo, c)
+}
+
+// scheduleChallenge seats an accepted challenge if the table is free, or once
+// the current match is over otherwise.
+func (h *hub) scheduleChallenge(m challengeMatch) {
+	h.sideMx.Lock()
+	free := h.phase == phaseOpen && h.rotation == nil && h.blackSide == [2]player{} && h.yellowSide == [2]player{}
+	if free {
+		h.seatChallenge(m)
+	} else {
+		h.log().Info("challenge waiting for the table", "challenge", m.id)
+		h.challenges = append(h.challenges, m)
+	}
+	h.sideMx.Unlock()
+
+	if free {
+		select {
+		case h.confirmations <- "match state":
+		case <-h.quit:
+		}
+	}
+}
+
+// seatChallenge fills both sides and teams from a challenge, leaving the
+// players to confirm.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) seatChallenge(m challengeMatch) {
+	h.log().Info("seating challenge", "challenge", m.id, "format", m.format)
+	h.format = m.format
+	h.blackSide = m.blackSide
+	h.yellowSide = m.yellowSide
+	h.blackTeam = m.blackTeam
+	h.yellowTeam = m.yellowTeam
+	h.challenge = &m
+	for _, p := range append(m.blackSide[:], m.yellowSide[:]...) {
+		h.unqueue(p.Sub)
+	}
+	h.setPhase(h.lobbyPhase())
+}
+
+// seatNextChallenge seats the oldest accepted challenge waiting for the table.
+// Challenges wait for a running rotation to end.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) seatNextChallenge() {
+	if len(h.challenges) == 0 || h.rotation != nil {
+		return
+	}
+	m := h.challenges[0]
+	h.challenges = h.challenges[1:]
+	h.seatChallenge(m)
+}
+
+// challengeStarted records that the seated challenge is being played, unless
+// the teams at the table have changed since it was seated.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) challengeStarted() {
+	if h.challenge == nil {
+		return
+	}
+	m := h.challenge
+	h.challenge = nil
+	if h.blackTeam.ID != m.blackTeam.ID || h.yellowTeam.ID != m.yellowTeam.ID {
+		h.log().Info("challenge teams changed, not counting game", "challenge", m.id)
+		return
+	}
+	err := h.repo.ChallengePlayed(m.id, h.gameID)
+	if err != nil {
+		h.log().Error("error recording challenge game", "challenge", m.id, "err", err)
+	}
+}
+
+// challengesHandler lists challenges on GET, optionally filtered by the status
+// query parameter, and issues a challenge on POST.
+type challengesHandler struct {
+	auth authenticateHandler
+	h    *hub
+	repo repository
+}
+
+func (ch challengesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		challenges, err := ch.repo.Challenges(challengeStatus(r.URL.Query().Get("status")))
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, challenges)
+		return
+	}
+
+	token, ok := ch.auth.identify(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Challenger int    `json:"challenger_team"`
+		Challenged int    `json:"challenged_team"`
+		Stakes     string `json:"stakes"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c, err := issueChallenge(ch.repo, ch.h, token.Sub, body.Challenger, body.Challenged, body.Stakes)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, c)
+}
+
+// challengeHandler returns a single challenge.
+type challengeHandler struct {
+	repo repository
+}
+
+func (ch challengeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	c, err := ch.repo.GetChallenge(id)
+	if err == errNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+// challengeResponseHandler accepts or declines a challenge.
+type challengeResponseHandler struct {
+	auth   authenticateHandler
+	h      *hub
+	repo   repository
+	accept bool
+}
+
+func (rh challengeResponseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := rh.auth.identify(w, r)
+	if !ok {
+		return
+	}
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	c, err := respondToChallenge(rh.repo, rh.h, token.Sub, id, rh.accept)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
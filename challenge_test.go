@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// post sends an authenticated JSON request as sub and decodes the response
+// into out, returning the status code.
+func (ts *testServer) post(sub string, path string, body any, out any) int {
+	ts.t.Helper()
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", ts.srv.URL+path, bytes.NewReader(data))
+	req.Header.Set("Authorization", ts.authorization(sub))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+func (ts *testServer) get(path string, out any) int {
+	ts.t.Helper()
+	resp, err := http.Get(ts.srv.URL + path)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+type challengeRequest struct {
+	Challenger int    `json:"challenger_team"`
+	Challenged int    `json:"challenged_team"`
+	Stakes     string `json:"stakes,omitempty"`
+}
+
+func newChallengeServer(t *testing.T) *testServer {
+	ts := newTestServer(t, "1", "2", "3", "4", "5", "6")
+	ts.repo.CreateTeam("Chicago", "Blackhawks", "1", "2")
+	ts.repo.CreateTeam("Boston", "Bruins", "3", "4")
+	ts.repo.CreateTeam("Vancouver", "Canucks", "5", "6")
+	return ts
+}
+
+func TestChallengeLifecycle(t *testing.T) {
+	ts := newChallengeServer(t)
+	clients := map[string]*testClient{}
+	for _, sub := range []string{"1", "2", "3", "4"} {
+		clients[sub] = ts.connect(sub)
+	}
+
+	var c challenge
+	if code := ts.post("5", "/challenges", challengeRequest{1, 2, ""}, nil); code != http.StatusForbidden {
+		t.Fatalf("expected outsiders to be refused, got %d", code)
+	}
+	if code := ts.post("1", "/challenges", challengeRequest{1, 1, ""}, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected a self challenge to be refused, got %d", code)
+	}
+	if code := ts.post("1", "/challenges", challengeRequest{1, 9, ""}, nil); code != http.StatusNotFound {
+		t.Fatalf("expected an unknown team to be refused, got %d", code)
+	}
+	if code := ts.post("2", "/challenges", challengeRequest{1, 2, "loser buys coffee"}, &c); code != http.StatusCreated {
+		t.Fatalf("expected challenge to be created, got %d", code)
+	}
+	if c.Status != challengePending || c.Challenger.Name != "Blackhawks" || c.Challenged.Name != "Bruins" || c.Stakes != "loser buys coffee" || c.IssuedBy != "2" {
+		t.Fatalf("unexpected challenge %+v", c)
+	}
+	ts.expectMessage("The Chicago Blackhawks challenge the Boston Bruins! Stakes: loser buys coffee")
+
+	var pending []challenge
+	ts.get("/challenges?status=pending", &pending)
+	if len(pending) != 1 || pending[0].ID != c.ID {
+		t.Fatalf("expected the challenge to be pending, got %+v", pending)
+	}
+
+	if code := ts.post("1", "/challenges/1/accept", nil, nil); code != http.StatusForbidden {
+		t.Fatalf("expected the challenger to be unable to accept, got %d", code)
+	}
+	if code := ts.post("4", "/challenges/1/accept", nil, &c); code != http.StatusOK || c.Status != challengeAccepted {
+		t.Fatalf("expected challenge to be accepted, got %d %+v", code, c)
+	}
+	ts.expectMessage("The Boston Bruins accepted the challenge from the Chicago Blackhawks!")
+	state := ts.expectState()
+	if state.BlackPlayer1 != seated("1", false, 0) || state.YellowPlayer2 != seated("4", false, 0) ||
+		state.BlackTeam.Name != "Blackhawks" || state.YellowTeam.Name != "Bruins" || state.Phase != phaseAwaitingConfirmations {
+		t.Fatalf("expected the challenge to be seated: %+v", state)
+	}
+	if code := ts.post("3", "/challenges/1/decline", nil, nil); code != http.StatusConflict {
+		t.Fatalf("expected an answered challenge to be final, got %d", code)
+	}
+
+	clients["1"].confirm("black")
+	ts.expectState()
+	clients["2"].confirm("black")
+	ts.expectState()
+	clients["3"].confirm("yellow")
+	ts.expectState()
+	clients["4"].confirm("yellow")
+	state = ts.expectState()
+	if state.Phase != phaseInPlay {
+		t.Fatalf("expected the game to start once everyone confirmed: %+v", state)
+	}
+
+	ts.get("/challenges/1", &c)
+	if c.Status != challengePlayed || c.GameID != 1 {
+		t.Fatalf("expected the challenge to be played in game 1, got %+v", c)
+	}
+}
+
+func TestChallengeWaitsForTable(t *testing.T) {
+	ts := newChallengeServer(t)
+	b1 := ts.connect("1")
+	b1.register("black")
+	ts.expectState()
+
+	var c challenge
+	ts.post("3", "/challenges", challengeRequest{2, 3, ""}, &c)
+	ts.expectMessage("The Boston Bruins challenge the Vancouver Canucks!")
+	ts.post("5", "/challenges/1/accept", nil, nil)
+	ts.expectMessage("The Vancouver Canucks accepted the challenge from the Boston Bruins!")
+
+	// Leaving frees the table, which seats the waiting challenge.
+	b1.send(dcflMsg{Action: "unregister", Side: "black"})
+	state := ts.expectState()
+	if state.BlackPlayer1.Sub != "" {
+		t.Fatalf("expected player 1 to leave: %+v", state)
+	}
+	if state.BlackTeam.Name != "" {
+		t.Fatalf("challenge must wait for a reset, got %+v", state)
+	}
+
+	ts.hub.sideMx.Lock()
+	ts.hub.scoreMx.Lock()
+	ts.hub.reset()
+	state = ts.hub.state()
+	ts.hub.scoreMx.Unlock()
+	ts.hub.sideMx.Unlock()
+	if state.BlackTeam.Name != "Bruins" || state.YellowTeam.Name != "Canucks" || state.YellowPlayer1.Sub != "5" {
+		t.Fatalf("expected the waiting challenge to be seated on reset: %+v", state)
+	}
+}
+
+func TestChallengeDecline(t *testing.T) {
+	ts := newChallengeServer(t)
+	ts.post("1", "/challenges", challengeRequest{1, 3, ""}, nil)
+	var c challenge
+	if code := ts.post("6", "/challenges/1/decline", nil, &c); code != http.StatusOK || c.Status != challengeDeclined {
+		t.Fatalf("expected challenge to be declined, got %d %+v", code, c)
+	}
+	var all []challenge
+	ts.get("/challenges", &all)
+	if len(all) != 1 || all[0].Status != challengeDeclined || all[0].RespondedTimestamp == 0 {
+		t.Fatalf("expected the declined challenge in the history, got %+v", all)
+	}
+	if state := ts.hub.state(); state.BlackTeam != (team{}) {
+		t.Fatalf("a declined challenge must not be seated: %+v", state)
+	}
+	if code := ts.get("/challenges/7", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown challenge, got %d", code)
+	}
+}
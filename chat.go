@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	chatTimestampHeader  = "X-DCFL-Request-Timestamp"
+	chatSignatureHeader  = "X-DCFL-Signature"
+	chatSignatureVersion = "v0"
+
+	// How far a signed request's timestamp may be from our clock.
+	chatMaxSkew = 5 * time.Minute
+
+	// How long a code from the link command can be redeemed for.
+	chatLinkTTL = 10 * time.Minute
+
+	leaderboardSize = 10
+)
+
+const chatHelp = "Commands:\n" +
+	"`status` shows who is playing and who is waiting\n" +
+	"`leaderboard [singles|doubles]` shows the top players\n" +
+	"`me [singles|doubles]` shows your record\n" +
+	"`queue` shows the queue, `queue join` and `queue leave` change your place in it\n" +
+	"`challenge @team [as @your team] [for stakes]` challenges a team to a game\n" +
+	"`accept 12` and `decline 12` answer challenge 12\n" +
+	"`link` connects your chat account to your player"
+
+// chatResponse is the reply to a slash command. Ephemeral responses are only
+// shown to the user who ran the command.
+type chatResponse struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+func ephemeral(format string, args ...any) chatResponse {
+	return chatResponse{ResponseType: "ephemeral", Text: fmt.Sprintf(format, args...)}
+}
+
+func inChannel(format string, args ...any) chatResponse {
+	return chatResponse{ResponseType: "in_channel", Text: fmt.Sprintf(format, args...)}
+}
+
+// signChatRequest returns the signature a request with the given timestamp and
+// body must carry.
+func signChatRequest(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s:%s:", chatSignatureVersion, timestamp)
+	mac.Write(body)
+	return chatSignatureVersion + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyChatRequest checks the signature and freshness of a slash command.
+func verifyChatRequest(secret string, r *http.Request, body []byte, now time.Time) error {
+	timestamp := r.Header.Get(chatTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad timestamp %q", timestamp)
+	}
+	skew := now.Sub(time.Unix(seconds, 0))
+	if skew > chatMaxSkew || skew < -chatMaxSkew {
+		return fmt.Errorf("stale timestamp %q", timestamp)
+	}
+	want := signChatRequest(secret, timestamp, body)
+	if !hmac.Equal([]byte(r.Header.Get(chatSignatureHeader)), []byte(want)) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// chatLinks holds the codes handed out by the link command until a signed in
+// player redeems them.
+type chatLinks struct {
+	mx    sync.Mutex
+	codes map[string]pendingLink
+}
+
+type pendingLink struct {
+	chatUserID string
+	expires    time.Time
+}
+
+func newChatLinks() *chatLinks {
+	return &chatLinks{codes: make(map[string]pendingLink)}
+}
+
+// issue returns a new code for chatUserID.
+func (cl *chatLinks) issue(chatUserID string) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	code := strings.ToUpper(hex.EncodeToString(b))
+
+	cl.mx.Lock()
+	defer cl.mx.Unlock()
+	now := time.Now()
+	for c, l := range cl.codes {
+		if now.After(l.expires) {
+			delete(cl.codes, c)
+		}
+	}
+	cl.codes[code] = pendingLink{chatUserID: chatUserID, expires: now.Add(chatLinkTTL)}
+	return code
+}
+
+// redeem returns the chat account a code was issued to. Codes can only be
+// redeemed once.
+func (cl *chatLinks) redeem(code string) (string, bool) {
+	cl.mx.Lock()
+	defer cl.mx.Unlock()
+	code = strings.ToUpper(strings.TrimSpace(code))
+	l, ok := cl.codes[code]
+	if !ok || time.Now().After(l.expires) {
+		return "", false
+	}
+	delete(cl.codes, code)
+	return l.chatUserID, true
+}
+
+// chatHandler answers slash commands sent by the chat service.
+type chatHandler struct {
+	secret string
+	h      *hub
+	repo   repository
+	links  *chatLinks
+}
+
+func (ch chatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = verifyChatRequest(ch.secret, r, body, time.Now())
+	if err != nil {
+		authFailures.inc("bad_chat_signature")
+		logger.Info("rejected chat command", "remote", r.RemoteAddr, "err", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	chatUser := form.Get("user_id")
+	args := strings.Fields(form.Get("text"))
+	logger.Info("chat command", "chat_user", chatUser, "args", args)
+	resp := ch.run(chatUser, args)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (ch chatHandler) run(chatUser string, args []string) chatResponse {
+	if len(args) == 0 {
+		return ch.status()
+	}
+	switch strings.ToLower(args[0]) {
+	case "status":
+		return ch.status()
+	case "leaderboard":
+		return ch.leaderboard(args[1:])
+	case "me":
+		return ch.me(chatUser, args[1:])
+	case "queue":
+		return ch.queue(chatUser, args[1:])
+	case "challenge":
+		return ch.challenge(chatUser, args[1:])
+	case "accept":
+		return ch.respond(chatUser, args[1:], true)
+	case "decline":
+		return ch.respond(chatUser, args[1:], false)
+	case "link":
+		return ephemeral("Your link code is %s. Enter it in the DCFL app within %d minutes to connect your chat account.",
+			ch.links.issue(chatUser), int(chatLinkTTL.Minutes()))
+	case "help":
+		return ephemeral(chatHelp)
+	}
+	return ephemeral("Unknown command %q.\n%s", args[0], chatHelp)
+}
+
+// player returns the player linked to a chat account, or a response asking the
+// user to link one.
+func (ch chatHandler) player(chatUser string) (string, *chatResponse) {
+	sub, err := ch.repo.ChatPlayer(chatUser)
+	if err == errNotFound {
+		resp := ephemeral("Your chat account is not linked to a player yet. Use `link` to connect it.")
+		return "", &resp
+	} else if err != nil {
+		logger.Error("error looking up chat link", "chat_user", chatUser, "err", err)
+		resp := ephemeral("Something went wrong, try again later.")
+		return "", &resp
+	}
+	return sub, nil
+}
+
+// name returns the display name of a player, falling back to their id.
+func (ch chatHandler) name(sub string) string {
+	p, err := ch.repo.GetPlayer(sub)
+	if err != nil || p.displayName() == "" {
+		return sub
+	}
+	return p.displayName()
+}
+
+func (ch chatHandler) names(subs []string) string {
+	var names []string
+	for _, sub := range subs {
+		names = append(names, ch.name(sub))
+	}
+	return strings.Join(names, ", ")
+}
+
+func (ch chatHandler) side(players ...player) string {
+	var subs []string
+	for _, p := range players {
+		if p.Sub != "" {
+			subs = append(subs, p.Sub)
+		}
+	}
+	if len(subs) == 0 {
+		return "empty"
+	}
+	return ch.names(subs)
+}
+
+func (ch chatHandler) status() chatResponse {
+	ch.h.sideMx.RLock()
+	state := ch.h.state()
+	ch.h.sideMx.RUnlock()
+	queue := ch.h.queued()
+
+	var b bytes.Buffer
+	if state.Phase == phaseOpen && state.BlackPlayer1 == (player{}) && state.BlackPlayer2 == (player{}) &&
+		state.YellowPlayer1 == (player{}) && state.YellowPlayer2 == (player{}) {
+		b.WriteString("The table is free.")
+	} else {
+		fmt.Fprintf(&b, "The table is taken, %s.\n", phaseDescriptions[state.Phase])
+		fmt.Fprintf(&b, "Black: %s\nYellow: %s", ch.side(state.BlackPlayer1, state.BlackPlayer2), ch.side(state.YellowPlayer1, state.YellowPlayer2))
+		if state.GameStarted {
+			fmt.Fprintf(&b, "\nScore: %d - %d", state.BlackScore, state.YellowScore)
+		}
+	}
+	if len(queue) > 0 {
+		fmt.Fprintf(&b, "\nQueue: %s", ch.names(queue))
+	}
+	if id, line := ch.h.rotationLine(); id != 0 && len(line) > 0 {
+		fmt.Fprintf(&b, "\nRotation %d, up next: %s", id, ch.names(line))
+	} else if id != 0 {
+		fmt.Fprintf(&b, "\nRotation %d, nobody waiting", id)
+	}
+	return ephemeral("%s", b.String())
+}
+
+// standings ranks players over the games of the format given in args, or of
+// every format if there is none.
+func (ch chatHandler) standings(args []string) ([]standing, *chatResponse) {
+	var format matchFormat
+	if len(args) > 0 {
+		var err error
+		format, err = parseFormat(strings.ToLower(args[0]))
+		if err != nil {
+			resp := ephemeral("The %s.", err)
+			return nil, &resp
+		}
+	}
+	standings, err := ch.repo.Standings(format)
+	if err != nil {
+		logger.Error("error loading standings", "err", err)
+		resp := ephemeral("Something went wrong, try again later.")
+		return nil, &resp
+	}
+	return standings, nil
+}
+
+func (ch chatHandler) leaderboard(args []string) chatResponse {
+	standings, errResp := ch.standings(args)
+	if errResp != nil {
+		return *errResp
+	}
+	if len(standings) == 0 {
+		return ephemeral("No games have been played yet.")
+	}
+	var b bytes.Buffer
+	b.WriteString("Leaderboard:")
+	for i, s := range standings {
+		if i == leaderboardSize {
+			break
+		}
+		fmt.Fprintf(&b, "\n%d. %s: %d won of %d, %d goals", i+1, s.Name, s.Won, s.Played, s.Goals)
+	}
+	return ephemeral("%s", b.String())
+}
+
+func (ch chatHandler) me(chatUser string, args []string) chatResponse {
+	sub, errResp := ch.player(chatUser)
+	if errResp != nil {
+		return *errResp
+	}
+	standings, errResp := ch.standings(args)
+	if errResp != nil {
+		return *errResp
+	}
+	for i, s := range standings {
+		if s.PlayerID == sub {
+			return ephemeral("%s: ranked %d of %d, %d won of %d, %d goals", s.Name, i+1, len(standings), s.Won, s.Played, s.Goals)
+		}
+	}
+	return ephemeral("%s: no finished games yet.", ch.name(sub))
+}
+
+func (ch chatHandler) queue(chatUser string, args []string) chatResponse {
+	if len(args) == 0 {
+		queue := ch.h.queued()
+		if len(queue) == 0 {
+			return ephemeral("Nobody is waiting.")
+		}
+		return ephemeral("Queue: %s", ch.names(queue))
+	}
+
+	sub, errResp := ch.player(chatUser)
+	if errResp != nil {
+		return *errResp
+	}
+	switch strings.ToLower(args[0]) {
+	case "join":
+		position, err := ch.h.joinQueue(sub)
+		if err != nil {
+			return ephemeral("You are %s.", err)
+		}
+		return inChannel("%s joined the queue at position %d.", ch.name(sub), position)
+	case "leave":
+		if !ch.h.leaveQueue(sub) {
+			return ephemeral("You are not in the queue.")
+		}
+		return inChannel("%s left the queue.", ch.name(sub))
+	}
+	return ephemeral("Unknown queue command %q, use `queue join` or `queue leave`.", args[0])
+}
+
+// challenge parses "challenge @team [as @own team] [for stakes]". The own team
+// may be left out by players who belong to a single team.
+func (ch chatHandler) challenge(chatUser string, args []string) chatResponse {
+	if len(args) == 0 {
+		return ephemeral("Which team? Use `challenge @team`, optionally followed by `as @your team` and `for stakes`.")
+	}
+	sub, errResp := ch.player(chatUser)
+	if errResp != nil {
+		return *errResp
+	}
+
+	text := strings.Join(args, " ")
+	var stakes, own string
+	if i := strings.Index(text, " for "); i >= 0 {
+		text, stakes = text[:i], strings.TrimSpace(text[i+len(" for "):])
+	}
+	if i := strings.Index(text, " as "); i >= 0 {
+		text, own = text[:i], strings.TrimSpace(text[i+len(" as "):])
+	}
+
+	challenged, errResp := ch.team(text)
+	if errResp != nil {
+		return *errResp
+	}
+	var challenger team
+	if own != "" {
+		challenger, errResp = ch.team(own)
+		if errResp != nil {
+			return *errResp
+		}
+	} else {
+		teams, err := ch.repo.TeamsOf(sub)
+		if err != nil {
+			logger.Error("error listing teams", "sub", sub, "err", err)
+			return ephemeral("Something went wrong, try again later.")
+		}
+		if len(teams) == 0 {
+			return ephemeral("You are not on a team yet.")
+		} else if len(teams) > 1 {
+			return ephemeral("You are on several teams, say which one with `challenge @%s as @your team`.", challenged.Name)
+		}
+		challenger = teams[0]
+	}
+
+	c, err := issueChallenge(ch.repo, ch.h, sub, challenger.ID, challenged.ID, stakes)
+	if err != nil {
+		return ch.challengeFailed(err)
+	}
+	return inChannel("%s (challenge %d, the %s can `accept %d` or `decline %d`)", c.announcement(), c.ID, c.Challenged.Name, c.ID, c.ID)
+}
+
+// team looks a team up by a name typed in chat.
+func (ch chatHandler) team(name string) (team, *chatResponse) {
+	name = strings.TrimPrefix(strings.TrimSpace(name), "@")
+	t, err := ch.repo.FindTeamByName(name)
+	if err == errNotFound {
+		resp := ephemeral("There is no team called %q.", name)
+		return team{}, &resp
+	} else if err != nil {
+		logger.Error("error finding team", "name", name, "err", err)
+		resp := ephemeral("Something went wrong, try again later.")
+		return team{}, &resp
+	}
+	return t, nil
+}
+
+func (ch chatHandler) respond(chatUser string, args []string, accept bool) chatResponse {
+	if len(args) == 0 {
+		return ephemeral("Which challenge? Give its number.")
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return ephemeral("%q is not a challenge number.", args[0])
+	}
+	sub, errResp := ch.player(chatUser)
+	if errResp != nil {
+		return *errResp
+	}
+	c, err := respondToChallenge(ch.repo, ch.h, sub, id, accept)
+	if err != nil {
+		return ch.challengeFailed(err)
+	}
+	if accept {
+		return inChannel("The %s accepted challenge %d from the %s!", c.Challenged.Name, c.ID, c.Challenger.Name)
+	}
+	return inChannel("The %s declined challenge %d from the %s.", c.Challenged.Name, c.ID, c.Challenger.Name)
+}
+
+func (ch chatHandler) challengeFailed(err error) chatResponse {
+	if ce, ok := err.(*requestError); ok {
+		return ephemeral("Sorry, %s.", ce.msg)
+	}
+	logger.Error("error handling challenge", "err", err)
+	return ephemeral("Something went wrong, try again later.")
+}
+
+// chatLinkHandler connects the chat account a link code was issued to with the
+// signed in player redeeming it.
+type chatLinkHandler struct {
+	auth  authenticateHandler
+	links *chatLinks
+	repo  repository
+}
+
+func (lh chatLinkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := lh.auth.identify(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	chatUser, ok := lh.links.redeem(body.Code)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	err = lh.repo.LinkChatUser(chatUser, token.Sub)
+	if err != nil {
+		logger.Error("error linking chat user", "sub", token.Sub, "chat_user", chatUser, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	logger.Info("linked chat user", "sub", token.Sub, "chat_user", chatUser)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testChatSecret = "chat-s3cret"
+
+// command runs a signed slash command as chatUser and returns the response.
+func (ts *testServer) command(chatUser string, text string) chatResponse {
+	ts.t.Helper()
+	body := url.Values{"user_id": {chatUser}, "text": {text}}.Encode()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, _ := http.NewRequest("POST", ts.srv.URL+"/chat/command", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(chatTimestampHeader, timestamp)
+	req.Header.Set(chatSignatureHeader, signChatRequest(testChatSecret, timestamp, []byte(body)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatalf("command %q: %v", text, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		ts.t.Fatalf("command %q: status %d", text, resp.StatusCode)
+	}
+	var cr chatResponse
+	json.NewDecoder(resp.Body).Decode(&cr)
+	return cr
+}
+
+// link connects chatUser to the player sub through the link code flow.
+func (ts *testServer) link(chatUser string, sub string) {
+	ts.t.Helper()
+	text := ts.command(chatUser, "link").Text
+	code := strings.Fields(strings.TrimPrefix(text, "Your link code is "))[0]
+	code = strings.TrimSuffix(code, ".")
+
+	body, _ := json.Marshal(map[string]string{"code": code})
+	req, _ := http.NewRequest("POST", ts.srv.URL+"/chat/link", bytes.NewReader(body))
+	req.Header.Set("Authorization", ts.authorization(sub))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		ts.t.Fatalf("link %s: status %d", sub, resp.StatusCode)
+	}
+}
+
+func expectReply(t *testing.T, resp chatResponse, responseType string, contains string) {
+	t.Helper()
+	if resp.ResponseType != responseType || !strings.Contains(resp.Text, contains) {
+		t.Fatalf("expected %s reply containing %q, got %+v", responseType, contains, resp)
+	}
+}
+
+func TestChatSignature(t *testing.T) {
+	ts := newTestServer(t)
+	body := "text=status"
+	send := func(timestamp string, signature string) int {
+		req, _ := http.NewRequest("POST", ts.srv.URL+"/chat/command", strings.NewReader(body))
+		req.Header.Set(chatTimestampHeader, timestamp)
+		req.Header.Set(chatSignatureHeader, signature)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if code := send(now, signChatRequest(testChatSecret, now, []byte(body))); code != http.StatusOK {
+		t.Fatalf("expected signed request to be accepted, got %d", code)
+	}
+	if code := send(now, signChatRequest("wrong", now, []byte(body))); code != http.StatusUnauthorized {
+		t.Fatalf("expected wrong signature to be rejected, got %d", code)
+	}
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	if code := send(stale, signChatRequest(testChatSecret, stale, []byte(body))); code != http.StatusUnauthorized {
+		t.Fatalf("expected stale request to be rejected, got %d", code)
+	}
+}
+
+func TestChatStatusAndQueue(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4", "5")
+	expectReply(t, ts.command("U1", "status"), "ephemeral", "The table is free.")
+	expectReply(t, ts.command("U5", "queue join"), "ephemeral", "not linked")
+
+	b1, _, _, _ := setUpMatch(ts)
+	b1.goal()
+	ts.expectState()
+	status := ts.command("U1", "")
+	expectReply(t, status, "ephemeral", "the game is in play")
+	expectReply(t, status, "ephemeral", "Black: Player 1, Player 2")
+	expectReply(t, status, "ephemeral", "Score: 1 - 0")
+
+	ts.link("U5", "5")
+	ts.link("U1", "1")
+	expectReply(t, ts.command("U1", "queue join"), "ephemeral", "already seated")
+	expectReply(t, ts.command("U5", "queue join"), "in_channel", "Player 5 joined the queue at position 1")
+	expectReply(t, ts.command("U5", "queue join"), "in_channel", "position 1")
+	expectReply(t, ts.command("U1", "status"), "ephemeral", "Queue: Player 5")
+	expectReply(t, ts.command("U5", "queue leave"), "in_channel", "Player 5 left the queue")
+	expectReply(t, ts.command("U1", "queue"), "ephemeral", "Nobody is waiting")
+}
+
+func TestChatQueueClearsOnRegistration(t *testing.T) {
+	ts := newTestServer(t, "1")
+	ts.link("U1", "1")
+	c := ts.connect("1")
+	expectReply(t, ts.command("U1", "queue join"), "in_channel", "position 1")
+	c.register("black")
+	ts.expectState()
+	if q := ts.hub.queued(); len(q) != 0 {
+		t.Fatalf("expected seated player to leave the queue, got %v", q)
+	}
+}
+
+func TestChatLeaderboardAndMe(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	ts.link("U3", "3")
+	expectReply(t, ts.command("U1", "leaderboard"), "ephemeral", "No games have been played yet")
+	expectReply(t, ts.command("U3", "me"), "ephemeral", "no finished games yet")
+
+	_, _, y1, y2 := setUpMatch(ts)
+	for i := 0; i < 5; i++ {
+		if i%2 == 0 {
+			y1.goal()
+		} else {
+			y2.goal()
+		}
+		ts.expectState()
+	}
+	ts.expectMessage("Game Over")
+
+	board := ts.command("U1", "leaderboard")
+	expectReply(t, board, "ephemeral", "1. Player 3: 1 won of 1, 3 goals")
+	expectReply(t, board, "ephemeral", "2. Player 4: 1 won of 1, 2 goals")
+	expectReply(t, ts.command("U3", "me"), "ephemeral", "Player 3: ranked 1 of 4")
+}
+
+func TestChatChallenge(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	ts.repo.CreateTeam("Chicago", "Blackhawks", "1", "2")
+	ts.repo.CreateTeam("Boston", "Bruins", "3", "4")
+	ts.link("U1", "1")
+	ts.link("U3", "3")
+	ts.connect("2")
+
+	expectReply(t, ts.command("U1", "challenge @Canucks"), "ephemeral", "no team called")
+	expectReply(t, ts.command("U1", "challenge @bruins for loser buys coffee"), "in_channel",
+		"The Chicago Blackhawks challenge the Boston Bruins! Stakes: loser buys coffee (challenge 1")
+	ts.expectMessage("The Chicago Blackhawks challenge the Boston Bruins! Stakes: loser buys coffee")
+
+	expectReply(t, ts.command("U1", "accept 1"), "ephemeral", "only players of the challenged team")
+	expectReply(t, ts.command("U3", "accept 1"), "in_channel", "The Bruins accepted challenge 1 from the Blackhawks!")
+	ts.expectMessage("The Boston Bruins accepted the challenge from the Chicago Blackhawks!")
+	state := ts.expectState()
+	if state.BlackTeam.Name != "Blackhawks" || state.YellowTeam.Name != "Bruins" || state.Phase != phaseAwaitingConfirmations {
+		t.Fatalf("expected the challenge to be seated: %+v", state)
+	}
+	expectReply(t, ts.command("U3", "decline 1"), "ephemeral", "no longer pending")
+}
+
+func TestChatLinkCodeIsSingleUse(t *testing.T) {
+	ts := newTestServer(t, "1", "2")
+	text := ts.command("U1", "link").Text
+	code := strings.TrimSuffix(strings.Fields(strings.TrimPrefix(text, "Your link code is "))[0], ".")
+
+	redeem := func(sub string) int {
+		body, _ := json.Marshal(map[string]string{"code": code})
+		req, _ := http.NewRequest("POST", ts.srv.URL+"/chat/link", bytes.NewReader(body))
+		req.Header.Set("Authorization", ts.authorization(sub))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := redeem("1"); code != http.StatusNoContent {
+		t.Fatalf("expected link to succeed, got %d", code)
+	}
+	if code := redeem("2"); code != http.StatusNotFound {
+		t.Fatalf("expected used code to be refused, got %d", code)
+	}
+	if sub, _ := ts.repo.ChatPlayer("U1"); sub != "1" {
+		t.Fatalf("expected U1 linked to player 1, got %q", sub)
+	}
+}
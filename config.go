@@ -0,0 +1,540 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// config holds every setting of the server. Settings are read, in increasing
+// order of precedence, from their defaults, an optional configuration file,
+// environment variables and command line flags.
+type config struct {
+	// DEV or PROD. DEV additionally loads variables from .env.
+	Env string
+
+	// Where data is kept: postgres, or memory for local demos.
+	Storage string
+
+	DB       dbConfig
+	Listen   listenConfig
+	Auth     authConfig
+	CORS     corsConfig
+	WS       wsConfig
+	Match    matchRules
+	Webhooks webhookConfig
+	Chat     chatConfig
+	Log      logConfig
+	Shutdown time.Duration
+}
+
+type dbConfig struct {
+	// A full connection string. Takes precedence over the individual fields.
+	URL           string
+	Host          string
+	Port          string
+	User          string
+	Password      string
+	Name          string
+	SSLMode       string
+	MigrationsDir string
+}
+
+type listenConfig struct {
+	Addr    string
+	TLSCert string
+	TLSKey  string
+}
+
+type authConfig struct {
+	// Which identity provider players sign in with: google, oidc or dev.
+	Provider string
+	// Client IDs tokens must be issued to. Required for oidc; empty accepts
+	// any audience from the other providers.
+	Audience          []string
+	TokeninfoEndpoint string
+	CertsEndpoint     string
+	// The iss of tokens from a generic OIDC provider, whose keys are served
+	// at CertsEndpoint.
+	OIDCIssuer string
+	// Names of the test users the dev provider signs in.
+	DevUsers []string
+	// Players allowed to use the admin endpoints.
+	Admins []string
+	// Key session tokens are signed with. A random key is used when empty,
+	// which signs everyone out whenever the server restarts.
+	SessionSecret string
+	// How long a session token is valid, and how long a session lasts
+	// without being refreshed.
+	SessionTTL time.Duration
+	RefreshTTL time.Duration
+}
+
+// corsConfig lists the origins allowed to call the REST routes and to open
+// WebSockets. An entry may contain one * wildcard.
+type corsConfig struct {
+	AllowedOrigins []string
+}
+
+type wsConfig struct {
+	// Largest message accepted from a client, in bytes.
+	MaxMessageSize int64
+	// Actions accepted per second from each connection and from each player
+	// across their connections, and how many may arrive at once.
+	ConnectionRate  float64
+	ConnectionBurst int
+	PlayerRate      float64
+	PlayerBurst     int
+}
+
+type matchRules struct {
+	// Goals a side must score to win.
+	GoalsToWin int
+	// Goals a side must score to win a game of a rotation session.
+	RotationGoalsToWin int
+}
+
+type webhookConfig struct {
+	URLs []string
+	// Key used to sign payloads with HMAC-SHA256.
+	Secret      string
+	MaxAttempts int
+	// Delay before the first retry, doubled after every failed attempt.
+	Backoff time.Duration
+}
+
+type chatConfig struct {
+	// Key chat slash-command requests are signed with. The chat endpoint is
+	// disabled when empty.
+	SigningSecret string
+}
+
+type logConfig struct {
+	Level  string
+	Format string
+}
+
+// setting describes how one configuration value is read. Name is both the
+// flag name and the key used in error messages; Env is the environment
+// variable, which is also the key used in the configuration file.
+type setting struct {
+	Name  string
+	Env   string
+	Usage string
+	Def   string
+	Set   func(c *config, v string) error
+}
+
+const configFileEnv = "DCFL_CONFIG"
+
+var settings = []setting{
+	{"env", "ENV", "deployment environment, DEV or PROD", "", func(c *config, v string) error {
+		c.Env = strings.ToUpper(v)
+		return nil
+	}},
+	{"storage", "DCFL_STORAGE", "storage backend, postgres or memory", "postgres", func(c *config, v string) error {
+		switch v {
+		case "postgres", "memory":
+		default:
+			return fmt.Errorf("unknown storage %q", v)
+		}
+		c.Storage = v
+		return nil
+	}},
+	{"db-url", "DATABASE_URL", "database connection string", "", func(c *config, v string) error {
+		c.DB.URL = v
+		return nil
+	}},
+	{"db-host", "DCFL_DEV_PG_HOST", "database host", "localhost", func(c *config, v string) error {
+		c.DB.Host = v
+		return nil
+	}},
+	{"db-port", "DCFL_DEV_PG_PORT", "database port", "5432", func(c *config, v string) error {
+		c.DB.Port = v
+		return nil
+	}},
+	{"db-user", "DCFL_DEV_PG_USER", "database user", "", func(c *config, v string) error {
+		c.DB.User = v
+		return nil
+	}},
+	{"db-password", "DCFL_DEV_PG_PASSWORD", "database password", "", func(c *config, v string) error {
+		c.DB.Password = v
+		return nil
+	}},
+	{"db-name", "DCFL_DEV_PG_NAME", "database name", "", func(c *config, v string) error {
+		c.DB.Name = v
+		return nil
+	}},
+	{"db-sslmode", "DCFL_DEV_PG_SSLMODE", "database sslmode", "disable", func(c *config, v string) error {
+		c.DB.SSLMode = v
+		return nil
+	}},
+	{"migrations-dir", "DCFL_MIGRATIONS_DIR", "directory containing the database migrations", "migrations/postgres", func(c *config, v string) error {
+		c.DB.MigrationsDir = v
+		return nil
+	}},
+	{"port", "PORT", "port to listen on, ignored if listen-addr is set", "", func(c *config, v string) error {
+		if v == "" {
+			return nil
+		}
+		if _, err := strconv.Atoi(v); err != nil {
+			return fmt.Errorf("not a port number: %q", v)
+		}
+		if c.Listen.Addr == "" {
+			c.Listen.Addr = ":" + v
+		}
+		return nil
+	}},
+	{"listen-addr", "DCFL_LISTEN_ADDR", "address to listen on", "", func(c *config, v string) error {
+		if v != "" {
+			c.Listen.Addr = v
+		}
+		return nil
+	}},
+	{"tls-cert", "DCFL_TLS_CERT", "TLS certificate file, enables HTTPS together with tls-key", "", func(c *config, v string) error {
+		c.Listen.TLSCert = v
+		return nil
+	}},
+	{"tls-key", "DCFL_TLS_KEY", "TLS private key file", "", func(c *config, v string) error {
+		c.Listen.TLSKey = v
+		return nil
+	}},
+	{"auth-provider", "DCFL_AUTH_PROVIDER", "identity provider players sign in with: google, oidc, or dev for local development", "google", func(c *config, v string) error {
+		switch strings.ToLower(v) {
+		case "google", "oidc", "dev":
+		default:
+			return fmt.Errorf("unknown provider %q", v)
+		}
+		c.Auth.Provider = strings.ToLower(v)
+		return nil
+	}},
+	{"auth-audience", "DCFL_AUTH_AUDIENCE", "comma separated OAuth client IDs accepted as token audience", "", func(c *config, v string) error {
+		c.Auth.Audience = splitList(v)
+		return nil
+	}},
+	{"auth-tokeninfo-endpoint", "DCFL_AUTH_TOKENINFO_ENDPOINT", "endpoint used to validate ID tokens", "https://www.googleapis.com/oauth2/v3/tokeninfo?id_token=", func(c *config, v string) error {
+		c.Auth.TokeninfoEndpoint = v
+		return nil
+	}},
+	{"auth-certs-endpoint", "DCFL_AUTH_CERTS_ENDPOINT", "endpoint serving the oidc provider's key set", "https://www.googleapis.com/oauth2/v3/certs", func(c *config, v string) error {
+		c.Auth.CertsEndpoint = v
+		return nil
+	}},
+	{"auth-oidc-issuer", "DCFL_AUTH_OIDC_ISSUER", "issuer of tokens from the oidc provider, whose keys are served at auth-certs-endpoint", "", func(c *config, v string) error {
+		c.Auth.OIDCIssuer = v
+		return nil
+	}},
+	{"auth-dev-users", "DCFL_AUTH_DEV_USERS", "comma separated names of the test users the dev provider signs in", "alice,bob,carol,dave", func(c *config, v string) error {
+		c.Auth.DevUsers = splitList(v)
+		return nil
+	}},
+	{"auth-admins", "DCFL_AUTH_ADMINS", "comma separated player ids allowed to use the admin endpoints", "", func(c *config, v string) error {
+		c.Auth.Admins = splitList(v)
+		return nil
+	}},
+	{"auth-session-secret", "DCFL_AUTH_SESSION_SECRET", "key session tokens are signed with; required in PROD", "", func(c *config, v string) error {
+		c.Auth.SessionSecret = v
+		return nil
+	}},
+	{"auth-session-ttl", "DCFL_AUTH_SESSION_TTL", "how long a session token is valid before it must be refreshed", "15m", func(c *config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("not a duration: %q", v)
+		}
+		c.Auth.SessionTTL = d
+		return nil
+	}},
+	{"auth-refresh-ttl", "DCFL_AUTH_REFRESH_TTL", "how long a session lasts without being refreshed", "720h", func(c *config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("not a duration: %q", v)
+		}
+		c.Auth.RefreshTTL = d
+		return nil
+	}},
+	{"cors-origins", "DCFL_CORS_ORIGINS", "comma separated origins allowed to make cross-origin requests and open WebSockets", "*", func(c *config, v string) error {
+		c.CORS.AllowedOrigins = splitList(v)
+		return nil
+	}},
+	{"ws-max-message-size", "DCFL_WS_MAX_MESSAGE_SIZE", "largest WebSocket message accepted from a client, in bytes", "4096", func(c *config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("not a number: %q", v)
+		}
+		c.WS.MaxMessageSize = n
+		return nil
+	}},
+	{"ws-connection-rate", "DCFL_WS_CONNECTION_RATE", "actions per second accepted from each WebSocket connection", "5", func(c *config, v string) error {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("not a number: %q", v)
+		}
+		c.WS.ConnectionRate = n
+		return nil
+	}},
+	{"ws-connection-burst", "DCFL_WS_CONNECTION_BURST", "actions a WebSocket connection may send at once", "10", func(c *config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("not a number: %q", v)
+		}
+		c.WS.ConnectionBurst = n
+		return nil
+	}},
+	{"ws-player-rate", "DCFL_WS_PLAYER_RATE", "actions per second accepted from each player across their connections", "10", func(c *config, v string) error {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("not a number: %q", v)
+		}
+		c.WS.PlayerRate = n
+		return nil
+	}},
+	{"ws-player-burst", "DCFL_WS_PLAYER_BURST", "actions a player may send at once across their connections", "20", func(c *config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("not a number: %q", v)
+		}
+		c.WS.PlayerBurst = n
+		return nil
+	}},
+	{"goals-to-win", "DCFL_GOALS_TO_WIN", "goals a side must score to win a match", "5", func(c *config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("not a number: %q", v)
+		}
+		c.Match.GoalsToWin = n
+		return nil
+	}},
+	{"rotation-goals-to-win", "DCFL_ROTATION_GOALS_TO_WIN", "goals a side must score to win a game of a rotation session", "3", func(c *config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("not a number: %q", v)
+		}
+		c.Match.RotationGoalsToWin = n
+		return nil
+	}},
+	{"webhook-urls", "DCFL_WEBHOOK_URLS", "comma separated URLs match events are posted to", "", func(c *config, v string) error {
+		c.Webhooks.URLs = splitList(v)
+		return nil
+	}},
+	{"webhook-secret", "DCFL_WEBHOOK_SECRET", "key used to sign webhook payloads", "", func(c *config, v string) error {
+		c.Webhooks.Secret = v
+		return nil
+	}},
+	{"webhook-max-attempts", "DCFL_WEBHOOK_MAX_ATTEMPTS", "delivery attempts per webhook event before giving up", "5", func(c *config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("not a number: %q", v)
+		}
+		c.Webhooks.MaxAttempts = n
+		return nil
+	}},
+	{"webhook-backoff", "DCFL_WEBHOOK_BACKOFF", "delay before the first webhook retry, doubled after each failure", "1s", func(c *config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("not a duration: %q", v)
+		}
+		c.Webhooks.Backoff = d
+		return nil
+	}},
+	{"chat-signing-secret", "DCFL_CHAT_SIGNING_SECRET", "key chat slash-command requests are signed with; empty disables the chat endpoint", "", func(c *config, v string) error {
+		c.Chat.SigningSecret = v
+		return nil
+	}},
+	{"log-level", "LOG_LEVEL", "log level: debug, info, warn or error", "info", func(c *config, v string) error {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("unknown level %q", v)
+		}
+		c.Log.Level = v
+		return nil
+	}},
+	{"log-format", "LOG_FORMAT", "log format: json or logfmt", "json", func(c *config, v string) error {
+		switch strings.ToLower(v) {
+		case "json", "logfmt", "text":
+		default:
+			return fmt.Errorf("unknown format %q", v)
+		}
+		c.Log.Format = v
+		return nil
+	}},
+	{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "how long a graceful shutdown may take", "15s", func(c *config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("not a duration: %q", v)
+		}
+		c.Shutdown = d
+		return nil
+	}},
+}
+
+// loadConfig reads the configuration from args and the environment. It
+// returns every problem found rather than stopping at the first.
+func loadConfig(args []string) (*config, []error) {
+	fs := flag.NewFlagSet("dcfl-server", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(configFileEnv), "configuration file of KEY=VALUE lines, keyed by environment variable")
+	flagValues := make(map[string]*string)
+	for _, s := range settings {
+		flagValues[s.Name] = fs.String(s.Name, "", fmt.Sprintf("%s (env %s)", s.Usage, s.Env))
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, []error{err}
+	}
+	setFlags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	var errs []error
+
+	fileValues := make(map[string]string)
+	if *configFile != "" {
+		fileValues, err = godotenv.Read(*configFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("config: error reading %s: %v", *configFile, err))
+		}
+	}
+
+	lookup := func(s setting) string {
+		if setFlags[s.Name] {
+			return *flagValues[s.Name]
+		}
+		if v, ok := os.LookupEnv(s.Env); ok {
+			return v
+		}
+		if v, ok := fileValues[s.Env]; ok {
+			return v
+		}
+		return s.Def
+	}
+
+	// DEV deployments keep their database settings in .env, which in-memory
+	// demos don't need.
+	if strings.ToUpper(lookup(settings[0])) == "DEV" {
+		err := godotenv.Load()
+		if err != nil && lookup(settings[1]) != "memory" {
+			errs = append(errs, fmt.Errorf("config: error loading .env file: %v", err))
+		}
+	}
+
+	c := &config{}
+	for _, s := range settings {
+		err := s.Set(c, lookup(s))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("config: %s (%s): %v", s.Name, s.Env, err))
+		}
+	}
+
+	return c, append(errs, c.validate()...)
+}
+
+func (c *config) validate() []error {
+	var errs []error
+	switch c.Env {
+	case "DEV":
+		if c.Storage == "postgres" && (c.DB.Name == "" || c.DB.User == "") {
+			errs = append(errs, fmt.Errorf("config: db-name and db-user must be set in DEV"))
+		}
+	case "PROD":
+		if c.Storage == "postgres" && c.DB.URL == "" {
+			errs = append(errs, fmt.Errorf("config: db-url must be set in PROD"))
+		}
+		if c.Auth.SessionSecret == "" {
+			errs = append(errs, fmt.Errorf("config: auth-session-secret must be set in PROD"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("config: env must be DEV or PROD, got %q", c.Env))
+	}
+	if c.Listen.Addr == "" {
+		errs = append(errs, fmt.Errorf("config: one of listen-addr or port must be set"))
+	}
+	if (c.Listen.TLSCert == "") != (c.Listen.TLSKey == "") {
+		errs = append(errs, fmt.Errorf("config: tls-cert and tls-key must be set together"))
+	}
+	if c.Match.GoalsToWin < 1 {
+		errs = append(errs, fmt.Errorf("config: goals-to-win must be at least 1"))
+	}
+	if c.Match.RotationGoalsToWin < 1 {
+		errs = append(errs, fmt.Errorf("config: rotation-goals-to-win must be at least 1"))
+	}
+	if c.Shutdown <= 0 {
+		errs = append(errs, fmt.Errorf("config: shutdown-timeout must be positive"))
+	}
+	switch c.Auth.Provider {
+	case "google":
+		// Without an audience, Google tokens issued to any client are accepted.
+		if c.Env == "PROD" && len(c.Auth.Audience) == 0 {
+			errs = append(errs, fmt.Errorf("config: auth-audience must be set for the google auth-provider in PROD"))
+		}
+	case "dev":
+		if c.Env != "DEV" {
+			errs = append(errs, fmt.Errorf("config: the dev auth-provider can only be used in DEV"))
+		}
+		if len(c.Auth.DevUsers) == 0 {
+			errs = append(errs, fmt.Errorf("config: auth-dev-users must not be empty"))
+		}
+	case "oidc":
+		if c.Auth.OIDCIssuer == "" {
+			errs = append(errs, fmt.Errorf("config: auth-oidc-issuer must be set for the oidc auth-provider"))
+		}
+		if len(c.Auth.Audience) == 0 {
+			errs = append(errs, fmt.Errorf("config: auth-audience must be set for the oidc auth-provider"))
+		}
+	}
+	if c.Auth.SessionTTL <= 0 || c.Auth.RefreshTTL < c.Auth.SessionTTL {
+		errs = append(errs, fmt.Errorf("config: auth-session-ttl must be positive and no longer than auth-refresh-ttl"))
+	}
+	if len(c.Webhooks.URLs) > 0 && c.Webhooks.Secret == "" {
+		errs = append(errs, fmt.Errorf("config: webhook-secret must be set when webhook-urls is"))
+	}
+	if c.Webhooks.MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("config: webhook-max-attempts must be at least 1"))
+	}
+	if len(c.CORS.AllowedOrigins) == 0 {
+		errs = append(errs, fmt.Errorf("config: cors-origins must not be empty"))
+	}
+	for _, o := range c.CORS.AllowedOrigins {
+		if strings.Count(o, "*") > 1 {
+			errs = append(errs, fmt.Errorf("config: cors-origins entry %q may contain at most one *", o))
+		}
+	}
+	if c.WS.MaxMessageSize < 1 {
+		errs = append(errs, fmt.Errorf("config: ws-max-message-size must be positive"))
+	}
+	if c.WS.ConnectionRate <= 0 || c.WS.PlayerRate <= 0 {
+		errs = append(errs, fmt.Errorf("config: ws-connection-rate and ws-player-rate must be positive"))
+	}
+	if c.WS.ConnectionBurst < 1 || c.WS.PlayerBurst < 1 {
+		errs = append(errs, fmt.Errorf("config: ws-connection-burst and ws-player-burst must be at least 1"))
+	}
+	return errs
+}
+
+// dsn returns the connection string for the database.
+func (c dbConfig) dsn() string {
+	if c.URL != "" {
+		return c.URL
+	}
+	dsn := fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=%s", c.Host, c.Port, c.User, c.Name, c.SSLMode)
+	if c.Password != "" {
+		dsn += fmt.Sprintf(" password=%s", c.Password)
+	}
+	return dsn
+}
+
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
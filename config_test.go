@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// isolateConfig unsets every configuration variable for the duration of the
+// test and runs it in a directory whose .env holds dotenv.
+func isolateConfig(t *testing.T, dotenv string) string {
+	t.Helper()
+	for _, env := range append([]string{configFileEnv}, settingEnvs()...) {
+		t.Setenv(env, "")
+		os.Unsetenv(env)
+	}
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, ".env"), []byte(dotenv), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+	return dir
+}
+
+func settingEnvs() []string {
+	var envs []string
+	for _, s := range settings {
+		envs = append(envs, s.Env)
+	}
+	return envs
+}
+
+// validArgs configure a server that passes validation.
+var validArgs = []string{"-env", "prod", "-storage", "memory", "-port", "8080", "-auth-session-secret", "s3cret", "-auth-audience", "dcfl"}
+
+func TestConfigPrecedence(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		file   string
+		dotenv string
+		env    map[string]string
+		args   []string
+		check  func(*config) bool
+	}{
+		{
+			name: "defaults",
+			check: func(c *config) bool {
+				return c.Match.GoalsToWin == 5 && c.Auth.Provider == "google" && c.DB.SSLMode == "disable"
+			},
+		},
+		{
+			name: "file over defaults",
+			file: "DCFL_GOALS_TO_WIN=7\nDCFL_AUTH_ADMINS=1, 2\n",
+			check: func(c *config) bool {
+				return c.Match.GoalsToWin == 7 && equalStrings(c.Auth.Admins, []string{"1", "2"})
+			},
+		},
+		{
+			name:  "environment over file",
+			file:  "DCFL_GOALS_TO_WIN=7\n",
+			env:   map[string]string{"DCFL_GOALS_TO_WIN": "8"},
+			check: func(c *config) bool { return c.Match.GoalsToWin == 8 },
+		},
+		{
+			name:  "flags over environment",
+			file:  "DCFL_GOALS_TO_WIN=7\n",
+			env:   map[string]string{"DCFL_GOALS_TO_WIN": "8"},
+			args:  []string{"-goals-to-win", "9"},
+			check: func(c *config) bool { return c.Match.GoalsToWin == 9 },
+		},
+		{
+			name:  "listen-addr over port",
+			args:  []string{"-listen-addr", "127.0.0.1:9000"},
+			check: func(c *config) bool { return c.Listen.Addr == "127.0.0.1:9000" },
+		},
+		{
+			name:   "DEV loads .env below the environment",
+			dotenv: "DCFL_DEV_PG_NAME=dcfl\nDCFL_DEV_PG_USER=dotenv\n",
+			env:    map[string]string{"DCFL_DEV_PG_USER": "env"},
+			args:   []string{"-env", "dev", "-storage", "postgres"},
+			check:  func(c *config) bool { return c.Env == "DEV" && c.DB.Name == "dcfl" && c.DB.User == "env" },
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := isolateConfig(t, c.dotenv)
+			args := append([]string{}, validArgs...)
+			if c.file != "" {
+				path := filepath.Join(dir, "dcfl.conf")
+				os.WriteFile(path, []byte(c.file), 0600)
+				args = append(args, "-config", path)
+			}
+			for k, v := range c.env {
+				t.Setenv(k, v)
+			}
+			cfg, errs := loadConfig(append(args, c.args...))
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors %v", errs)
+			}
+			if !c.check(cfg) {
+				t.Fatalf("unexpected config %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestConfigFileFromEnvironment(t *testing.T) {
+	dir := isolateConfig(t, "")
+	path := filepath.Join(dir, "dcfl.conf")
+	os.WriteFile(path, []byte("DCFL_ROTATION_GOALS_TO_WIN=4\n"), 0600)
+	t.Setenv(configFileEnv, path)
+	cfg, errs := loadConfig(validArgs)
+	if len(errs) != 0 || cfg.Match.RotationGoalsToWin != 4 {
+		t.Fatalf("expected the file named by %s to be read, got %v %+v", configFileEnv, errs, cfg)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-env", "qa"}, `env must be DEV or PROD, got "QA"`},
+		{[]string{"-env", "dev", "-storage", "postgres"}, "db-name and db-user must be set in DEV"},
+		{[]string{"-storage", "postgres"}, "db-url must be set in PROD"},
+		{[]string{"-storage", "sqlite"}, `storage (DCFL_STORAGE): unknown storage "sqlite"`},
+		{[]string{"-auth-session-secret", ""}, "auth-session-secret must be set in PROD"},
+		{[]string{"-port", ""}, "one of listen-addr or port must be set"},
+		{[]string{"-port", "http"}, `port (PORT): not a port number: "http"`},
+		{[]string{"-tls-cert", "cert.pem"}, "tls-cert and tls-key must be set together"},
+		{[]string{"-goals-to-win", "0"}, "goals-to-win must be at least 1"},
+		{[]string{"-goals-to-win", "five"}, `goals-to-win (DCFL_GOALS_TO_WIN): not a number: "five"`},
+		{[]string{"-rotation-goals-to-win", "0"}, "rotation-goals-to-win must be at least 1"},
+		{[]string{"-shutdown-timeout", "0s"}, "shutdown-timeout must be positive"},
+		{[]string{"-shutdown-timeout", "soon"}, `shutdown-timeout (SHUTDOWN_TIMEOUT): not a duration: "soon"`},
+		{[]string{"-auth-provider", "facebook"}, `auth-provider (DCFL_AUTH_PROVIDER): unknown provider "facebook"`},
+		{[]string{"-auth-provider", "dev"}, "the dev auth-provider can only be used in DEV"},
+		{[]string{"-env", "dev", "-auth-provider", "dev", "-auth-dev-users", ""}, "auth-dev-users must not be empty"},
+		{[]string{"-auth-provider", "oidc", "-auth-audience", "dcfl"}, "auth-oidc-issuer must be set for the oidc auth-provider"},
+		{[]string{"-auth-provider", "oidc", "-auth-oidc-issuer", "https://id.example", "-auth-audience", ""}, "auth-audience must be set for the oidc auth-provider"},
+		{[]string{"-auth-audience", ""}, "auth-audience must be set for the google auth-provider in PROD"},
+		{[]string{"-auth-session-ttl", "2h", "-auth-refresh-ttl", "1h"}, "auth-session-ttl must be positive and no longer than auth-refresh-ttl"},
+		{[]string{"-webhook-urls", "https://hooks.example"}, "webhook-secret must be set when webhook-urls is"},
+		{[]string{"-webhook-max-attempts", "0"}, "webhook-max-attempts must be at least 1"},
+		{[]string{"-cors-origins", ""}, "cors-origins must not be empty"},
+		{[]string{"-cors-origins", "https://*.*.example"}, `cors-origins entry "https://*.*.example" may contain at most one *`},
+		{[]string{"-ws-max-message-size", "0"}, "ws-max-message-size must be positive"},
+		{[]string{"-ws-player-rate", "0"}, "ws-connection-rate and ws-player-rate must be positive"},
+		{[]string{"-ws-connection-burst", "0"}, "ws-connection-burst and ws-player-burst must be at least 1"},
+		{[]string{"-log-level", "loud"}, `log-level (LOG_LEVEL): unknown level "loud"`},
+		{[]string{"-log-format", "xml"}, `log-format (LOG_FORMAT): unknown format "xml"`},
+		{[]string{"-config", "missing.conf"}, "error reading missing.conf"},
+	} {
+		isolateConfig(t, "")
+		_, errs := loadConfig(append(append([]string{}, validArgs...), c.args...))
+		found := false
+		for _, err := range errs {
+			found = found || strings.Contains(err.Error(), c.want)
+		}
+		if !found {
+			t.Errorf("%v: expected %q, got %v", c.args, c.want, errs)
+		}
+	}
+}
@@ -1,72 +1,170 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
 
+// lastConnectionID is used to give every connection a unique id for logging.
+var lastConnectionID uint64
+
 type connection struct {
+	// Unique id of the connection.
+	id uint64
+
 	// Buffered channel of outbound messages.
 	send chan []byte
 
 	// The hub.
 	h *hub
 
-	// The id of the user who created the connection.
-	sub string
+	// The id of the user who created the connection, and the session they
+	// opened it with.
+	sub     string
+	session string
+
+	// The underlying WebSocket connection.
+	ws *websocket.Conn
+
+	// Limit the actions accepted from this connection and from its player.
+	limit  *rateLimiter
+	player *rateLimiter
+}
+
+func (c *connection) log() *slog.Logger {
+	return logger.With("table", c.h.table, "conn", c.id, "sub", c.sub)
+}
+
+// close sends a close frame with the given code and reason, then closes the
+// underlying connection.
+func (c *connection) close(code int, reason string) {
+	err := c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	if err != nil {
+		c.log().Debug("error sending close frame", "err", err)
+	}
+	c.ws.Close()
 }
 
-func (c *connection) reader(wg *sync.WaitGroup, wsConn *websocket.Conn) {
-	defer wg.Done()
+func (c *connection) reader(wsConn *websocket.Conn) {
 	for {
 		_, message, err := wsConn.ReadMessage()
-		if err != nil {
-			break
+		if err == websocket.ErrReadLimit {
+			// The WebSocket library has already closed the connection with
+			// CloseMessageTooBig.
+			wsViolations.inc("message_size")
+			c.log().Warn("message too large, closing connection")
+			return
+		} else if err != nil {
+			c.log().Debug("read failed", "err", err)
+			return
+		}
+		if !c.limit.allow() {
+			c.violation("connection_rate", "too many messages")
+			return
+		}
+		if !c.player.allow() {
+			c.violation("player_rate", "too many messages from this player")
+			return
+		}
+		select {
+		case c.h.requests <- request{c: c, msg: message}:
+		case <-c.h.quit:
+			return
 		}
-		c.h.requests <- message
 	}
 }
 
-func (c *connection) writer(wg *sync.WaitGroup, wsConn *websocket.Conn) {
-	defer wg.Done()
+// violation closes a connection that broke one of the limits.
+func (c *connection) violation(kind string, reason string) {
+	wsViolations.inc(kind)
+	c.log().Warn("closing connection", "violation", kind)
+	c.close(websocket.ClosePolicyViolation, reason)
+}
+
+func (c *connection) writer(wsConn *websocket.Conn) {
 	for message := range c.send {
 		err := wsConn.WriteMessage(websocket.TextMessage, message)
 		if err != nil {
+			c.log().Debug("write failed", "err", err)
 			break
 		}
 	}
+	// The hub has dropped this connection or the client went away; closing
+	// makes the reader fail so the hub is told the connection left.
+	wsConn.Close()
 }
 
-var upgrader = &websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+type wsHandler struct {
+	h        *hub
+	cfg      wsConfig
+	upgrader *websocket.Upgrader
+	players  *playerLimiters
+	sessions *sessionIssuer
 }
 
-type wsHandler struct {
-	h *hub
+func newWSHandler(h *hub, cfg *config, sessions *sessionIssuer) wsHandler {
+	origins := cfg.CORS.AllowedOrigins
+	return wsHandler{
+		h:   h,
+		cfg: cfg.WS,
+		upgrader: &websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin: func(r *http.Request) bool {
+				if originAllowed(origins, r.Header.Get("Origin")) {
+					return true
+				}
+				wsViolations.inc("origin")
+				logger.Warn("refused WebSocket from origin", "origin", r.Header.Get("Origin"), "remote", r.RemoteAddr)
+				return false
+			},
+		},
+		players:  newPlayerLimiters(cfg.WS.PlayerRate, cfg.WS.PlayerBurst),
+		sessions: sessions,
+	}
 }
 
 func (wsh wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	wsConn, err := upgrader.Upgrade(w, r, nil)
+	// Browsers cannot set headers on WebSocket requests, so the session token
+	// comes in the query string.
+	token, err := wsh.sessions.verify(r.URL.Query().Get("token"))
 	if err != nil {
-		log.Printf("error upgrading %s", err)
+		authFailures.inc(failureReason(err))
+		logger.Info("rejected WebSocket session", "remote", r.RemoteAddr, "err", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if token.Sub != vars["sub"] {
+		logger.Info("refused WebSocket for another player", "sub", token.Sub, "register", vars["sub"], "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
-	c := &connection{send: make(chan []byte, 256), h: wsh.h, sub: vars["sub"]}
+	wsConn, err := wsh.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Warn("error upgrading connection", "err", err, "remote", r.RemoteAddr)
+		return
+	}
+	wsConn.SetReadLimit(wsh.cfg.MaxMessageSize)
+	c := &connection{
+		id:      atomic.AddUint64(&lastConnectionID, 1),
+		send:    make(chan []byte, 256),
+		h:       wsh.h,
+		sub:     token.Sub,
+		session: token.SessionID,
+		ws:      wsConn,
+		limit:   newRateLimiter(wsh.cfg.ConnectionRate, wsh.cfg.ConnectionBurst),
+		player:  wsh.players.get(token.Sub),
+	}
+	c.log().Info("connection opened", "remote", r.RemoteAddr)
 	c.h.addConnection(c)
-	defer c.h.removeConnection(c)
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go c.writer(&wg, wsConn)
-	go c.reader(&wg, wsConn)
-	wg.Wait()
+	go c.writer(wsConn)
+	c.reader(wsConn)
+	c.h.leave(c)
 	wsConn.Close()
 }
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The end-to-end harness runs the real router and hub against an in-memory
+// repository and a fake identity provider, and drives them through WebSocket
+// clients the way the web client does.
+
+const broadcastTimeout = 2 * time.Second
+
+// fakeVerifier accepts tokens of the form "<sub>" for every known player.
+type fakeVerifier map[string]validatedID
+
+func (fv fakeVerifier) Verify(token string) (*validatedID, error) {
+	id, ok := fv[token]
+	if !ok {
+		return nil, authFailure("invalid_token", nil)
+	}
+	return &id, nil
+}
+
+type testServer struct {
+	t       *testing.T
+	srv     *httptest.Server
+	repo    *memoryRepository
+	hub     *hub
+	clients []*testClient
+	// Sessions started by authenticate, by player.
+	sessions map[string]sessionTokens
+	verifier fakeVerifier
+}
+
+type testClient struct {
+	t   *testing.T
+	sub string
+	ws  *websocket.Conn
+}
+
+// broadcast is either a match state or a message such as "Game Over".
+type broadcast struct {
+	state   matchState
+	message string
+	badges  []badgeAward
+}
+
+func TestMain(m *testing.M) {
+	logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	os.Exit(m.Run())
+}
+
+func newTestServer(t *testing.T, players ...string) *testServer {
+	return newConfiguredTestServer(t, nil, players...)
+}
+
+// newConfiguredTestServer is newTestServer with configure applied to the
+// configuration, if not nil, before the server starts.
+func newConfiguredTestServer(t *testing.T, configure func(*config), players ...string) *testServer {
+	cfg := &config{
+		Match: matchRules{GoalsToWin: 5, RotationGoalsToWin: 3},
+		Auth:  authConfig{Admins: []string{"1"}, SessionSecret: "test", SessionTTL: time.Minute, RefreshTTL: time.Hour},
+		CORS:  corsConfig{AllowedOrigins: []string{"*"}},
+		WS:    wsConfig{MaxMessageSize: 4096, ConnectionRate: 100, ConnectionBurst: 100, PlayerRate: 100, PlayerBurst: 100},
+		Chat:  chatConfig{SigningSecret: testChatSecret},
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	verifier := fakeVerifier{}
+	for _, sub := range players {
+		verifier[sub] = validatedID{Sub: sub, Name: "Player " + sub, Picture: "https://example.com/" + sub + ".png"}
+	}
+
+	ts := startTestServer(t, cfg, verifier)
+	ts.verifier = verifier
+	for _, sub := range players {
+		ts.authenticate(sub)
+	}
+	return ts
+}
+
+// startTestServer serves cfg with players signing in through verifier.
+func startTestServer(t *testing.T, cfg *config, verifier identityVerifier) *testServer {
+	repo := newMemoryRepository()
+	h := newHub("test", cfg.Match, repo)
+	s := &server{cfg: cfg, repo: repo, hub: h, verifier: verifier, sessions: newSessionIssuer(cfg.Auth, repo), links: newChatLinks()}
+	ts := &testServer{t: t, srv: httptest.NewServer(s.routes()), repo: repo, hub: h, sessions: make(map[string]sessionTokens)}
+	t.Cleanup(ts.close)
+	return ts
+}
+
+func (ts *testServer) close() {
+	for _, c := range ts.clients {
+		c.ws.Close()
+	}
+	ts.srv.Close()
+}
+
+// authenticate signs sub in with the fake identity provider and keeps the
+// session for later requests.
+func (ts *testServer) authenticate(sub string) sessionTokens {
+	return ts.authenticateWith(sub, sub)
+}
+
+// authenticateWith signs sub in with idToken and keeps the session for later
+// requests.
+func (ts *testServer) authenticateWith(sub string, idToken string) sessionTokens {
+	req, _ := http.NewRequest("POST", ts.srv.URL+"/authenticate", nil)
+	req.Header.Set("Authorization", idToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatalf("authenticate %s: %v", sub, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		ts.t.Fatalf("authenticate %s: status %d", sub, resp.StatusCode)
+	}
+	var tokens sessionTokens
+	json.NewDecoder(resp.Body).Decode(&tokens)
+	ts.sessions[sub] = tokens
+	return tokens
+}
+
+// authorization returns the Authorization header for requests as sub. Players
+// who never signed in send their bare id, which the server refuses.
+func (ts *testServer) authorization(sub string) string {
+	if tokens, ok := ts.sessions[sub]; ok {
+		return "Bearer " + tokens.Token
+	}
+	return sub
+}
+
+// connect opens a WebSocket for sub and consumes the state broadcast that
+// every connected client receives when it joins.
+func (ts *testServer) connect(sub string) *testClient {
+	url := "ws" + strings.TrimPrefix(ts.srv.URL, "http") + "/register/" + sub + "?token=" + ts.sessions[sub].Token
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		ts.t.Fatalf("connect %s: %v", sub, err)
+	}
+	c := &testClient{t: ts.t, sub: sub, ws: ws}
+	ts.clients = append(ts.clients, c)
+	ts.expectState()
+	return c
+}
+
+// disconnect closes a client; it no longer takes part in expected broadcasts.
+func (ts *testServer) disconnect(c *testClient) {
+	c.ws.Close()
+	for i, other := range ts.clients {
+		if other == c {
+			ts.clients = append(ts.clients[:i], ts.clients[i+1:]...)
+			break
+		}
+	}
+}
+
+// expectState reads the next broadcast on every client, checks that they all
+// saw the same match state and returns it.
+func (ts *testServer) expectState() matchState {
+	ts.t.Helper()
+	var first matchState
+	for i, c := range ts.clients {
+		b := c.next()
+		if b.message != "" {
+			ts.t.Fatalf("client %s: expected match state, got message %q", c.sub, b.message)
+		}
+		if i == 0 {
+			first = b.state
+		} else if b.state != first {
+			ts.t.Fatalf("client %s saw %+v, client %s saw %+v", ts.clients[0].sub, first, c.sub, b.state)
+		}
+	}
+	return first
+}
+
+// expectMessage reads the next broadcast on every client and checks that it
+// is the given message.
+func (ts *testServer) expectMessage(message string) {
+	ts.t.Helper()
+	for _, c := range ts.clients {
+		b := c.next()
+		if b.message != message {
+			ts.t.Fatalf("client %s: expected message %q, got %+v", c.sub, message, b)
+		}
+	}
+}
+
+// expectRejection reads the next broadcast on c only and checks that it is the
+// match state with the given error.
+func (c *testClient) expectRejection(reason string) matchState {
+	c.t.Helper()
+	b := c.next()
+	if b.state.Error != reason {
+		c.t.Fatalf("client %s: expected rejection %q, got %+v", c.sub, reason, b)
+	}
+	return b.state
+}
+
+func (c *testClient) send(msg dcflMsg) {
+	c.t.Helper()
+	if msg.Sub == "" {
+		msg.Sub = c.sub
+	}
+	err := c.ws.WriteJSON(msg)
+	if err != nil {
+		c.t.Fatalf("client %s: send %s: %v", c.sub, msg.Action, err)
+	}
+}
+
+func (c *testClient) next() broadcast {
+	c.t.Helper()
+	c.ws.SetReadDeadline(time.Now().Add(broadcastTimeout))
+	_, data, err := c.ws.ReadMessage()
+	if err != nil {
+		c.t.Fatalf("client %s: waiting for broadcast: %v", c.sub, err)
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		c.t.Fatalf("client %s: malformed broadcast %s: %v", c.sub, data, err)
+	}
+	b := broadcast{}
+	if raw, ok := fields["message"]; ok {
+		json.Unmarshal(raw, &b.message)
+		json.Unmarshal(fields["badges"], &b.badges)
+		return b
+	}
+	err = json.Unmarshal(data, &b.state)
+	if err != nil {
+		c.t.Fatalf("client %s: malformed match state %s: %v", c.sub, data, err)
+	}
+	return b
+}
+
+func (c *testClient) register(side string) {
+	c.send(dcflMsg{Action: "register game", Side: side})
+}
+
+func (c *testClient) confirm(side string) {
+	c.send(dcflMsg{Action: "confirm", Side: side})
+}
+
+func (c *testClient) registerTeam(side string, partner string, city string, name string) {
+	c.send(dcflMsg{Action: "register team", Side: side, Player1: c.sub, Player2: partner, City: city, Name: name})
+}
+
+func (c *testClient) goal() {
+	c.send(dcflMsg{Action: "goal"})
+}
+
+func (c *testClient) undoGoal() {
+	c.send(dcflMsg{Action: "undo goal"})
+}
+
+func picture(sub string) string {
+	return "https://example.com/" + sub + ".png"
+}
+
+func seated(sub string, confirmed bool, goals int) player {
+	return player{Sub: sub, Name: "Player " + sub, Picture: picture(sub), Confirmed: confirmed, Goals: goals}
+}
+
+// setUpMatch connects four players, seats them, confirms them and registers
+// both teams, checking every broadcast along the way. It returns the clients
+// as black 1, black 2, yellow 1 and yellow 2.
+func setUpMatch(ts *testServer) (*testClient, *testClient, *testClient, *testClient) {
+	ts.t.Helper()
+	b1 := ts.connect("1")
+	b2 := ts.connect("2")
+	y1 := ts.connect("3")
+	y2 := ts.connect("4")
+
+	b1.register("black")
+	state := ts.expectState()
+	if state.BlackPlayer1 != seated("1", false, 0) {
+		ts.t.Fatalf("black player 1 not seated: %+v", state)
+	}
+	b2.register("black")
+	state = ts.expectState()
+	if state.BlackPlayer2 != seated("2", false, 0) {
+		ts.t.Fatalf("black player 2 not seated: %+v", state)
+	}
+	y1.register("yellow")
+	ts.expectState()
+	y2.register("yellow")
+	state = ts.expectState()
+	if state.YellowPlayer1 != seated("3", false, 0) || state.YellowPlayer2 != seated("4", false, 0) {
+		ts.t.Fatalf("yellow players not seated: %+v", state)
+	}
+	if state.Phase != phaseAwaitingConfirmations {
+		ts.t.Fatalf("expected to await confirmations once seated: %+v", state)
+	}
+
+	b1.confirm("black")
+	state = ts.expectState()
+	if !state.BlackPlayer1.Confirmed || state.BlackPlayer2.Confirmed {
+		ts.t.Fatalf("expected only black player 1 confirmed: %+v", state)
+	}
+	b2.confirm("black")
+	state = ts.expectState()
+	if !state.BlackPlayer2.Confirmed || state.BlackTeam != (team{}) {
+		ts.t.Fatalf("expected black confirmed without a team: %+v", state)
+	}
+	y1.confirm("yellow")
+	ts.expectState()
+	y2.confirm("yellow")
+	state = ts.expectState()
+	if !state.YellowPlayer1.Confirmed || !state.YellowPlayer2.Confirmed || state.GameStarted || state.Phase != phaseAwaitingTeams {
+		ts.t.Fatalf("expected yellow confirmed and game waiting for teams: %+v", state)
+	}
+
+	b1.registerTeam("black", "2", "Chicago", "Blackhawks")
+	state = ts.expectState()
+	if state.BlackTeam.Name != "Blackhawks" || state.GameStarted {
+		ts.t.Fatalf("expected black team registered: %+v", state)
+	}
+	y1.registerTeam("yellow", "4", "Boston", "Bruins")
+	state = ts.expectState()
+	if state.YellowTeam.Name != "Bruins" || !state.GameStarted || state.Phase != phaseInPlay {
+		ts.t.Fatalf("expected game started: %+v", state)
+	}
+	return b1, b2, y1, y2
+}
+
+func TestFullMatch(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	b1, b2, y1, _ := setUpMatch(ts)
+
+	y1.goal()
+	state := ts.expectState()
+	if state.YellowScore != 1 || state.YellowPlayer1.Goals != 1 {
+		t.Fatalf("yellow goal not counted: %+v", state)
+	}
+	y1.undoGoal()
+	state = ts.expectState()
+	if state.YellowScore != 0 || state.YellowPlayer1.Goals != 0 {
+		t.Fatalf("yellow goal not undone: %+v", state)
+	}
+
+	for i := 1; i <= 4; i++ {
+		b1.goal()
+		state = ts.expectState()
+		if state.BlackScore != i || state.BlackPlayer1.Goals != i {
+			t.Fatalf("goal %d not counted: %+v", i, state)
+		}
+	}
+
+	b2.goal()
+	state = ts.expectState()
+	if state != (matchState{Phase: phaseOpen, Format: formatDoubles}) {
+		t.Fatalf("expected the table to reset after the game, got %+v", state)
+	}
+	ts.expectMessage("Game Over")
+
+	if len(ts.repo.games) != 1 {
+		t.Fatalf("expected 1 game recorded, got %d", len(ts.repo.games))
+	}
+	g := ts.repo.games[0]
+	if !g.finished || g.blackScore != 5 || g.yellowScore != 0 {
+		t.Fatalf("wrong game result recorded: %+v", g)
+	}
+	goals := make(map[string]int)
+	for _, gg := range ts.repo.goals {
+		goals[gg.playerID] = gg.goals
+	}
+	want := map[string]int{"1": 4, "2": 1, "3": 0, "4": 0}
+	if fmt.Sprint(goals) != fmt.Sprint(want) {
+		t.Fatalf("expected goals %v, got %v", want, goals)
+	}
+}
+
+func TestKnownTeamsStartOnConfirmation(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	ts.repo.CreateTeam("Chicago", "Blackhawks", "2", "1")
+	ts.repo.CreateTeam("Boston", "Bruins", "3", "4")
+
+	clients := []*testClient{ts.connect("1"), ts.connect("2"), ts.connect("3"), ts.connect("4")}
+	sides := []string{"black", "black", "yellow", "yellow"}
+	for i, c := range clients {
+		c.register(sides[i])
+		ts.expectState()
+	}
+	for i, c := range clients[:3] {
+		c.confirm(sides[i])
+		ts.expectState()
+	}
+	clients[3].confirm("yellow")
+	state := ts.expectState()
+	if state.BlackTeam.Name != "Blackhawks" || state.YellowTeam.Name != "Bruins" || !state.GameStarted {
+		t.Fatalf("expected known teams to start the game: %+v", state)
+	}
+}
+
+func TestRegistrationRules(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3")
+	c1 := ts.connect("1")
+	c2 := ts.connect("2")
+	c3 := ts.connect("3")
+
+	c1.register("black")
+	ts.expectState()
+
+	// Switching sides moves the player.
+	c1.register("yellow")
+	state := ts.expectState()
+	if state.BlackPlayer1 != (player{}) || state.YellowPlayer1 != seated("1", false, 0) {
+		t.Fatalf("expected player 1 to move to yellow: %+v", state)
+	}
+
+	// Registering again for the same side while unconfirmed gets up again.
+	c1.register("yellow")
+	state = ts.expectState()
+	if state.YellowPlayer1 != (player{}) {
+		t.Fatalf("expected player 1 to leave yellow: %+v", state)
+	}
+
+	// A full side turns further players away.
+	c1.register("black")
+	ts.expectState()
+	c2.register("black")
+	ts.expectState()
+	c3.register("black")
+	state = c3.expectRejection("black side is full")
+	if state.BlackPlayer1.Sub != "1" || state.BlackPlayer2.Sub != "2" {
+		t.Fatalf("expected black side to keep players 1 and 2: %+v", state)
+	}
+
+	// Players can only act as themselves.
+	c3.send(dcflMsg{Action: "register game", Side: "yellow", Sub: "1"})
+	c3.expectRejection("signed in as another player")
+	c3.register("green")
+	c3.expectRejection("unknown side")
+}
+
+func TestPhaseRules(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4", "5")
+	spectator := ts.connect("5")
+
+	// Nothing but seating happens in an open lobby.
+	spectator.confirm("black")
+	spectator.expectRejection("cannot confirm while the lobby is open")
+	spectator.goal()
+	spectator.expectRejection("cannot goal while the lobby is open")
+	spectator.send(dcflMsg{Action: "dance"})
+	spectator.expectRejection(`unknown action "dance"`)
+
+	b1, _, y1, _ := setUpMatch(ts)
+
+	// Seats are fixed once the game is in play.
+	spectator.register("black")
+	spectator.expectRejection("cannot register game while the game is in play")
+	b1.undoGoal()
+	b1.expectRejection("no goal to undo")
+	spectator.goal()
+	spectator.expectRejection("not playing in this game")
+
+	spectator.send(dcflMsg{Action: "pause"})
+	spectator.expectRejection("only players in the game can pause it")
+	y1.send(dcflMsg{Action: "pause"})
+	state := ts.expectState()
+	if state.Phase != phasePaused || !state.GameStarted {
+		t.Fatalf("expected the game to be paused: %+v", state)
+	}
+	b1.goal()
+	b1.expectRejection("cannot goal while the game is paused")
+
+	b1.send(dcflMsg{Action: "resume"})
+	state = ts.expectState()
+	if state.Phase != phaseInPlay {
+		t.Fatalf("expected the game to resume: %+v", state)
+	}
+	b1.goal()
+	state = ts.expectState()
+	if state.BlackScore != 1 {
+		t.Fatalf("expected goal after resuming: %+v", state)
+	}
+}
+
+func TestConfirmedPlayersKeepTheirSeat(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	clients := []*testClient{ts.connect("1"), ts.connect("2"), ts.connect("3"), ts.connect("4")}
+	sides := []string{"black", "black", "yellow", "yellow"}
+	for i, c := range clients {
+		c.register(sides[i])
+		ts.expectState()
+	}
+
+	clients[0].confirm("black")
+	ts.expectState()
+	clients[0].register("black")
+	state := clients[0].expectRejection("already confirmed on this side")
+	if state.BlackPlayer1 != seated("1", true, 0) {
+		t.Fatalf("expected confirmed player to keep the seat: %+v", state)
+	}
+	clients[2].confirm("black")
+	clients[2].expectRejection("not seated on this side")
+
+	// Leaving empties the seat and reopens the lobby.
+	clients[3].send(dcflMsg{Action: "unregister", Side: "yellow"})
+	state = ts.expectState()
+	if state.YellowPlayer2 != (player{}) || state.Phase != phaseOpen {
+		t.Fatalf("expected the lobby to reopen: %+v", state)
+	}
+}
+
+func TestDisconnectMidGame(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	b1, _, y1, _ := setUpMatch(ts)
+
+	b1.goal()
+	ts.expectState()
+
+	ts.disconnect(y1)
+	state := ts.expectState()
+	if state != (matchState{Phase: phaseOpen, Format: formatDoubles}) {
+		t.Fatalf("expected the table to reset, got %+v", state)
+	}
+	ts.expectMessage("Player left mid-game")
+
+	if len(ts.repo.games) != 1 || ts.repo.games[0].finished {
+		t.Fatalf("abandoned game must not be recorded as finished: %+v", ts.repo.games)
+	}
+}
+
+func TestDisconnectInLobby(t *testing.T) {
+	ts := newTestServer(t, "1", "2")
+	c1 := ts.connect("1")
+	c2 := ts.connect("2")
+	c1.register("black")
+	ts.expectState()
+	c2.register("black")
+	ts.expectState()
+
+	ts.disconnect(c2)
+	state := ts.expectState()
+	if state.BlackPlayer1.Sub != "1" || state.BlackPlayer2 != (player{}) {
+		t.Fatalf("expected player 2 to be unseated: %+v", state)
+	}
+}
+
+func TestSpectatorDisconnect(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4", "5")
+	b1, _, _, _ := setUpMatch(ts)
+	b1.goal()
+	before := ts.expectState()
+
+	ts.disconnect(ts.connect("5"))
+	if state := ts.expectState(); state != before {
+		t.Fatalf("expected a spectator leaving mid-game to change nothing, got %+v", state)
+	}
+	b1.goal()
+	if state := ts.expectState(); state.BlackScore != 2 || state.Phase != phaseInPlay {
+		t.Fatalf("expected the game to go on, got %+v", state)
+	}
+}
+
+func TestSpectatorDisconnectInLobby(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4", "5")
+	ts.repo.CreateTeam("Chicago", "Blackhawks", "1", "2")
+	ts.repo.CreateTeam("Boston", "Bruins", "3", "4")
+	clients := []*testClient{ts.connect("1"), ts.connect("2"), ts.connect("3"), ts.connect("4")}
+	sides := []string{"black", "black", "yellow", "yellow"}
+	for i, c := range clients {
+		c.register(sides[i])
+		ts.expectState()
+	}
+	clients[2].confirm("yellow")
+	ts.expectState()
+	clients[3].confirm("yellow")
+	if state := ts.expectState(); state.YellowTeam.Name != "Bruins" {
+		t.Fatalf("expected the yellow team to be found, got %+v", state)
+	}
+
+	ts.disconnect(ts.connect("5"))
+	if state := ts.expectState(); state.YellowTeam.Name != "Bruins" {
+		t.Fatalf("expected a spectator leaving to keep the yellow team, got %+v", state)
+	}
+	clients[0].confirm("black")
+	ts.expectState()
+	clients[1].confirm("black")
+	if state := ts.expectState(); !state.GameStarted || state.YellowTeam.Name != "Bruins" {
+		t.Fatalf("expected the game to start, got %+v", state)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Events buffered per watcher before it starts missing updates.
+	watcherBuffer = 16
+
+	// How often an idle event stream sends a comment to keep proxies from
+	// closing it.
+	keepAliveInterval = 15 * time.Second
+)
+
+// watchEvent is a broadcast as seen by a watcher: either the match state or a
+// message such as "Game Over".
+type watchEvent struct {
+	name string
+	data []byte
+}
+
+// watcher receives the hub's broadcasts without taking part in the match.
+// Unlike connections, watchers are not players and a slow watcher only misses
+// updates rather than being dropped.
+type watcher chan watchEvent
+
+// watch registers a new watcher. It returns nil once the hub has stopped
+// accepting watchers.
+func (h *hub) watch() watcher {
+	h.connectionsMx.Lock()
+	defer h.connectionsMx.Unlock()
+	if h.watchers == nil {
+		return nil
+	}
+	w := make(watcher, watcherBuffer)
+	h.watchers[w] = struct{}{}
+	eventWatchers.inc()
+	return w
+}
+
+// unwatch removes a watcher. It is safe to call after stopWatchers.
+func (h *hub) unwatch(w watcher) {
+	h.connectionsMx.Lock()
+	defer h.connectionsMx.Unlock()
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		close(w)
+		eventWatchers.dec()
+	}
+}
+
+// stopWatchers ends every event stream so that HTTP shutdown does not wait on
+// them.
+func (h *hub) stopWatchers() {
+	h.connectionsMx.Lock()
+	defer h.connectionsMx.Unlock()
+	for w := range h.watchers {
+		close(w)
+		eventWatchers.dec()
+	}
+	h.watchers = nil
+}
+
+// notifyWatchers passes a broadcast on to every watcher without blocking.
+// This function assumes and requires the connectionsMx lock to be acquired by the caller.
+func (h *hub) notifyWatchers(name string, data []byte) {
+	for w := range h.watchers {
+		select {
+		case w <- watchEvent{name: name, data: data}:
+		default:
+			logger.Debug("watcher is behind, skipping event", "table", h.table, "event", name)
+		}
+	}
+}
+
+// tableHub returns the hub for the table named in the request, or responds with
+// 404.
+func tableHub(tables map[string]*hub, w http.ResponseWriter, r *http.Request) *hub {
+	h, ok := tables[mux.Vars(r)["id"]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return h
+}
+
+// stateHandler returns a table's current match state.
+type stateHandler struct {
+	tables map[string]*hub
+}
+
+func (sh stateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := tableHub(sh.tables, w, r)
+	if h == nil {
+		return
+	}
+	h.sideMx.RLock()
+	state := h.state()
+	h.sideMx.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// eventsHandler streams a table's broadcasts as Server-Sent Events. The
+// current state is sent first, followed by a "state" event for every change
+// and a "message" event for every message.
+type eventsHandler struct {
+	tables map[string]*hub
+}
+
+func (eh eventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := tableHub(eh.tables, w, r)
+	if h == nil {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	events := h.watch()
+	if events == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer h.unwatch(events)
+
+	log := logger.With("table", h.table, "remote", r.RemoteAddr)
+	log.Info("event stream opened")
+	defer log.Info("event stream closed")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	h.sideMx.RLock()
+	state, _ := json.Marshal(h.state())
+	h.sideMx.RUnlock()
+	fmt.Fprintf(w, "event: state\ndata: %s\n\n", state)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.name, e.data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
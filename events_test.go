@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	name string
+	data string
+}
+
+// openEvents subscribes to a table's event stream and returns its events.
+func (ts *testServer) openEvents(table string) <-chan sseEvent {
+	ts.t.Helper()
+	resp, err := http.Get(ts.srv.URL + "/tables/" + table + "/events")
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		ts.t.Fatalf("events: status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		ts.t.Fatalf("events: content type %q", ct)
+	}
+	ts.t.Cleanup(func() { resp.Body.Close() })
+
+	events := make(chan sseEvent)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		var e sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				e.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				e.data = strings.TrimPrefix(line, "data: ")
+			case line == "" && e.name != "":
+				events <- e
+				e = sseEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("event stream closed")
+		}
+		return e
+	case <-time.After(broadcastTimeout):
+		t.Fatal("timed out waiting for event")
+	}
+	return sseEvent{}
+}
+
+func expectStateEvent(t *testing.T, events <-chan sseEvent) matchState {
+	t.Helper()
+	e := nextEvent(t, events)
+	var state matchState
+	if e.name != "state" || json.Unmarshal([]byte(e.data), &state) != nil {
+		t.Fatalf("expected state event, got %+v", e)
+	}
+	return state
+}
+
+func TestStateSnapshot(t *testing.T) {
+	ts := newTestServer(t, "1")
+	c := ts.connect("1")
+	c.register("yellow")
+	want := ts.expectState()
+
+	resp, err := http.Get(ts.srv.URL + "/tables/test/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got matchState
+	json.NewDecoder(resp.Body).Decode(&got)
+	if got != want || got.YellowPlayer1.Sub != "1" {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	resp, err = http.Get(ts.srv.URL + "/tables/nope/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown table, got %d", resp.StatusCode)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	events := ts.openEvents("test")
+	if state := expectStateEvent(t, events); state != (matchState{Phase: phaseOpen, Format: formatDoubles}) {
+		t.Fatalf("expected the initial state first, got %+v", state)
+	}
+	ts.hub.connectionsMx.RLock()
+	players := len(ts.hub.connections)
+	ts.hub.connectionsMx.RUnlock()
+	if players != 0 {
+		t.Fatalf("watchers must not count as connections, got %d", players)
+	}
+
+	b1, _, _, _ := setUpMatch(ts)
+	// Four joins, four registrations, four confirmations and two teams.
+	for i := 0; i < 14; i++ {
+		expectStateEvent(t, events)
+	}
+	for i := 0; i < 5; i++ {
+		b1.goal()
+		ts.expectState()
+	}
+	ts.expectMessage("Game Over")
+	for i := 0; i < 4; i++ {
+		if state := expectStateEvent(t, events); state.BlackScore != i+1 {
+			t.Fatalf("expected score %d, got %+v", i+1, state)
+		}
+	}
+	expectStateEvent(t, events)
+	if e := nextEvent(t, events); e.name != "message" || !strings.HasPrefix(e.data, `{"message":"Game Over"`) {
+		t.Fatalf("expected Game Over message, got %+v", e)
+	}
+
+	ts.hub.stopWatchers()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("expected no more events after stopping watchers")
+		}
+	case <-time.After(broadcastTimeout):
+		t.Fatal("event stream did not end when watchers were stopped")
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// leagueDump is every player, team, game and goal record, as exported and
+// imported. Unfinished games have no end timestamp.
+type leagueDump struct {
+	Players []exportPlayer `json:"players"`
+	Teams   []exportTeam   `json:"teams"`
+	Games   []exportGame   `json:"games"`
+	Goals   []exportGoals  `json:"goals"`
+}
+
+// exportPlayer is a player, or a guest when GuestOf or ClaimCode is set.
+type exportPlayer struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Picture   string `json:"picture"`
+	GuestOf   string `json:"guest_of,omitempty"`
+	ClaimCode string `json:"claim_code,omitempty"`
+}
+
+type exportTeam struct {
+	ID      int    `json:"id"`
+	City    string `json:"city"`
+	Name    string `json:"name"`
+	Player1 string `json:"player1"`
+	Player2 string `json:"player2"`
+}
+
+type exportGame struct {
+	ID             int   `json:"id"`
+	BlackTeam      int   `json:"black_team"`
+	YellowTeam     int   `json:"yellow_team"`
+	StartTimestamp int64 `json:"start_timestamp"`
+	EndTimestamp   int64 `json:"end_timestamp"`
+	BlackScore     int   `json:"black_score"`
+	YellowScore    int   `json:"yellow_score"`
+	// Taken from the teams on import.
+	Format matchFormat `json:"format,omitempty"`
+}
+
+type exportGoals struct {
+	GameID   int    `json:"game_id"`
+	PlayerID string `json:"player_id"`
+	Goals    int    `json:"goals"`
+}
+
+// The CSV tables of a dump, in the order they are imported, and their columns.
+var csvTables = []string{"players", "teams", "games", "goals"}
+
+var csvHeaders = map[string][]string{
+	"players": {"id", "name", "picture", "guest_of", "claim_code"},
+	"teams":   {"id", "city", "name", "player1", "player2"},
+	"games":   {"id", "black_team", "yellow_team", "start_timestamp", "end_timestamp", "black_score", "yellow_score"},
+	"goals":   {"game_id", "player_id", "goals"},
+}
+
+// writeCSV writes one table of the dump, header first.
+func (d leagueDump) writeCSV(w io.Writer, table string) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeaders[table])
+	itoa := strconv.Itoa
+	i64 := func(n int64) string { return strconv.FormatInt(n, 10) }
+	switch table {
+	case "players":
+		for _, p := range d.Players {
+			cw.Write([]string{p.ID, p.Name, p.Picture, p.GuestOf, p.ClaimCode})
+		}
+	case "teams":
+		for _, t := range d.Teams {
+			cw.Write([]string{itoa(t.ID), t.City, t.Name, t.Player1, t.Player2})
+		}
+	case "games":
+		for _, g := range d.Games {
+			cw.Write([]string{itoa(g.ID), itoa(g.BlackTeam), itoa(g.YellowTeam), i64(g.StartTimestamp), i64(g.EndTimestamp), itoa(g.BlackScore), itoa(g.YellowScore)})
+		}
+	case "goals":
+		for _, g := range d.Goals {
+			cw.Write([]string{itoa(g.GameID), g.PlayerID, itoa(g.Goals)})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// readCSV reads one table into the dump. The header must list the table's
+// columns in order.
+func (d *leagueDump) readCSV(r io.Reader, table string) error {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return fmt.Errorf("%s: %v", table, err)
+	}
+	if len(records) == 0 || strings.Join(records[0], ",") != strings.Join(csvHeaders[table], ",") {
+		return fmt.Errorf("%s: header must be %s", table, strings.Join(csvHeaders[table], ","))
+	}
+	for i, rec := range records[1:] {
+		row := i + 1
+		var bad error
+		num := func(col int) int {
+			n, err := strconv.Atoi(rec[col])
+			if err != nil && bad == nil {
+				bad = fmt.Errorf("%s row %d: %s must be a number", table, row, csvHeaders[table][col])
+			}
+			return n
+		}
+		timestamp := func(col int) int64 {
+			n, err := strconv.ParseInt(rec[col], 10, 64)
+			if err != nil && bad == nil {
+				bad = fmt.Errorf("%s row %d: %s must be a number", table, row, csvHeaders[table][col])
+			}
+			return n
+		}
+		switch table {
+		case "players":
+			d.Players = append(d.Players, exportPlayer{ID: rec[0], Name: rec[1], Picture: rec[2], GuestOf: rec[3], ClaimCode: rec[4]})
+		case "teams":
+			d.Teams = append(d.Teams, exportTeam{ID: num(0), City: rec[1], Name: rec[2], Player1: rec[3], Player2: rec[4]})
+		case "games":
+			d.Games = append(d.Games, exportGame{ID: num(0), BlackTeam: num(1), YellowTeam: num(2), StartTimestamp: timestamp(3), EndTimestamp: timestamp(4), BlackScore: num(5), YellowScore: num(6)})
+		case "goals":
+			d.Goals = append(d.Goals, exportGoals{GameID: num(0), PlayerID: rec[1], Goals: num(2)})
+		}
+		if bad != nil {
+			return bad
+		}
+	}
+	return nil
+}
+
+// importConflict is a row of an import that was not loaded, or was matched to
+// an existing record. Rows are numbered from 1 within their table.
+type importConflict struct {
+	Table  string `json:"table"`
+	Row    int    `json:"row"`
+	Reason string `json:"reason"`
+}
+
+type importReport struct {
+	DryRun    bool             `json:"dry_run"`
+	Players   int              `json:"players"`
+	Teams     int              `json:"teams"`
+	Games     int              `json:"games"`
+	Goals     int              `json:"goals"`
+	Conflicts []importConflict `json:"conflicts"`
+}
+
+// planImport validates d against itself and the repository. It returns the
+// records to create, the existing teams that teams in d were matched to, and a
+// report of what will be loaded and what will not.
+func planImport(repo repository, d leagueDump) (leagueDump, map[int]int, importReport, error) {
+	plan := leagueDump{}
+	report := importReport{Conflicts: []importConflict{}}
+	conflict := func(table string, i int, format string, args ...any) {
+		report.Conflicts = append(report.Conflicts, importConflict{table, i + 1, fmt.Sprintf(format, args...)})
+	}
+
+	// Guests are created after every other player, as they refer to their
+	// host. Their claim codes must stay unique.
+	listed := map[string]bool{}
+	for _, p := range d.Players {
+		listed[p.ID] = p.ID != "" && p.Name != ""
+	}
+	var guests []exportPlayer
+	codes := map[string]bool{}
+	known := map[string]bool{}
+	for i, p := range d.Players {
+		if p.ID == "" || p.Name == "" {
+			conflict("players", i, "id and name are required")
+			continue
+		}
+		if known[p.ID] {
+			conflict("players", i, "player %s appears more than once", p.ID)
+			continue
+		}
+		existing, err := repo.GetPlayer(p.ID)
+		if err == nil {
+			known[p.ID] = true
+			if existing.Name != p.Name {
+				conflict("players", i, "player %s already exists as %s, keeping the existing player", p.ID, existing.Name)
+			}
+			continue
+		} else if err != errNotFound {
+			return plan, nil, report, err
+		}
+		if p.GuestOf == "" && p.ClaimCode == "" {
+			known[p.ID] = true
+			plan.Players = append(plan.Players, p)
+			continue
+		}
+		if !isGuest(p.ID) || p.ClaimCode == "" {
+			conflict("players", i, "guest %s needs an id starting with %s and a claim code", p.ID, guestPrefix)
+			continue
+		}
+		if p.GuestOf != "" && !listed[p.GuestOf] {
+			_, err := repo.GetPlayer(p.GuestOf)
+			if err == errNotFound {
+				conflict("players", i, "unknown host %s of guest %s", p.GuestOf, p.ID)
+				continue
+			} else if err != nil {
+				return plan, nil, report, err
+			}
+		}
+		_, err = repo.FindGuest(p.ClaimCode)
+		if err == nil || codes[p.ClaimCode] {
+			conflict("players", i, "claim code of guest %s is already in use", p.ID)
+			continue
+		} else if err != errNotFound {
+			return plan, nil, report, err
+		}
+		codes[p.ClaimCode] = true
+		known[p.ID] = true
+		guests = append(guests, p)
+	}
+	plan.Players = append(plan.Players, guests...)
+	isKnown := func(id string) (bool, error) {
+		if known[id] {
+			return true, nil
+		}
+		_, err := repo.GetPlayer(id)
+		if err == errNotFound {
+			return false, nil
+		}
+		known[id] = err == nil
+		return known[id], err
+	}
+
+	// Teams in d resolve to an existing team or to a team to create, which is
+	// known by its id in d. Teams of the same players in d share the first.
+	teamIDs := map[int]int{}
+	created := map[int]exportTeam{}
+	alias := map[int]int{}
+	players := map[int][2]string{}
+	pairs := map[string]int{}
+	names := map[string]bool{}
+	for i, t := range d.Teams {
+		if _, dup := players[t.ID]; dup {
+			conflict("teams", i, "team %d appears more than once", t.ID)
+			continue
+		}
+		// Singles teams list their player twice.
+		if t.City == "" || t.Name == "" || t.Player1 == "" || t.Player2 == "" {
+			conflict("teams", i, "city, name and players are required")
+			continue
+		}
+		missing := ""
+		for _, sub := range []string{t.Player1, t.Player2} {
+			ok, err := isKnown(sub)
+			if err != nil {
+				return plan, nil, report, err
+			}
+			if !ok {
+				missing = sub
+				break
+			}
+		}
+		if missing != "" {
+			conflict("teams", i, "unknown player %s", missing)
+			continue
+		}
+		pair := t.Player1 + "\x00" + t.Player2
+		if t.Player2 < t.Player1 {
+			pair = t.Player2 + "\x00" + t.Player1
+		}
+		if first, ok := pairs[pair]; ok {
+			alias[t.ID] = first
+			players[t.ID] = [2]string{t.Player1, t.Player2}
+			conflict("teams", i, "same players as team %d, results are recorded against it", first)
+			continue
+		}
+		existing, err := repo.FindTeam(t.Player1, t.Player2)
+		if err == nil {
+			teamIDs[t.ID] = existing.ID
+			pairs[pair] = t.ID
+			players[t.ID] = [2]string{t.Player1, t.Player2}
+			if existing.City != t.City || existing.Name != t.Name {
+				conflict("teams", i, "players already form the %s %s, results are recorded against it", existing.City, existing.Name)
+			}
+			continue
+		} else if err != errNotFound {
+			return plan, nil, report, err
+		}
+		conflicts, err := repo.TeamConflicts(t.Player1, t.Player2, t.City, t.Name)
+		if err != nil {
+			return plan, nil, report, err
+		}
+		if conflicts > 0 || names[t.City] || names[t.Name] {
+			conflict("teams", i, "the city or name of the %s %s is already taken", t.City, t.Name)
+			continue
+		}
+		names[t.City], names[t.Name] = true, true
+		pairs[pair] = t.ID
+		players[t.ID] = [2]string{t.Player1, t.Player2}
+		created[t.ID] = t
+		plan.Teams = append(plan.Teams, t)
+	}
+	resolve := func(id int) (int, bool) {
+		if first, ok := alias[id]; ok {
+			id = first
+		}
+		_, existing := teamIDs[id]
+		_, isNew := created[id]
+		return id, existing || isNew
+	}
+
+	games := map[int]exportGame{}
+	seen := map[int]bool{}
+	for i, g := range d.Games {
+		if seen[g.ID] {
+			conflict("games", i, "game %d appears more than once", g.ID)
+			continue
+		}
+		seen[g.ID] = true
+		black, okBlack := resolve(g.BlackTeam)
+		yellow, okYellow := resolve(g.YellowTeam)
+		switch {
+		case !okBlack || !okYellow:
+			conflict("games", i, "unknown or skipped team")
+			continue
+		case black == yellow:
+			conflict("games", i, "a team cannot play itself")
+			continue
+		case (players[black][0] == players[black][1]) != (players[yellow][0] == players[yellow][1]):
+			conflict("games", i, "a singles team cannot play a doubles team")
+			continue
+		case g.EndTimestamp == 0:
+			conflict("games", i, "only finished games can be imported")
+			continue
+		case g.BlackScore < 0 || g.YellowScore < 0 || g.BlackScore == g.YellowScore:
+			conflict("games", i, "scores must be positive and have a winner")
+			continue
+		}
+		if g.StartTimestamp == 0 {
+			g.StartTimestamp = g.EndTimestamp
+		}
+		if g.EndTimestamp < g.StartTimestamp {
+			conflict("games", i, "game ends before it starts")
+			continue
+		}
+		blackID, blackExists := teamIDs[black]
+		yellowID, yellowExists := teamIDs[yellow]
+		if blackExists && yellowExists {
+			id, err := repo.FindGame(blackID, yellowID, g.StartTimestamp)
+			if err == nil {
+				conflict("games", i, "already recorded as game %d", id)
+				continue
+			} else if err != errNotFound {
+				return plan, nil, report, err
+			}
+		}
+		g.BlackTeam, g.YellowTeam = black, yellow
+		g.Format = teamRecord{Player1: players[black][0], Player2: players[black][1]}.format()
+		games[g.ID] = g
+		plan.Games = append(plan.Games, g)
+	}
+
+	scored := map[int][2]int{}
+	recorded := map[string]bool{}
+	for i, gl := range d.Goals {
+		g, ok := games[gl.GameID]
+		if !ok {
+			conflict("goals", i, "unknown or skipped game %d", gl.GameID)
+			continue
+		}
+		key := strconv.Itoa(gl.GameID) + "\x00" + gl.PlayerID
+		if recorded[key] {
+			conflict("goals", i, "goals of %s in game %d appear more than once", gl.PlayerID, gl.GameID)
+			continue
+		}
+		side := -1
+		for s, team := range []int{g.BlackTeam, g.YellowTeam} {
+			if p := players[team]; p[0] == gl.PlayerID || p[1] == gl.PlayerID {
+				side = s
+			}
+		}
+		if side < 0 {
+			conflict("goals", i, "%s did not play in game %d", gl.PlayerID, gl.GameID)
+			continue
+		}
+		total := scored[gl.GameID]
+		total[side] += gl.Goals
+		if gl.Goals < 0 || total[side] > []int{g.BlackScore, g.YellowScore}[side] {
+			conflict("goals", i, "goals of %s exceed the score of game %d", gl.PlayerID, gl.GameID)
+			continue
+		}
+		scored[gl.GameID] = total
+		recorded[key] = true
+		plan.Goals = append(plan.Goals, gl)
+	}
+
+	report.Players = len(plan.Players)
+	report.Teams = len(plan.Teams)
+	report.Games = len(plan.Games)
+	report.Goals = len(plan.Goals)
+	return plan, teamIDs, report, nil
+}
+
+// exportHandler dumps the league as JSON, or one table of it as CSV when
+// format=csv.
+type exportHandler struct {
+	auth authenticateHandler
+	repo repository
+}
+
+func (eh exportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := eh.auth.admin(w, r); !ok {
+		return
+	}
+	format, table := r.URL.Query().Get("format"), r.URL.Query().Get("table")
+	if format == "csv" && csvHeaders[table] == nil {
+		http.Error(w, "table must be one of "+strings.Join(csvTables, ", "), http.StatusBadRequest)
+		return
+	} else if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
+
+	d, err := eh.repo.ExportLeague()
+	if err != nil {
+		logger.Error("error exporting league", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "dcfl-"+table+".csv"))
+		d.writeCSV(w, table)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// importHandler loads a dump, given as JSON or as multipart form data with a
+// CSV file per table. Rows that conflict are reported and skipped. With
+// dry_run=true nothing is stored.
+type importHandler struct {
+	auth authenticateHandler
+	repo repository
+}
+
+func (ih importHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := ih.auth.admin(w, r)
+	if !ok {
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	var d leagueDump
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		err := json.NewDecoder(r.Body).Decode(&d)
+		if err != nil {
+			http.Error(w, "malformed JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "multipart/form-data":
+		err := r.ParseMultipartForm(32 << 20)
+		if err != nil {
+			http.Error(w, "malformed form: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, table := range csvTables {
+			f, _, err := r.FormFile(table)
+			if err == http.ErrMissingFile {
+				continue
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = d.readCSV(f, table)
+			f.Close()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	plan, teamIDs, report, err := planImport(ih.repo, d)
+	if err != nil {
+		logger.Error("error validating import", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	report.DryRun = dryRun
+	if !dryRun {
+		err = ih.repo.ImportLeague(plan, teamIDs)
+		if err != nil {
+			logger.Error("error importing league", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	logger.Info("league imported", "sub", token.Sub, "dry_run", dryRun,
+		"players", report.Players, "teams", report.Teams, "games", report.Games, "goals", report.Goals, "conflicts", len(report.Conflicts))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
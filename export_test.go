@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// send makes an authenticated request as sub and decodes a successful JSON
+// response into out, returning the status code and raw body.
+func (ts *testServer) send(sub string, method string, path string, contentType string, body io.Reader, out any) (int, string) {
+	ts.t.Helper()
+	req, _ := http.NewRequest(method, ts.srv.URL+path, body)
+	req.Header.Set("Authorization", ts.authorization(sub))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if out != nil && resp.StatusCode < 300 {
+		json.Unmarshal(data, out)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func seedLeague(t *testing.T, ts *testServer) {
+	blackhawks, _ := ts.repo.CreateTeam("Chicago", "Blackhawks", "1", "2")
+	bruins, _ := ts.repo.CreateTeam("Boston", "Bruins", "3", "4")
+	recordGame(t, ts.repo, blackhawks, bruins, 5, 3, map[string]int{"1": 4, "2": 1, "3": 3})
+	ts.repo.CreateGame(formatDoubles, bruins, blackhawks)
+}
+
+func TestExport(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	seedLeague(t, ts)
+
+	if code, _ := ts.send("2", "GET", "/export", "", nil, nil); code != http.StatusForbidden {
+		t.Fatalf("expected non-admins to be refused, got %d", code)
+	}
+	if code, _ := ts.send("", "GET", "/export", "", nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected anonymous requests to be refused, got %d", code)
+	}
+
+	var d leagueDump
+	if code, _ := ts.send("1", "GET", "/export", "", nil, &d); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(d.Players) != 4 || d.Players[0].Name != "Player 1" || len(d.Teams) != 2 || len(d.Games) != 2 || len(d.Goals) != 3 {
+		t.Fatalf("unexpected dump %+v", d)
+	}
+	if g := d.Games[0]; g.BlackTeam != 1 || g.BlackScore != 5 || g.EndTimestamp == 0 || d.Games[1].EndTimestamp != 0 {
+		t.Fatalf("unexpected games %+v", d.Games)
+	}
+
+	code, body := ts.send("1", "GET", "/export?format=csv&table=teams", "", nil, nil)
+	want := "id,city,name,player1,player2\n1,Chicago,Blackhawks,1,2\n2,Boston,Bruins,3,4\n"
+	if code != http.StatusOK || body != want {
+		t.Fatalf("unexpected teams CSV %d %q", code, body)
+	}
+	if code, _ := ts.send("1", "GET", "/export?format=csv", "", nil, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected a CSV export without a table to be refused, got %d", code)
+	}
+}
+
+func TestImportRoundTrip(t *testing.T) {
+	src := newTestServer(t, "1", "2", "3", "4")
+	seedLeague(t, src)
+	var d leagueDump
+	src.send("1", "GET", "/export", "", nil, &d)
+	data, _ := json.Marshal(d)
+
+	ts := newTestServer(t, "1")
+	var report importReport
+	code, _ := ts.send("1", "POST", "/import?dry_run=true", "application/json", bytes.NewReader(data), &report)
+	if code != http.StatusOK || !report.DryRun || report.Players != 3 || report.Teams != 2 || report.Games != 1 || report.Goals != 3 {
+		t.Fatalf("unexpected dry run %d %+v", code, report)
+	}
+	// The unfinished game is reported, and nothing was stored.
+	if len(report.Conflicts) != 1 || report.Conflicts[0] != (importConflict{"games", 2, "only finished games can be imported"}) {
+		t.Fatalf("unexpected conflicts %+v", report.Conflicts)
+	}
+	if _, err := ts.repo.GetPlayer("2"); err != errNotFound {
+		t.Fatalf("dry run must not store anything, got %v", err)
+	}
+
+	ts.send("1", "POST", "/import", "application/json", bytes.NewReader(data), &report)
+	if report.DryRun || report.Games != 1 {
+		t.Fatalf("unexpected import %+v", report)
+	}
+	var hh headToHead
+	ts.get("/head-to-head?a=1&b=3", &hh)
+	if hh.Played != 1 || hh.A.Wins != 1 || hh.A.Goals != 4 || hh.B.Goals != 3 {
+		t.Fatalf("expected the imported game in the head-to-head, got %+v", hh)
+	}
+
+	// Importing the same results again only reports conflicts.
+	ts.send("1", "POST", "/import", "application/json", bytes.NewReader(data), &report)
+	if report.Players != 0 || report.Teams != 0 || report.Games != 0 || report.Goals != 0 {
+		t.Fatalf("expected nothing new on a second import, got %+v", report)
+	}
+	found := false
+	for _, c := range report.Conflicts {
+		found = found || c.Reason == "already recorded as game 1"
+	}
+	if !found {
+		t.Fatalf("expected the duplicate game to be reported, got %+v", report.Conflicts)
+	}
+}
+
+func TestImportGuests(t *testing.T) {
+	src := newTestServer(t, "1", "2", "3")
+	src.repo.CreateGuest(playerRecord{ID: "guest-1", Name: "Visitor", GuestOf: "1", ClaimCode: "C0DE"})
+	guests, _ := src.repo.CreateTeam("Visiting", "Guests", "1", "guest-1")
+	hosts, _ := src.repo.CreateTeam("Home", "Regulars", "2", "3")
+	recordGame(t, src.repo, guests, hosts, 5, 1, map[string]int{"guest-1": 5, "2": 1})
+	var d leagueDump
+	src.send("1", "GET", "/export", "", nil, &d)
+	if g := d.Players[3]; g != (exportPlayer{ID: "guest-1", Name: "Visitor", GuestOf: "1", ClaimCode: "C0DE"}) {
+		t.Fatalf("expected the guest to be exported, got %+v", d.Players)
+	}
+	_, body := src.send("1", "GET", "/export?format=csv&table=players", "", nil, nil)
+	if !strings.Contains(body, "id,name,picture,guest_of,claim_code\n") || !strings.Contains(body, "\nguest-1,Visitor,,1,C0DE\n") {
+		t.Fatalf("expected the guest in the players CSV, got %q", body)
+	}
+
+	// Guests may come before their host, and must keep a unique claim code.
+	d.Players = append([]exportPlayer{d.Players[3]}, d.Players[:3]...)
+	d.Players = append(d.Players,
+		exportPlayer{ID: "5", Name: "Player 5", ClaimCode: "FIVE"},
+		exportPlayer{ID: "guest-2", Name: "Stranger", GuestOf: "9", ClaimCode: "NINE"},
+		exportPlayer{ID: "guest-3", Name: "Copy", GuestOf: "1", ClaimCode: "C0DE"})
+	data, _ := json.Marshal(d)
+	ts := newTestServer(t, "1", "4")
+	var report importReport
+	ts.send("1", "POST", "/import", "application/json", bytes.NewReader(data), &report)
+	want := []importConflict{
+		{"players", 5, "guest 5 needs an id starting with guest- and a claim code"},
+		{"players", 6, "unknown host 9 of guest guest-2"},
+		{"players", 7, "claim code of guest guest-3 is already in use"},
+	}
+	if fmt.Sprint(report.Conflicts) != fmt.Sprint(want) || report.Players != 3 || report.Games != 1 {
+		t.Fatalf("expected the guest to be imported, got %+v", report)
+	}
+	if g, err := ts.repo.GetPlayer("guest-1"); err != nil || g.GuestOf != "1" || g.ClaimCode != "C0DE" {
+		t.Fatalf("expected the imported guest to keep its host and code, got %+v %v", g, err)
+	}
+	if status := ts.post("4", "/players/me/claim", map[string]string{"code": "C0DE"}, nil); status != http.StatusOK {
+		t.Fatalf("expected the imported guest to be claimed, got %d", status)
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	ts := newTestServer(t, "1", "2")
+	ts.repo.CreateTeam("Chicago", "Blackhawks", "1", "2")
+
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	files := map[string]string{
+		"players": "id,name,picture,guest_of,claim_code\n3,Player 3,,,\n4,Player 4,,,\n5,,,,\n",
+		"teams":   "id,city,name,player1,player2\n10,Chicago,Bruins,3,4\n11,Boston,Bruins,4,3\n12,Windy City,Hawks,2,1\n13,Nowhere,Ghosts,5,6\n",
+		"games":   "id,black_team,yellow_team,start_timestamp,end_timestamp,black_score,yellow_score\n1,12,11,1000,2000,5,2\n2,11,13,1000,2000,5,0\n3,12,11,3000,2000,5,1\n",
+		"goals":   "game_id,player_id,goals\n1,1,5\n1,3,2\n1,4,1\n2,3,5\n",
+	}
+	for _, table := range csvTables {
+		w, _ := form.CreateFormFile(table, table+".csv")
+		w.Write([]byte(files[table]))
+	}
+	form.Close()
+
+	var report importReport
+	code, body := ts.send("1", "POST", "/import", form.FormDataContentType(), &buf, &report)
+	if code != http.StatusOK {
+		t.Fatalf("status %d: %s", code, body)
+	}
+	want := []importConflict{
+		{"players", 3, "id and name are required"},
+		{"teams", 1, "the city or name of the Chicago Bruins is already taken"},
+		{"teams", 3, "players already form the Chicago Blackhawks, results are recorded against it"},
+		{"teams", 4, "unknown player 5"},
+		{"games", 2, "unknown or skipped team"},
+		{"games", 3, "game ends before it starts"},
+		{"goals", 3, "goals of 4 exceed the score of game 1"},
+		{"goals", 4, "unknown or skipped game 2"},
+	}
+	if len(report.Conflicts) != len(want) {
+		t.Fatalf("expected conflicts %+v, got %+v", want, report.Conflicts)
+	}
+	for i := range want {
+		if report.Conflicts[i] != want[i] {
+			t.Errorf("conflict %d: expected %+v, got %+v", i, want[i], report.Conflicts[i])
+		}
+	}
+	if report.Players != 2 || report.Teams != 1 || report.Games != 1 || report.Goals != 2 {
+		t.Fatalf("unexpected counts %+v", report)
+	}
+	var hh headToHead
+	ts.get("/head-to-head?type=team&a=1&b=2", &hh)
+	if hh.Played != 1 || hh.A.Wins != 1 || hh.A.Name != "Chicago Blackhawks" || hh.B.Name != "Boston Bruins" {
+		t.Fatalf("expected the imported game between the teams, got %+v", hh)
+	}
+
+	code, _ = ts.send("1", "POST", "/import", "text/csv", strings.NewReader("id\n"), nil)
+	if code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected bare CSV to be refused, got %d", code)
+	}
+}
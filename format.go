@@ -0,0 +1,104 @@
+package main
+
+import "fmt"
+
+// matchFormat is the number of players per side. Singles teams are a single
+// player, stored as a team whose two players are the same.
+type matchFormat string
+
+const (
+	formatSingles matchFormat = "singles"
+	formatDoubles matchFormat = "doubles"
+)
+
+// parseFormat checks a format given by a client. An empty format is allowed
+// and matches games of every format.
+func parseFormat(s string) (matchFormat, error) {
+	switch f := matchFormat(s); f {
+	case "", formatSingles, formatDoubles:
+		return f, nil
+	}
+	return "", fmt.Errorf("format must be %s or %s", formatSingles, formatDoubles)
+}
+
+// seats returns the number of players on each side.
+func (f matchFormat) seats() int {
+	if f == formatSingles {
+		return 1
+	}
+	return 2
+}
+
+// pair returns the players that make up the team of side.
+func (f matchFormat) pair(side [2]player) (string, string) {
+	if f == formatSingles {
+		return side[0].Sub, side[0].Sub
+	}
+	return side[0].Sub, side[1].Sub
+}
+
+// format returns the format the team plays.
+func (t teamRecord) format() matchFormat {
+	if t.Player1 == t.Player2 {
+		return formatSingles
+	}
+	return formatDoubles
+}
+
+// side returns the players of the team as seated for a game, with the goals
+// each of them scored.
+func (t teamRecord) side(goals map[string]int) [2]player {
+	side := [2]player{{Sub: t.Player1, Goals: goals[t.Player1]}}
+	if t.format() == formatDoubles {
+		side[1] = player{Sub: t.Player2, Goals: goals[t.Player2]}
+	}
+	return side
+}
+
+// lineup returns the seats used by the format, black first.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) lineup() []player {
+	n := h.format.seats()
+	return append(append([]player{}, h.blackSide[:n]...), h.yellowSide[:n]...)
+}
+
+// full reports whether every seat the format uses on side is taken.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) full(side [2]player) bool {
+	for _, p := range side[:h.format.seats()] {
+		if p == (player{}) {
+			return false
+		}
+	}
+	return true
+}
+
+// confirmed reports whether every player the format needs on side has
+// confirmed.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) confirmed(side [2]player) bool {
+	for _, p := range side[:h.format.seats()] {
+		if !p.Confirmed {
+			return false
+		}
+	}
+	return true
+}
+
+// setFormat chooses the format of the next game. It can only change while
+// nobody is seated.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func setFormat(h *hub, cm *dcflMsg) (string, bool) {
+	f, err := parseFormat(cm.Format)
+	if err != nil || f == "" {
+		h.reject(cm, fmt.Sprintf("format must be %s or %s", formatSingles, formatDoubles))
+		return "", false
+	}
+	if h.blackSide != [2]player{} || h.yellowSide != [2]player{} {
+		h.reject(cm, "the format can only change while the table is empty")
+		return "", false
+	}
+	h.logFor(cm).Info("format changed", "from", h.format, "to", f)
+	h.format = f
+	return "", false
+}
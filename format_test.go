@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSinglesMatch(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3")
+	black := ts.connect("1")
+	yellow := ts.connect("2")
+	other := ts.connect("3")
+
+	black.send(dcflMsg{Action: "set format", Format: "triples"})
+	black.expectRejection("format must be singles or doubles")
+	black.send(dcflMsg{Action: "set format", Format: "singles"})
+	if state := ts.expectState(); state.Format != formatSingles {
+		t.Fatalf("expected a singles lobby, got %+v", state)
+	}
+
+	black.register("black")
+	ts.expectState()
+	other.register("black")
+	other.expectRejection("black side is full")
+	other.send(dcflMsg{Action: "set format", Format: "doubles"})
+	other.expectRejection("the format can only change while the table is empty")
+	yellow.register("yellow")
+	if state := ts.expectState(); state.Phase != phaseAwaitingConfirmations {
+		t.Fatalf("expected one player a side to fill the table, got %+v", state)
+	}
+	black.confirm("black")
+	ts.expectState()
+	yellow.confirm("yellow")
+	if state := ts.expectState(); state.Phase != phaseAwaitingTeams {
+		t.Fatalf("expected to await teams, got %+v", state)
+	}
+	black.registerTeam("black", "", "Chicago", "Lone Wolf")
+	ts.expectState()
+	yellow.registerTeam("yellow", "2", "Boston", "Solo")
+	state := ts.expectState()
+	if !state.GameStarted || state.BlackTeam.Name != "Lone Wolf" || state.YellowTeam.Name != "Solo" {
+		t.Fatalf("expected the singles game to start, got %+v", state)
+	}
+	for i := 0; i < 5; i++ {
+		black.goal()
+		state = ts.expectState()
+	}
+	ts.expectMessage("Game Over")
+	if state.Format != formatSingles || state.Phase != phaseOpen {
+		t.Fatalf("expected the next lobby to stay singles, got %+v", state)
+	}
+
+	games, _ := ts.repo.RecentGames(1)
+	if len(games) != 1 || games[0].Format != formatSingles {
+		t.Fatalf("expected a singles game to be recorded, got %+v", games)
+	}
+	if _, err := ts.repo.FindTeam("1", "1"); err != nil {
+		t.Fatalf("expected a singles team for player 1, got %v", err)
+	}
+	for format, want := range map[matchFormat]int{formatSingles: 2, formatDoubles: 0, "": 2} {
+		standings, _ := ts.repo.Standings(format)
+		if len(standings) != want {
+			t.Errorf("%q: expected %d players, got %+v", format, want, standings)
+		}
+		for _, s := range standings {
+			if s.Played != 1 {
+				t.Errorf("%q: expected one game for %s, got %+v", format, s.PlayerID, s)
+			}
+		}
+	}
+}
+
+func TestFormatsDoNotMix(t *testing.T) {
+	ts := newChallengeServer(t)
+	ts.repo.CreateTeam("Calgary", "Flames", "5", "5")
+	ts.repo.CreateTeam("Edmonton", "Oilers", "6", "6")
+	clients := map[string]*testClient{}
+	for _, sub := range []string{"5", "6"} {
+		clients[sub] = ts.connect(sub)
+	}
+
+	if code := ts.post("5", "/challenges", challengeRequest{4, 2, ""}, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected a singles team challenging a doubles team to be refused, got %d", code)
+	}
+	result := map[string]any{"black_team": 4, "yellow_team": 2, "black_score": 5, "yellow_score": 0, "goals": map[string]int{"5": 5}}
+	if code := ts.post("5", "/games/manual", result, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected a result between formats to be refused, got %d", code)
+	}
+
+	// An accepted singles challenge sets up a singles table.
+	if code := ts.post("5", "/challenges", challengeRequest{4, 5, ""}, nil); code != http.StatusCreated {
+		t.Fatalf("expected the singles challenge to be created, got %d", code)
+	}
+	ts.expectMessage("The Calgary Flames challenge the Edmonton Oilers!")
+	if code := ts.post("6", "/challenges/1/accept", nil, nil); code != http.StatusOK {
+		t.Fatalf("expected the challenge to be accepted, got %d", code)
+	}
+	ts.expectMessage("The Edmonton Oilers accepted the challenge from the Calgary Flames!")
+	state := ts.expectState()
+	if state.Format != formatSingles || state.BlackPlayer1.Sub != "5" || state.BlackPlayer2 != (player{}) || state.YellowPlayer1.Sub != "6" || state.YellowPlayer2 != (player{}) {
+		t.Fatalf("expected a singles table, got %+v", state)
+	}
+	clients["5"].confirm("black")
+	ts.expectState()
+	clients["6"].confirm("yellow")
+	if state := ts.expectState(); !state.GameStarted {
+		t.Fatalf("expected the challenge game to start, got %+v", state)
+	}
+}
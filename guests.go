@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Guests are people playing without an account. A signed-in player adds them
+// to a side by name and acts for them at the table, and the guest's results
+// are kept under a player record of their own. When the guest signs up, they
+// claim that record with a code from the player who added them, and its
+// results move to their account.
+
+const guestPrefix = "guest-"
+
+// Badges marking a milestone that only count once per player.
+var milestoneBadges = []string{badgeFirstGame, badgeGoals100}
+
+func isGuest(sub string) bool {
+	return strings.HasPrefix(sub, guestPrefix)
+}
+
+// guest is a guest as shown to the player who added them.
+type guest struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	ClaimCode string `json:"claim_code"`
+}
+
+// findOrCreateGuest returns the guest named name that host added before, or
+// adds a new one.
+func findOrCreateGuest(repo repository, host string, name string) (playerRecord, error) {
+	guests, err := repo.Guests(host)
+	if err != nil {
+		return playerRecord{}, err
+	}
+	for _, g := range guests {
+		if strings.EqualFold(g.Name, name) {
+			return g, nil
+		}
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	code := make([]byte, 4)
+	rand.Read(code)
+	g := playerRecord{
+		ID:        guestPrefix + hex.EncodeToString(id),
+		Name:      name,
+		GuestOf:   host,
+		ClaimCode: strings.ToUpper(hex.EncodeToString(code)),
+	}
+	return g, repo.CreateGuest(g)
+}
+
+// addGuest seats a guest named cm.Name on cm.Side on behalf of the player who
+// sent the request.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func addGuest(h *hub, cm *dcflMsg) (string, bool) {
+	log := h.logFor(cm).With("side", cm.Side)
+	name, err := validNickname(cm.Name)
+	if err != nil {
+		h.reject(cm, err.Error())
+		return "", false
+	}
+	if name == "" {
+		h.reject(cm, "guests need a name")
+		return "", false
+	}
+	var side [2]player
+	switch cm.Side {
+	case "black":
+		side = h.blackSide
+	case "yellow":
+		side = h.yellowSide
+	default:
+		h.reject(cm, "unknown side")
+		return "", false
+	}
+	if h.full(side) {
+		h.reject(cm, cm.Side+" side is full")
+		return "", false
+	}
+
+	g, err := findOrCreateGuest(h.repo, cm.Sub, name)
+	if err != nil {
+		log.Error("error adding guest", "err", err)
+		return "", false
+	}
+	if h.seated(g.ID) {
+		h.reject(cm, "guest is already seated")
+		return "", false
+	}
+	log.Info("guest added", "guest", g.ID)
+	seat := *cm
+	seat.Action = "register game"
+	seat.Sub = g.ID
+	return registerGame(h, &seat)
+}
+
+// hosts reports whether sub is a guest added by host, who may then act for
+// them.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) hosts(host string, sub string) bool {
+	if !isGuest(sub) {
+		return false
+	}
+	g, err := h.repo.GetPlayer(sub)
+	return err == nil && g.GuestOf == host
+}
+
+// claimGuest moves the results of the guest with the given claim code to the
+// player's account. Claims that would give the player two records of the same
+// game, two teams with the same partner or two singles teams are refused.
+func claimGuest(repo repository, h *hub, sub string, code string) (playerRecord, error) {
+	g, err := repo.FindGuest(strings.ToUpper(strings.TrimSpace(code)))
+	if err == errNotFound {
+		return playerRecord{}, &requestError{http.StatusNotFound, "unknown claim code"}
+	} else if err != nil {
+		return playerRecord{}, err
+	}
+	h.sideMx.RLock()
+	seated := h.seated(g.ID)
+	h.sideMx.RUnlock()
+	if seated {
+		return playerRecord{}, &requestError{http.StatusConflict, "the guest is at the table, claim them after the game"}
+	}
+	teams, err := repo.TeamsOf(g.ID)
+	if err != nil {
+		return playerRecord{}, err
+	}
+	for _, t := range teams {
+		record, err := repo.GetTeam(t.ID)
+		if err != nil {
+			return playerRecord{}, err
+		}
+		if record.format() == formatSingles {
+			_, err = repo.FindTeam(sub, sub)
+			if err == nil {
+				return playerRecord{}, &requestError{http.StatusConflict, fmt.Sprintf("you already have a singles team and %s played as the %s %s", g.Name, t.City, t.Name)}
+			} else if err != errNotFound {
+				return playerRecord{}, err
+			}
+			continue
+		}
+		partner := record.Player1
+		if partner == g.ID {
+			partner = record.Player2
+		}
+		if partner == sub {
+			return playerRecord{}, &requestError{http.StatusConflict, fmt.Sprintf("you played with %s on the %s %s", g.Name, t.City, t.Name)}
+		}
+		_, err = repo.FindTeam(sub, partner)
+		if err == nil {
+			return playerRecord{}, &requestError{http.StatusConflict, fmt.Sprintf("you already have a team with the partner of %s on the %s %s", g.Name, t.City, t.Name)}
+		} else if err != errNotFound {
+			return playerRecord{}, err
+		}
+	}
+	games, err := repo.PlayerRivalry(g.ID, sub, "")
+	if err != nil {
+		return playerRecord{}, err
+	}
+	if len(games) != 0 {
+		return playerRecord{}, &requestError{http.StatusConflict, fmt.Sprintf("you played against %s", g.Name)}
+	}
+
+	err = repo.MergeGuest(g.ID, sub)
+	if err != nil {
+		return playerRecord{}, err
+	}
+	logger.Info("guest claimed", "guest", g.ID, "sub", sub, "teams", len(teams))
+	return g, nil
+}
+
+// guestsHandler lists the guests the caller has added, with the codes they
+// can hand over to let a guest claim their results.
+type guestsHandler struct {
+	auth authenticateHandler
+	repo repository
+}
+
+func (gh guestsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := gh.auth.identify(w, r)
+	if !ok {
+		return
+	}
+	records, err := gh.repo.Guests(token.Sub)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	guests := []guest{}
+	for _, g := range records {
+		guests = append(guests, guest{ID: g.ID, Name: g.Name, ClaimCode: g.ClaimCode})
+	}
+	writeJSON(w, http.StatusOK, guests)
+}
+
+// claimHandler merges a guest into the caller's account.
+type claimHandler struct {
+	auth authenticateHandler
+	h    *hub
+	repo repository
+}
+
+func (ch claimHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := ch.auth.identify(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	g, err := claimGuest(ch.repo, ch.h, token.Sub, body.Code)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Guest    string `json:"guest"`
+		PlayerID string `json:"player_id"`
+	}{g.ID, token.Sub})
+}
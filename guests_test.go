@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGuests(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	host := ts.connect("1")
+	y1 := ts.connect("2")
+	y2 := ts.connect("3")
+
+	host.register("black")
+	ts.expectState()
+	host.send(dcflMsg{Action: "add guest", Side: "black", Name: " Visitor "})
+	state := ts.expectState()
+	guestID := state.BlackPlayer2.Sub
+	if !isGuest(guestID) || state.BlackPlayer2 != (player{Sub: guestID, Name: "Visitor", Guest: true}) {
+		t.Fatalf("expected the guest to be seated, got %+v", state.BlackPlayer2)
+	}
+	y1.send(dcflMsg{Action: "add guest", Side: "black", Name: "Another"})
+	y1.expectRejection("black side is full")
+
+	y1.register("yellow")
+	ts.expectState()
+	y2.register("yellow")
+	ts.expectState()
+	// Only the host acts for the guest.
+	y1.send(dcflMsg{Action: "confirm", Side: "black", Sub: guestID})
+	y1.expectRejection("signed in as another player")
+	for _, msg := range []struct {
+		c   *testClient
+		sub string
+	}{{host, "1"}, {host, guestID}, {y1, "2"}, {y2, "3"}} {
+		side := "black"
+		if msg.c != host {
+			side = "yellow"
+		}
+		msg.c.send(dcflMsg{Action: "confirm", Side: side, Sub: msg.sub})
+		ts.expectState()
+	}
+	host.registerTeam("black", guestID, "Visiting", "Guests")
+	ts.expectState()
+	y1.registerTeam("yellow", "3", "Home", "Regulars")
+	state = ts.expectState()
+	if !state.GameStarted {
+		t.Fatalf("expected the game to start with the guest, got %+v", state)
+	}
+	for i := 0; i < 4; i++ {
+		host.send(dcflMsg{Action: "goal", Sub: guestID})
+		ts.expectState()
+	}
+	host.goal()
+	ts.expectState()
+	ts.expectMessage("Game Over")
+
+	var guests []guest
+	if code := ts.withToken(ts.sessions["1"].Token, "GET", "/players/me/guests", nil, &guests); code != http.StatusOK || len(guests) != 1 || guests[0].ID != guestID {
+		t.Fatalf("expected the host to see their guest, got %d %+v", code, guests)
+	}
+	code := map[string]string{"code": guests[0].ClaimCode}
+
+	if status := ts.post("2", "/players/me/claim", code, nil); status != http.StatusConflict {
+		t.Fatalf("expected an opponent's claim to be refused, got %d", status)
+	}
+	if status := ts.post("4", "/players/me/claim", code, nil); status != http.StatusOK {
+		t.Fatalf("expected the claim to succeed, got %d", status)
+	}
+	if _, err := ts.repo.GetPlayer(guestID); err != errNotFound {
+		t.Fatalf("expected the guest to be merged away, got %v", err)
+	}
+	var hh headToHead
+	ts.get("/head-to-head?a=4&b=2", &hh)
+	if hh.Played != 1 || hh.A.Wins != 1 || hh.A.Goals != 4 {
+		t.Fatalf("expected the guest's game to count for player 4, got %+v", hh)
+	}
+	var badges []badgeAward
+	ts.get("/players/4/badges", &badges)
+	if len(badges) == 0 {
+		t.Fatalf("expected the guest's badges to move to player 4")
+	}
+	if status := ts.post("4", "/players/me/claim", code, nil); status != http.StatusNotFound {
+		t.Fatalf("expected a claim code to work once, got %d", status)
+	}
+}
+
+func TestGuestLeavesWithHost(t *testing.T) {
+	ts := newTestServer(t, "1", "2")
+	host := ts.connect("1")
+	other := ts.connect("2")
+
+	host.send(dcflMsg{Action: "add guest", Side: "yellow", Name: "Visitor"})
+	state := ts.expectState()
+	if !state.YellowPlayer1.Guest {
+		t.Fatalf("expected the guest to be seated, got %+v", state)
+	}
+	ts.disconnect(host)
+	state = other.next().state
+	if state.YellowPlayer1 != (player{}) {
+		t.Fatalf("expected the guest to leave with their host, got %+v", state)
+	}
+}
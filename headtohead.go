@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Results listed in a head-to-head, most recent first.
+const headToHeadRecent = 5
+
+type headToHeadSide struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Wins  int    `json:"wins"`
+	Goals int    `json:"goals"`
+	// The win by the largest margin, if any.
+	BiggestWin *headToHeadResult `json:"biggest_win,omitempty"`
+}
+
+// headToHeadResult is one game of a head-to-head. Winner is "a", "b" or empty
+// for a draw.
+type headToHeadResult struct {
+	GameID       int    `json:"game_id"`
+	ScoreA       int    `json:"score_a"`
+	ScoreB       int    `json:"score_b"`
+	Winner       string `json:"winner"`
+	EndTimestamp int64  `json:"end_timestamp"`
+}
+
+type streak struct {
+	// "a" or "b", empty if no one has won the last game.
+	Holder string `json:"holder"`
+	Length int    `json:"length"`
+}
+
+type headToHead struct {
+	Type   string             `json:"type"`
+	A      headToHeadSide     `json:"a"`
+	B      headToHeadSide     `json:"b"`
+	Played int                `json:"played"`
+	Recent []headToHeadResult `json:"recent"`
+	Streak streak             `json:"streak"`
+}
+
+// summarize works out the head-to-head statistics from games ordered oldest
+// first.
+func summarize(games []rivalryGame, a headToHeadSide, b headToHeadSide) headToHead {
+	hh := headToHead{A: a, B: b, Played: len(games), Recent: []headToHeadResult{}}
+	results := make([]headToHeadResult, len(games))
+	for i, g := range games {
+		r := headToHeadResult{GameID: g.GameID, ScoreA: g.AScore, ScoreB: g.BScore, EndTimestamp: g.EndTimestamp}
+		hh.A.Goals += g.AGoals
+		hh.B.Goals += g.BGoals
+		switch {
+		case g.AScore > g.BScore:
+			r.Winner = "a"
+			hh.A.Wins++
+			if hh.A.BiggestWin == nil || r.ScoreA-r.ScoreB > hh.A.BiggestWin.ScoreA-hh.A.BiggestWin.ScoreB {
+				hh.A.BiggestWin = &results[i]
+			}
+		case g.BScore > g.AScore:
+			r.Winner = "b"
+			hh.B.Wins++
+			if hh.B.BiggestWin == nil || r.ScoreB-r.ScoreA > hh.B.BiggestWin.ScoreB-hh.B.BiggestWin.ScoreA {
+				hh.B.BiggestWin = &results[i]
+			}
+		}
+		results[i] = r
+
+		if r.Winner == "" {
+			hh.Streak = streak{}
+		} else if r.Winner == hh.Streak.Holder {
+			hh.Streak.Length++
+		} else {
+			hh.Streak = streak{Holder: r.Winner, Length: 1}
+		}
+	}
+	for i := len(results) - 1; i >= 0 && len(hh.Recent) < headToHeadRecent; i-- {
+		hh.Recent = append(hh.Recent, results[i])
+	}
+	return hh
+}
+
+// headToHeadHandler compares two players, or two teams when type=team, given
+// as the a and b query parameters. Players are compared over the games of the
+// format query parameter, or of every format when it is empty.
+type headToHeadHandler struct {
+	repo repository
+}
+
+func (hh headToHeadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	a, b := q.Get("a"), q.Get("b")
+	if a == "" || b == "" || a == b {
+		http.Error(w, "a and b must name two different players or teams", http.StatusBadRequest)
+		return
+	}
+
+	format, err := parseFormat(q.Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result headToHead
+	switch q.Get("type") {
+	case "", "player":
+		result, err = hh.players(a, b, format)
+	case "team":
+		ia, errA := strconv.Atoi(a)
+		ib, errB := strconv.Atoi(b)
+		if errA != nil || errB != nil {
+			http.Error(w, "team ids must be numbers", http.StatusBadRequest)
+			return
+		}
+		result, err = hh.teams(ia, ib)
+	default:
+		http.Error(w, "type must be player or team", http.StatusBadRequest)
+		return
+	}
+	if err == errNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logger.Error("error computing head-to-head", "a", a, "b", b, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (hh headToHeadHandler) players(a string, b string, format matchFormat) (headToHead, error) {
+	pa, err := hh.repo.GetPlayer(a)
+	if err != nil {
+		return headToHead{}, err
+	}
+	pb, err := hh.repo.GetPlayer(b)
+	if err != nil {
+		return headToHead{}, err
+	}
+	games, err := hh.repo.PlayerRivalry(a, b, format)
+	if err != nil {
+		return headToHead{}, err
+	}
+	result := summarize(games, headToHeadSide{ID: a, Name: pa.displayName()}, headToHeadSide{ID: b, Name: pb.displayName()})
+	result.Type = "player"
+	return result, nil
+}
+
+func (hh headToHeadHandler) teams(a int, b int) (headToHead, error) {
+	ta, err := hh.repo.GetTeam(a)
+	if err != nil {
+		return headToHead{}, err
+	}
+	tb, err := hh.repo.GetTeam(b)
+	if err != nil {
+		return headToHead{}, err
+	}
+	games, err := hh.repo.TeamRivalry(a, b)
+	if err != nil {
+		return headToHead{}, err
+	}
+	result := summarize(games, headToHeadSide{ID: strconv.Itoa(a), Name: ta.City + " " + ta.Name}, headToHeadSide{ID: strconv.Itoa(b), Name: tb.City + " " + tb.Name})
+	result.Type = "team"
+	return result, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// recordGame stores a finished doubles game along with each player's goals.
+func recordGame(t *testing.T, repo repository, blackTeam int, yellowTeam int, blackScore int, yellowScore int, goals map[string]int) int {
+	t.Helper()
+	return recordFormatGame(t, repo, formatDoubles, blackTeam, yellowTeam, blackScore, yellowScore, goals)
+}
+
+// recordFormatGame is recordGame for a game of any format.
+func recordFormatGame(t *testing.T, repo repository, format matchFormat, blackTeam int, yellowTeam int, blackScore int, yellowScore int, goals map[string]int) int {
+	t.Helper()
+	id, err := repo.CreateGame(format, blackTeam, yellowTeam)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.FinishGame(id, blackScore, yellowScore); err != nil {
+		t.Fatal(err)
+	}
+	for sub, n := range goals {
+		if err := repo.RecordGoals(id, sub, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return id
+}
+
+func TestSummarize(t *testing.T) {
+	games := []rivalryGame{
+		{GameID: 1, AScore: 5, BScore: 1, AGoals: 5, BGoals: 1},
+		{GameID: 2, AScore: 2, BScore: 5, AGoals: 2, BGoals: 5},
+		{GameID: 3, AScore: 5, BScore: 4, AGoals: 5, BGoals: 4},
+		{GameID: 4, AScore: 5, BScore: 3, AGoals: 5, BGoals: 3},
+		{GameID: 5, AScore: 5, BScore: 0, AGoals: 5, BGoals: 0},
+		{GameID: 6, AScore: 5, BScore: 2, AGoals: 5, BGoals: 2},
+	}
+	hh := summarize(games, headToHeadSide{ID: "a"}, headToHeadSide{ID: "b"})
+	if hh.Played != 6 || hh.A.Wins != 5 || hh.B.Wins != 1 || hh.A.Goals != 27 || hh.B.Goals != 15 {
+		t.Fatalf("wrong totals: %+v", hh)
+	}
+	if hh.A.BiggestWin == nil || hh.A.BiggestWin.GameID != 5 || hh.B.BiggestWin == nil || hh.B.BiggestWin.GameID != 2 {
+		t.Fatalf("wrong biggest wins: %+v %+v", hh.A.BiggestWin, hh.B.BiggestWin)
+	}
+	if hh.Streak != (streak{Holder: "a", Length: 4}) {
+		t.Fatalf("wrong streak: %+v", hh.Streak)
+	}
+	if len(hh.Recent) != 5 || hh.Recent[0].GameID != 6 || hh.Recent[4].GameID != 2 || hh.Recent[4].Winner != "b" {
+		t.Fatalf("wrong recent results: %+v", hh.Recent)
+	}
+
+	empty := summarize(nil, headToHeadSide{ID: "a"}, headToHeadSide{ID: "b"})
+	if empty.Played != 0 || empty.A.BiggestWin != nil || empty.Streak != (streak{}) || len(empty.Recent) != 0 {
+		t.Fatalf("expected an empty head-to-head, got %+v", empty)
+	}
+}
+
+func TestHeadToHead(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4", "5")
+	blackhawks, _ := ts.repo.CreateTeam("Chicago", "Blackhawks", "1", "2")
+	bruins, _ := ts.repo.CreateTeam("Boston", "Bruins", "3", "4")
+	canucks, _ := ts.repo.CreateTeam("Vancouver", "Canucks", "5", "1")
+
+	recordGame(t, ts.repo, blackhawks, bruins, 5, 3, map[string]int{"1": 4, "2": 1, "3": 3})
+	recordGame(t, ts.repo, bruins, blackhawks, 5, 1, map[string]int{"3": 2, "4": 3, "1": 1})
+	recordGame(t, ts.repo, canucks, bruins, 5, 4, map[string]int{"5": 1, "1": 4, "3": 4})
+	// Unfinished games do not count.
+	ts.repo.CreateGame(formatDoubles, blackhawks, bruins)
+
+	var hh headToHead
+	if code := ts.get("/head-to-head?a=1&b=3", &hh); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if hh.Type != "player" || hh.A.Name != "Player 1" || hh.Played != 3 || hh.A.Wins != 2 || hh.B.Wins != 1 || hh.A.Goals != 9 || hh.B.Goals != 9 {
+		t.Fatalf("wrong player head-to-head: %+v", hh)
+	}
+	if hh.Streak != (streak{Holder: "a", Length: 1}) || hh.B.BiggestWin.ScoreB != 5 || hh.B.BiggestWin.ScoreA != 1 {
+		t.Fatalf("wrong streak or biggest win: %+v", hh)
+	}
+
+	// Teammates never face each other.
+	ts.get("/head-to-head?a=1&b=2", &hh)
+	if hh.Played != 0 {
+		t.Fatalf("expected teammates to have no head-to-head, got %+v", hh)
+	}
+
+	ts.get("/head-to-head?type=team&a=2&b=1", &hh)
+	if hh.Type != "team" || hh.A.Name != "Boston Bruins" || hh.Played != 2 || hh.A.Wins != 1 || hh.A.Goals != 8 || hh.B.Goals != 6 {
+		t.Fatalf("wrong team head-to-head: %+v", hh)
+	}
+	if len(hh.Recent) != 2 || hh.Recent[0].Winner != "a" || hh.Recent[0].ScoreA != 5 {
+		t.Fatalf("wrong recent results: %+v", hh.Recent)
+	}
+
+	for query, want := range map[string]int{
+		"a=1":                 http.StatusBadRequest,
+		"a=1&b=1":             http.StatusBadRequest,
+		"a=1&b=9":             http.StatusNotFound,
+		"type=team&a=1&b=x":   http.StatusBadRequest,
+		"type=team&a=1&b=9":   http.StatusNotFound,
+		"type=league&a=1&b=2": http.StatusBadRequest,
+	} {
+		if code := ts.get("/head-to-head?"+query, nil); code != want {
+			t.Errorf("%s: expected %d, got %d", query, want, code)
+		}
+	}
+}
+
+func TestHeadToHeadFormat(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	blackhawks, _ := ts.repo.CreateTeam("Chicago", "Blackhawks", "1", "2")
+	bruins, _ := ts.repo.CreateTeam("Boston", "Bruins", "3", "4")
+	wolf, _ := ts.repo.CreateTeam("Chicago", "Lone Wolf", "1", "1")
+	solo, _ := ts.repo.CreateTeam("Boston", "Solo", "3", "3")
+
+	recordGame(t, ts.repo, blackhawks, bruins, 5, 3, map[string]int{"1": 4, "2": 1, "3": 3})
+	recordFormatGame(t, ts.repo, formatSingles, solo, wolf, 5, 2, map[string]int{"3": 5, "1": 2})
+	recordFormatGame(t, ts.repo, formatSingles, solo, wolf, 5, 1, map[string]int{"3": 5, "1": 1})
+
+	for _, c := range []struct {
+		format string
+		played int
+		wins   int
+		goals  int
+	}{{"", 3, 1, 7}, {"doubles", 1, 1, 4}, {"singles", 2, 0, 3}} {
+		var hh headToHead
+		if code := ts.get("/head-to-head?a=1&b=3&format="+c.format, &hh); code != http.StatusOK {
+			t.Fatalf("%q: status %d", c.format, code)
+		}
+		if hh.Played != c.played || hh.A.Wins != c.wins || hh.A.Goals != c.goals {
+			t.Errorf("%q: wrong head-to-head %+v", c.format, hh)
+		}
+	}
+	if code := ts.get("/head-to-head?a=1&b=3&format=triples", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown format to be refused, got %d", code)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const readinessTimeout = 2 * time.Second
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+func (hr *healthReport) add(name string, err error, detail string) {
+	result := checkResult{Status: "ok", Detail: detail}
+	if err != nil {
+		result.Status = "failing"
+		result.Error = err.Error()
+		hr.Status = "failing"
+	}
+	hr.Checks[name] = result
+}
+
+func (hr *healthReport) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	if hr.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(hr)
+}
+
+func newHealthReport() *healthReport {
+	return &healthReport{Status: "ok", Checks: make(map[string]checkResult)}
+}
+
+// healthHandler reports whether the process is alive and the hub is running.
+type healthHandler struct {
+	h *hub
+}
+
+func (hh healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := newHealthReport()
+	var err error
+	if !hh.h.running() {
+		err = fmt.Errorf("hub goroutines are not running")
+	}
+	report.add("hub", err, "")
+	report.write(w)
+}
+
+// readyHandler reports whether the server can serve players: the database is
+// reachable and fully migrated and the auth key set, if the identity provider
+// uses one, has been loaded.
+type readyHandler struct {
+	keys *keySet
+	repo repository
+}
+
+func (rh readyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := newHealthReport()
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	dbErr := rh.repo.Ping(ctx)
+	report.add("database", dbErr, "")
+
+	if dbErr != nil {
+		report.add("migrations", fmt.Errorf("database unreachable"), "")
+	} else {
+		pending, err := rh.repo.PendingMigrations()
+		if err == nil && pending != 0 {
+			err = fmt.Errorf("%d migrations pending", pending)
+		}
+		report.add("migrations", err, "")
+	}
+
+	if rh.keys != nil {
+		loadedAt, err := rh.keys.loaded()
+		if loadedAt.IsZero() {
+			if err == nil {
+				err = fmt.Errorf("key set not loaded yet")
+			}
+			report.add("auth_keys", err, "")
+		} else {
+			report.add("auth_keys", nil, fmt.Sprint("loaded at ", loadedAt.UTC().Format(time.RFC3339)))
+		}
+	}
+
+	report.write(w)
+}
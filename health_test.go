@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expectHealth polls path until it answers status, and returns the report.
+func expectHealth(t *testing.T, handler http.Handler, path string, status int) healthReport {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var report healthReport
+		json.NewDecoder(w.Body).Decode(&report)
+		if w.Code == status {
+			return report
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: expected %d, got %d %+v", path, status, w.Code, report)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ts := newTestServer(t)
+	report := expectHealth(t, ts.srv.Config.Handler, "/healthz", http.StatusOK)
+	if report.Status != "ok" || report.Checks["hub"].Status != "ok" {
+		t.Fatalf("expected a healthy hub, got %+v", report)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ts.hub.shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	report = expectHealth(t, ts.srv.Config.Handler, "/healthz", http.StatusServiceUnavailable)
+	if report.Status != "failing" || report.Checks["hub"].Error != "hub goroutines are not running" {
+		t.Fatalf("expected a stopped hub to fail, got %+v", report)
+	}
+}
+
+func TestReady(t *testing.T) {
+	ts := newTestServer(t)
+	report := expectHealth(t, ts.srv.Config.Handler, "/readyz", http.StatusOK)
+	if report.Checks["database"].Status != "ok" || report.Checks["migrations"].Status != "ok" {
+		t.Fatalf("expected the repository to be ready, got %+v", report)
+	}
+	if _, ok := report.Checks["auth_keys"]; ok {
+		t.Fatalf("expected no key set check without a key set, got %+v", report)
+	}
+
+	ti := newTestIssuer(t)
+	keys := newKeySet(ti.srv.URL)
+	rh := readyHandler{keys: keys, repo: ts.repo}
+	report = expectHealth(t, rh, "/readyz", http.StatusServiceUnavailable)
+	if report.Checks["auth_keys"].Error != "key set not loaded yet" {
+		t.Fatalf("expected the key set to be missing, got %+v", report)
+	}
+	keys.refresh()
+	report = expectHealth(t, rh, "/readyz", http.StatusOK)
+	if !strings.HasPrefix(report.Checks["auth_keys"].Detail, "loaded at ") {
+		t.Fatalf("expected the key set to be loaded, got %+v", report)
+	}
+
+	broken := newKeySet(ti.srv.URL + "/missing")
+	ti.srv.Close()
+	broken.refresh()
+	report = expectHealth(t, readyHandler{keys: broken, repo: ts.repo}, "/readyz", http.StatusServiceUnavailable)
+	if report.Checks["auth_keys"].Status != "failing" || report.Checks["auth_keys"].Error == "key set not loaded yet" {
+		t.Fatalf("expected the fetch error to be reported, got %+v", report)
+	}
+}
+
+func TestGoogleHasNoKeySet(t *testing.T) {
+	_, keys, err := newIdentityVerifier(authConfig{Provider: "google", TokeninfoEndpoint: "https://id.example/tokeninfo?id_token="})
+	if err != nil || keys != nil {
+		t.Fatalf("expected google to verify without a key set, got %v %v", keys, err)
+	}
+}
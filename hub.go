@@ -1,20 +1,39 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 type hub struct {
+	// The table this hub is running.
+	table string
+
+	// The rules matches on this table are played by.
+	rules matchRules
+
+	// Where players, teams and results are stored.
+	repo repository
+
+	// Delivers match events to outgoing webhooks. May be nil.
+	webhooks *webhookDispatcher
+
 	// Connections mutex.
 	connectionsMx sync.RWMutex
 
 	// Registered connections.
 	connections map[*connection]struct{}
 
+	// Event stream watchers. Guarded by connectionsMx.
+	watchers map[watcher]struct{}
+
 	// Side mutex.
 	sideMx sync.RWMutex
 
@@ -35,17 +54,52 @@ type hub struct {
 
 	yellowScore int
 
-	gameStarted bool
+	// The side that scored each goal of the current game, in order.
+	timeline []string
 
-	gameOver bool
+	// Badges awarded for the last finished game. Guarded by sideMx.
+	badges []badgeAward
+
+	// The phase the match is in.
+	phase phase
+
+	// The number of players per side, chosen while the table is empty.
+	// Guarded by sideMx.
+	format matchFormat
+
+	// Players waiting for the next free seat, first in line first.
+	queue []string
+
+	// Accepted challenges waiting for the table, and the one currently seated.
+	challenges []challengeMatch
+	challenge  *challengeMatch
+
+	// The rotation session running on the table, if any. Guarded by sideMx.
+	rotation *rotation
 
 	gameID int
 
+	// Match clock, see matchState.
+	startedAt    int64
+	pausedAt     int64
+	pausedMillis int64
+
 	// Inbound request messages from the connections.
-	requests chan []byte
+	requests chan request
 
 	// Outbound messages from the server.
 	confirmations chan string
+
+	// Set while the request processing and broadcasting goroutines are running.
+	processing   int32
+	broadcasting int32
+
+	// Set once the server has started shutting down.
+	closing int32
+
+	// Closed to stop request processing, which then closes stopped.
+	quit    chan struct{}
+	stopped chan struct{}
 }
 
 type dcflMsg struct {
@@ -65,27 +119,53 @@ type dcflMsg struct {
 	City string `json:"city"`
 	// name, if applicable
 	Name string `json:"name"`
+	// match format, if applicable
+	Format string `json:"format"`
+	// the connection the request arrived on, if any
+	conn *connection
+	// set when the request was refused
+	rejected bool
+}
+
+type request struct {
+	c   *connection
+	msg []byte
+	// set when the connection has closed
+	leave bool
 }
 
 type matchState struct {
-	BlackPlayer1  player `json:"black_player_1"`
-	BlackPlayer2  player `json:"black_player_2"`
-	YellowPlayer1 player `json:"yellow_player_1"`
-	YellowPlayer2 player `json:"yellow_player_2"`
-	BlackTeam     team   `json:"black_team"`
-	YellowTeam    team   `json:"yellow_team"`
-	BlackScore    int    `json:"black_score"`
-	YellowScore   int    `json:"yellow_score"`
-	GameStarted   bool   `json:"game_started"`
-	GameOver      bool   `json:"game_over"`
-	Error         string `json:"error"`
+	BlackPlayer1  player      `json:"black_player_1"`
+	BlackPlayer2  player      `json:"black_player_2"`
+	YellowPlayer1 player      `json:"yellow_player_1"`
+	YellowPlayer2 player      `json:"yellow_player_2"`
+	BlackTeam     team        `json:"black_team"`
+	YellowTeam    team        `json:"yellow_team"`
+	BlackScore    int         `json:"black_score"`
+	YellowScore   int         `json:"yellow_score"`
+	GameStarted   bool        `json:"game_started"`
+	GameOver      bool        `json:"game_over"`
+	Phase         phase       `json:"phase"`
+	Format        matchFormat `json:"format"`
+	// The rotation session seating the table, if any.
+	RotationID int `json:"rotation_id,omitempty"`
+	// When the game started, and how long it has been paused for, in
+	// milliseconds. PausedAt is set while the game is paused.
+	StartedAt    int64  `json:"started_at,omitempty"`
+	PausedAt     int64  `json:"paused_at,omitempty"`
+	PausedMillis int64  `json:"paused_millis,omitempty"`
+	Error        string `json:"error"`
 }
 
 type player struct {
-	Sub       string `json:"sub"`
+	Sub string `json:"sub"`
+	// The player's nickname, or their name if they have none.
+	Name      string `json:"name"`
 	Picture   string `json:"picture"`
 	Confirmed bool   `json:"confirmed"`
 	Goals     int    `json:"goals"`
+	// Set for guests, who are acted for by the player who added them.
+	Guest bool `json:"guest,omitempty"`
 }
 
 type team struct {
@@ -94,58 +174,164 @@ type team struct {
 	Name string `json:"name"`
 }
 
+// log returns a logger annotated with the table and the game in progress.
+func (h *hub) log() *slog.Logger {
+	return logger.With("table", h.table, "game_id", h.gameID)
+}
+
+// logFor additionally annotates the logger with the player and connection a
+// request came from.
+func (h *hub) logFor(cm *dcflMsg) *slog.Logger {
+	l := h.log().With("sub", cm.Sub)
+	if cm.conn != nil {
+		l = l.With("conn", cm.conn.id)
+	}
+	return l
+}
+
 func startGame(h *hub) error {
-	var id int
-	err := db.QueryRow(
-		"INSERT INTO public.game(black_team, yellow_team) VALUES ($1, $2) RETURNING id",
-		h.blackTeam.ID,
-		h.yellowTeam.ID).Scan(&id)
+	id, err := h.repo.CreateGame(h.format, h.blackTeam.ID, h.yellowTeam.ID)
 	if err != nil {
 		return err
 	}
 	h.gameID = id
-	h.gameStarted = true
+	h.startedAt = nowMillis()
+	h.setPhase(phaseInPlay)
+	h.challengeStarted()
+	h.rotationGameStarted()
+	h.log().Info("game started",
+		"format", h.format,
+		"black_team", h.blackTeam.ID,
+		"yellow_team", h.yellowTeam.ID,
+		"black_players", []string{h.blackSide[0].Sub, h.blackSide[1].Sub},
+		"yellow_players", []string{h.yellowSide[0].Sub, h.yellowSide[1].Sub})
+	gamesStarted.inc()
+	gamesActive.inc()
+	h.notify(eventGameStarted, "")
 	return nil
 }
 
+// This function assumes and requires the caller to have the sideMx and scoreMx locks acquired.
 func endGame(h *hub) {
-	h.gameOver = true
-	_, err := db.Exec(
-		"UPDATE public.game SET end_timestamp = EXTRACT(epoch FROM NOW()) * 1000, black_score = $1, yellow_score = $2 WHERE id = $3",
-		h.blackScore,
-		h.yellowScore,
-		h.gameID)
+	h.setPhase(phaseFinished)
+	gamesFinished.inc()
+	h.notify(eventGameFinished, "")
+	log := h.log()
+	log.Info("game over", "black_score", h.blackScore, "yellow_score", h.yellowScore)
+	badges, err := finalize(h.repo, h.currentRules(), h.finishedGame(), h.recordGame(log), log)
 	if err != nil {
-		fmt.Println("Error recording game end_timestamp")
-		fmt.Println(err)
+		log.Error("error recording game result", "err", err)
 	}
-	for _, p := range h.blackSide {
-		_, err := db.Exec(
-			"INSERT INTO public.game_goals(game_id, player_id, goals) VALUES ($1, $2, $3)",
-			h.gameID,
-			p.Sub,
-			p.Goals)
-		if err != nil {
-			fmt.Println("Error recording black player goals")
-			fmt.Println(err)
+	h.badges = badges
+}
+
+// finishedGame is a game whose result is being recorded, either at the end of
+// a match or when a manually entered result is confirmed.
+type finishedGame struct {
+	id          int
+	format      matchFormat
+	blackSide   [2]player
+	yellowSide  [2]player
+	blackScore  int
+	yellowScore int
+	// The side that scored each goal, in order, if known.
+	timeline []string
+}
+
+// This function assumes and requires the caller to have the sideMx and scoreMx locks acquired.
+func (h *hub) finishedGame() finishedGame {
+	return finishedGame{
+		id:          h.gameID,
+		format:      h.format,
+		blackSide:   h.blackSide,
+		yellowSide:  h.yellowSide,
+		blackScore:  h.blackScore,
+		yellowScore: h.yellowScore,
+		timeline:    h.timeline,
+	}
+}
+
+// validate checks that the game was won under rules and that the players'
+// goals add up to the score.
+func (g finishedGame) validate(rules matchRules) error {
+	winner, loser := g.blackScore, g.yellowScore
+	if loser > winner {
+		winner, loser = loser, winner
+	}
+	if winner != rules.GoalsToWin || loser < 0 || loser >= winner {
+		return fmt.Errorf("a game is won by the first side to %d goals, not %d - %d", rules.GoalsToWin, g.blackScore, g.yellowScore)
+	}
+	for _, side := range []struct {
+		name    string
+		players [2]player
+		score   int
+	}{{"black", g.blackSide, g.blackScore}, {"yellow", g.yellowSide, g.yellowScore}} {
+		goals := 0
+		for _, p := range side.players {
+			if p.Goals < 0 {
+				return fmt.Errorf("%s cannot score %d goals", p.Sub, p.Goals)
+			}
+			goals += p.Goals
+		}
+		if goals != side.score {
+			return fmt.Errorf("%s players scored %d goals but the score is %d", side.name, goals, side.score)
 		}
 	}
-	for _, p := range h.yellowSide {
-		_, err := db.Exec(
-			"INSERT INTO public.game_goals(game_id, player_id, goals) VALUES ($1, $2, $3)",
-			h.gameID,
-			p.Sub,
-			p.Goals)
+	return nil
+}
+
+// finalize validates the result of a game, stores it with record and awards
+// the badges it earned. Matches and confirmed manual results both end here, so
+// they are held to the same rules. A result breaking the rules is refused with
+// a requestError.
+func finalize(repo repository, rules matchRules, g finishedGame, record func(finishedGame) (int, error), log *slog.Logger) ([]badgeAward, error) {
+	err := g.validate(rules)
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, err.Error()}
+	}
+	g.id, err = record(g)
+	if err != nil {
+		return nil, err
+	}
+	return awardBadges(repo, rules, g, log), nil
+}
+
+// recordGame returns the record function finalize stores the current game
+// with.
+func (h *hub) recordGame(log *slog.Logger) func(finishedGame) (int, error) {
+	return func(g finishedGame) (int, error) {
+		err := h.repo.FinishGame(g.id, g.blackScore, g.yellowScore)
 		if err != nil {
-			fmt.Println("Error recording yellow player goals")
-			fmt.Println(err)
+			return 0, err
+		}
+		for _, side := range []struct {
+			name    string
+			players [2]player
+		}{{"black", g.blackSide}, {"yellow", g.yellowSide}} {
+			for _, p := range side.players {
+				if p.Sub == "" {
+					continue
+				}
+				err := h.repo.RecordGoals(g.id, p.Sub, p.Goals)
+				if err != nil {
+					log.Error("error recording player goals", "side", side.name, "player", p.Sub, "goals", p.Goals, "err", err)
+				}
+			}
 		}
+		return g.id, nil
 	}
 }
 
 // This function assumes and requires the caller to have the sideMx and scoreMx locks acquired.
 func (h *hub) reset() {
-	fmt.Println("Reseting")
+	h.log().Info("resetting match", "phase", h.phase)
+	if h.gameStarted() {
+		gamesActive.dec()
+	}
+	if h.phase == phaseInPlay || h.phase == phasePaused {
+		h.notify(eventGameAbandoned, "")
+	}
+	h.rotate()
 	h.blackTeam = team{}
 	h.yellowTeam = team{}
 	h.blackSide[0] = player{}
@@ -155,13 +341,50 @@ func (h *hub) reset() {
 
 	h.blackScore = 0
 	h.yellowScore = 0
-	h.gameStarted = false
-	h.gameOver = false
+	h.timeline = nil
+	h.startedAt = 0
+	h.pausedAt = 0
+	h.pausedMillis = 0
+	h.challenge = nil
+	h.setPhase(phaseOpen)
+	h.seatNextChallenge()
+	h.seatRotation()
+}
+
+// gameStarted reports whether a game has been created for the current match.
+func (h *hub) gameStarted() bool {
+	return h.phase == phaseInPlay || h.phase == phasePaused || h.phase == phaseFinished
+}
+
+// sideOf returns the side sub is seated on, or an empty string.
+func (h *hub) sideOf(sub string) string {
+	for _, p := range h.blackSide {
+		if p.Sub == sub {
+			return "black"
+		}
+	}
+	for _, p := range h.yellowSide {
+		if p.Sub == sub {
+			return "yellow"
+		}
+	}
+	return ""
+}
+
+// seated reports whether sub has a seat at the table.
+func (h *hub) seated(sub string) bool {
+	for _, p := range append(h.blackSide[:], h.yellowSide[:]...) {
+		if p.Sub == sub {
+			return true
+		}
+	}
+	return false
 }
 
 // Assumes and requires that caller has acquired sideMx lock.
 func registerGame(h *hub, cm *dcflMsg) (string, bool) {
-	fmt.Println("Registering")
+	log := h.logFor(cm).With("side", cm.Side)
+	log.Debug("registering")
 	if cm.Side == "black" {
 		// Check if already registered on black side.
 		found := false
@@ -174,16 +397,16 @@ func registerGame(h *hub, cm *dcflMsg) (string, bool) {
 		}
 		if found {
 			if !confirmed {
-				fmt.Println("Already registered to black side, unregistering")
-				unregisterGame(h, cm)
+				log.Debug("already registered to side, unregistering")
+				return unregisterGame(h, cm)
 			}
-			fmt.Println("Already registered and confirmed to black side")
+			h.reject(cm, "already confirmed on this side")
 			return "", false
 		}
 
 		// Check if black side is full.
-		if h.blackSide[0] != (player{}) && h.blackSide[1] != (player{}) {
-			fmt.Println("Black side full")
+		if h.full(h.blackSide) {
+			h.reject(cm, "black side is full")
 			return "", false
 		}
 	} else if cm.Side == "yellow" {
@@ -198,37 +421,38 @@ func registerGame(h *hub, cm *dcflMsg) (string, bool) {
 		}
 		if found {
 			if !confirmed {
-				fmt.Println("Already registered to yellow side, unregistering")
-				unregisterGame(h, cm)
+				log.Debug("already registered to side, unregistering")
+				return unregisterGame(h, cm)
 			}
-			fmt.Println("Already registered and confirmed to yellow side")
+			h.reject(cm, "already confirmed on this side")
 			return "", false
 		}
 
 		// Check if yellow side is full.
-		if h.yellowSide[0] != (player{}) && h.yellowSide[1] != (player{}) {
-			fmt.Println("Yellow side full")
+		if h.full(h.yellowSide) {
+			h.reject(cm, "yellow side is full")
 			return "", false
 		}
 	} else {
-		// If side is neither black nor yellow, ignore the request.
+		h.reject(cm, "unknown side")
 		return "", false
 	}
 
-	fmt.Println("Getting user picture")
-	var picture string
-	err := db.QueryRow("SELECT picture FROM public.player WHERE id = $1", cm.Sub).Scan(&picture)
-	if err != nil {
+	record, err := h.repo.GetPlayer(cm.Sub)
+	if err == errNotFound {
+		h.reject(cm, "unknown player")
+		return "", false
+	} else if err != nil {
+		log.Warn("error getting player picture", "err", err)
 		return "", false
 	}
 
 	if cm.Side == "black" {
 		// If registering for black side, unregister from yellow side.
-		fmt.Println("Registering to black side")
 		var err error
 		for _, v := range h.yellowSide {
 			if v.Sub == cm.Sub {
-				fmt.Println("Unregistering from yellow side")
+				log.Debug("unregistering from opposite side")
 				unregisterMsg := cm
 				unregisterMsg.Side = "yellow"
 				unregisterGame(h, unregisterMsg)
@@ -239,21 +463,19 @@ func registerGame(h *hub, cm *dcflMsg) (string, bool) {
 		}
 
 		// Register to first free side slot.
-		fmt.Println("Placing in black player slot")
 		if h.blackSide[0] == (player{}) {
-			fmt.Println("Placed in black slot 1")
-			h.blackSide[0] = player{Sub: cm.Sub, Picture: picture, Confirmed: false}
+			log.Info("registered", "slot", 1)
+			h.blackSide[0] = record.seat()
 		} else if h.blackSide[1] == (player{}) {
-			fmt.Println("Placed in black slot 2")
-			h.blackSide[1] = player{Sub: cm.Sub, Picture: picture, Confirmed: false}
+			log.Info("registered", "slot", 2)
+			h.blackSide[1] = record.seat()
 		}
 	} else {
 		// If registering for yellow side, unregister from black side.
-		fmt.Println("Registering to yellow side")
 		var err error
 		for _, v := range h.blackSide {
 			if v.Sub == cm.Sub {
-				fmt.Println("Unregistering from black side")
+				log.Debug("unregistering from opposite side")
 				unregisterMsg := cm
 				unregisterMsg.Side = "black"
 				unregisterGame(h, unregisterMsg)
@@ -264,85 +486,103 @@ func registerGame(h *hub, cm *dcflMsg) (string, bool) {
 		}
 
 		// Register to first free side slot.
-		fmt.Println("Placing in yellow player slot")
 		if h.yellowSide[0] == (player{}) {
-			fmt.Println("Placed in yellow slot 1")
-			h.yellowSide[0] = player{Sub: cm.Sub, Picture: picture, Confirmed: false}
+			log.Info("registered", "slot", 1)
+			h.yellowSide[0] = record.seat()
 		} else if h.yellowSide[1] == (player{}) {
-			fmt.Println("Placed in yellow slot 2")
-			h.yellowSide[1] = player{Sub: cm.Sub, Picture: picture, Confirmed: false}
+			log.Info("registered", "slot", 2)
+			h.yellowSide[1] = record.seat()
 		}
 	}
-	return "", false
+	h.unqueue(cm.Sub)
+	return h.advance()
 }
 
 // This function assumes and requires the sideMx lock to be acquired by the caller.
 func unregisterGame(h *hub, cm *dcflMsg) (string, bool) {
-	fmt.Println("Unregistering")
+	log := h.logFor(cm).With("side", cm.Side)
+	log.Debug("unregistering")
+	if (cm.Side == "black" || cm.Side == "yellow") && h.sideOf(cm.Sub) != cm.Side {
+		h.reject(cm, "not seated on this side")
+		return "", false
+	}
 	if cm.Side == "black" {
 		if h.blackSide[0].Sub == cm.Sub {
 			h.blackSide[0] = player{}
-			if h.gameStarted {
+			if h.gameStarted() {
 				h.scoreMx.Lock()
 				defer h.scoreMx.Unlock()
 				h.reset()
+				log.Info("player left mid-game")
 				return "Player left mid-game", true
 			}
 		} else if h.blackSide[1].Sub == cm.Sub {
 			h.blackSide[1] = player{}
-			if h.gameStarted {
+			if h.gameStarted() {
 				h.scoreMx.Lock()
 				defer h.scoreMx.Unlock()
 				h.reset()
+				log.Info("player left mid-game")
 				return "Player left mid-game", true
 			}
 		}
 	} else if cm.Side == "yellow" {
 		if h.yellowSide[0].Sub == cm.Sub {
 			h.yellowSide[0] = player{}
-			if h.gameStarted {
+			if h.gameStarted() {
 				h.scoreMx.Lock()
 				defer h.scoreMx.Unlock()
 				h.reset()
+				log.Info("player left mid-game")
 				return "Player left mid-game", true
 			}
 		} else if h.yellowSide[1].Sub == cm.Sub {
 			h.yellowSide[1] = player{}
-			if h.gameStarted {
+			if h.gameStarted() {
 				h.scoreMx.Lock()
 				defer h.scoreMx.Unlock()
 				h.reset()
+				log.Info("player left mid-game")
 				return "Player left mid-game", true
 			}
 		}
 	} else {
+		h.reject(cm, "unknown side")
 		return "", false
 	}
 
-	fmt.Println("Completed unregistration")
-	return "", false
+	// The team no longer matches the players on the side.
+	if cm.Side == "black" {
+		h.blackTeam = team{}
+	} else {
+		h.yellowTeam = team{}
+	}
+	log.Debug("completed unregistration")
+	return h.advance()
 }
 
 // This function assumes and requires the sideMx lock to be acquired by the caller.
 func confirmPlayer(h *hub, cm *dcflMsg) (string, bool) {
-	fmt.Println("Confirming")
+	log := h.logFor(cm).With("side", cm.Side)
+	log.Debug("confirming")
 	if cm.Side == "black" {
 		if h.blackSide[0].Sub == cm.Sub {
-			fmt.Println("Confirming black player 1")
+			log.Info("confirmed", "slot", 1)
 			h.blackSide[0].Confirmed = true
 		} else if h.blackSide[1].Sub == cm.Sub {
-			fmt.Println("Confirming black player 2")
+			log.Info("confirmed", "slot", 2)
 			h.blackSide[1].Confirmed = true
 		} else {
-			fmt.Println("Black player not found")
+			h.reject(cm, "not seated on this side")
 			return "", false
 		}
 
 		// Get team name.
-		if h.blackSide[0].Confirmed && h.blackSide[1].Confirmed {
-			team, err := getTeam(h.blackSide[0].Sub, h.blackSide[1].Sub)
+		if h.confirmed(h.blackSide) {
+			player1, player2 := h.format.pair(h.blackSide)
+			team, err := getTeam(h.repo, player1, player2)
 			if err != nil {
-				fmt.Println(err)
+				log.Error("error getting team", "err", err)
 				return "", false
 			}
 			h.blackTeam = team
@@ -350,51 +590,45 @@ func confirmPlayer(h *hub, cm *dcflMsg) (string, bool) {
 
 	} else if cm.Side == "yellow" {
 		if h.yellowSide[0].Sub == cm.Sub {
-			fmt.Println("Confirming yellow player 1")
+			log.Info("confirmed", "slot", 1)
 			h.yellowSide[0].Confirmed = true
 		} else if h.yellowSide[1].Sub == cm.Sub {
-			fmt.Println("Confirming yellow player 2")
+			log.Info("confirmed", "slot", 2)
 			h.yellowSide[1].Confirmed = true
 		} else {
-			fmt.Println("Yellow player not found")
+			h.reject(cm, "not seated on this side")
 			return "", false
 		}
 
 		// Get team name.
-		if h.yellowSide[0].Confirmed && h.yellowSide[1].Confirmed {
-			team, err := getTeam(h.yellowSide[0].Sub, h.yellowSide[1].Sub)
+		if h.confirmed(h.yellowSide) {
+			player1, player2 := h.format.pair(h.yellowSide)
+			team, err := getTeam(h.repo, player1, player2)
 			if err != nil {
-				fmt.Println(err)
+				log.Error("error getting team", "err", err)
 				return "", false
 			}
 			h.yellowTeam = team
 		}
+	} else {
+		h.reject(cm, "unknown side")
+		return "", false
 	}
 
-	if h.blackSide[0].Confirmed &&
-		h.blackSide[1].Confirmed &&
-		h.yellowSide[0].Confirmed &&
-		h.yellowSide[1].Confirmed &&
-		h.blackTeam != (team{}) &&
-		h.yellowTeam != (team{}) {
-		err := startGame(h)
-		if err != nil {
-			h.scoreMx.Lock()
-			defer h.scoreMx.Unlock()
-			h.reset()
-			return "Error starting game", true
-		}
-	}
-
-	return "", false
+	return h.advance()
 }
 
 // This function assumes and requires the sideMx lock to be acquired by the caller.
 func registerTeam(h *hub, cm *dcflMsg) (string, bool) {
-	fmt.Println("Registering team")
+	log := h.logFor(cm).With("side", cm.Side)
+	log.Debug("registering team", "player1", cm.Player1, "player2", cm.Player2, "city", cm.City, "name", cm.Name)
+	// Singles teams are one player, stored as a pair of the same player.
+	if h.format == formatSingles && cm.Player2 == "" {
+		cm.Player2 = cm.Player1
+	}
 	if cm.Player1 == "" ||
 		cm.Player2 == "" ||
-		cm.Player1 == cm.Player2 ||
+		(cm.Player1 == cm.Player2) != (h.format == formatSingles) ||
 		cm.City == "" ||
 		cm.Name == "" {
 		h.scoreMx.Lock()
@@ -402,28 +636,18 @@ func registerTeam(h *hub, cm *dcflMsg) (string, bool) {
 		h.reset()
 		return "Error registering teams", true
 	}
-	var count int
-	err := db.QueryRow(
-		"SELECT COUNT(*) FROM public.team WHERE (player1 = $1 AND player2 = $2) OR (player1 = $2 AND player2 = $1) OR city = $3 OR name = $4",
-		cm.Player1,
-		cm.Player2,
-		cm.City,
-		cm.Name).Scan(&count)
+	count, err := h.repo.TeamConflicts(cm.Player1, cm.Player2, cm.City, cm.Name)
 	if err != nil || count != 0 {
+		log.Warn("rejected team registration", "existing", count, "err", err)
 		h.scoreMx.Lock()
 		defer h.scoreMx.Unlock()
 		h.reset()
 		return "Error registering teams", true
 	}
 
-	var id int
-	err = db.QueryRow(
-		"INSERT INTO public.team(city, name, player1, player2) VALUES ($1, $2, $3, $4) RETURNING id",
-		cm.City,
-		cm.Name,
-		cm.Player1,
-		cm.Player2).Scan(&id)
+	id, err := h.repo.CreateTeam(cm.City, cm.Name, cm.Player1, cm.Player2)
 	if err != nil {
+		log.Error("error creating team", "err", err)
 		h.scoreMx.Lock()
 		defer h.scoreMx.Unlock()
 		h.reset()
@@ -431,6 +655,7 @@ func registerTeam(h *hub, cm *dcflMsg) (string, bool) {
 	}
 
 	teamObj := team{ID: id, City: cm.City, Name: cm.Name}
+	log.Info("registered team", "team", id)
 
 	if cm.Side == "black" {
 		h.blackTeam = teamObj
@@ -443,35 +668,19 @@ func registerTeam(h *hub, cm *dcflMsg) (string, bool) {
 		return "Error setting up team", true
 	}
 
-	if h.blackSide[0].Confirmed &&
-		h.blackSide[1].Confirmed &&
-		h.yellowSide[0].Confirmed &&
-		h.yellowSide[1].Confirmed &&
-		h.blackTeam != (team{}) &&
-		h.yellowTeam != (team{}) {
-		err := startGame(h)
-		if err != nil {
-			h.scoreMx.Lock()
-			defer h.scoreMx.Unlock()
-			h.reset()
-			return "Error starting game", true
-		}
-	}
-
-	return "", false
+	return h.advance()
 }
 
 // This function assumes and requires the scoreMx and sideMx locks to be acquired by the caller.
 func registerGoal(h *hub, cm *dcflMsg) (string, bool) {
-	fmt.Println("Registering goal")
-	// Must be in game to score goal.
-	if !h.gameStarted || h.gameOver {
-		return "", false
-	}
+	log := h.logFor(cm)
 	if h.blackSide[0].Sub == cm.Sub {
 		h.blackSide[0].Goals++
 		h.blackScore++
-		if h.blackScore == 5 || h.yellowScore == 5 {
+		goalsRecorded.inc()
+		h.timeline = append(h.timeline, "black")
+		h.notify(eventGoal, cm.Sub)
+		if h.blackScore == h.currentRules().GoalsToWin || h.yellowScore == h.currentRules().GoalsToWin {
 			endGame(h)
 			h.reset()
 			return "Game Over", true
@@ -479,7 +688,10 @@ func registerGoal(h *hub, cm *dcflMsg) (string, bool) {
 	} else if h.blackSide[1].Sub == cm.Sub {
 		h.blackSide[1].Goals++
 		h.blackScore++
-		if h.blackScore == 5 || h.yellowScore == 5 {
+		goalsRecorded.inc()
+		h.timeline = append(h.timeline, "black")
+		h.notify(eventGoal, cm.Sub)
+		if h.blackScore == h.currentRules().GoalsToWin || h.yellowScore == h.currentRules().GoalsToWin {
 			endGame(h)
 			h.reset()
 			return "Game Over", true
@@ -487,7 +699,10 @@ func registerGoal(h *hub, cm *dcflMsg) (string, bool) {
 	} else if h.yellowSide[0].Sub == cm.Sub {
 		h.yellowSide[0].Goals++
 		h.yellowScore++
-		if h.blackScore == 5 || h.yellowScore == 5 {
+		goalsRecorded.inc()
+		h.timeline = append(h.timeline, "yellow")
+		h.notify(eventGoal, cm.Sub)
+		if h.blackScore == h.currentRules().GoalsToWin || h.yellowScore == h.currentRules().GoalsToWin {
 			endGame(h)
 			h.reset()
 			return "Game Over", true
@@ -495,27 +710,43 @@ func registerGoal(h *hub, cm *dcflMsg) (string, bool) {
 	} else if h.yellowSide[1].Sub == cm.Sub {
 		h.yellowSide[1].Goals++
 		h.yellowScore++
-		if h.blackScore == 5 || h.yellowScore == 5 {
+		goalsRecorded.inc()
+		h.timeline = append(h.timeline, "yellow")
+		h.notify(eventGoal, cm.Sub)
+		if h.blackScore == h.currentRules().GoalsToWin || h.yellowScore == h.currentRules().GoalsToWin {
 			endGame(h)
 			h.reset()
 			return "Game Over", true
 		}
 	} else {
-		// Player not in game.
+		h.reject(cm, "not playing in this game")
 		return "", false
 	}
-	fmt.Println("Unlocking mutexes in goal")
-	fmt.Println("Done goal")
+	log.Info("goal", "black_score", h.blackScore, "yellow_score", h.yellowScore)
 	return "", false
 }
 
 // This function assumes and requires the caller to have the sideMx and scoreMx locks acquired.
 func unregisterGoal(h *hub, cm *dcflMsg) (string, bool) {
-	fmt.Println("Undoing goal")
-	// Must be in game to undo goal.
-	if !h.gameStarted || h.gameOver {
+	log := h.logFor(cm)
+	var scorer *player
+	for i := range h.blackSide {
+		if h.blackSide[i].Sub == cm.Sub {
+			scorer = &h.blackSide[i]
+		}
+		if h.yellowSide[i].Sub == cm.Sub {
+			scorer = &h.yellowSide[i]
+		}
+	}
+	if scorer == nil {
+		h.reject(cm, "not playing in this game")
+		return "", false
+	}
+	if scorer.Goals == 0 {
+		h.reject(cm, "no goal to undo")
 		return "", false
 	}
+
 	if h.blackSide[0].Sub == cm.Sub {
 		h.blackSide[0].Goals--
 		h.blackScore--
@@ -528,37 +759,59 @@ func unregisterGoal(h *hub, cm *dcflMsg) (string, bool) {
 	} else if h.yellowSide[1].Sub == cm.Sub {
 		h.yellowSide[1].Goals--
 		h.yellowScore--
-	} else {
-		// Player not in game.
-		return "", false
 	}
+	h.undoTimeline(h.sideOf(cm.Sub))
+	goalsUndone.inc()
+	log.Info("goal undone", "black_score", h.blackScore, "yellow_score", h.yellowScore)
 	return "", false
 }
 
-func getTeam(player1 string, player2 string) (team, error) {
-	var id int
-	var city string
-	var name string
-	err := db.QueryRow(
-		"SELECT id, city, name FROM public.team WHERE (player1 = $1 AND player2 = $2) OR (player1 = $2 AND player2 = $1)",
-		player1,
-		player2,
-	).Scan(&id, &city, &name)
-	if err == sql.ErrNoRows {
+// undoTimeline removes the last goal scored by side from the timeline.
+// This function assumes and requires the scoreMx lock to be acquired by the caller.
+func (h *hub) undoTimeline(side string) {
+	for i := len(h.timeline) - 1; i >= 0; i-- {
+		if h.timeline[i] == side {
+			h.timeline = append(h.timeline[:i], h.timeline[i+1:]...)
+			return
+		}
+	}
+}
+
+func getTeam(repo repository, player1 string, player2 string) (team, error) {
+	t, err := repo.FindTeam(player1, player2)
+	if err == errNotFound {
 		// If client sees that both players have confirmed, but team is empty,
 		// it must prompt user to register team.
 		return team{}, nil
-	} else if err != nil {
-		return team{}, err
 	}
+	return t, err
+}
+
+// The hubs processing requests, whose queues hubQueueDepth samples.
+var (
+	runningHubsMx sync.Mutex
+	runningHubs   = make(map[*hub]struct{})
+)
 
-	return team{ID: id, City: city, Name: name}, nil
+// queuedRequests counts the requests waiting in the queues of every running
+// hub.
+func queuedRequests() float64 {
+	runningHubsMx.Lock()
+	defer runningHubsMx.Unlock()
+	n := 0
+	for h := range runningHubs {
+		n += len(h.requests)
+	}
+	return float64(n)
 }
 
-func newHub() *hub {
+func newHub(table string, rules matchRules, repo repository) *hub {
 	h := &hub{
+		table:         table,
+		rules:         rules,
+		repo:          repo,
 		connectionsMx: sync.RWMutex{},
-		requests:      make(chan []byte, 1),
+		requests:      make(chan request, 1),
 		confirmations: make(chan string),
 		sideMx:        sync.RWMutex{},
 		blackTeam:     team{},
@@ -566,24 +819,66 @@ func newHub() *hub {
 		scoreMx:       sync.RWMutex{},
 		blackScore:    0,
 		yellowScore:   0,
-		gameStarted:   false,
-		gameOver:      false,
+		phase:         phaseOpen,
+		format:        formatDoubles,
 		connections:   make(map[*connection]struct{}),
+		watchers:      make(map[watcher]struct{}),
+		quit:          make(chan struct{}),
+		stopped:       make(chan struct{}),
 	}
 
+	runningHubsMx.Lock()
+	runningHubs[h] = struct{}{}
+	runningHubsMx.Unlock()
+
 	go func() {
+		atomic.StoreInt32(&h.processing, 1)
+		defer atomic.StoreInt32(&h.processing, 0)
 		for {
-			fmt.Println("polling...")
-			msg := <-h.requests
+			var req request
+			select {
+			case req = <-h.requests:
+			case <-h.quit:
+				runningHubsMx.Lock()
+				delete(runningHubs, h)
+				runningHubsMx.Unlock()
+				close(h.stopped)
+				return
+			}
+
+			var broadcast string
+			var reset bool
+
+			if req.leave {
+				h.sideMx.Lock()
+				broadcast, reset = h.disconnect(req.c)
+				h.sideMx.Unlock()
+				h.confirmations <- "match state"
+				if reset {
+					h.confirmations <- broadcast
+				}
+				continue
+			}
 
 			cm := &dcflMsg{}
-			err := json.Unmarshal(msg, cm)
+			err := json.Unmarshal(req.msg, cm)
 			if err != nil {
+				logger.Warn("malformed request", "table", h.table, "conn", req.c.id, "sub", req.c.sub, "err", err)
 				continue
 			}
+			cm.conn = req.c
+			h.logFor(cm).Debug("request received", "action", cm.Action, "side", cm.Side)
 
-			var broadcast string
-			var reset bool
+			h.sideMx.Lock()
+			if cm.Sub != req.c.sub && !h.hosts(req.c.sub, cm.Sub) {
+				h.reject(cm, "signed in as another player")
+			} else if reason := h.checkAction(cm.Action); reason != "" {
+				h.reject(cm, reason)
+			}
+			h.sideMx.Unlock()
+			if cm.rejected {
+				continue
+			}
 
 			switch cm.Action {
 			case "register game":
@@ -598,6 +893,30 @@ func newHub() *hub {
 				h.sideMx.Lock()
 				broadcast, reset = confirmPlayer(h, cm)
 				h.sideMx.Unlock()
+			case "set format":
+				h.sideMx.Lock()
+				broadcast, reset = setFormat(h, cm)
+				h.sideMx.Unlock()
+			case "start rotation":
+				h.sideMx.Lock()
+				broadcast, reset = startRotation(h, cm)
+				h.sideMx.Unlock()
+			case "join rotation":
+				h.sideMx.Lock()
+				broadcast, reset = joinRotation(h, cm)
+				h.sideMx.Unlock()
+			case "leave rotation":
+				h.sideMx.Lock()
+				broadcast, reset = leaveRotation(h, cm)
+				h.sideMx.Unlock()
+			case "end rotation":
+				h.sideMx.Lock()
+				broadcast, reset = endRotation(h, cm)
+				h.sideMx.Unlock()
+			case "add guest":
+				h.sideMx.Lock()
+				broadcast, reset = addGuest(h, cm)
+				h.sideMx.Unlock()
 			case "register team":
 				h.sideMx.Lock()
 				broadcast, reset = registerTeam(h, cm)
@@ -614,6 +933,17 @@ func newHub() *hub {
 				broadcast, reset = unregisterGoal(h, cm)
 				h.sideMx.Unlock()
 				h.scoreMx.Unlock()
+			case "pause":
+				h.sideMx.Lock()
+				broadcast, reset = pauseGame(h, cm)
+				h.sideMx.Unlock()
+			case "resume":
+				h.sideMx.Lock()
+				broadcast, reset = resumeGame(h, cm)
+				h.sideMx.Unlock()
+			}
+			if cm.rejected {
+				continue
 			}
 			h.confirmations <- "match state"
 			if reset {
@@ -623,34 +953,32 @@ func newHub() *hub {
 	}()
 
 	go func() {
+		atomic.StoreInt32(&h.broadcasting, 1)
+		defer atomic.StoreInt32(&h.broadcasting, 0)
 		for {
 			var msg []byte
+			var event string
 			broadcast := <-h.confirmations
-			fmt.Println("Sending broadcast")
+			start := time.Now()
 
 			h.sideMx.RLock()
 			h.connectionsMx.Lock()
 			switch broadcast {
 			case "match state":
-				state := matchState{
-					BlackPlayer1:  h.blackSide[0],
-					BlackPlayer2:  h.blackSide[1],
-					YellowPlayer1: h.yellowSide[0],
-					YellowPlayer2: h.yellowSide[1],
-					BlackTeam:     h.blackTeam,
-					YellowTeam:    h.yellowTeam,
-					BlackScore:    h.blackScore,
-					YellowScore:   h.yellowScore,
-					GameStarted:   h.gameStarted,
-					GameOver:      h.gameOver,
-				}
-				stateJSON, _ := json.Marshal(state)
+				stateJSON, _ := json.Marshal(h.state())
 				msg = stateJSON
+				event = "state"
 			default:
+				event = "message"
 				type message struct {
 					Message string `json:"message"`
+					// Badges earned in the game, with "Game Over".
+					Badges []badgeAward `json:"badges,omitempty"`
 				}
 				state := message{Message: broadcast}
+				if broadcast == "Game Over" {
+					state.Badges = h.badges
+				}
 				stateJSON, _ := json.Marshal(state)
 				msg = stateJSON
 			}
@@ -660,36 +988,140 @@ func newHub() *hub {
 				// stop trying to send to this connection after trying for 1 second.
 				// if we have to stop, it means that a reader died so remove the connection also.
 				case <-time.After(1 * time.Second):
+					droppedConnections.inc()
+					c.log().Warn("send timed out, dropping connection")
 					h.removeConnection(c)
 				}
 			}
+			h.notifyWatchers(event, msg)
+			broadcastLatency.since("", start)
+			logger.Debug("broadcast sent", "table", h.table, "broadcast", broadcast, "connections", len(h.connections))
 			h.sideMx.RUnlock()
 			h.connectionsMx.Unlock()
-			fmt.Println("Confirmations sent successfully.")
 		}
 	}()
 
 	return h
 }
 
+// state returns the current match state. It assumes and requires the caller to
+// have acquired the sideMx lock.
+func (h *hub) state() matchState {
+	state := matchState{
+		BlackPlayer1:  h.blackSide[0],
+		BlackPlayer2:  h.blackSide[1],
+		YellowPlayer1: h.yellowSide[0],
+		YellowPlayer2: h.yellowSide[1],
+		BlackTeam:     h.blackTeam,
+		YellowTeam:    h.yellowTeam,
+		BlackScore:    h.blackScore,
+		YellowScore:   h.yellowScore,
+		GameStarted:   h.gameStarted(),
+		GameOver:      h.phase == phaseFinished,
+		Phase:         h.phase,
+		Format:        h.format,
+		StartedAt:     h.startedAt,
+		PausedAt:      h.pausedAt,
+		PausedMillis:  h.pausedMillis,
+	}
+	if h.rotation != nil {
+		state.RotationID = h.rotation.ID
+	}
+	return state
+}
+
+// running reports whether both hub goroutines are alive.
+func (h *hub) running() bool {
+	return atomic.LoadInt32(&h.processing) == 1 && atomic.LoadInt32(&h.broadcasting) == 1
+}
+
 func (h *hub) addConnection(conn *connection) {
 	h.connectionsMx.Lock()
 	h.connections[conn] = struct{}{}
 	h.connectionsMx.Unlock()
+	connectedClients.inc()
 	h.confirmations <- "match state"
 }
 
-// This function assumes and requires both the sideMx and connectionsMx locks to be
-// acquired by the caller.
+// This function assumes and requires the connectionsMx lock to be acquired by the caller.
 func (h *hub) removeConnection(conn *connection) {
-	fmt.Println("remove conn called")
-	fmt.Println("removing...")
 	if _, ok := h.connections[conn]; ok {
-		blackMsg := dcflMsg{Sub: conn.sub, Side: "black"}
-		yellowMsg := dcflMsg{Sub: conn.sub, Side: "yellow"}
-		unregisterGame(h, &blackMsg)
-		unregisterGame(h, &yellowMsg)
+		conn.log().Info("removing connection")
 		delete(h.connections, conn)
 		close(conn.send)
+		connectedClients.dec()
+	}
+}
+
+// signOut closes the connections opened with a revoked session, or with any
+// session of the player if session is empty.
+func (h *hub) signOut(sub string, session string) {
+	h.connectionsMx.RLock()
+	var closing []*connection
+	for c := range h.connections {
+		if c.sub == sub && (session == "" || c.session == session) {
+			closing = append(closing, c)
+		}
 	}
+	h.connectionsMx.RUnlock()
+	// Closing makes each reader stop, which removes the connection.
+	for _, c := range closing {
+		c.close(websocket.ClosePolicyViolation, "signed out")
+	}
+}
+
+// announce broadcasts a message to every connection.
+func (h *hub) announce(message string) {
+	select {
+	case h.confirmations <- message:
+	case <-h.quit:
+	}
+}
+
+// leave asks the hub to remove a connection whose reader has stopped.
+func (h *hub) leave(conn *connection) {
+	select {
+	case h.requests <- request{c: conn, leave: true}:
+	case <-h.quit:
+	}
+}
+
+// disconnect unseats the player behind a closed connection and removes it.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) disconnect(conn *connection) (string, bool) {
+	var broadcast string
+	var reset bool
+	// Players keep their seats across a restart so the match can resume.
+	if atomic.LoadInt32(&h.closing) == 0 {
+		// Guests leave along with the player who added them.
+		subs := []string{conn.sub}
+		for _, p := range append(h.blackSide[:], h.yellowSide[:]...) {
+			if h.hosts(conn.sub, p.Sub) {
+				subs = append(subs, p.Sub)
+			}
+		}
+		for _, sub := range subs {
+			side := h.sideOf(sub)
+			if side == "" {
+				continue
+			}
+			msg := dcflMsg{Sub: sub, Side: side, conn: conn}
+			if b, r := unregisterGame(h, &msg); r {
+				broadcast, reset = b, r
+			}
+		}
+		// Players who leave the table leave its rotation too.
+		if h.rotation != nil {
+			for _, sub := range subs {
+				h.dropFromRotation(sub, conn)
+			}
+			if b, r := h.settleRotation(); r {
+				broadcast, reset = b, r
+			}
+		}
+	}
+	h.connectionsMx.Lock()
+	h.removeConnection(conn)
+	h.connectionsMx.Unlock()
+	return broadcast, reset
 }
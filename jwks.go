@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How often the key set is refreshed, and how soon a failed fetch is retried.
+const keySetRefreshInterval = 1 * time.Hour
+const keySetRetryInterval = 30 * time.Second
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// keySet holds the public keys an identity provider signs its tokens with.
+type keySet struct {
+	url string
+
+	mx       sync.RWMutex
+	keys     map[string]*rsa.PublicKey
+	loadedAt time.Time
+	err      error
+}
+
+func newKeySet(url string) *keySet {
+	return &keySet{url: url, keys: make(map[string]*rsa.PublicKey)}
+}
+
+// refreshLoop fetches the key set and keeps it up to date. It never returns.
+func (ks *keySet) refreshLoop() {
+	for {
+		err := ks.refresh()
+		if err != nil {
+			logger.Warn("error fetching key set", "url", ks.url, "err", err)
+			time.Sleep(keySetRetryInterval)
+			continue
+		}
+		time.Sleep(keySetRefreshInterval)
+	}
+}
+
+func (ks *keySet) refresh() error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(ks.url)
+	if err != nil {
+		ks.setError(err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected status %d", resp.StatusCode)
+		ks.setError(err)
+		return err
+	}
+
+	var body struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		ks.setError(err)
+		return err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range body.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		key, err := parseRSAKey(k)
+		if err != nil {
+			logger.Warn("skipping malformed key", "url", ks.url, "kid", k.Kid, "err", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		err := fmt.Errorf("no usable keys in key set")
+		ks.setError(err)
+		return err
+	}
+
+	ks.mx.Lock()
+	ks.keys = keys
+	ks.loadedAt = time.Now()
+	ks.err = nil
+	ks.mx.Unlock()
+	logger.Debug("key set loaded", "url", ks.url, "keys", len(keys))
+	return nil
+}
+
+func (ks *keySet) setError(err error) {
+	ks.mx.Lock()
+	ks.err = err
+	ks.mx.Unlock()
+}
+
+// loaded reports when the key set was last fetched successfully, and the most
+// recent fetch error if any. The time is zero if it has never been fetched.
+func (ks *keySet) loaded() (time.Time, error) {
+	ks.mx.RLock()
+	defer ks.mx.RUnlock()
+	return ks.loadedAt, ks.err
+}
+
+// key returns the key with the given id, if it is in the set.
+func (ks *keySet) key(kid string) (*rsa.PublicKey, bool) {
+	ks.mx.RLock()
+	defer ks.mx.RUnlock()
+	k, ok := ks.keys[kid]
+	return k, ok
+}
+
+func parseRSAKey(k jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("exponent too large")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// originAllowed reports whether a browser at origin may use the server. An
+// allowed entry of * matches any origin, and an entry may contain one *
+// matching any part of the origin, as in https://*.example.com. Requests
+// without an Origin header do not come from browsers and are allowed.
+func originAllowed(allowed []string, origin string) bool {
+	if origin == "" {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if a == "*" || a == origin {
+			return true
+		}
+		i := strings.Index(a, "*")
+		if i >= 0 && len(origin) > len(a)-1 && strings.HasPrefix(origin, a[:i]) && strings.HasSuffix(origin, a[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimiter is a token bucket allowing rate actions per second on average
+// and up to burst at once.
+type rateLimiter struct {
+	mx     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow takes a token if one is available.
+func (l *rateLimiter) allow() bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// playerLimiters hands out one rateLimiter per player, shared by all of the
+// player's connections.
+type playerLimiters struct {
+	mx       sync.Mutex
+	rate     float64
+	burst    int
+	limiters map[string]*rateLimiter
+}
+
+func newPlayerLimiters(rate float64, burst int) *playerLimiters {
+	return &playerLimiters{rate: rate, burst: burst, limiters: make(map[string]*rateLimiter)}
+}
+
+func (pl *playerLimiters) get(sub string) *rateLimiter {
+	pl.mx.Lock()
+	defer pl.mx.Unlock()
+	l, ok := pl.limiters[sub]
+	if !ok {
+		l = newRateLimiter(pl.rate, pl.burst)
+		pl.limiters[sub] = l
+	}
+	return l
+}
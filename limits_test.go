@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	allowed := []string{"https://dcfl.example", "https://*.dcfl.example"}
+	for origin, want := range map[string]bool{
+		"":                           true,
+		"https://dcfl.example":       true,
+		"HTTPS://DCFL.example":       true,
+		"https://table.dcfl.example": true,
+		"https://evil.example":       false,
+		"http://dcfl.example":        false,
+		"https://dcfl.example.evil":  false,
+		"https://.dcfl.example":      false,
+	} {
+		if got := originAllowed(allowed, origin); got != want {
+			t.Errorf("%q: expected %v, got %v", origin, want, got)
+		}
+	}
+	if !originAllowed([]string{"*"}, "https://anywhere.example") {
+		t.Error("expected * to allow any origin")
+	}
+}
+
+// dial opens a WebSocket for sub with the given Origin header.
+func (ts *testServer) dial(sub string, origin string) (*websocket.Conn, *http.Response, error) {
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	url := "ws" + strings.TrimPrefix(ts.srv.URL, "http") + "/register/" + sub + "?token=" + ts.sessions[sub].Token
+	return websocket.DefaultDialer.Dial(url, header)
+}
+
+// expectClose reads from ws until the server closes it, and checks the close
+// code.
+func expectClose(t *testing.T, ws *websocket.Conn, code int) {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(broadcastTimeout))
+	for {
+		_, _, err := ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, code) {
+			t.Fatalf("expected close code %d, got %v", code, err)
+		}
+		return
+	}
+}
+
+func TestOriginAllowlist(t *testing.T) {
+	ts := newConfiguredTestServer(t, func(c *config) {
+		c.CORS.AllowedOrigins = []string{"https://dcfl.example"}
+	}, "1")
+
+	_, resp, err := ts.dial("1", "https://evil.example")
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a WebSocket from another origin to be refused, got %v", err)
+	}
+	ws, _, err := ts.dial("1", "https://dcfl.example")
+	if err != nil {
+		t.Fatalf("expected an allowed origin to connect: %v", err)
+	}
+	ws.Close()
+
+	for origin, want := range map[string]string{"https://dcfl.example": "https://dcfl.example", "https://evil.example": ""} {
+		req, _ := http.NewRequest("GET", ts.srv.URL+"/healthz", nil)
+		req.Header.Set("Origin", origin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("%s: expected CORS origin %q, got %q", origin, want, got)
+		}
+	}
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	ts := newConfiguredTestServer(t, func(c *config) {
+		c.WS.MaxMessageSize = 64
+	}, "1")
+	ws, _, err := ts.dial("1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"action":"pause","name":"`+strings.Repeat("x", 100)+`"}`))
+	expectClose(t, ws, websocket.CloseMessageTooBig)
+}
+
+func TestConnectionRateLimit(t *testing.T) {
+	ts := newConfiguredTestServer(t, func(c *config) {
+		c.WS.ConnectionRate = 0.01
+		c.WS.ConnectionBurst = 3
+	}, "1", "2")
+	ws, _, err := ts.dial("1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	for i := 0; i < 4; i++ {
+		ws.WriteJSON(dcflMsg{Action: "pause", Sub: "1"})
+	}
+	expectClose(t, ws, websocket.ClosePolicyViolation)
+
+	// The hub is not starved: other players are still served.
+	ts.connect("2")
+}
+
+func TestPlayerRateLimit(t *testing.T) {
+	ts := newConfiguredTestServer(t, func(c *config) {
+		c.WS.PlayerRate = 0.01
+		c.WS.PlayerBurst = 2
+	}, "1")
+	first, _, err := ts.dial("1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, _, err := ts.dial("1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	first.WriteJSON(dcflMsg{Action: "pause", Sub: "1"})
+	first.WriteJSON(dcflMsg{Action: "pause", Sub: "1"})
+	// The first connection's messages use up the player's allowance.
+	time.Sleep(50 * time.Millisecond)
+	second.WriteJSON(dcflMsg{Action: "pause", Sub: "1"})
+	expectClose(t, second, websocket.ClosePolicyViolation)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// logLevel can be changed while the server is running through /loglevel.
+var logLevel = new(slog.LevelVar)
+
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
+
+// initLogging configures the global logger. Format is either "json" (the
+// default) or "logfmt".
+func initLogging(level string, format string) {
+	logger = newLogger(os.Stdout, level, format)
+}
+
+// newLogger returns a logger writing to w in format and sets the log level.
+func newLogger(w io.Writer, level string, format string) *slog.Logger {
+	var l *slog.Logger
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch strings.ToLower(format) {
+	case "", "json":
+		l = slog.New(slog.NewJSONHandler(w, opts))
+	case "logfmt", "text":
+		l = slog.New(slog.NewTextHandler(w, opts))
+	default:
+		l = slog.New(slog.NewJSONHandler(w, opts))
+		l.Warn("unknown log format, defaulting to json", "format", format)
+	}
+
+	if level != "" {
+		var lvl slog.Level
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			l.Warn("unknown log level, defaulting to info", "level", level)
+		} else {
+			logLevel.Set(lvl)
+		}
+	}
+	return l
+}
+
+type logLevelMsg struct {
+	Level string `json:"level"`
+}
+
+// logLevelHandler reports the current log level on GET and lets admins change
+// it on PUT.
+type logLevelHandler struct {
+	auth authenticateHandler
+}
+
+func (lh logLevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		token, ok := lh.auth.admin(w, r)
+		if !ok {
+			return
+		}
+		msg := &logLevelMsg{}
+		err := json.NewDecoder(r.Body).Decode(msg)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(msg.Level)); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		logLevel.Set(l)
+		logger.Info("log level changed", "level", l.String(), "sub", token.Sub)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevelMsg{Level: logLevel.Level().String()})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLogLevel(t *testing.T) {
+	ts := newTestServer(t, "1", "2")
+	defer logLevel.Set(logLevel.Level())
+
+	var msg logLevelMsg
+	if code := ts.get("/loglevel", &msg); code != http.StatusOK || msg.Level != logLevel.Level().String() {
+		t.Fatalf("expected the current level, got %d %+v", code, msg)
+	}
+	for _, c := range []struct {
+		sub    string
+		body   string
+		status int
+	}{
+		{"", `{"level":"debug"}`, http.StatusUnauthorized},
+		{"2", `{"level":"debug"}`, http.StatusForbidden},
+		{"1", `{"level":"loud"}`, http.StatusBadRequest},
+		{"1", `not json`, http.StatusBadRequest},
+	} {
+		code, _ := ts.send(c.sub, "PUT", "/loglevel", "application/json", strings.NewReader(c.body), nil)
+		if code != c.status {
+			t.Errorf("%q %s: expected %d, got %d", c.sub, c.body, c.status, code)
+		}
+	}
+	if logLevel.Level() == slog.LevelDebug {
+		t.Fatal("a refused request must not change the level")
+	}
+
+	msg = logLevelMsg{}
+	code, _ := ts.send("1", "PUT", "/loglevel", "application/json", strings.NewReader(`{"level":"debug"}`), &msg)
+	if code != http.StatusOK || msg.Level != "DEBUG" || logLevel.Level() != slog.LevelDebug {
+		t.Fatalf("expected the level to change, got %d %+v", code, msg)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	defer logLevel.Set(logLevel.Level())
+	logLevel.Set(slog.LevelInfo)
+
+	for _, c := range []struct {
+		level  string
+		format string
+		want   slog.Level
+		output string
+	}{
+		{"", "", slog.LevelInfo, `{"time":`},
+		{"warn", "json", slog.LevelWarn, `{"time":`},
+		{"info", "logfmt", slog.LevelInfo, "time="},
+		{"debug", "TEXT", slog.LevelDebug, "time="},
+		{"loud", "json", slog.LevelDebug, `"msg":"unknown log level, defaulting to info","level":"loud"`},
+		{"error", "xml", slog.LevelError, `"msg":"unknown log format, defaulting to json","format":"xml"`},
+	} {
+		var out bytes.Buffer
+		l := newLogger(&out, c.level, c.format)
+		l.Error("hello")
+		if logLevel.Level() != c.want {
+			t.Errorf("%q: expected level %s, got %s", c.level, c.want, logLevel.Level())
+		}
+		if !strings.Contains(out.String(), c.output) {
+			t.Errorf("%q %q: expected %s in %q", c.level, c.format, c.output, out.String())
+		}
+	}
+}
@@ -1,32 +1,18 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 	"github.com/rs/cors"
-	"github.com/rubenv/sql-migrate"
 )
 
-const devDbHost = "DCFL_DEV_PG_HOST"
-const devDbPort = "DCFL_DEV_PG_PORT"
-const devDbUser = "DCFL_DEV_PG_USER"
-const devDbName = "DCFL_DEV_PG_NAME"
-const dbURL = "DATABASE_URL"
-const devDbDriver = "postgres"
-const migrationsDirectory = "migrations/postgres"
-const tokeninfoEndpoint = "https://www.googleapis.com/oauth2/v3/tokeninfo?id_token="
-
-var db *sql.DB
-
 type validatedID struct {
 	Iss        string `json:"iss"`
 	Sub        string `json:"sub"`
@@ -46,111 +32,266 @@ type Request struct {
 	r *http.Request
 }
 
-func IndexHandler(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("Hello World!"))
+// authenticateHandler signs a player in with an ID token from the identity
+// provider and starts a session. Every other route identifies the player by
+// the session token.
+type authenticateHandler struct {
+	auth     authConfig
+	verifier identityVerifier
+	sessions *sessionIssuer
+	repo     repository
 }
 
-func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
-	resp, err := http.Get(tokeninfoEndpoint + r.Header.Get("Authorization"))
+func (ah authenticateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, err := ah.verifier.Verify(bearer(r.Header.Get("Authorization")))
 	if err != nil {
+		authFailures.inc(failureReason(err))
+		logger.Info("rejected token", "remote", r.RemoteAddr, "err", err)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	if !ah.validAudience(token.Aud) {
+		authFailures.inc("wrong_audience")
+		logger.Info("rejected token for another audience", "aud", token.Aud, "remote", r.RemoteAddr)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	token := &validatedID{}
-	err = json.Unmarshal(body, token)
+	// The name and picture follow the identity provider on every sign-in.
+	err = ah.repo.SyncPlayer(playerRecord{ID: token.Sub, Name: token.Name, Picture: token.Picture})
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	if *token == (validatedID{}) {
-		w.WriteHeader(http.StatusUnauthorized)
+		logger.Error("error saving player", "sub", token.Sub, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-
-	var count int
-	err = db.QueryRow("SELECT COUNT(*) FROM public.player WHERE id = $1", token.Sub).Scan(&count)
+	tokens, err := ah.sessions.issue(token.Sub, r.UserAgent())
 	if err != nil {
+		logger.Error("error starting session", "sub", token.Sub, "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if count == 0 {
-		_, err := db.Query(
-			"INSERT INTO public.player(id, name, picture) VALUES ($1, $2, $3)",
-			token.Sub,
-			token.Name,
-			token.Picture)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	logger.Info("player authenticated", "sub", token.Sub, "session", tokens.SessionID)
+	writeJSON(w, http.StatusOK, struct {
+		*validatedID
+		sessionTokens
+	}{token, tokens})
+}
+
+// identify verifies the session token in the Authorization header. It
+// responds with 401 and returns false if the token is rejected.
+func (ah authenticateHandler) identify(w http.ResponseWriter, r *http.Request) (*sessionClaims, bool) {
+	token, err := ah.sessions.verify(bearer(r.Header.Get("Authorization")))
+	if err != nil {
+		authFailures.inc(failureReason(err))
+		logger.Info("rejected session", "remote", r.RemoteAddr, "err", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
 	}
+	return token, true
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(token)
+// admin identifies the caller and checks that they are an admin. It responds
+// with 401 or 403 and returns false otherwise.
+func (ah authenticateHandler) admin(w http.ResponseWriter, r *http.Request) (*sessionClaims, bool) {
+	token, ok := ah.identify(w, r)
+	if !ok {
+		return nil, false
+	}
+	if ah.isAdmin(token.Sub) {
+		return token, true
+	}
+	logger.Info("refused admin request", "sub", token.Sub, "path", r.URL.Path)
+	w.WriteHeader(http.StatusForbidden)
+	return nil, false
 }
 
-func initDB() {
-	var dbInfo string
-	if env := os.Getenv("ENV"); env == "DEV" {
-		err := godotenv.Load()
-		if err != nil {
-			log.Fatal("Error loading .env file")
+// isAdmin reports whether sub is one of the configured admins.
+func (ah authenticateHandler) isAdmin(sub string) bool {
+	for _, admin := range ah.auth.Admins {
+		if admin == sub {
+			return true
 		}
-
-		dbInfo = fmt.Sprintf("host=%s port=%s user=%s "+"dbname=%s sslmode=disable",
-			os.Getenv(devDbHost),
-			os.Getenv(devDbPort),
-			os.Getenv(devDbUser),
-			os.Getenv(devDbName),
-		)
-
-	} else if env == "PROD" {
-		dbInfo = os.Getenv(dbURL)
-	} else {
-		log.Fatal("$ENV must be set")
 	}
+	return false
+}
 
-	var err error
-	db, err = sql.Open(devDbDriver, dbInfo)
-	if err != nil {
-		log.Fatalf("Error opening database: %q", err)
+// validAudience reports whether a token issued to aud is meant for us.
+func (ah authenticateHandler) validAudience(aud string) bool {
+	if len(ah.auth.Audience) == 0 {
+		return true
 	}
+	for _, a := range ah.auth.Audience {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
 
-	migrations := &migrate.FileMigrationSource{
-		Dir: migrationsDirectory,
+// openRepository returns the repository selected by the configuration.
+func openRepository(c *config) (repository, error) {
+	if c.Storage == "memory" {
+		logger.Warn("using in-memory storage, nothing will be persisted")
+		return newMemoryRepository(), nil
 	}
+	return newPostgresRepository(c.DB)
+}
 
-	applies, err := migrate.Exec(db, devDbDriver, migrations, migrate.Up)
-	if err != nil {
-		log.Fatalf("Exec: %v", err)
+// requestError is a request that cannot be carried out, along with the HTTP
+// status describing why.
+type requestError struct {
+	status int
+	msg    string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+// writeRequestError responds with the status of a requestError, or 500 for
+// any other error.
+func writeRequestError(w http.ResponseWriter, r *http.Request, err error) {
+	if ce, ok := err.(*requestError); ok {
+		http.Error(w, ce.msg, ce.status)
+		return
 	}
+	logger.Error("error handling request", "path", r.URL.Path, "err", err)
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, status int, c any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(c)
+}
 
-	fmt.Printf("Applied %d migrations!\n", applies)
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
 }
 
-func main() {
-	initDB()
-	defer db.Close()
+// server holds the dependencies shared by the HTTP handlers.
+type server struct {
+	cfg      *config
+	repo     repository
+	hub      *hub
+	keys     *keySet
+	verifier identityVerifier
+	sessions *sessionIssuer
+	links    *chatLinks
+}
 
-	h := newHub()
+func (s *server) routes() http.Handler {
+	auth := authenticateHandler{auth: s.cfg.Auth, verifier: s.verifier, sessions: s.sessions, repo: s.repo}
 	router := mux.NewRouter()
-	router.HandleFunc("/", IndexHandler).Methods("GET")
-	router.HandleFunc("/authenticate", AuthenticateHandler).Methods("POST")
-	router.Handle("/register/{sub:[0-9]+}", wsHandler{h: h})
+	router.Handle("/", scoreboardHandler{h: s.hub, repo: s.repo}).Methods("GET")
+	router.Handle("/authenticate", auth).Methods("POST")
+	router.Handle("/sessions", sessionsHandler{auth: auth, repo: s.repo}).Methods("GET")
+	router.Handle("/sessions/refresh", refreshHandler{sessions: s.sessions}).Methods("POST")
+	router.Handle("/sessions/{id}", sessionRevokeHandler{auth: auth, h: s.hub, repo: s.repo}).Methods("DELETE")
+	router.Handle("/logout", logoutHandler{auth: auth, h: s.hub, repo: s.repo}).Methods("POST")
+	router.Handle("/register/{sub}", newWSHandler(s.hub, s.cfg, s.sessions))
+	tables := map[string]*hub{s.hub.table: s.hub}
+	router.Handle("/tables/{id}/state", stateHandler{tables: tables}).Methods("GET")
+	router.Handle("/tables/{id}/events", eventsHandler{tables: tables}).Methods("GET")
+	router.Handle("/metrics", metrics).Methods("GET")
+	router.Handle("/loglevel", logLevelHandler{auth: auth}).Methods("GET", "PUT")
+	router.Handle("/healthz", healthHandler{h: s.hub}).Methods("GET")
+	router.Handle("/readyz", readyHandler{keys: s.keys, repo: s.repo}).Methods("GET")
+	router.Handle("/challenges", challengesHandler{auth: auth, h: s.hub, repo: s.repo}).Methods("GET", "POST")
+	router.Handle("/challenges/{id:[0-9]+}", challengeHandler{repo: s.repo}).Methods("GET")
+	router.Handle("/challenges/{id:[0-9]+}/accept", challengeResponseHandler{auth: auth, h: s.hub, repo: s.repo, accept: true}).Methods("POST")
+	router.Handle("/challenges/{id:[0-9]+}/decline", challengeResponseHandler{auth: auth, h: s.hub, repo: s.repo}).Methods("POST")
+	router.Handle("/rotations/{id:[0-9]+}", rotationHandler{h: s.hub, repo: s.repo}).Methods("GET")
+	router.Handle("/games/manual", manualResultsHandler{auth: auth, h: s.hub, repo: s.repo}).Methods("GET", "POST")
+	router.Handle("/games/manual/{id:[0-9]+}", manualResultHandler{auth: auth, repo: s.repo}).Methods("GET")
+	router.Handle("/games/manual/{id:[0-9]+}/confirm", manualResponseHandler{auth: auth, h: s.hub, repo: s.repo, confirm: true}).Methods("POST")
+	router.Handle("/games/manual/{id:[0-9]+}/reject", manualResponseHandler{auth: auth, h: s.hub, repo: s.repo}).Methods("POST")
+	router.Handle("/players/me", profileHandler{auth: auth, h: s.hub, repo: s.repo}).Methods("GET", "PATCH")
+	router.Handle("/players/me/guests", guestsHandler{auth: auth, repo: s.repo}).Methods("GET")
+	router.Handle("/players/me/claim", claimHandler{auth: auth, h: s.hub, repo: s.repo}).Methods("POST")
+	router.Handle("/players/{sub}/badges", badgesHandler{repo: s.repo}).Methods("GET")
+	router.Handle("/head-to-head", headToHeadHandler{repo: s.repo}).Methods("GET")
+	router.Handle("/webhooks/deliveries", webhookDeliveriesHandler{auth: auth, repo: s.repo}).Methods("GET")
+	router.Handle("/export", exportHandler{auth: auth, repo: s.repo}).Methods("GET")
+	router.Handle("/import", importHandler{auth: auth, repo: s.repo}).Methods("POST")
+	if s.cfg.Chat.SigningSecret != "" {
+		router.Handle("/chat/command", chatHandler{secret: s.cfg.Chat.SigningSecret, h: s.hub, repo: s.repo, links: s.links}).Methods("POST")
+		router.Handle("/chat/link", chatLinkHandler{auth: auth, links: s.links, repo: s.repo}).Methods("POST")
+	}
 
-	handler := cors.New(cors.Options{
+	return cors.New(cors.Options{
+		AllowedOrigins: s.cfg.CORS.AllowedOrigins,
 		AllowedHeaders: []string{"*"},
 	}).Handler(router)
+}
+
+func main() {
+	cfg, errs := loadConfig(os.Args[1:])
+	if len(errs) != 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(2)
+	}
+
+	initLogging(cfg.Log.Level, cfg.Log.Format)
+	repo, err := openRepository(cfg)
+	if err != nil {
+		fatal("error opening repository", "err", err)
+	}
+
+	verifier, keys, err := newIdentityVerifier(cfg.Auth)
+	if err != nil {
+		fatal("error setting up identity provider", "err", err)
+	}
+	if keys != nil {
+		go keys.refreshLoop()
+	}
+	if cfg.Auth.Provider == "dev" {
+		logger.Warn("signing players in with the dev identity provider", "users", cfg.Auth.DevUsers)
+	}
+
+	h := newHub("default", cfg.Match, repo)
+	h.webhooks = newWebhookDispatcher(cfg.Webhooks, repo)
+	err = h.restoreState()
+	if err != nil {
+		logger.Error("error restoring match state", "err", err)
+	}
+
+	s := &server{
+		cfg:      cfg,
+		repo:     repo,
+		hub:      h,
+		keys:     keys,
+		verifier: verifier,
+		sessions: newSessionIssuer(cfg.Auth, repo),
+		links:    newChatLinks(),
+	}
+
+	srv := &http.Server{Addr: cfg.Listen.Addr, Handler: s.routes()}
+	go func() {
+		logger.Info("listening", "addr", srv.Addr, "tls", cfg.Listen.TLSCert != "")
+		var err error
+		if cfg.Listen.TLSCert != "" {
+			err = srv.ListenAndServeTLS(cfg.Listen.TLSCert, cfg.Listen.TLSKey)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			fatal("server stopped", "err", err)
+		}
+	}()
 
-	log.Fatal(http.ListenAndServe(fmt.Sprint(":", os.Getenv("PORT")), handler))
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	logger.Info("shutting down", "signal", sig.String(), "timeout", cfg.Shutdown.String())
+	err = gracefulShutdown(srv, h, repo, cfg.Shutdown)
+	if err != nil {
+		fatal("error shutting down", "err", err)
+	}
+	logger.Info("shutdown complete")
 }
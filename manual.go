@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type manualStatus string
+
+const (
+	manualPending   manualStatus = "pending"
+	manualConfirmed manualStatus = "confirmed"
+	manualRejected  manualStatus = "rejected"
+)
+
+// How far ahead of the server's clock a result may say it was played.
+const manualClockSkew = 5 * time.Minute
+
+// manualResult is a game played away from the server, entered by one of its
+// players. It counts once a player of the opposing team confirms it.
+type manualResult struct {
+	ID          int  `json:"id"`
+	BlackTeam   team `json:"black_team"`
+	YellowTeam  team `json:"yellow_team"`
+	BlackScore  int  `json:"black_score"`
+	YellowScore int  `json:"yellow_score"`
+	// Goals scored by each player.
+	Goals map[string]int `json:"goals"`
+	// Roughly when the game was played, in milliseconds.
+	PlayedTimestamp    int64        `json:"played_timestamp"`
+	SubmittedBy        string       `json:"submitted_by"`
+	Status             manualStatus `json:"status"`
+	RespondedBy        string       `json:"responded_by,omitempty"`
+	CreatedTimestamp   int64        `json:"created_timestamp"`
+	RespondedTimestamp int64        `json:"responded_timestamp,omitempty"`
+	GameID             int          `json:"game_id,omitempty"`
+}
+
+// game returns the result as a finished game with the players of both teams.
+func (m manualResult) game(black teamRecord, yellow teamRecord) finishedGame {
+	return finishedGame{
+		format:      black.format(),
+		blackSide:   black.side(m.Goals),
+		yellowSide:  yellow.side(m.Goals),
+		blackScore:  m.BlackScore,
+		yellowScore: m.YellowScore,
+	}
+}
+
+// manualTeams loads both teams of a result.
+func manualTeams(repo repository, m manualResult) (teamRecord, teamRecord, error) {
+	black, err := repo.GetTeam(m.BlackTeam.ID)
+	if err == errNotFound {
+		return black, teamRecord{}, &requestError{http.StatusNotFound, "unknown black team"}
+	} else if err != nil {
+		return black, teamRecord{}, err
+	}
+	yellow, err := repo.GetTeam(m.YellowTeam.ID)
+	if err == errNotFound {
+		return black, yellow, &requestError{http.StatusNotFound, "unknown yellow team"}
+	}
+	return black, yellow, err
+}
+
+// submitManualResult records a result entered by one of its players, to be
+// confirmed by the other team. It is validated as the end of a match would be.
+func submitManualResult(repo repository, rules matchRules, submitter string, m manualResult) (manualResult, error) {
+	black, yellow, err := manualTeams(repo, m)
+	if err != nil {
+		return manualResult{}, err
+	}
+	if black.has(yellow.Player1) || black.has(yellow.Player2) {
+		return manualResult{}, &requestError{http.StatusBadRequest, "the teams must not share players"}
+	}
+	if black.format() != yellow.format() {
+		return manualResult{}, &requestError{http.StatusBadRequest, fmt.Sprintf("a %s team cannot play a %s team", black.format(), yellow.format())}
+	}
+	if !black.has(submitter) && !yellow.has(submitter) {
+		return manualResult{}, &requestError{http.StatusForbidden, "only players of the game can enter its result"}
+	}
+	for sub := range m.Goals {
+		if !black.has(sub) && !yellow.has(sub) {
+			return manualResult{}, &requestError{http.StatusBadRequest, fmt.Sprintf("%s did not play in the game", sub)}
+		}
+	}
+	if m.PlayedTimestamp == 0 {
+		m.PlayedTimestamp = nowMillis()
+	} else if m.PlayedTimestamp > nowMillis()+manualClockSkew.Milliseconds() {
+		return manualResult{}, &requestError{http.StatusBadRequest, "the game cannot have been played in the future"}
+	}
+	err = m.game(black, yellow).validate(rules)
+	if err != nil {
+		return manualResult{}, &requestError{http.StatusBadRequest, err.Error()}
+	}
+
+	m.SubmittedBy = submitter
+	id, err := repo.CreateManualResult(m)
+	if err != nil {
+		return manualResult{}, err
+	}
+	logger.Info("manual result entered", "manual_result", id, "sub", submitter)
+	return repo.GetManualResult(id)
+}
+
+// respondToManualResult confirms or rejects a pending result on behalf of a
+// player of the team that did not enter it. Confirmed results are finalized as
+// the end of a match is.
+func respondToManualResult(repo repository, h *hub, responder string, id int, confirm bool) (manualResult, error) {
+	m, err := repo.GetManualResult(id)
+	if err == errNotFound {
+		return manualResult{}, &requestError{http.StatusNotFound, "unknown result"}
+	} else if err != nil {
+		return manualResult{}, err
+	}
+	black, yellow, err := manualTeams(repo, m)
+	if err != nil {
+		return manualResult{}, err
+	}
+	opponents := yellow
+	if yellow.has(m.SubmittedBy) {
+		opponents = black
+	}
+	if !opponents.has(responder) {
+		return manualResult{}, &requestError{http.StatusForbidden, "only players of the opposing team can respond to a result"}
+	}
+
+	log := logger.With("manual_result", id)
+	if confirm {
+		// The result is recorded as a game together with its confirmation.
+		_, err = finalize(repo, h.rules, m.game(black, yellow), func(g finishedGame) (int, error) {
+			return repo.ConfirmManualResult(id, responder, g)
+		}, log)
+	} else {
+		err = repo.RespondToManualResult(id, manualRejected, responder)
+	}
+	if err == errNotFound {
+		return manualResult{}, &requestError{http.StatusConflict, "result is no longer pending"}
+	} else if err != nil {
+		return manualResult{}, err
+	}
+	log.Info("manual result answered", "confirmed", confirm, "sub", responder)
+	if !confirm {
+		return repo.GetManualResult(id)
+	}
+
+	h.announce(fmt.Sprintf("Result entered: the %s %s %d - %d the %s %s",
+		black.City, black.Name, m.BlackScore, m.YellowScore, yellow.City, yellow.Name))
+	return repo.GetManualResult(id)
+}
+
+// visibleManualResults keeps the results sub may see: every result for admins,
+// otherwise only those involving one of sub's teams.
+func visibleManualResults(auth authenticateHandler, repo repository, sub string, results []manualResult) ([]manualResult, error) {
+	if auth.isAdmin(sub) {
+		return results, nil
+	}
+	teams, err := repo.TeamsOf(sub)
+	if err != nil {
+		return nil, err
+	}
+	own := map[int]bool{}
+	for _, t := range teams {
+		own[t.ID] = true
+	}
+	visible := []manualResult{}
+	for _, m := range results {
+		if own[m.BlackTeam.ID] || own[m.YellowTeam.ID] {
+			visible = append(visible, m)
+		}
+	}
+	return visible, nil
+}
+
+// manualResultsHandler lists the manually entered results visible to the
+// caller on GET, optionally filtered by the status query parameter, and enters
+// one on POST.
+type manualResultsHandler struct {
+	auth authenticateHandler
+	h    *hub
+	repo repository
+}
+
+func (mh manualResultsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := mh.auth.identify(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == "GET" {
+		results, err := mh.repo.ManualResults(manualStatus(r.URL.Query().Get("status")))
+		if err == nil {
+			results, err = visibleManualResults(mh.auth, mh.repo, token.Sub, results)
+		}
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, results)
+		return
+	}
+
+	var body struct {
+		BlackTeam       int            `json:"black_team"`
+		YellowTeam      int            `json:"yellow_team"`
+		BlackScore      int            `json:"black_score"`
+		YellowScore     int            `json:"yellow_score"`
+		Goals           map[string]int `json:"goals"`
+		PlayedTimestamp int64          `json:"played_timestamp"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	m, err := submitManualResult(mh.repo, mh.h.rules, token.Sub, manualResult{
+		BlackTeam:       team{ID: body.BlackTeam},
+		YellowTeam:      team{ID: body.YellowTeam},
+		BlackScore:      body.BlackScore,
+		YellowScore:     body.YellowScore,
+		Goals:           body.Goals,
+		PlayedTimestamp: body.PlayedTimestamp,
+	})
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, m)
+}
+
+// manualResultHandler returns a single manually entered result to the admins
+// and the players of its teams.
+type manualResultHandler struct {
+	auth authenticateHandler
+	repo repository
+}
+
+func (mh manualResultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := mh.auth.identify(w, r)
+	if !ok {
+		return
+	}
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	m, err := mh.repo.GetManualResult(id)
+	if err == nil {
+		var visible []manualResult
+		visible, err = visibleManualResults(mh.auth, mh.repo, token.Sub, []manualResult{m})
+		if err == nil && len(visible) == 0 {
+			err = errNotFound
+		}
+	}
+	if err == errNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// manualResponseHandler confirms or rejects a manually entered result.
+type manualResponseHandler struct {
+	auth    authenticateHandler
+	h       *hub
+	repo    repository
+	confirm bool
+}
+
+func (mh manualResponseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := mh.auth.identify(w, r)
+	if !ok {
+		return
+	}
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	m, err := respondToManualResult(mh.repo, mh.h, token.Sub, id, mh.confirm)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
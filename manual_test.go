@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type manualRequest struct {
+	BlackTeam       int            `json:"black_team"`
+	YellowTeam      int            `json:"yellow_team"`
+	BlackScore      int            `json:"black_score"`
+	YellowScore     int            `json:"yellow_score"`
+	Goals           map[string]int `json:"goals"`
+	PlayedTimestamp int64          `json:"played_timestamp,omitempty"`
+}
+
+func TestManualResult(t *testing.T) {
+	ts := newChallengeServer(t)
+	ts.connect("6")
+	played := time.Now().Add(-2*time.Hour).UnixNano() / int64(time.Millisecond)
+	result := manualRequest{1, 2, 5, 0, map[string]int{"1": 3, "2": 2}, played}
+
+	var m manualResult
+	if code := ts.post("2", "/games/manual", result, &m); code != http.StatusCreated {
+		t.Fatalf("expected the result to be entered, got %d", code)
+	}
+	if m.Status != manualPending || m.SubmittedBy != "2" || m.BlackTeam.Name != "Blackhawks" || m.PlayedTimestamp != played {
+		t.Fatalf("unexpected result %+v", m)
+	}
+	var recent []gameResult
+	if recent, _ = ts.repo.RecentGames(5); len(recent) != 0 {
+		t.Fatalf("a result must not count before it is confirmed: %+v", recent)
+	}
+
+	if code := ts.post("1", "/games/manual/1/confirm", nil, nil); code != http.StatusForbidden {
+		t.Fatalf("expected the submitting team to be unable to confirm, got %d", code)
+	}
+	if code := ts.post("5", "/games/manual/1/confirm", nil, nil); code != http.StatusForbidden {
+		t.Fatalf("expected outsiders to be unable to confirm, got %d", code)
+	}
+	if code := ts.post("4", "/games/manual/1/confirm", nil, &m); code != http.StatusOK || m.Status != manualConfirmed || m.GameID != 1 || m.RespondedBy != "4" {
+		t.Fatalf("expected the result to be confirmed, got %d %+v", code, m)
+	}
+	ts.expectMessage("Result entered: the Chicago Blackhawks 5 - 0 the Boston Bruins")
+	if code := ts.post("3", "/games/manual/1/reject", nil, nil); code != http.StatusConflict {
+		t.Fatalf("expected an answered result to be final, got %d", code)
+	}
+
+	recent, _ = ts.repo.RecentGames(5)
+	if len(recent) != 1 || !recent[0].Manual || recent[0].BlackScore != 5 || recent[0].EndTimestamp != played {
+		t.Fatalf("expected a manual game played at the given time, got %+v", recent)
+	}
+	// Confirmed results go through the same finalization as a match.
+	var badges []badgeAward
+	ts.get("/players/1/badges", &badges)
+	if len(badges) != 3 || badges[2].Badge != badgeShutout || badges[0].Badge != badgeFirstGame {
+		t.Fatalf("expected badges for the manual game, got %+v", badges)
+	}
+	var hh headToHead
+	ts.get("/head-to-head?a=1&b=3", &hh)
+	if hh.Played != 1 || hh.A.Goals != 3 {
+		t.Fatalf("expected the manual game in the head-to-head, got %+v", hh)
+	}
+}
+
+// A result confirmed after a later live game takes its place in the past.
+func TestManualResultBackdated(t *testing.T) {
+	ts := newChallengeServer(t)
+	ts.connect("6")
+	live := recordGame(t, ts.repo, 1, 2, 5, 1, map[string]int{"1": 5})
+	played := time.Now().Add(-2*time.Hour).UnixNano() / int64(time.Millisecond)
+	if code := ts.post("3", "/games/manual", manualRequest{1, 2, 0, 5, map[string]int{"3": 5}, played}, nil); code != http.StatusCreated {
+		t.Fatalf("expected the result to be entered, got %d", code)
+	}
+	if code := ts.post("1", "/games/manual/1/confirm", nil, nil); code != http.StatusOK {
+		t.Fatalf("expected the result to be confirmed, got %d", code)
+	}
+	ts.expectMessage("Result entered: the Chicago Blackhawks 0 - 5 the Boston Bruins")
+
+	recent, _ := ts.repo.RecentGames(5)
+	if len(recent) != 2 || recent[0].ID != live || !recent[1].Manual {
+		t.Fatalf("expected the live game to be the most recent, got %+v", recent)
+	}
+	history, _ := ts.repo.PlayerHistory("1", "")
+	if history != (playerHistory{Played: 2, Goals: 5, WinStreak: 1}) {
+		t.Fatalf("expected the streak to end with the live game, got %+v", history)
+	}
+	var hh headToHead
+	ts.get("/head-to-head?a=1&b=3", &hh)
+	if hh.Played != 2 || hh.Recent[0].GameID != live || hh.Streak != (streak{Holder: "a", Length: 1}) {
+		t.Fatalf("expected the live game last in the head-to-head, got %+v", hh)
+	}
+}
+
+func TestManualResultValidation(t *testing.T) {
+	ts := newChallengeServer(t)
+	future := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	for _, c := range []struct {
+		sub    string
+		result manualRequest
+		status int
+		reason string
+	}{
+		{"5", manualRequest{1, 2, 5, 3, map[string]int{"1": 5, "3": 3}, 0}, http.StatusForbidden, "only players of the game"},
+		{"1", manualRequest{1, 9, 5, 3, nil, 0}, http.StatusNotFound, "unknown yellow team"},
+		{"1", manualRequest{1, 1, 5, 3, nil, 0}, http.StatusBadRequest, "must not share players"},
+		{"1", manualRequest{1, 2, 5, 5, map[string]int{"1": 5, "3": 5}, 0}, http.StatusBadRequest, "first side to 5 goals"},
+		{"1", manualRequest{1, 2, 4, 2, map[string]int{"1": 4, "3": 2}, 0}, http.StatusBadRequest, "first side to 5 goals"},
+		{"1", manualRequest{1, 2, 5, 3, map[string]int{"1": 4, "3": 3}, 0}, http.StatusBadRequest, "black players scored 4 goals but the score is 5"},
+		{"1", manualRequest{1, 2, 5, 3, map[string]int{"1": 5, "5": 3}, 0}, http.StatusBadRequest, "5 did not play"},
+		{"1", manualRequest{1, 2, 5, 3, map[string]int{"1": 5, "3": 3}, future}, http.StatusBadRequest, "in the future"},
+	} {
+		data, _ := json.Marshal(c.result)
+		code, body := ts.send(c.sub, "POST", "/games/manual", "application/json", bytes.NewReader(data), nil)
+		if code != c.status || !strings.Contains(body, c.reason) {
+			t.Errorf("%+v: expected %d %q, got %d %q", c.result, c.status, c.reason, code, body)
+		}
+	}
+
+	var m manualResult
+	ts.post("3", "/games/manual", manualRequest{1, 2, 5, 3, map[string]int{"1": 5, "3": 3}, 0}, &m)
+	if code := ts.post("2", "/games/manual/1/reject", nil, &m); code != http.StatusOK || m.Status != manualRejected {
+		t.Fatalf("expected the result to be rejected, got %d %+v", code, m)
+	}
+	var pending []manualResult
+	ts.send("2", "GET", "/games/manual?status=pending", "", nil, &pending)
+	if len(pending) != 0 {
+		t.Fatalf("expected no pending results, got %+v", pending)
+	}
+	ts.post("3", "/games/manual", manualRequest{1, 2, 5, 3, map[string]int{"1": 5, "3": 3}, 0}, &m)
+	ts.post("3", "/games/manual", manualRequest{3, 2, 5, 3, map[string]int{"5": 5, "3": 3}, 0}, &m)
+	if code := ts.get("/games/manual", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected listing results to require sign-in, got %d", code)
+	}
+	if code := ts.get("/games/manual/2", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected a result to require sign-in, got %d", code)
+	}
+	for _, c := range []struct {
+		sub  string
+		seen int
+	}{{"1", 3}, {"2", 2}, {"5", 1}} {
+		var results []manualResult
+		ts.send(c.sub, "GET", "/games/manual", "", nil, &results)
+		if len(results) != c.seen {
+			t.Errorf("expected %s to see %d results, got %+v", c.sub, c.seen, results)
+		}
+	}
+	if code, _ := ts.send("5", "GET", "/games/manual/2", "", nil, nil); code != http.StatusNotFound {
+		t.Fatalf("expected another team's result to be hidden, got %d", code)
+	}
+	if recent, _ := ts.repo.RecentGames(5); len(recent) != 0 {
+		t.Fatalf("a rejected result must not count: %+v", recent)
+	}
+	if code, _ := ts.send("1", "GET", "/games/manual/7", "", nil, nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown result, got %d", code)
+	}
+
+	// The rules may change between entering a result and confirming it.
+	ts.hub.rules.GoalsToWin = 7
+	code, body := ts.send("1", "POST", "/games/manual/2/confirm", "", nil, nil)
+	if code != http.StatusBadRequest || !strings.Contains(body, "first side to 7 goals") {
+		t.Fatalf("expected the result to break the new rules, got %d %q", code, body)
+	}
+	ts.send("1", "GET", "/games/manual/2", "", nil, &m)
+	if m.Status != manualPending {
+		t.Fatalf("expected a refused confirmation to leave the result pending, got %+v", m)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are exposed in the Prometheus text exposition format at /metrics.
+
+var defaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+type metric interface {
+	write(buf *bytes.Buffer)
+}
+
+type registry struct {
+	mx      sync.Mutex
+	metrics []metric
+}
+
+var metrics = &registry{}
+
+func (reg *registry) register(m metric) {
+	reg.mx.Lock()
+	reg.metrics = append(reg.metrics, m)
+	reg.mx.Unlock()
+}
+
+func (reg *registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	reg.mx.Lock()
+	for _, m := range reg.metrics {
+		m.write(&buf)
+	}
+	reg.mx.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func writeHeader(buf *bytes.Buffer, name string, help string, kind string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type counter struct {
+	name string
+	help string
+	v    uint64
+}
+
+func newCounter(name string, help string) *counter {
+	c := &counter{name: name, help: help}
+	metrics.register(c)
+	return c
+}
+
+func (c *counter) inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *counter) write(buf *bytes.Buffer) {
+	writeHeader(buf, c.name, c.help, "counter")
+	fmt.Fprintf(buf, "%s %d\n", c.name, atomic.LoadUint64(&c.v))
+}
+
+// counterVec is a counter partitioned by the value of a single label.
+type counterVec struct {
+	name  string
+	help  string
+	label string
+	mx    sync.Mutex
+	vals  map[string]uint64
+}
+
+func newCounterVec(name string, help string, label string) *counterVec {
+	c := &counterVec{name: name, help: help, label: label, vals: make(map[string]uint64)}
+	metrics.register(c)
+	return c
+}
+
+func (c *counterVec) inc(value string) {
+	c.mx.Lock()
+	c.vals[value]++
+	c.mx.Unlock()
+}
+
+func (c *counterVec) write(buf *bytes.Buffer) {
+	writeHeader(buf, c.name, c.help, "counter")
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for _, k := range sortedKeys(c.vals) {
+		fmt.Fprintf(buf, "%s{%s=%q} %d\n", c.name, c.label, k, c.vals[k])
+	}
+}
+
+type gauge struct {
+	name string
+	help string
+	v    int64
+}
+
+func newGauge(name string, help string) *gauge {
+	g := &gauge{name: name, help: help}
+	metrics.register(g)
+	return g
+}
+
+func (g *gauge) inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+func (g *gauge) dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+func (g *gauge) write(buf *bytes.Buffer) {
+	writeHeader(buf, g.name, g.help, "gauge")
+	fmt.Fprintf(buf, "%s %d\n", g.name, atomic.LoadInt64(&g.v))
+}
+
+// gaugeFunc is a gauge whose value is sampled when the metrics are scraped.
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func newGaugeFunc(name string, help string, fn func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, fn: fn}
+	metrics.register(g)
+	return g
+}
+
+func (g *gaugeFunc) write(buf *bytes.Buffer) {
+	writeHeader(buf, g.name, g.help, "gauge")
+	fmt.Fprintf(buf, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+type histogramData struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a histogram partitioned by the value of a single label. An
+// empty label name produces an unlabelled histogram.
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	mx      sync.Mutex
+	data    map[string]*histogramData
+}
+
+func newHistogram(name string, help string) *histogramVec {
+	return newHistogramVec(name, help, "")
+}
+
+func newHistogramVec(name string, help string, label string) *histogramVec {
+	h := &histogramVec{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: defaultBuckets,
+		data:    make(map[string]*histogramData),
+	}
+	metrics.register(h)
+	return h
+}
+
+func (h *histogramVec) observe(value string, v float64) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	d, ok := h.data[value]
+	if !ok {
+		d = &histogramData{counts: make([]uint64, len(h.buckets))}
+		h.data[value] = d
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			d.counts[i]++
+		}
+	}
+	d.sum += v
+	d.count++
+}
+
+// since records the time elapsed since start. It is meant to be deferred.
+func (h *histogramVec) since(value string, start time.Time) {
+	h.observe(value, time.Since(start).Seconds())
+}
+
+func (h *histogramVec) labels(value string, extra string) string {
+	var pairs []string
+	if h.label != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", h.label, value))
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i, p := range pairs {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString(p)
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+func (h *histogramVec) write(buf *bytes.Buffer) {
+	writeHeader(buf, h.name, h.help, "histogram")
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	keys := make([]string, 0, len(h.data))
+	for k := range h.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		d := h.data[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, h.labels(k, fmt.Sprintf("le=%q", formatFloat(b))), d.counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, h.labels(k, `le="+Inf"`), d.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.name, h.labels(k, ""), formatFloat(d.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.name, h.labels(k, ""), d.count)
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	connectedClients   = newGauge("dcfl_websocket_connections", "Number of connected WebSocket clients.")
+	eventWatchers      = newGauge("dcfl_event_stream_watchers", "Number of open Server-Sent Events streams.")
+	gamesActive        = newGauge("dcfl_games_active", "Number of games currently in play.")
+	gamesStarted       = newCounter("dcfl_games_started_total", "Number of games started.")
+	gamesFinished      = newCounter("dcfl_games_finished_total", "Number of games played to completion.")
+	goalsRecorded      = newCounter("dcfl_goals_total", "Number of goals recorded.")
+	goalsUndone        = newCounter("dcfl_goals_undone_total", "Number of goals undone.")
+	broadcastLatency   = newHistogram("dcfl_broadcast_duration_seconds", "Time taken to fan a broadcast out to every connection.")
+	droppedConnections = newCounter("dcfl_connections_dropped_total", "Number of connections removed after the send timeout expired.")
+	dbQueryLatency     = newHistogramVec("dcfl_db_query_duration_seconds", "Database query latency.", "query")
+	authFailures       = newCounterVec("dcfl_auth_failures_total", "Number of failed authentication attempts.", "reason")
+	webhookDeliveries  = newCounterVec("dcfl_webhook_deliveries_total", "Number of webhook events delivered or given up on.", "result")
+	wsViolations       = newCounterVec("dcfl_websocket_violations_total", "Number of WebSockets refused or closed for breaking a limit.", "reason")
+	badgesAwarded      = newCounterVec("dcfl_badges_awarded_total", "Number of achievement badges awarded.", "badge")
+	hubQueueDepth      = newGaugeFunc("dcfl_hub_request_queue_depth", "Number of requests waiting to be processed by the hubs.", queuedRequests)
+)
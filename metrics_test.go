@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape reads /metrics, returning the text and each sample keyed by its name
+// and labels.
+func (ts *testServer) scrape() (string, map[string]float64) {
+	ts.t.Helper()
+	resp, err := http.Get(ts.srv.URL + "/metrics")
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		ts.t.Fatalf("unexpected metrics response %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if i < 0 || err != nil {
+			ts.t.Fatalf("malformed sample %q", line)
+		}
+		samples[line[:i]] = v
+	}
+	return string(body), samples
+}
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	_, before := ts.scrape()
+
+	b1, _, _, _ := setUpMatch(ts)
+	for i := 0; i < 5; i++ {
+		b1.goal()
+		ts.expectState()
+	}
+	ts.expectMessage("Game Over")
+	text, after := ts.scrape()
+
+	for _, header := range []string{
+		"# HELP dcfl_goals_total Number of goals recorded.\n# TYPE dcfl_goals_total counter\n",
+		"# TYPE dcfl_badges_awarded_total counter\n",
+		"# TYPE dcfl_websocket_connections gauge\n",
+		"# TYPE dcfl_broadcast_duration_seconds histogram\n",
+	} {
+		if !strings.Contains(text, header) {
+			t.Errorf("expected %q in the metrics", header)
+		}
+	}
+	// Every family is written once however many hubs the tests started.
+	families := map[string]bool{}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			if families[line] {
+				t.Errorf("%q is written more than once", line)
+			}
+			families[line] = true
+		}
+	}
+	if !families["# TYPE dcfl_hub_request_queue_depth gauge"] {
+		t.Errorf("expected the hub request queue depth in the metrics")
+	}
+	for sample, delta := range map[string]float64{
+		"dcfl_games_started_total":                      1,
+		"dcfl_games_finished_total":                     1,
+		"dcfl_goals_total":                              5,
+		`dcfl_badges_awarded_total{badge="first_game"}`: 4,
+		`dcfl_badges_awarded_total{badge="shutout"}`:    2,
+		`dcfl_badges_awarded_total{badge="hat_trick"}`:  1,
+	} {
+		if got := after[sample] - before[sample]; got != delta {
+			t.Errorf("%s: expected to grow by %v, got %v", sample, delta, got)
+		}
+	}
+
+	// Histogram buckets are cumulative and end with every observation.
+	if after["dcfl_broadcast_duration_seconds_count"] <= before["dcfl_broadcast_duration_seconds_count"] {
+		t.Fatalf("expected broadcasts to be timed, got %v", after)
+	}
+	previous := 0.0
+	for _, b := range defaultBuckets {
+		n := after[`dcfl_broadcast_duration_seconds_bucket{le="`+formatFloat(b)+`"}`]
+		if n < previous {
+			t.Fatalf("bucket %v holds fewer observations than the one before it", b)
+		}
+		previous = n
+	}
+	if after[`dcfl_broadcast_duration_seconds_bucket{le="+Inf"}`] != after["dcfl_broadcast_duration_seconds_count"] ||
+		after["dcfl_broadcast_duration_seconds_sum"] <= 0 {
+		t.Fatalf("expected the +Inf bucket to count every broadcast, got %v", after)
+	}
+}
@@ -0,0 +1,10 @@
+
+-- +migrate Up
+CREATE TABLE hub_state (
+    table_id VARCHAR(255) PRIMARY KEY,
+    state TEXT NOT NULL,
+    saved_timestamp BIGINT NOT NULL DEFAULT EXTRACT(epoch FROM NOW()) * 1000
+);
+
+-- +migrate Down
+DROP TABLE hub_state;
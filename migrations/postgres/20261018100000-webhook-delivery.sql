@@ -0,0 +1,16 @@
+
+-- +migrate Up
+CREATE TABLE webhook_delivery (
+    id SERIAL PRIMARY KEY,
+    event_id VARCHAR(64) NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    url TEXT NOT NULL,
+    attempt INT NOT NULL,
+    status_code INT NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    delivered BOOLEAN NOT NULL,
+    delivery_timestamp BIGINT NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE webhook_delivery;
@@ -0,0 +1,10 @@
+
+-- +migrate Up
+CREATE TABLE chat_link (
+    chat_user_id VARCHAR(255) PRIMARY KEY,
+    player_id VARCHAR(255) NOT NULL,
+    linked_timestamp BIGINT NOT NULL DEFAULT EXTRACT(epoch FROM NOW()) * 1000
+);
+
+-- +migrate Down
+DROP TABLE chat_link;
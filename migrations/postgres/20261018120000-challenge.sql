@@ -0,0 +1,16 @@
+
+-- +migrate Up
+CREATE TABLE challenge (
+    id SERIAL PRIMARY KEY,
+    challenger_team INTEGER NOT NULL,
+    challenged_team INTEGER NOT NULL,
+    stakes TEXT NOT NULL DEFAULT '',
+    issued_by VARCHAR(255) NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    created_timestamp BIGINT NOT NULL DEFAULT EXTRACT(epoch FROM NOW()) * 1000,
+    responded_timestamp BIGINT,
+    game_id INTEGER
+);
+
+-- +migrate Down
+DROP TABLE challenge;
@@ -0,0 +1,12 @@
+
+-- +migrate Up
+CREATE TABLE badge (
+    id SERIAL PRIMARY KEY,
+    player_id VARCHAR(255) NOT NULL,
+    badge VARCHAR(64) NOT NULL,
+    game_id INTEGER NOT NULL,
+    awarded_timestamp BIGINT NOT NULL DEFAULT EXTRACT(epoch FROM NOW()) * 1000
+);
+
+-- +migrate Down
+DROP TABLE badge;
@@ -0,0 +1,106 @@
+
+-- +migrate Up
+-- Repair rows that would violate the new constraints. What cannot be repaired
+-- is removed; postgresRepository.reportOrphans logs it before this runs.
+
+-- Players known only by id get a placeholder record.
+INSERT INTO player(id, name)
+SELECT DISTINCT p.id, p.id FROM (
+    SELECT player1 AS id FROM team
+    UNION SELECT player2 FROM team
+    UNION SELECT player_id FROM game_goals
+    UNION SELECT player_id FROM badge
+    UNION SELECT issued_by FROM challenge
+) p
+WHERE NOT EXISTS (SELECT 1 FROM player WHERE player.id = p.id);
+
+-- Duplicate teams for the same pair of players are merged into the oldest.
+CREATE TEMPORARY TABLE team_merge AS
+SELECT t.id AS duplicate, MIN(o.id) AS keep
+FROM team t
+JOIN team o ON LEAST(o.player1, o.player2) = LEAST(t.player1, t.player2)
+    AND GREATEST(o.player1, o.player2) = GREATEST(t.player1, t.player2)
+    AND o.id < t.id
+GROUP BY t.id;
+UPDATE game SET black_team = m.keep FROM team_merge m WHERE black_team = m.duplicate;
+UPDATE game SET yellow_team = m.keep FROM team_merge m WHERE yellow_team = m.duplicate;
+UPDATE challenge SET challenger_team = m.keep FROM team_merge m WHERE challenger_team = m.duplicate;
+UPDATE challenge SET challenged_team = m.keep FROM team_merge m WHERE challenged_team = m.duplicate;
+DELETE FROM team WHERE id IN (SELECT duplicate FROM team_merge);
+DROP TABLE team_merge;
+
+-- Different teams sharing a city and name keep it apart by id.
+UPDATE team SET name = team.name || ' (' || team.id || ')'
+WHERE EXISTS (SELECT 1 FROM team o WHERE o.city = team.city AND o.name = team.name AND o.id < team.id);
+
+-- Games between teams that no longer exist cannot be repaired.
+DELETE FROM game
+WHERE black_team NOT IN (SELECT id FROM team) OR yellow_team NOT IN (SELECT id FROM team);
+DELETE FROM game_goals WHERE game_id NOT IN (SELECT id FROM game);
+DELETE FROM badge WHERE game_id NOT IN (SELECT id FROM game);
+DELETE FROM game_goals a USING game_goals b
+WHERE a.game_id = b.game_id AND a.player_id = b.player_id AND a.ctid > b.ctid;
+
+DELETE FROM challenge
+WHERE challenger_team NOT IN (SELECT id FROM team) OR challenged_team NOT IN (SELECT id FROM team);
+UPDATE challenge SET game_id = NULL WHERE game_id NOT IN (SELECT id FROM game);
+DELETE FROM chat_link WHERE player_id NOT IN (SELECT id FROM player);
+
+-- Referential integrity.
+ALTER TABLE team ADD CONSTRAINT team_player1_fkey FOREIGN KEY (player1) REFERENCES player(id);
+ALTER TABLE team ADD CONSTRAINT team_player2_fkey FOREIGN KEY (player2) REFERENCES player(id);
+ALTER TABLE game ADD CONSTRAINT game_black_team_fkey FOREIGN KEY (black_team) REFERENCES team(id);
+ALTER TABLE game ADD CONSTRAINT game_yellow_team_fkey FOREIGN KEY (yellow_team) REFERENCES team(id);
+ALTER TABLE game_goals ADD CONSTRAINT game_goals_game_id_fkey FOREIGN KEY (game_id) REFERENCES game(id) ON DELETE CASCADE;
+ALTER TABLE game_goals ADD CONSTRAINT game_goals_player_id_fkey FOREIGN KEY (player_id) REFERENCES player(id);
+ALTER TABLE challenge ADD CONSTRAINT challenge_challenger_team_fkey FOREIGN KEY (challenger_team) REFERENCES team(id);
+ALTER TABLE challenge ADD CONSTRAINT challenge_challenged_team_fkey FOREIGN KEY (challenged_team) REFERENCES team(id);
+ALTER TABLE challenge ADD CONSTRAINT challenge_issued_by_fkey FOREIGN KEY (issued_by) REFERENCES player(id);
+ALTER TABLE challenge ADD CONSTRAINT challenge_game_id_fkey FOREIGN KEY (game_id) REFERENCES game(id) ON DELETE SET NULL;
+ALTER TABLE badge ADD CONSTRAINT badge_player_id_fkey FOREIGN KEY (player_id) REFERENCES player(id);
+ALTER TABLE badge ADD CONSTRAINT badge_game_id_fkey FOREIGN KEY (game_id) REFERENCES game(id) ON DELETE CASCADE;
+ALTER TABLE chat_link ADD CONSTRAINT chat_link_player_id_fkey FOREIGN KEY (player_id) REFERENCES player(id) ON DELETE CASCADE;
+
+-- Uniqueness.
+ALTER TABLE game_goals ADD PRIMARY KEY (game_id, player_id);
+ALTER TABLE team ADD CONSTRAINT team_city_name_key UNIQUE (city, name);
+-- One team per pair of players, in either order. Also serves FindTeam.
+CREATE UNIQUE INDEX team_players_key ON team (LEAST(player1, player2), GREATEST(player1, player2));
+
+-- Lookups.
+CREATE INDEX team_player1_idx ON team (player1);
+CREATE INDEX team_player2_idx ON team (player2);
+CREATE INDEX game_black_team_idx ON game (black_team);
+CREATE INDEX game_yellow_team_idx ON game (yellow_team);
+CREATE INDEX game_end_timestamp_idx ON game (end_timestamp);
+CREATE INDEX game_goals_player_id_idx ON game_goals (player_id);
+CREATE INDEX challenge_status_idx ON challenge (status);
+CREATE INDEX badge_player_id_idx ON badge (player_id);
+CREATE INDEX chat_link_player_id_idx ON chat_link (player_id);
+
+-- +migrate Down
+DROP INDEX chat_link_player_id_idx;
+DROP INDEX badge_player_id_idx;
+DROP INDEX challenge_status_idx;
+DROP INDEX game_goals_player_id_idx;
+DROP INDEX game_end_timestamp_idx;
+DROP INDEX game_yellow_team_idx;
+DROP INDEX game_black_team_idx;
+DROP INDEX team_player2_idx;
+DROP INDEX team_player1_idx;
+DROP INDEX team_players_key;
+ALTER TABLE team DROP CONSTRAINT team_city_name_key;
+ALTER TABLE game_goals DROP CONSTRAINT game_goals_pkey;
+ALTER TABLE chat_link DROP CONSTRAINT chat_link_player_id_fkey;
+ALTER TABLE badge DROP CONSTRAINT badge_game_id_fkey;
+ALTER TABLE badge DROP CONSTRAINT badge_player_id_fkey;
+ALTER TABLE challenge DROP CONSTRAINT challenge_game_id_fkey;
+ALTER TABLE challenge DROP CONSTRAINT challenge_issued_by_fkey;
+ALTER TABLE challenge DROP CONSTRAINT challenge_challenged_team_fkey;
+ALTER TABLE challenge DROP CONSTRAINT challenge_challenger_team_fkey;
+ALTER TABLE game_goals DROP CONSTRAINT game_goals_player_id_fkey;
+ALTER TABLE game_goals DROP CONSTRAINT game_goals_game_id_fkey;
+ALTER TABLE game DROP CONSTRAINT game_yellow_team_fkey;
+ALTER TABLE game DROP CONSTRAINT game_black_team_fkey;
+ALTER TABLE team DROP CONSTRAINT team_player2_fkey;
+ALTER TABLE team DROP CONSTRAINT team_player1_fkey;
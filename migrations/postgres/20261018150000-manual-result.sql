@@ -0,0 +1,24 @@
+
+-- +migrate Up
+ALTER TABLE game ADD COLUMN manual BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE manual_result (
+    id SERIAL PRIMARY KEY,
+    black_team INTEGER NOT NULL REFERENCES team(id),
+    yellow_team INTEGER NOT NULL REFERENCES team(id),
+    black_score INTEGER NOT NULL,
+    yellow_score INTEGER NOT NULL,
+    goals TEXT NOT NULL,
+    played_timestamp BIGINT NOT NULL,
+    submitted_by VARCHAR(255) NOT NULL REFERENCES player(id),
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    responded_by VARCHAR(255) REFERENCES player(id),
+    created_timestamp BIGINT NOT NULL DEFAULT EXTRACT(epoch FROM NOW()) * 1000,
+    responded_timestamp BIGINT,
+    game_id INTEGER REFERENCES game(id) ON DELETE SET NULL
+);
+CREATE INDEX manual_result_status_idx ON manual_result (status);
+
+-- +migrate Down
+DROP TABLE manual_result;
+ALTER TABLE game DROP COLUMN manual;
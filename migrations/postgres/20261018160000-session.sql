@@ -0,0 +1,16 @@
+
+-- +migrate Up
+CREATE TABLE session (
+    id VARCHAR(64) PRIMARY KEY,
+    player_id VARCHAR(255) NOT NULL REFERENCES player(id) ON DELETE CASCADE,
+    refresh_hash VARCHAR(64) NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    created_timestamp BIGINT NOT NULL,
+    refreshed_timestamp BIGINT NOT NULL,
+    expires_timestamp BIGINT NOT NULL,
+    revoked_timestamp BIGINT
+);
+CREATE INDEX session_player_idx ON session (player_id);
+
+-- +migrate Down
+DROP TABLE session;
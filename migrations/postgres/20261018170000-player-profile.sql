@@ -0,0 +1,8 @@
+
+-- +migrate Up
+ALTER TABLE player ADD COLUMN nickname VARCHAR(32);
+ALTER TABLE player ADD COLUMN hide_picture BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +migrate Down
+ALTER TABLE player DROP COLUMN hide_picture;
+ALTER TABLE player DROP COLUMN nickname;
@@ -0,0 +1,9 @@
+
+-- +migrate Up
+ALTER TABLE player ADD COLUMN guest_of VARCHAR(255) REFERENCES player(id) ON DELETE SET NULL;
+ALTER TABLE player ADD COLUMN claim_code VARCHAR(16) UNIQUE;
+CREATE INDEX player_guest_of_idx ON player (guest_of);
+
+-- +migrate Down
+ALTER TABLE player DROP COLUMN claim_code;
+ALTER TABLE player DROP COLUMN guest_of;
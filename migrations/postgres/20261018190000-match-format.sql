@@ -0,0 +1,11 @@
+
+-- +migrate Up
+-- Games so far were all doubles. Singles teams are stored with the same
+-- player twice.
+ALTER TABLE game ADD COLUMN format VARCHAR(16) NOT NULL DEFAULT 'doubles'
+    CONSTRAINT game_format_check CHECK (format IN ('singles', 'doubles'));
+CREATE INDEX game_format_idx ON game (format);
+
+-- +migrate Down
+DROP INDEX game_format_idx;
+ALTER TABLE game DROP COLUMN format;
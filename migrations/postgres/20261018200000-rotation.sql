@@ -0,0 +1,18 @@
+
+-- +migrate Up
+CREATE TABLE rotation (
+    id SERIAL PRIMARY KEY,
+    table_name VARCHAR(255) NOT NULL,
+    format VARCHAR(16) NOT NULL
+        CONSTRAINT rotation_format_check CHECK (format IN ('singles', 'doubles')),
+    goals_to_win INTEGER NOT NULL,
+    started_timestamp BIGINT NOT NULL DEFAULT EXTRACT(epoch FROM NOW()) * 1000,
+    ended_timestamp BIGINT
+);
+ALTER TABLE game ADD COLUMN rotation_id INTEGER REFERENCES rotation(id) ON DELETE SET NULL;
+CREATE INDEX game_rotation_id_idx ON game (rotation_id);
+
+-- +migrate Down
+DROP INDEX game_rotation_id_idx;
+ALTER TABLE game DROP COLUMN rotation_id;
+DROP TABLE rotation;
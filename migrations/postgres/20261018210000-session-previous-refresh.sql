@@ -0,0 +1,7 @@
+
+-- +migrate Up
+-- Only the refresh token a session last replaced counts as a replay.
+ALTER TABLE session ADD COLUMN previous_refresh_hash VARCHAR(64);
+
+-- +migrate Down
+ALTER TABLE session DROP COLUMN previous_refresh_hash;
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// phase is the stage a table's match is in.
+type phase string
+
+const (
+	// Seats are still free.
+	phaseOpen phase = "open"
+	// All seats are taken and players are confirming.
+	phaseAwaitingConfirmations phase = "awaiting_confirmations"
+	// Everyone has confirmed but at least one pair has no team yet.
+	phaseAwaitingTeams phase = "awaiting_teams"
+	phaseInPlay        phase = "in_play"
+	phasePaused        phase = "paused"
+	// The game has been won and is being recorded.
+	phaseFinished phase = "finished"
+)
+
+var phaseDescriptions = map[phase]string{
+	phaseOpen:                  "the lobby is open",
+	phaseAwaitingConfirmations: "players are confirming",
+	phaseAwaitingTeams:         "teams are being named",
+	phaseInPlay:                "the game is in play",
+	phasePaused:                "the game is paused",
+	phaseFinished:              "the game is finished",
+}
+
+// transitions lists the phases each phase may move to. Every phase may go back
+// to phaseOpen when the table is reset.
+var transitions = map[phase][]phase{
+	phaseOpen:                  {phaseAwaitingConfirmations},
+	phaseAwaitingConfirmations: {phaseOpen, phaseAwaitingTeams, phaseInPlay},
+	phaseAwaitingTeams:         {phaseOpen, phaseInPlay},
+	phaseInPlay:                {phaseOpen, phasePaused, phaseFinished},
+	phasePaused:                {phaseOpen, phaseInPlay},
+	phaseFinished:              {phaseOpen},
+}
+
+// allowedActions lists the phases in which each action is accepted.
+var allowedActions = map[string][]phase{
+	"register game": {phaseOpen, phaseAwaitingConfirmations},
+	"add guest":     {phaseOpen},
+	"set format":    {phaseOpen},
+	"unregister":    {phaseOpen, phaseAwaitingConfirmations, phaseAwaitingTeams, phaseInPlay, phasePaused},
+	"confirm":       {phaseAwaitingConfirmations},
+	"register team": {phaseAwaitingConfirmations, phaseAwaitingTeams},
+	"goal":          {phaseInPlay},
+	"undo goal":     {phaseInPlay},
+	"pause":         {phaseInPlay},
+	"resume":        {phasePaused},
+
+	"start rotation": {phaseOpen},
+	"join rotation":  {phaseOpen, phaseAwaitingConfirmations, phaseAwaitingTeams, phaseInPlay, phasePaused},
+	"leave rotation": {phaseOpen, phaseAwaitingConfirmations, phaseAwaitingTeams, phaseInPlay, phasePaused},
+	"end rotation":   {phaseOpen, phaseAwaitingConfirmations, phaseAwaitingTeams},
+}
+
+func containsPhase(phases []phase, p phase) bool {
+	for _, v := range phases {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAction returns why action is not allowed in the current phase, or an
+// empty string if it is.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) checkAction(action string) string {
+	phases, ok := allowedActions[action]
+	if !ok {
+		return fmt.Sprintf("unknown action %q", action)
+	}
+	if !containsPhase(phases, h.phase) {
+		return fmt.Sprintf("cannot %s while %s", action, phaseDescriptions[h.phase])
+	}
+	if h.rotation != nil && rotationSeating[action] {
+		return "seats are assigned by the rotation"
+	}
+	return ""
+}
+
+// setPhase moves the match to another phase. Transitions not in the table are
+// refused and logged, as they indicate a bug in the hub.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) setPhase(to phase) bool {
+	if to == h.phase {
+		return true
+	}
+	if to != phaseOpen && !containsPhase(transitions[h.phase], to) {
+		h.log().Error("illegal phase transition", "from", h.phase, "to", to)
+		return false
+	}
+	h.log().Info("phase changed", "from", h.phase, "to", to)
+	h.phase = to
+	return true
+}
+
+// lobbyPhase works out which pre-game phase the seats, confirmations and teams
+// call for. It returns phaseInPlay once everything is in place.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) lobbyPhase() phase {
+	seats := h.lineup()
+	for _, p := range seats {
+		if p == (player{}) {
+			return phaseOpen
+		}
+	}
+	for _, p := range seats {
+		if !p.Confirmed {
+			return phaseAwaitingConfirmations
+		}
+	}
+	if h.blackTeam == (team{}) || h.yellowTeam == (team{}) {
+		return phaseAwaitingTeams
+	}
+	return phaseInPlay
+}
+
+// advance moves the lobby on to the phase it is ready for, starting the game
+// once all players have confirmed and both teams are known. It does nothing
+// once a game has started.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) advance() (string, bool) {
+	if h.gameStarted() {
+		return "", false
+	}
+	next := h.lobbyPhase()
+	if next != phaseInPlay {
+		h.setPhase(next)
+		return "", false
+	}
+
+	err := startGame(h)
+	if err != nil {
+		h.log().Error("error starting game", "err", err)
+		h.scoreMx.Lock()
+		defer h.scoreMx.Unlock()
+		h.reset()
+		return "Error starting game", true
+	}
+	return "", false
+}
+
+// reject tells the connection a request came from why it was refused, by
+// sending it the unchanged match state with the reason as its error. Rejected
+// requests are not broadcast.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) reject(cm *dcflMsg, reason string) {
+	h.logFor(cm).Info("rejected request", "action", cm.Action, "side", cm.Side, "reason", reason)
+	cm.rejected = true
+	if cm.conn == nil {
+		return
+	}
+
+	state := h.state()
+	state.Error = reason
+	msg, _ := json.Marshal(state)
+	h.connectionsMx.RLock()
+	defer h.connectionsMx.RUnlock()
+	if _, ok := h.connections[cm.conn]; ok {
+		select {
+		case cm.conn.send <- msg:
+		default:
+		}
+	}
+}
+
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func pauseGame(h *hub, cm *dcflMsg) (string, bool) {
+	if !h.seated(cm.Sub) {
+		h.reject(cm, "only players in the game can pause it")
+		return "", false
+	}
+	h.pausedAt = nowMillis()
+	h.setPhase(phasePaused)
+	return "", false
+}
+
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func resumeGame(h *hub, cm *dcflMsg) (string, bool) {
+	if !h.seated(cm.Sub) {
+		h.reject(cm, "only players in the game can resume it")
+		return "", false
+	}
+	h.pausedMillis += nowMillis() - h.pausedAt
+	h.pausedAt = 0
+	h.setPhase(phaseInPlay)
+	return "", false
+}
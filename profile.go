@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxNicknameLength = 24
+
+// playerProfile is a player as they see themselves. Name and Picture come
+// from the identity provider and are refreshed on every sign-in; the rest is
+// chosen by the player.
+type playerProfile struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Picture     string `json:"picture"`
+	Nickname    string `json:"nickname"`
+	HidePicture bool   `json:"hide_picture"`
+	DisplayName string `json:"display_name"`
+}
+
+func profileOf(p playerRecord) playerProfile {
+	return playerProfile{
+		ID:          p.ID,
+		Name:        p.Name,
+		Picture:     p.Picture,
+		Nickname:    p.Nickname,
+		HidePicture: p.HidePicture,
+		DisplayName: p.displayName(),
+	}
+}
+
+// validNickname trims a nickname and checks that it can be shown to others.
+// An empty nickname clears it.
+func validNickname(nickname string) (string, error) {
+	nickname = strings.TrimSpace(nickname)
+	if utf8.RuneCountInString(nickname) > maxNicknameLength {
+		return "", &requestError{http.StatusBadRequest, fmt.Sprintf("nickname must be at most %d characters", maxNicknameLength)}
+	}
+	for _, r := range nickname {
+		if !unicode.IsPrint(r) {
+			return "", &requestError{http.StatusBadRequest, "nickname must only contain printable characters"}
+		}
+	}
+	return nickname, nil
+}
+
+// profileChanged shows a seated player's new name and picture at the table.
+func (h *hub) profileChanged(p playerRecord) {
+	h.sideMx.Lock()
+	changed := false
+	for _, side := range []*[2]player{&h.blackSide, &h.yellowSide} {
+		for i := range side {
+			if side[i].Sub == p.ID {
+				side[i].Name = p.displayName()
+				side[i].Picture = p.displayPicture()
+				changed = true
+			}
+		}
+	}
+	h.sideMx.Unlock()
+	if !changed {
+		return
+	}
+	select {
+	case h.confirmations <- "match state":
+	case <-h.quit:
+	}
+}
+
+// profileHandler returns the caller's profile on GET and changes their
+// nickname and display settings on PATCH. Fields left out of a PATCH are
+// unchanged.
+type profileHandler struct {
+	auth authenticateHandler
+	h    *hub
+	repo repository
+}
+
+func (ph profileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := ph.auth.identify(w, r)
+	if !ok {
+		return
+	}
+	p, err := ph.repo.GetPlayer(token.Sub)
+	if err == errNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	if r.Method == "GET" {
+		writeJSON(w, http.StatusOK, profileOf(p))
+		return
+	}
+
+	var body struct {
+		Nickname    *string `json:"nickname"`
+		HidePicture *bool   `json:"hide_picture"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if body.Nickname != nil {
+		p.Nickname, err = validNickname(*body.Nickname)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+	}
+	if body.HidePicture != nil {
+		p.HidePicture = *body.HidePicture
+	}
+	err = ph.repo.UpdatePlayerSettings(p)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	logger.Info("profile updated", "sub", p.ID, "nickname", p.Nickname, "hide_picture", p.HidePicture)
+	ph.h.profileChanged(p)
+	writeJSON(w, http.StatusOK, profileOf(p))
+}
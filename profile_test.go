@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestProfileFollowsSignIn(t *testing.T) {
+	ts := newTestServer(t, "1")
+	ts.verifier["1"] = validatedID{Sub: "1", Name: "Renamed", Picture: "https://example.com/new.png"}
+	ts.authenticate("1")
+
+	var p playerProfile
+	if code := ts.withToken(ts.sessions["1"].Token, "GET", "/players/me", nil, &p); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	want := playerProfile{ID: "1", Name: "Renamed", Picture: "https://example.com/new.png", DisplayName: "Renamed"}
+	if p != want {
+		t.Fatalf("expected the profile to follow the identity provider, got %+v", p)
+	}
+}
+
+func TestNickname(t *testing.T) {
+	ts := newTestServer(t, "1", "2")
+	c1 := ts.connect("1")
+	ts.connect("2")
+	c1.register("black")
+	ts.expectState()
+
+	token := ts.sessions["1"].Token
+	var p playerProfile
+	code := ts.withToken(token, "PATCH", "/players/me", map[string]any{"nickname": "  Snipes  ", "hide_picture": true}, &p)
+	if code != http.StatusOK || p.Nickname != "Snipes" || p.DisplayName != "Snipes" || p.Name != "Player 1" || !p.HidePicture {
+		t.Fatalf("unexpected profile %d %+v", code, p)
+	}
+	// The seated player is shown by their new name, without a picture.
+	state := ts.expectState()
+	if state.BlackPlayer1 != (player{Sub: "1", Name: "Snipes"}) {
+		t.Fatalf("expected the table to show the nickname, got %+v", state.BlackPlayer1)
+	}
+
+	// Signing in again keeps the player's own settings.
+	ts.authenticate("1")
+	var hh headToHead
+	ts.get("/head-to-head?a=1&b=2", &hh)
+	if hh.A.Name != "Snipes" {
+		t.Fatalf("expected the nickname to be kept, got %+v", hh.A)
+	}
+
+	ts.withToken(ts.sessions["1"].Token, "PATCH", "/players/me", map[string]any{"nickname": ""}, &p)
+	if p.Nickname != "" || p.DisplayName != "Player 1" || !p.HidePicture {
+		t.Fatalf("expected only the nickname to be cleared, got %+v", p)
+	}
+	ts.expectState()
+
+	for _, nickname := range []string{strings.Repeat("x", maxNicknameLength+1), "tab\there"} {
+		code, _ := ts.send("1", "PATCH", "/players/me", "application/json", strings.NewReader(`{"nickname":"`+strings.ReplaceAll(nickname, "\t", `\t`)+`"}`), nil)
+		if code != http.StatusBadRequest {
+			t.Errorf("%q: expected the nickname to be refused, got %d", nickname, code)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import "errors"
+
+var errAlreadySeated = errors.New("already seated at the table")
+
+// joinQueue adds sub to the end of the queue for the table and returns its
+// position, counting from 1. Joining twice keeps the original place.
+func (h *hub) joinQueue(sub string) (int, error) {
+	h.sideMx.Lock()
+	defer h.sideMx.Unlock()
+	if h.seated(sub) {
+		return 0, errAlreadySeated
+	}
+	for i, s := range h.queue {
+		if s == sub {
+			return i + 1, nil
+		}
+	}
+	h.queue = append(h.queue, sub)
+	h.log().Info("joined queue", "sub", sub, "position", len(h.queue))
+	return len(h.queue), nil
+}
+
+// leaveQueue removes sub from the queue and reports whether it was queued.
+func (h *hub) leaveQueue(sub string) bool {
+	h.sideMx.Lock()
+	defer h.sideMx.Unlock()
+	return h.unqueue(sub)
+}
+
+// queued returns the players waiting for the table, first in line first.
+func (h *hub) queued() []string {
+	h.sideMx.RLock()
+	defer h.sideMx.RUnlock()
+	return append([]string(nil), h.queue...)
+}
+
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) unqueue(sub string) bool {
+	for i, s := range h.queue {
+		if s == sub {
+			h.queue = append(h.queue[:i], h.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
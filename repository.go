@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// errNotFound is returned by repository lookups that match nothing.
+var errNotFound = errors.New("not found")
+
+// repository stores players, teams, games and goals.
+type repository interface {
+	// SyncPlayer adds a player, or refreshes the name and picture of an
+	// existing one from the identity provider. Settings chosen by the player
+	// are kept.
+	SyncPlayer(p playerRecord) error
+	GetPlayer(id string) (playerRecord, error)
+	// UpdatePlayerSettings stores the nickname and display settings of p.
+	UpdatePlayerSettings(p playerRecord) error
+	CreateGuest(p playerRecord) error
+	// Guests returns the guests a player has added, by name.
+	Guests(hostID string) ([]playerRecord, error)
+	// FindGuest returns the guest with the given claim code.
+	FindGuest(claimCode string) (playerRecord, error)
+	// MergeGuest moves the teams, goals and badges of a guest to a player and
+	// removes the guest. Badges in milestoneBadges the player already has are
+	// dropped. The guest and the player must not share a game or a partner.
+	MergeGuest(guestID string, playerID string) error
+
+	// FindTeam returns the team made up of the two players, in either order.
+	// Singles teams are found by giving their player twice.
+	FindTeam(player1 string, player2 string) (team, error)
+	// TeamConflicts counts the teams that already use either the pair of
+	// players, the city or the name.
+	TeamConflicts(player1 string, player2 string, city string, name string) (int, error)
+	CreateTeam(city string, name string, player1 string, player2 string) (int, error)
+	GetTeam(id int) (teamRecord, error)
+	// TeamsOf returns the teams a player belongs to.
+	TeamsOf(playerID string) ([]team, error)
+	// FindTeamByName looks a team up by name, ignoring case.
+	FindTeamByName(name string) (team, error)
+
+	// CreateGame records the start of a game and returns its id.
+	CreateGame(format matchFormat, blackTeam int, yellowTeam int) (int, error)
+	FinishGame(id int, blackScore int, yellowScore int) error
+	RecordGoals(gameID int, playerID string, goals int) error
+	// RecentGames returns up to limit finished games, most recent first.
+	RecentGames(limit int) ([]gameResult, error)
+	// PlayerRivalry returns the finished games of the format a and b played
+	// on opposite sides, oldest first, from a's point of view. An empty format
+	// returns games of every format.
+	PlayerRivalry(a string, b string, format matchFormat) ([]rivalryGame, error)
+	// TeamRivalry returns the finished games between teams a and b, oldest
+	// first, from a's point of view.
+	TeamRivalry(a int, b int) ([]rivalryGame, error)
+	CreateManualResult(m manualResult) (int, error)
+	GetManualResult(id int) (manualResult, error)
+	// ManualResults returns manually entered results, newest first, optionally
+	// filtered by status.
+	ManualResults(status manualStatus) ([]manualResult, error)
+	// RespondToManualResult confirms or rejects a pending result. It returns
+	// errNotFound if the result is not pending.
+	RespondToManualResult(id int, status manualStatus, responder string) error
+	// ConfirmManualResult confirms a pending result and records it as the
+	// game g with the goals of each player, all at once, returning the game
+	// id. The game's duration is unknown, so it ends when it was played. It
+	// returns errNotFound if the result is not pending.
+	ConfirmManualResult(id int, responder string, g finishedGame) (int, error)
+	// FindGame returns the id of the game between two teams that started at
+	// startTimestamp.
+	FindGame(blackTeam int, yellowTeam int, startTimestamp int64) (int, error)
+	// ExportLeague returns every player, team, game and goal record.
+	ExportLeague() (leagueDump, error)
+	// ImportLeague stores the records of d all at once. Teams, games and goals
+	// refer to teams by their id in d, or to existing teams through teamIDs,
+	// which is updated with the ids of the teams created.
+	ImportLeague(d leagueDump, teamIDs map[int]int) error
+	// PlayerHistory summarizes a player's finished games of the format. An
+	// empty format counts games of every format.
+	PlayerHistory(playerID string, format matchFormat) (playerHistory, error)
+	AwardBadge(a badgeAward) error
+	// Badges returns the badges a player has been awarded, most recent first.
+	Badges(playerID string) ([]badgeAward, error)
+	// Standings ranks every player who has finished a game of the format by
+	// wins, then goals. An empty format counts games of every format.
+	Standings(format matchFormat) ([]standing, error)
+
+	SaveHubState(table string, state string) error
+	// LoadHubState returns errNotFound if no state was saved for the table.
+	LoadHubState(table string) (string, error)
+	DeleteHubState(table string) error
+
+	// CreateChallenge stores a new pending challenge and returns its id.
+	CreateChallenge(c challenge) (int, error)
+	GetChallenge(id int) (challenge, error)
+	// Challenges returns the challenges with the given status, or all of them
+	// if status is empty, most recent first.
+	Challenges(status challengeStatus) ([]challenge, error)
+	// RespondToChallenge moves a pending challenge to status. It returns
+	// errNotFound if the challenge does not exist or is no longer pending.
+	RespondToChallenge(id int, status challengeStatus) error
+	// ChallengePlayed records the game an accepted challenge was played in.
+	ChallengePlayed(id int, gameID int) error
+
+	// CreateRotation stores a new rotation session and returns its id.
+	CreateRotation(s rotationSession) (int, error)
+	GetRotation(id int) (rotationSession, error)
+	// EndRotation records that a rotation session is over.
+	EndRotation(id int) error
+	// RotationGamePlayed adds a game to a rotation session.
+	RotationGamePlayed(id int, gameID int) error
+	// RotationGames returns the finished games of a rotation session, oldest
+	// first.
+	RotationGames(id int) ([]rotationGame, error)
+
+	// LinkChatUser ties a chat account to a player, replacing any previous link.
+	LinkChatUser(chatUserID string, playerID string) error
+	// ChatPlayer returns the player linked to a chat account, or errNotFound.
+	ChatPlayer(chatUserID string) (string, error)
+
+	CreateSession(s sessionRecord) error
+	// GetSession returns a session, including revoked and expired ones.
+	GetSession(id string) (sessionRecord, error)
+	// RotateSession replaces the refresh token hash of a session, keeping the
+	// old one as its previous hash, and extends it until expiresTimestamp. It
+	// returns errNotFound if the session is revoked or its hash is not oldHash.
+	RotateSession(id string, oldHash string, newHash string, expiresTimestamp int64) error
+	RevokeSession(id string) error
+	// RevokePlayerSessions revokes every session of a player.
+	RevokePlayerSessions(playerID string) error
+	// PlayerSessions returns the live sessions of a player, most recently
+	// refreshed first.
+	PlayerSessions(playerID string) ([]sessionRecord, error)
+
+	RecordWebhookDelivery(d webhookDelivery) error
+	// WebhookDeliveries returns up to limit delivery attempts, newest first.
+	WebhookDeliveries(limit int) ([]webhookDelivery, error)
+
+	// Ping checks that the storage is reachable.
+	Ping(ctx context.Context) error
+	// PendingMigrations returns the number of schema migrations not yet applied.
+	PendingMigrations() (int, error)
+	Close() error
+}
+
+type playerRecord struct {
+	ID      string
+	Name    string
+	Picture string
+	// Chosen by the player and shown instead of Name when set.
+	Nickname    string
+	HidePicture bool
+	// Set on guests: the player who added them, and the code that lets the
+	// guest claim the record.
+	GuestOf   string
+	ClaimCode string
+}
+
+// displayName returns the name a player is shown by.
+func (p playerRecord) displayName() string {
+	if p.Nickname != "" {
+		return p.Nickname
+	}
+	return p.Name
+}
+
+// displayPicture returns the picture a player is shown with, if any.
+func (p playerRecord) displayPicture() string {
+	if p.HidePicture {
+		return ""
+	}
+	return p.Picture
+}
+
+// seat returns the player as shown at the table.
+func (p playerRecord) seat() player {
+	return player{Sub: p.ID, Name: p.displayName(), Picture: p.displayPicture(), Guest: p.GuestOf != ""}
+}
+
+// teamRecord is a team along with its players. Both players of a singles team
+// are the same.
+type teamRecord struct {
+	team
+	Player1 string
+	Player2 string
+}
+
+// has reports whether playerID is on the team.
+func (t teamRecord) has(playerID string) bool {
+	return t.Player1 == playerID || t.Player2 == playerID
+}
+
+// gameResult is the outcome of a finished game.
+type gameResult struct {
+	ID           int         `json:"id"`
+	BlackTeam    team        `json:"black_team"`
+	YellowTeam   team        `json:"yellow_team"`
+	BlackScore   int         `json:"black_score"`
+	YellowScore  int         `json:"yellow_score"`
+	EndTimestamp int64       `json:"end_timestamp"`
+	Format       matchFormat `json:"format"`
+	// Set for results entered by hand rather than played at the table.
+	Manual bool `json:"manual,omitempty"`
+}
+
+// rivalryGame is a finished game between two players or teams, seen from the
+// first one's side. For teams the goals are the team scores.
+type rivalryGame struct {
+	GameID       int
+	EndTimestamp int64
+	AScore       int
+	BScore       int
+	AGoals       int
+	BGoals       int
+}
+
+// playerHistory is a player's record over all finished games.
+type playerHistory struct {
+	Played int
+	Goals  int
+	// Games won in a row, counting back from the most recent game.
+	WinStreak int
+}
+
+// standing is a player's record over all finished games.
+type standing struct {
+	PlayerID string `json:"player_id"`
+	Name     string `json:"name"`
+	Played   int    `json:"played"`
+	Won      int    `json:"won"`
+	Goals    int    `json:"goals"`
+}
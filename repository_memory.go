@@ -0,0 +1,914 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryTeam struct {
+	team
+	player1 string
+	player2 string
+}
+
+type memoryGame struct {
+	id             int
+	format         matchFormat
+	blackTeam      int
+	yellowTeam     int
+	startTimestamp int64
+	endTimestamp   int64
+	blackScore     int
+	yellowScore    int
+	finished       bool
+	manual         bool
+	// The rotation session the game was played in, if any.
+	rotation int
+}
+
+type memoryGoals struct {
+	gameID   int
+	playerID string
+	goals    int
+}
+
+// memoryRepository keeps everything in memory. It is used for local demos
+// and tests, and loses all data when the server stops.
+type memoryRepository struct {
+	mx         sync.RWMutex
+	players    map[string]playerRecord
+	teams      []memoryTeam
+	games      []memoryGame
+	goals      []memoryGoals
+	hubState   map[string]string
+	chat       map[string]string
+	challenges []challenge
+	rotations  []rotationSession
+	manual     []manualResult
+	badges     []badgeAward
+	sessions   map[string]sessionRecord
+	// Ids of guest players, in the order they were added.
+	guests   []string
+	webhooks []webhookDelivery
+}
+
+func newMemoryRepository() *memoryRepository {
+	return &memoryRepository{
+		players:  make(map[string]playerRecord),
+		hubState: make(map[string]string),
+		chat:     make(map[string]string),
+		sessions: make(map[string]sessionRecord),
+	}
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (repo *memoryRepository) SyncPlayer(p playerRecord) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	if existing, ok := repo.players[p.ID]; ok {
+		existing.Name = p.Name
+		existing.Picture = p.Picture
+		p = existing
+	}
+	repo.players[p.ID] = p
+	return nil
+}
+
+func (repo *memoryRepository) GetPlayer(id string) (playerRecord, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	p, ok := repo.players[id]
+	if !ok {
+		return playerRecord{}, errNotFound
+	}
+	return p, nil
+}
+
+func (repo *memoryRepository) UpdatePlayerSettings(p playerRecord) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	existing, ok := repo.players[p.ID]
+	if !ok {
+		return errNotFound
+	}
+	existing.Nickname = p.Nickname
+	existing.HidePicture = p.HidePicture
+	repo.players[p.ID] = existing
+	return nil
+}
+
+func (repo *memoryRepository) CreateGuest(p playerRecord) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	repo.players[p.ID] = p
+	repo.guests = append(repo.guests, p.ID)
+	return nil
+}
+
+func (repo *memoryRepository) Guests(hostID string) ([]playerRecord, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	guests := []playerRecord{}
+	for _, id := range repo.guests {
+		if p, ok := repo.players[id]; ok && p.GuestOf == hostID {
+			guests = append(guests, p)
+		}
+	}
+	sort.Slice(guests, func(i, j int) bool {
+		return guests[i].Name < guests[j].Name
+	})
+	return guests, nil
+}
+
+func (repo *memoryRepository) FindGuest(claimCode string) (playerRecord, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	for _, id := range repo.guests {
+		if p, ok := repo.players[id]; ok && p.ClaimCode == claimCode {
+			return p, nil
+		}
+	}
+	return playerRecord{}, errNotFound
+}
+
+func (repo *memoryRepository) MergeGuest(guestID string, playerID string) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	if _, ok := repo.players[guestID]; !ok {
+		return errNotFound
+	}
+	for i, t := range repo.teams {
+		if t.player1 == guestID {
+			repo.teams[i].player1 = playerID
+		}
+		if t.player2 == guestID {
+			repo.teams[i].player2 = playerID
+		}
+	}
+	for i, g := range repo.goals {
+		if g.playerID == guestID {
+			repo.goals[i].playerID = playerID
+		}
+	}
+	held := make(map[string]bool)
+	for _, a := range repo.badges {
+		if a.PlayerID == playerID {
+			held[a.Badge] = true
+		}
+	}
+	badges := repo.badges[:0]
+	for _, a := range repo.badges {
+		if a.PlayerID == guestID {
+			if held[a.Badge] && slices.Contains(milestoneBadges, a.Badge) {
+				continue
+			}
+			a.PlayerID = playerID
+		}
+		badges = append(badges, a)
+	}
+	repo.badges = badges
+	delete(repo.players, guestID)
+	return nil
+}
+
+func (repo *memoryRepository) FindTeam(player1 string, player2 string) (team, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	for _, t := range repo.teams {
+		if (t.player1 == player1 && t.player2 == player2) || (t.player1 == player2 && t.player2 == player1) {
+			return t.team, nil
+		}
+	}
+	return team{}, errNotFound
+}
+
+func (repo *memoryRepository) TeamConflicts(player1 string, player2 string, city string, name string) (int, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	count := 0
+	for _, t := range repo.teams {
+		if (t.player1 == player1 && t.player2 == player2) ||
+			(t.player1 == player2 && t.player2 == player1) ||
+			t.City == city ||
+			t.Name == name {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (repo *memoryRepository) CreateTeam(city string, name string, player1 string, player2 string) (int, error) {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	id := len(repo.teams) + 1
+	repo.teams = append(repo.teams, memoryTeam{
+		team:    team{ID: id, City: city, Name: name},
+		player1: player1,
+		player2: player2,
+	})
+	return id, nil
+}
+
+func (repo *memoryRepository) GetTeam(id int) (teamRecord, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	if id < 1 || id > len(repo.teams) {
+		return teamRecord{}, errNotFound
+	}
+	t := repo.teams[id-1]
+	return teamRecord{team: t.team, Player1: t.player1, Player2: t.player2}, nil
+}
+
+func (repo *memoryRepository) TeamsOf(playerID string) ([]team, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	teams := []team{}
+	for _, t := range repo.teams {
+		if t.player1 == playerID || t.player2 == playerID {
+			teams = append(teams, t.team)
+		}
+	}
+	return teams, nil
+}
+
+func (repo *memoryRepository) FindTeamByName(name string) (team, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	for _, t := range repo.teams {
+		if strings.EqualFold(t.Name, name) {
+			return t.team, nil
+		}
+	}
+	return team{}, errNotFound
+}
+
+// This function assumes and requires the mx lock to be acquired by the caller.
+func (repo *memoryRepository) team(id int) memoryTeam {
+	if id < 1 || id > len(repo.teams) {
+		return memoryTeam{}
+	}
+	return repo.teams[id-1]
+}
+
+func (repo *memoryRepository) CreateGame(format matchFormat, blackTeam int, yellowTeam int) (int, error) {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	id := len(repo.games) + 1
+	repo.games = append(repo.games, memoryGame{
+		id:             id,
+		format:         format,
+		blackTeam:      blackTeam,
+		yellowTeam:     yellowTeam,
+		startTimestamp: nowMillis(),
+	})
+	return id, nil
+}
+
+func (repo *memoryRepository) FinishGame(id int, blackScore int, yellowScore int) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	if id < 1 || id > len(repo.games) {
+		return errNotFound
+	}
+	g := &repo.games[id-1]
+	g.endTimestamp = nowMillis()
+	if g.manual {
+		g.endTimestamp = g.startTimestamp
+	}
+	g.blackScore = blackScore
+	g.yellowScore = yellowScore
+	g.finished = true
+	return nil
+}
+
+func (repo *memoryRepository) RecordGoals(gameID int, playerID string, goals int) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	repo.goals = append(repo.goals, memoryGoals{gameID: gameID, playerID: playerID, goals: goals})
+	return nil
+}
+
+// finishedGames returns the finished games in the order they ended, by end
+// timestamp and then id. A confirmed manual result ends when it was played, so
+// it can come before games recorded earlier.
+// This function assumes and requires the mx lock to be acquired by the caller.
+func (repo *memoryRepository) finishedGames() []memoryGame {
+	var games []memoryGame
+	for _, g := range repo.games {
+		if g.finished {
+			games = append(games, g)
+		}
+	}
+	sort.Slice(games, func(i, j int) bool {
+		if games[i].endTimestamp != games[j].endTimestamp {
+			return games[i].endTimestamp < games[j].endTimestamp
+		}
+		return games[i].id < games[j].id
+	})
+	return games
+}
+
+func (repo *memoryRepository) RecentGames(limit int) ([]gameResult, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	results := []gameResult{}
+	games := repo.finishedGames()
+	for i := len(games) - 1; i >= 0 && len(results) < limit; i-- {
+		g := games[i]
+		results = append(results, gameResult{
+			ID:           g.id,
+			BlackTeam:    repo.team(g.blackTeam).team,
+			YellowTeam:   repo.team(g.yellowTeam).team,
+			BlackScore:   g.blackScore,
+			YellowScore:  g.yellowScore,
+			EndTimestamp: g.endTimestamp,
+			Format:       g.format,
+			Manual:       g.manual,
+		})
+	}
+	return results, nil
+}
+
+func (repo *memoryRepository) PlayerRivalry(a string, b string, format matchFormat) ([]rivalryGame, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	games := []rivalryGame{}
+	for _, g := range repo.finishedGames() {
+		if format != "" && g.format != format {
+			continue
+		}
+		black := repo.team(g.blackTeam)
+		yellow := repo.team(g.yellowTeam)
+		onBlack := func(p string) bool { return black.player1 == p || black.player2 == p }
+		onYellow := func(p string) bool { return yellow.player1 == p || yellow.player2 == p }
+		rg := rivalryGame{GameID: g.id, EndTimestamp: g.endTimestamp, AGoals: repo.playerGoals(g.id, a), BGoals: repo.playerGoals(g.id, b)}
+		if onBlack(a) && onYellow(b) {
+			rg.AScore, rg.BScore = g.blackScore, g.yellowScore
+		} else if onYellow(a) && onBlack(b) {
+			rg.AScore, rg.BScore = g.yellowScore, g.blackScore
+		} else {
+			continue
+		}
+		games = append(games, rg)
+	}
+	return games, nil
+}
+
+// This function assumes and requires the mx lock to be acquired by the caller.
+func (repo *memoryRepository) playerGoals(gameID int, playerID string) int {
+	for _, g := range repo.goals {
+		if g.gameID == gameID && g.playerID == playerID {
+			return g.goals
+		}
+	}
+	return 0
+}
+
+func (repo *memoryRepository) TeamRivalry(a int, b int) ([]rivalryGame, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	games := []rivalryGame{}
+	for _, g := range repo.finishedGames() {
+		rg := rivalryGame{GameID: g.id, EndTimestamp: g.endTimestamp}
+		if g.blackTeam == a && g.yellowTeam == b {
+			rg.AScore, rg.BScore = g.blackScore, g.yellowScore
+		} else if g.blackTeam == b && g.yellowTeam == a {
+			rg.AScore, rg.BScore = g.yellowScore, g.blackScore
+		} else {
+			continue
+		}
+		rg.AGoals, rg.BGoals = rg.AScore, rg.BScore
+		games = append(games, rg)
+	}
+	return games, nil
+}
+
+func (repo *memoryRepository) CreateManualResult(m manualResult) (int, error) {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	m.ID = len(repo.manual) + 1
+	m.BlackTeam = repo.team(m.BlackTeam.ID).team
+	m.YellowTeam = repo.team(m.YellowTeam.ID).team
+	m.Status = manualPending
+	m.CreatedTimestamp = nowMillis()
+	repo.manual = append(repo.manual, m)
+	return m.ID, nil
+}
+
+func (repo *memoryRepository) GetManualResult(id int) (manualResult, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	if id < 1 || id > len(repo.manual) {
+		return manualResult{}, errNotFound
+	}
+	return repo.manual[id-1], nil
+}
+
+func (repo *memoryRepository) ManualResults(status manualStatus) ([]manualResult, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	results := []manualResult{}
+	for i := len(repo.manual) - 1; i >= 0; i-- {
+		if status == "" || repo.manual[i].Status == status {
+			results = append(results, repo.manual[i])
+		}
+	}
+	return results, nil
+}
+
+func (repo *memoryRepository) RespondToManualResult(id int, status manualStatus, responder string) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	if id < 1 || id > len(repo.manual) || repo.manual[id-1].Status != manualPending {
+		return errNotFound
+	}
+	m := &repo.manual[id-1]
+	m.Status = status
+	m.RespondedBy = responder
+	m.RespondedTimestamp = nowMillis()
+	return nil
+}
+
+func (repo *memoryRepository) ConfirmManualResult(id int, responder string, g finishedGame) (int, error) {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	if id < 1 || id > len(repo.manual) || repo.manual[id-1].Status != manualPending {
+		return 0, errNotFound
+	}
+	m := &repo.manual[id-1]
+	gameID := len(repo.games) + 1
+	repo.games = append(repo.games, memoryGame{
+		id:             gameID,
+		format:         g.format,
+		blackTeam:      m.BlackTeam.ID,
+		yellowTeam:     m.YellowTeam.ID,
+		startTimestamp: m.PlayedTimestamp,
+		endTimestamp:   m.PlayedTimestamp,
+		blackScore:     g.blackScore,
+		yellowScore:    g.yellowScore,
+		finished:       true,
+		manual:         true,
+	})
+	for _, p := range append(g.blackSide[:], g.yellowSide[:]...) {
+		if p.Sub != "" {
+			repo.goals = append(repo.goals, memoryGoals{gameID: gameID, playerID: p.Sub, goals: p.Goals})
+		}
+	}
+	m.Status = manualConfirmed
+	m.RespondedBy = responder
+	m.RespondedTimestamp = nowMillis()
+	m.GameID = gameID
+	return gameID, nil
+}
+
+func (repo *memoryRepository) FindGame(blackTeam int, yellowTeam int, startTimestamp int64) (int, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	for _, g := range repo.games {
+		if g.blackTeam == blackTeam && g.yellowTeam == yellowTeam && g.startTimestamp == startTimestamp {
+			return g.id, nil
+		}
+	}
+	return 0, errNotFound
+}
+
+func (repo *memoryRepository) ExportLeague() (leagueDump, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	d := leagueDump{Players: []exportPlayer{}, Teams: []exportTeam{}, Games: []exportGame{}, Goals: []exportGoals{}}
+	for _, p := range repo.players {
+		d.Players = append(d.Players, exportPlayer{ID: p.ID, Name: p.Name, Picture: p.Picture, GuestOf: p.GuestOf, ClaimCode: p.ClaimCode})
+	}
+	sort.Slice(d.Players, func(i, j int) bool {
+		return d.Players[i].ID < d.Players[j].ID
+	})
+	for _, t := range repo.teams {
+		d.Teams = append(d.Teams, exportTeam{ID: t.ID, City: t.City, Name: t.Name, Player1: t.player1, Player2: t.player2})
+	}
+	for _, g := range repo.games {
+		d.Games = append(d.Games, exportGame{
+			ID:             g.id,
+			BlackTeam:      g.blackTeam,
+			YellowTeam:     g.yellowTeam,
+			StartTimestamp: g.startTimestamp,
+			EndTimestamp:   g.endTimestamp,
+			BlackScore:     g.blackScore,
+			YellowScore:    g.yellowScore,
+			Format:         g.format,
+		})
+	}
+	for _, g := range repo.goals {
+		d.Goals = append(d.Goals, exportGoals{GameID: g.gameID, PlayerID: g.playerID, Goals: g.goals})
+	}
+	return d, nil
+}
+
+func (repo *memoryRepository) ImportLeague(d leagueDump, teamIDs map[int]int) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	for _, p := range d.Players {
+		repo.players[p.ID] = playerRecord{ID: p.ID, Name: p.Name, Picture: p.Picture, GuestOf: p.GuestOf, ClaimCode: p.ClaimCode}
+		if p.ClaimCode != "" {
+			repo.guests = append(repo.guests, p.ID)
+		}
+	}
+	for _, t := range d.Teams {
+		id := len(repo.teams) + 1
+		repo.teams = append(repo.teams, memoryTeam{team: team{ID: id, City: t.City, Name: t.Name}, player1: t.Player1, player2: t.Player2})
+		teamIDs[t.ID] = id
+	}
+	gameIDs := map[int]int{}
+	for _, g := range d.Games {
+		id := len(repo.games) + 1
+		repo.games = append(repo.games, memoryGame{
+			id:             id,
+			format:         g.Format,
+			blackTeam:      teamIDs[g.BlackTeam],
+			yellowTeam:     teamIDs[g.YellowTeam],
+			startTimestamp: g.StartTimestamp,
+			endTimestamp:   g.EndTimestamp,
+			blackScore:     g.BlackScore,
+			yellowScore:    g.YellowScore,
+			finished:       true,
+		})
+		gameIDs[g.ID] = id
+	}
+	for _, g := range d.Goals {
+		repo.goals = append(repo.goals, memoryGoals{gameID: gameIDs[g.GameID], playerID: g.PlayerID, goals: g.Goals})
+	}
+	return nil
+}
+
+func (repo *memoryRepository) PlayerHistory(playerID string, format matchFormat) (playerHistory, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	var h playerHistory
+	streaking := true
+	games := repo.finishedGames()
+	for i := len(games) - 1; i >= 0; i-- {
+		g := games[i]
+		if format != "" && g.format != format {
+			continue
+		}
+		black := repo.team(g.blackTeam)
+		yellow := repo.team(g.yellowTeam)
+		var won bool
+		if black.player1 == playerID || black.player2 == playerID {
+			won = g.blackScore > g.yellowScore
+		} else if yellow.player1 == playerID || yellow.player2 == playerID {
+			won = g.yellowScore > g.blackScore
+		} else {
+			continue
+		}
+		h.Played++
+		h.Goals += repo.playerGoals(g.id, playerID)
+		if streaking && won {
+			h.WinStreak++
+		} else {
+			streaking = false
+		}
+	}
+	return h, nil
+}
+
+func (repo *memoryRepository) AwardBadge(a badgeAward) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	a.Timestamp = nowMillis()
+	repo.badges = append(repo.badges, a)
+	return nil
+}
+
+func (repo *memoryRepository) Badges(playerID string) ([]badgeAward, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	badges := []badgeAward{}
+	for i := len(repo.badges) - 1; i >= 0; i-- {
+		if repo.badges[i].PlayerID == playerID {
+			a := repo.badges[i]
+			a.Name = badgeNames[a.Badge]
+			badges = append(badges, a)
+		}
+	}
+	return badges, nil
+}
+
+func (repo *memoryRepository) Standings(format matchFormat) ([]standing, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	byPlayer := make(map[string]*standing)
+	record := func(playerID string, gameID int, won bool) {
+		s, ok := byPlayer[playerID]
+		if !ok {
+			s = &standing{PlayerID: playerID, Name: repo.players[playerID].displayName()}
+			byPlayer[playerID] = s
+		}
+		s.Played++
+		if won {
+			s.Won++
+		}
+		for _, g := range repo.goals {
+			if g.gameID == gameID && g.playerID == playerID {
+				s.Goals += g.goals
+			}
+		}
+	}
+	for _, g := range repo.games {
+		if !g.finished || (format != "" && g.format != format) {
+			continue
+		}
+		black := repo.team(g.blackTeam)
+		yellow := repo.team(g.yellowTeam)
+		record(black.player1, g.id, g.blackScore > g.yellowScore)
+		record(yellow.player1, g.id, g.yellowScore > g.blackScore)
+		if g.format != formatSingles {
+			record(black.player2, g.id, g.blackScore > g.yellowScore)
+			record(yellow.player2, g.id, g.yellowScore > g.blackScore)
+		}
+	}
+
+	standings := []standing{}
+	for _, s := range byPlayer {
+		standings = append(standings, *s)
+	}
+	sort.Slice(standings, func(i, j int) bool {
+		a, b := standings[i], standings[j]
+		if a.Won != b.Won {
+			return a.Won > b.Won
+		}
+		if a.Goals != b.Goals {
+			return a.Goals > b.Goals
+		}
+		return a.Name < b.Name
+	})
+	return standings, nil
+}
+
+func (repo *memoryRepository) CreateChallenge(c challenge) (int, error) {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	c.ID = len(repo.challenges) + 1
+	c.Challenger = repo.team(c.Challenger.ID).team
+	c.Challenged = repo.team(c.Challenged.ID).team
+	c.Status = challengePending
+	c.CreatedTimestamp = nowMillis()
+	repo.challenges = append(repo.challenges, c)
+	return c.ID, nil
+}
+
+func (repo *memoryRepository) GetChallenge(id int) (challenge, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	if id < 1 || id > len(repo.challenges) {
+		return challenge{}, errNotFound
+	}
+	return repo.challenges[id-1], nil
+}
+
+func (repo *memoryRepository) Challenges(status challengeStatus) ([]challenge, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	challenges := []challenge{}
+	for i := len(repo.challenges) - 1; i >= 0; i-- {
+		if status == "" || repo.challenges[i].Status == status {
+			challenges = append(challenges, repo.challenges[i])
+		}
+	}
+	return challenges, nil
+}
+
+func (repo *memoryRepository) RespondToChallenge(id int, status challengeStatus) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	if id < 1 || id > len(repo.challenges) || repo.challenges[id-1].Status != challengePending {
+		return errNotFound
+	}
+	c := &repo.challenges[id-1]
+	c.Status = status
+	c.RespondedTimestamp = nowMillis()
+	return nil
+}
+
+func (repo *memoryRepository) ChallengePlayed(id int, gameID int) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	if id < 1 || id > len(repo.challenges) {
+		return errNotFound
+	}
+	repo.challenges[id-1].Status = challengePlayed
+	repo.challenges[id-1].GameID = gameID
+	return nil
+}
+
+func (repo *memoryRepository) CreateRotation(s rotationSession) (int, error) {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	s.ID = len(repo.rotations) + 1
+	s.StartedTimestamp = nowMillis()
+	repo.rotations = append(repo.rotations, s)
+	return s.ID, nil
+}
+
+func (repo *memoryRepository) GetRotation(id int) (rotationSession, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	if id < 1 || id > len(repo.rotations) {
+		return rotationSession{}, errNotFound
+	}
+	return repo.rotations[id-1], nil
+}
+
+func (repo *memoryRepository) EndRotation(id int) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	if id < 1 || id > len(repo.rotations) {
+		return errNotFound
+	}
+	if repo.rotations[id-1].EndedTimestamp == 0 {
+		repo.rotations[id-1].EndedTimestamp = nowMillis()
+	}
+	return nil
+}
+
+func (repo *memoryRepository) RotationGamePlayed(id int, gameID int) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	if gameID < 1 || gameID > len(repo.games) {
+		return errNotFound
+	}
+	repo.games[gameID-1].rotation = id
+	return nil
+}
+
+func (repo *memoryRepository) RotationGames(id int) ([]rotationGame, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	games := []rotationGame{}
+	for _, g := range repo.finishedGames() {
+		if g.rotation != id {
+			continue
+		}
+		winners, losers := repo.team(g.blackTeam), repo.team(g.yellowTeam)
+		if g.yellowScore > g.blackScore {
+			winners, losers = losers, winners
+		}
+		games = append(games, rotationGame{
+			GameID:  g.id,
+			Winners: teamPlayers(winners.player1, winners.player2),
+			Losers:  teamPlayers(losers.player1, losers.player2),
+		})
+	}
+	return games, nil
+}
+
+func (repo *memoryRepository) LinkChatUser(chatUserID string, playerID string) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	repo.chat[chatUserID] = playerID
+	return nil
+}
+
+func (repo *memoryRepository) ChatPlayer(chatUserID string) (string, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	playerID, ok := repo.chat[chatUserID]
+	if !ok {
+		return "", errNotFound
+	}
+	return playerID, nil
+}
+
+func (repo *memoryRepository) CreateSession(s sessionRecord) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	repo.sessions[s.ID] = s
+	return nil
+}
+
+func (repo *memoryRepository) GetSession(id string) (sessionRecord, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	s, ok := repo.sessions[id]
+	if !ok {
+		return sessionRecord{}, errNotFound
+	}
+	return s, nil
+}
+
+func (repo *memoryRepository) RotateSession(id string, oldHash string, newHash string, expiresTimestamp int64) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	s, ok := repo.sessions[id]
+	if !ok || s.RevokedTimestamp != 0 || s.RefreshHash != oldHash {
+		return errNotFound
+	}
+	s.PreviousRefreshHash = s.RefreshHash
+	s.RefreshHash = newHash
+	s.RefreshedTimestamp = nowMillis()
+	s.ExpiresTimestamp = expiresTimestamp
+	repo.sessions[id] = s
+	return nil
+}
+
+func (repo *memoryRepository) RevokeSession(id string) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	s, ok := repo.sessions[id]
+	if ok && s.RevokedTimestamp == 0 {
+		s.RevokedTimestamp = nowMillis()
+		repo.sessions[id] = s
+	}
+	return nil
+}
+
+func (repo *memoryRepository) RevokePlayerSessions(playerID string) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	now := nowMillis()
+	for id, s := range repo.sessions {
+		if s.PlayerID == playerID && s.RevokedTimestamp == 0 {
+			s.RevokedTimestamp = now
+			repo.sessions[id] = s
+		}
+	}
+	return nil
+}
+
+func (repo *memoryRepository) PlayerSessions(playerID string) ([]sessionRecord, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	now := nowMillis()
+	sessions := []sessionRecord{}
+	for _, s := range repo.sessions {
+		if s.PlayerID == playerID && s.live(now) {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].RefreshedTimestamp != sessions[j].RefreshedTimestamp {
+			return sessions[i].RefreshedTimestamp > sessions[j].RefreshedTimestamp
+		}
+		return sessions[i].CreatedTimestamp > sessions[j].CreatedTimestamp
+	})
+	return sessions, nil
+}
+
+func (repo *memoryRepository) SaveHubState(table string, state string) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	repo.hubState[table] = state
+	return nil
+}
+
+func (repo *memoryRepository) LoadHubState(table string) (string, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	state, ok := repo.hubState[table]
+	if !ok {
+		return "", errNotFound
+	}
+	return state, nil
+}
+
+func (repo *memoryRepository) DeleteHubState(table string) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	delete(repo.hubState, table)
+	return nil
+}
+
+func (repo *memoryRepository) RecordWebhookDelivery(d webhookDelivery) error {
+	repo.mx.Lock()
+	defer repo.mx.Unlock()
+	repo.webhooks = append(repo.webhooks, d)
+	return nil
+}
+
+func (repo *memoryRepository) WebhookDeliveries(limit int) ([]webhookDelivery, error) {
+	repo.mx.RLock()
+	defer repo.mx.RUnlock()
+	deliveries := []webhookDelivery{}
+	for i := len(repo.webhooks) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		deliveries = append(deliveries, repo.webhooks[i])
+	}
+	return deliveries, nil
+}
+
+func (repo *memoryRepository) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (repo *memoryRepository) PendingMigrations() (int, error) {
+	return 0, nil
+}
+
+func (repo *memoryRepository) Close() error {
+	return nil
+}
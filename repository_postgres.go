@@ -0,0 +1,1122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rubenv/sql-migrate"
+)
+
+const postgresDriver = "postgres"
+
+type postgresRepository struct {
+	db            *sql.DB
+	migrationsDir string
+}
+
+// newPostgresRepository connects to the database and applies any pending
+// migrations.
+func newPostgresRepository(c dbConfig) (*postgresRepository, error) {
+	db, err := sql.Open(postgresDriver, c.dsn())
+	if err != nil {
+		return nil, err
+	}
+
+	repo := &postgresRepository{db: db, migrationsDir: c.MigrationsDir}
+	applies, err := repo.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	logger.Info("applied migrations", "count", applies)
+	return repo, nil
+}
+
+// migrate applies pending migrations. Before the schema v2 migration it stops
+// to report the rows that migration is going to repair or remove.
+func (repo *postgresRepository) migrate() (int, error) {
+	planned, _, err := migrate.PlanMigration(repo.db, postgresDriver, repo.migrations(), migrate.Up, 0)
+	if err != nil {
+		return 0, err
+	}
+	applies := 0
+	for i, m := range planned {
+		if m.Id != schemaV2Migration {
+			continue
+		}
+		if i > 0 {
+			applies, err = migrate.ExecMax(repo.db, postgresDriver, repo.migrations(), migrate.Up, i)
+			if err != nil {
+				return applies, err
+			}
+		}
+		err = repo.reportOrphans()
+		if err != nil {
+			return applies, err
+		}
+	}
+	n, err := migrate.Exec(repo.db, postgresDriver, repo.migrations(), migrate.Up)
+	return applies + n, err
+}
+
+// The migration adding foreign keys and unique constraints, which repairs or
+// removes the rows that would violate them.
+const schemaV2Migration = "20261018140000-schema-v2.sql"
+
+// orphanChecks count the rows the schema v2 migration repairs or removes.
+var orphanChecks = []struct {
+	description string
+	query       string
+}{
+	{"players referenced without a player record, placeholders will be created", `
+SELECT COUNT(*) FROM (
+    SELECT player1 AS id FROM team UNION SELECT player2 FROM team
+    UNION SELECT player_id FROM game_goals UNION SELECT player_id FROM badge
+    UNION SELECT issued_by FROM challenge
+) p WHERE NOT EXISTS (SELECT 1 FROM player WHERE player.id = p.id)`},
+	{"duplicate teams for the same players, will be merged into the oldest", `
+SELECT COUNT(*) FROM team t WHERE EXISTS (
+    SELECT 1 FROM team o WHERE o.id < t.id
+    AND LEAST(o.player1, o.player2) = LEAST(t.player1, t.player2)
+    AND GREATEST(o.player1, o.player2) = GREATEST(t.player1, t.player2))`},
+	{"teams sharing a city and name, will be renamed", `
+SELECT COUNT(*) FROM team t WHERE EXISTS (SELECT 1 FROM team o WHERE o.id < t.id AND o.city = t.city AND o.name = t.name)`},
+	{"games between missing teams, will be deleted", `
+SELECT COUNT(*) FROM game WHERE black_team NOT IN (SELECT id FROM team) OR yellow_team NOT IN (SELECT id FROM team)`},
+	{"goals for missing games, will be deleted", `
+SELECT COUNT(*) FROM game_goals WHERE game_id NOT IN (SELECT id FROM game)`},
+	{"goals recorded more than once for a player in a game, all but the first will be deleted", `
+SELECT COUNT(*) FROM game_goals a WHERE game_id IN (SELECT id FROM game) AND EXISTS (
+    SELECT 1 FROM game_goals b WHERE b.game_id = a.game_id AND b.player_id = a.player_id AND b.ctid < a.ctid)`},
+	{"badges for missing games, will be deleted", `
+SELECT COUNT(*) FROM badge WHERE game_id NOT IN (SELECT id FROM game)`},
+	{"challenges between missing teams, will be deleted", `
+SELECT COUNT(*) FROM challenge WHERE challenger_team NOT IN (SELECT id FROM team) OR challenged_team NOT IN (SELECT id FROM team)`},
+	{"chat links to missing players, will be deleted", `
+SELECT COUNT(*) FROM chat_link WHERE player_id NOT IN (SELECT id FROM player)`},
+}
+
+// reportOrphans logs the rows the schema v2 migration is about to repair or
+// remove.
+func (repo *postgresRepository) reportOrphans() error {
+	for _, check := range orphanChecks {
+		var count int
+		err := repo.db.QueryRow(check.query).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			logger.Warn("schema cleanup: "+check.description, "rows", count)
+		}
+	}
+	return nil
+}
+
+func (repo *postgresRepository) migrations() migrate.MigrationSource {
+	return &migrate.FileMigrationSource{
+		Dir: repo.migrationsDir,
+	}
+}
+
+func (repo *postgresRepository) SyncPlayer(p playerRecord) error {
+	defer dbQueryLatency.since("sync_player", time.Now())
+	_, err := repo.db.Exec(
+		"INSERT INTO public.player(id, name, picture) VALUES ($1, $2, $3) ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, picture = EXCLUDED.picture",
+		p.ID,
+		p.Name,
+		p.Picture)
+	return err
+}
+
+func (repo *postgresRepository) GetPlayer(id string) (playerRecord, error) {
+	defer dbQueryLatency.since("get_player", time.Now())
+	p, err := scanPlayer(repo.db.QueryRow(playerColumns+" WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return playerRecord{}, errNotFound
+	}
+	return p, err
+}
+
+const playerColumns = `
+SELECT id, name, COALESCE(picture, ''), COALESCE(nickname, ''), hide_picture, COALESCE(guest_of, ''), COALESCE(claim_code, '')
+FROM public.player`
+
+func scanPlayer(row scanner) (playerRecord, error) {
+	var p playerRecord
+	err := row.Scan(&p.ID, &p.Name, &p.Picture, &p.Nickname, &p.HidePicture, &p.GuestOf, &p.ClaimCode)
+	return p, err
+}
+
+func (repo *postgresRepository) CreateGuest(p playerRecord) error {
+	defer dbQueryLatency.since("create_guest", time.Now())
+	_, err := repo.db.Exec(
+		"INSERT INTO public.player(id, name, guest_of, claim_code) VALUES ($1, $2, $3, $4)",
+		p.ID,
+		p.Name,
+		p.GuestOf,
+		p.ClaimCode)
+	return err
+}
+
+func (repo *postgresRepository) Guests(hostID string) ([]playerRecord, error) {
+	defer dbQueryLatency.since("guests", time.Now())
+	rows, err := repo.db.Query(playerColumns+" WHERE guest_of = $1 ORDER BY name, id", hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	guests := []playerRecord{}
+	for rows.Next() {
+		p, err := scanPlayer(rows)
+		if err != nil {
+			return nil, err
+		}
+		guests = append(guests, p)
+	}
+	return guests, rows.Err()
+}
+
+func (repo *postgresRepository) FindGuest(claimCode string) (playerRecord, error) {
+	defer dbQueryLatency.since("find_guest", time.Now())
+	p, err := scanPlayer(repo.db.QueryRow(playerColumns+" WHERE claim_code = $1", claimCode))
+	if err == sql.ErrNoRows {
+		return playerRecord{}, errNotFound
+	}
+	return p, err
+}
+
+func (repo *postgresRepository) MergeGuest(guestID string, playerID string) error {
+	defer dbQueryLatency.since("merge_guest", time.Now())
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		"UPDATE public.team SET player1 = $2 WHERE player1 = $1",
+		"UPDATE public.team SET player2 = $2 WHERE player2 = $1",
+		"UPDATE public.game_goals SET player_id = $2 WHERE player_id = $1",
+	} {
+		_, err = tx.Exec(stmt, guestID, playerID)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(
+		"DELETE FROM public.badge b WHERE b.player_id = $1 AND b.badge = ANY($3) AND EXISTS (SELECT 1 FROM public.badge o WHERE o.player_id = $2 AND o.badge = b.badge)",
+		guestID,
+		playerID,
+		pq.Array(milestoneBadges))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE public.badge SET player_id = $2 WHERE player_id = $1", guestID, playerID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM public.player WHERE id = $1", guestID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repo *postgresRepository) UpdatePlayerSettings(p playerRecord) error {
+	defer dbQueryLatency.since("update_player_settings", time.Now())
+	res, err := repo.db.Exec(
+		"UPDATE public.player SET nickname = NULLIF($1, ''), hide_picture = $2 WHERE id = $3",
+		p.Nickname,
+		p.HidePicture,
+		p.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (repo *postgresRepository) FindTeam(player1 string, player2 string) (team, error) {
+	defer dbQueryLatency.since("get_team", time.Now())
+	t := team{}
+	err := repo.db.QueryRow(
+		"SELECT id, city, name FROM public.team WHERE LEAST(player1, player2) = LEAST($1, $2) AND GREATEST(player1, player2) = GREATEST($1, $2)",
+		player1,
+		player2,
+	).Scan(&t.ID, &t.City, &t.Name)
+	if err == sql.ErrNoRows {
+		return team{}, errNotFound
+	} else if err != nil {
+		return team{}, err
+	}
+	return t, nil
+}
+
+func (repo *postgresRepository) TeamConflicts(player1 string, player2 string, city string, name string) (int, error) {
+	defer dbQueryLatency.since("team_conflicts", time.Now())
+	var count int
+	err := repo.db.QueryRow(
+		"SELECT COUNT(*) FROM public.team WHERE (player1 = $1 AND player2 = $2) OR (player1 = $2 AND player2 = $1) OR city = $3 OR name = $4",
+		player1,
+		player2,
+		city,
+		name).Scan(&count)
+	return count, err
+}
+
+func (repo *postgresRepository) CreateTeam(city string, name string, player1 string, player2 string) (int, error) {
+	defer dbQueryLatency.since("create_team", time.Now())
+	var id int
+	err := repo.db.QueryRow(
+		"INSERT INTO public.team(city, name, player1, player2) VALUES ($1, $2, $3, $4) RETURNING id",
+		city,
+		name,
+		player1,
+		player2).Scan(&id)
+	return id, err
+}
+
+func (repo *postgresRepository) GetTeam(id int) (teamRecord, error) {
+	defer dbQueryLatency.since("get_team_by_id", time.Now())
+	t := teamRecord{}
+	err := repo.db.QueryRow("SELECT id, city, name, player1, player2 FROM public.team WHERE id = $1", id).Scan(&t.ID, &t.City, &t.Name, &t.Player1, &t.Player2)
+	if err == sql.ErrNoRows {
+		return teamRecord{}, errNotFound
+	} else if err != nil {
+		return teamRecord{}, err
+	}
+	return t, nil
+}
+
+func (repo *postgresRepository) TeamsOf(playerID string) ([]team, error) {
+	defer dbQueryLatency.since("teams_of", time.Now())
+	rows, err := repo.db.Query("SELECT id, city, name FROM public.team WHERE player1 = $1 OR player2 = $1 ORDER BY id", playerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	teams := []team{}
+	for rows.Next() {
+		var t team
+		err := rows.Scan(&t.ID, &t.City, &t.Name)
+		if err != nil {
+			return nil, err
+		}
+		teams = append(teams, t)
+	}
+	return teams, rows.Err()
+}
+
+func (repo *postgresRepository) FindTeamByName(name string) (team, error) {
+	defer dbQueryLatency.since("find_team_by_name", time.Now())
+	t := team{}
+	err := repo.db.QueryRow("SELECT id, city, name FROM public.team WHERE LOWER(name) = LOWER($1)", name).Scan(&t.ID, &t.City, &t.Name)
+	if err == sql.ErrNoRows {
+		return team{}, errNotFound
+	} else if err != nil {
+		return team{}, err
+	}
+	return t, nil
+}
+
+func (repo *postgresRepository) CreateGame(format matchFormat, blackTeam int, yellowTeam int) (int, error) {
+	defer dbQueryLatency.since("start_game", time.Now())
+	var id int
+	err := repo.db.QueryRow(
+		"INSERT INTO public.game(format, black_team, yellow_team) VALUES ($1, $2, $3) RETURNING id",
+		format,
+		blackTeam,
+		yellowTeam).Scan(&id)
+	return id, err
+}
+
+func (repo *postgresRepository) FinishGame(id int, blackScore int, yellowScore int) error {
+	defer dbQueryLatency.since("end_game", time.Now())
+	_, err := repo.db.Exec(
+		"UPDATE public.game SET end_timestamp = CASE WHEN manual THEN start_timestamp ELSE EXTRACT(epoch FROM NOW()) * 1000 END, black_score = $1, yellow_score = $2 WHERE id = $3",
+		blackScore,
+		yellowScore,
+		id)
+	return err
+}
+
+func (repo *postgresRepository) RecordGoals(gameID int, playerID string, goals int) error {
+	defer dbQueryLatency.since("record_goals", time.Now())
+	_, err := repo.db.Exec(
+		"INSERT INTO public.game_goals(game_id, player_id, goals) VALUES ($1, $2, $3)",
+		gameID,
+		playerID,
+		goals)
+	return err
+}
+
+func (repo *postgresRepository) RecentGames(limit int) ([]gameResult, error) {
+	defer dbQueryLatency.since("recent_games", time.Now())
+	rows, err := repo.db.Query(`
+SELECT g.id, g.black_score, g.yellow_score, g.end_timestamp, g.format, g.manual,
+    b.id, b.city, b.name, y.id, y.city, y.name
+FROM public.game g
+JOIN public.team b ON b.id = g.black_team
+JOIN public.team y ON y.id = g.yellow_team
+WHERE g.end_timestamp IS NOT NULL
+ORDER BY g.end_timestamp DESC, g.id DESC
+LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := []gameResult{}
+	for rows.Next() {
+		var r gameResult
+		err := rows.Scan(&r.ID, &r.BlackScore, &r.YellowScore, &r.EndTimestamp, &r.Format, &r.Manual,
+			&r.BlackTeam.ID, &r.BlackTeam.City, &r.BlackTeam.Name,
+			&r.YellowTeam.ID, &r.YellowTeam.City, &r.YellowTeam.Name)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+func (repo *postgresRepository) PlayerRivalry(a string, b string, format matchFormat) ([]rivalryGame, error) {
+	defer dbQueryLatency.since("player_rivalry", time.Now())
+	return repo.rivalry(`
+SELECT g.id, g.end_timestamp,
+    CASE WHEN $1 IN (bt.player1, bt.player2) THEN g.black_score ELSE g.yellow_score END,
+    CASE WHEN $1 IN (bt.player1, bt.player2) THEN g.yellow_score ELSE g.black_score END,
+    COALESCE(ga.goals, 0), COALESCE(gb.goals, 0)
+FROM public.game g
+JOIN public.team bt ON bt.id = g.black_team
+JOIN public.team yt ON yt.id = g.yellow_team
+LEFT JOIN public.game_goals ga ON ga.game_id = g.id AND ga.player_id = $1
+LEFT JOIN public.game_goals gb ON gb.game_id = g.id AND gb.player_id = $2
+WHERE g.end_timestamp IS NOT NULL AND ($3 = '' OR g.format = $3)
+    AND (($1 IN (bt.player1, bt.player2) AND $2 IN (yt.player1, yt.player2))
+        OR ($2 IN (bt.player1, bt.player2) AND $1 IN (yt.player1, yt.player2)))
+ORDER BY g.end_timestamp, g.id`, a, b, format)
+}
+
+func (repo *postgresRepository) TeamRivalry(a int, b int) ([]rivalryGame, error) {
+	defer dbQueryLatency.since("team_rivalry", time.Now())
+	return repo.rivalry(`
+SELECT g.id, g.end_timestamp,
+    CASE WHEN g.black_team = $1 THEN g.black_score ELSE g.yellow_score END,
+    CASE WHEN g.black_team = $1 THEN g.yellow_score ELSE g.black_score END,
+    CASE WHEN g.black_team = $1 THEN g.black_score ELSE g.yellow_score END,
+    CASE WHEN g.black_team = $1 THEN g.yellow_score ELSE g.black_score END
+FROM public.game g
+WHERE g.end_timestamp IS NOT NULL
+    AND ((g.black_team = $1 AND g.yellow_team = $2) OR (g.black_team = $2 AND g.yellow_team = $1))
+ORDER BY g.end_timestamp, g.id`, a, b)
+}
+
+func (repo *postgresRepository) rivalry(query string, args ...any) ([]rivalryGame, error) {
+	rows, err := repo.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	games := []rivalryGame{}
+	for rows.Next() {
+		var g rivalryGame
+		err := rows.Scan(&g.GameID, &g.EndTimestamp, &g.AScore, &g.BScore, &g.AGoals, &g.BGoals)
+		if err != nil {
+			return nil, err
+		}
+		games = append(games, g)
+	}
+	return games, rows.Err()
+}
+
+const manualResultColumns = `
+SELECT m.id, m.black_score, m.yellow_score, m.goals, m.played_timestamp, m.submitted_by, m.status,
+    COALESCE(m.responded_by, ''), m.created_timestamp, COALESCE(m.responded_timestamp, 0), COALESCE(m.game_id, 0),
+    b.id, b.city, b.name, y.id, y.city, y.name
+FROM public.manual_result m
+JOIN public.team b ON b.id = m.black_team
+JOIN public.team y ON y.id = m.yellow_team`
+
+func scanManualResult(row scanner) (manualResult, error) {
+	var m manualResult
+	var goals string
+	err := row.Scan(&m.ID, &m.BlackScore, &m.YellowScore, &goals, &m.PlayedTimestamp, &m.SubmittedBy, &m.Status,
+		&m.RespondedBy, &m.CreatedTimestamp, &m.RespondedTimestamp, &m.GameID,
+		&m.BlackTeam.ID, &m.BlackTeam.City, &m.BlackTeam.Name,
+		&m.YellowTeam.ID, &m.YellowTeam.City, &m.YellowTeam.Name)
+	if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal([]byte(goals), &m.Goals)
+}
+
+func (repo *postgresRepository) CreateManualResult(m manualResult) (int, error) {
+	defer dbQueryLatency.since("create_manual_result", time.Now())
+	goals, err := json.Marshal(m.Goals)
+	if err != nil {
+		return 0, err
+	}
+	var id int
+	err = repo.db.QueryRow(
+		"INSERT INTO public.manual_result(black_team, yellow_team, black_score, yellow_score, goals, played_timestamp, submitted_by) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+		m.BlackTeam.ID,
+		m.YellowTeam.ID,
+		m.BlackScore,
+		m.YellowScore,
+		string(goals),
+		m.PlayedTimestamp,
+		m.SubmittedBy).Scan(&id)
+	return id, err
+}
+
+func (repo *postgresRepository) GetManualResult(id int) (manualResult, error) {
+	defer dbQueryLatency.since("get_manual_result", time.Now())
+	m, err := scanManualResult(repo.db.QueryRow(manualResultColumns+" WHERE m.id = $1", id))
+	if err == sql.ErrNoRows {
+		return manualResult{}, errNotFound
+	}
+	return m, err
+}
+
+func (repo *postgresRepository) ManualResults(status manualStatus) ([]manualResult, error) {
+	defer dbQueryLatency.since("manual_results", time.Now())
+	rows, err := repo.db.Query(manualResultColumns+" WHERE $1 = '' OR m.status = $1 ORDER BY m.id DESC", status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := []manualResult{}
+	for rows.Next() {
+		m, err := scanManualResult(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, m)
+	}
+	return results, rows.Err()
+}
+
+func (repo *postgresRepository) RespondToManualResult(id int, status manualStatus, responder string) error {
+	defer dbQueryLatency.since("respond_to_manual_result", time.Now())
+	res, err := repo.db.Exec(
+		"UPDATE public.manual_result SET status = $1, responded_by = $2, responded_timestamp = EXTRACT(epoch FROM NOW()) * 1000 WHERE id = $3 AND status = $4",
+		status,
+		responder,
+		id,
+		manualPending)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (repo *postgresRepository) ConfirmManualResult(id int, responder string, g finishedGame) (int, error) {
+	defer dbQueryLatency.since("confirm_manual_result", time.Now())
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var blackTeam, yellowTeam int
+	var played int64
+	err = tx.QueryRow(
+		"UPDATE public.manual_result SET status = $1, responded_by = $2, responded_timestamp = EXTRACT(epoch FROM NOW()) * 1000 WHERE id = $3 AND status = $4 RETURNING black_team, yellow_team, played_timestamp",
+		manualConfirmed,
+		responder,
+		id,
+		manualPending).Scan(&blackTeam, &yellowTeam, &played)
+	if err == sql.ErrNoRows {
+		return 0, errNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	var gameID int
+	err = tx.QueryRow(
+		"INSERT INTO public.game(format, black_team, yellow_team, start_timestamp, end_timestamp, black_score, yellow_score, manual) VALUES ($1, $2, $3, $4, $4, $5, $6, TRUE) RETURNING id",
+		g.format,
+		blackTeam,
+		yellowTeam,
+		played,
+		g.blackScore,
+		g.yellowScore).Scan(&gameID)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range append(g.blackSide[:], g.yellowSide[:]...) {
+		if p.Sub == "" {
+			continue
+		}
+		_, err = tx.Exec("INSERT INTO public.game_goals(game_id, player_id, goals) VALUES ($1, $2, $3)", gameID, p.Sub, p.Goals)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err = tx.Exec("UPDATE public.manual_result SET game_id = $1 WHERE id = $2", gameID, id)
+	if err != nil {
+		return 0, err
+	}
+	return gameID, tx.Commit()
+}
+
+func (repo *postgresRepository) FindGame(blackTeam int, yellowTeam int, startTimestamp int64) (int, error) {
+	defer dbQueryLatency.since("find_game", time.Now())
+	var id int
+	err := repo.db.QueryRow(
+		"SELECT id FROM public.game WHERE black_team = $1 AND yellow_team = $2 AND start_timestamp = $3",
+		blackTeam,
+		yellowTeam,
+		startTimestamp).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, errNotFound
+	}
+	return id, err
+}
+
+func (repo *postgresRepository) ExportLeague() (leagueDump, error) {
+	defer dbQueryLatency.since("export_league", time.Now())
+	d := leagueDump{Players: []exportPlayer{}, Teams: []exportTeam{}, Games: []exportGame{}, Goals: []exportGoals{}}
+	tables := []struct {
+		query string
+		scan  func(s scanner) error
+	}{
+		{"SELECT id, name, COALESCE(picture, ''), COALESCE(guest_of, ''), COALESCE(claim_code, '') FROM public.player ORDER BY id", func(s scanner) error {
+			var p exportPlayer
+			err := s.Scan(&p.ID, &p.Name, &p.Picture, &p.GuestOf, &p.ClaimCode)
+			d.Players = append(d.Players, p)
+			return err
+		}},
+		{"SELECT id, city, name, player1, player2 FROM public.team ORDER BY id", func(s scanner) error {
+			var t exportTeam
+			err := s.Scan(&t.ID, &t.City, &t.Name, &t.Player1, &t.Player2)
+			d.Teams = append(d.Teams, t)
+			return err
+		}},
+		{"SELECT id, black_team, yellow_team, start_timestamp, COALESCE(end_timestamp, 0), COALESCE(black_score, 0), COALESCE(yellow_score, 0), format FROM public.game ORDER BY id", func(s scanner) error {
+			var g exportGame
+			err := s.Scan(&g.ID, &g.BlackTeam, &g.YellowTeam, &g.StartTimestamp, &g.EndTimestamp, &g.BlackScore, &g.YellowScore, &g.Format)
+			d.Games = append(d.Games, g)
+			return err
+		}},
+		{"SELECT game_id, player_id, goals FROM public.game_goals ORDER BY game_id, player_id", func(s scanner) error {
+			var g exportGoals
+			err := s.Scan(&g.GameID, &g.PlayerID, &g.Goals)
+			d.Goals = append(d.Goals, g)
+			return err
+		}},
+	}
+	for _, t := range tables {
+		rows, err := repo.db.Query(t.query)
+		if err != nil {
+			return leagueDump{}, err
+		}
+		for rows.Next() {
+			err := t.scan(rows)
+			if err != nil {
+				rows.Close()
+				return leagueDump{}, err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return leagueDump{}, err
+		}
+	}
+	return d, nil
+}
+
+func (repo *postgresRepository) ImportLeague(d leagueDump, teamIDs map[int]int) error {
+	defer dbQueryLatency.since("import_league", time.Now())
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, p := range d.Players {
+		_, err := tx.Exec(
+			"INSERT INTO public.player(id, name, picture, guest_of, claim_code) VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''))",
+			p.ID,
+			p.Name,
+			p.Picture,
+			p.GuestOf,
+			p.ClaimCode)
+		if err != nil {
+			return err
+		}
+	}
+	for _, t := range d.Teams {
+		var id int
+		err := tx.QueryRow(
+			"INSERT INTO public.team(city, name, player1, player2) VALUES ($1, $2, $3, $4) RETURNING id",
+			t.City,
+			t.Name,
+			t.Player1,
+			t.Player2).Scan(&id)
+		if err != nil {
+			return err
+		}
+		teamIDs[t.ID] = id
+	}
+	gameIDs := map[int]int{}
+	for _, g := range d.Games {
+		var id int
+		err := tx.QueryRow(
+			"INSERT INTO public.game(format, black_team, yellow_team, start_timestamp, end_timestamp, black_score, yellow_score) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+			g.Format,
+			teamIDs[g.BlackTeam],
+			teamIDs[g.YellowTeam],
+			g.StartTimestamp,
+			g.EndTimestamp,
+			g.BlackScore,
+			g.YellowScore).Scan(&id)
+		if err != nil {
+			return err
+		}
+		gameIDs[g.ID] = id
+	}
+	for _, g := range d.Goals {
+		_, err := tx.Exec("INSERT INTO public.game_goals(game_id, player_id, goals) VALUES ($1, $2, $3)", gameIDs[g.GameID], g.PlayerID, g.Goals)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (repo *postgresRepository) PlayerHistory(playerID string, format matchFormat) (playerHistory, error) {
+	defer dbQueryLatency.since("player_history", time.Now())
+	rows, err := repo.db.Query(`
+SELECT CASE WHEN $1 IN (bt.player1, bt.player2) THEN g.black_score > g.yellow_score ELSE g.yellow_score > g.black_score END,
+    COALESCE(gg.goals, 0)
+FROM public.game g
+JOIN public.team bt ON bt.id = g.black_team
+JOIN public.team yt ON yt.id = g.yellow_team
+LEFT JOIN public.game_goals gg ON gg.game_id = g.id AND gg.player_id = $1
+WHERE g.end_timestamp IS NOT NULL AND ($2 = '' OR g.format = $2)
+    AND $1 IN (bt.player1, bt.player2, yt.player1, yt.player2)
+ORDER BY g.end_timestamp DESC, g.id DESC`, playerID, format)
+	if err != nil {
+		return playerHistory{}, err
+	}
+	defer rows.Close()
+	var h playerHistory
+	streaking := true
+	for rows.Next() {
+		var won bool
+		var goals int
+		err := rows.Scan(&won, &goals)
+		if err != nil {
+			return playerHistory{}, err
+		}
+		h.Played++
+		h.Goals += goals
+		if streaking && won {
+			h.WinStreak++
+		} else {
+			streaking = false
+		}
+	}
+	return h, rows.Err()
+}
+
+func (repo *postgresRepository) AwardBadge(a badgeAward) error {
+	defer dbQueryLatency.since("award_badge", time.Now())
+	_, err := repo.db.Exec(
+		"INSERT INTO public.badge(player_id, badge, game_id) VALUES ($1, $2, $3)",
+		a.PlayerID,
+		a.Badge,
+		a.GameID)
+	return err
+}
+
+func (repo *postgresRepository) Badges(playerID string) ([]badgeAward, error) {
+	defer dbQueryLatency.since("badges", time.Now())
+	rows, err := repo.db.Query("SELECT player_id, badge, game_id, awarded_timestamp FROM public.badge WHERE player_id = $1 ORDER BY id DESC", playerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	badges := []badgeAward{}
+	for rows.Next() {
+		var a badgeAward
+		err := rows.Scan(&a.PlayerID, &a.Badge, &a.GameID, &a.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		a.Name = badgeNames[a.Badge]
+		badges = append(badges, a)
+	}
+	return badges, rows.Err()
+}
+
+func (repo *postgresRepository) Standings(format matchFormat) ([]standing, error) {
+	defer dbQueryLatency.since("standings", time.Now())
+	rows, err := repo.db.Query(`
+SELECT p.id, COALESCE(p.nickname, p.name),
+    COUNT(g.id),
+    COUNT(g.id) FILTER (WHERE (g.black_team = t.id AND g.black_score > g.yellow_score) OR (g.yellow_team = t.id AND g.yellow_score > g.black_score)),
+    COALESCE(SUM(gg.goals), 0)
+FROM public.player p
+JOIN public.team t ON p.id IN (t.player1, t.player2)
+JOIN public.game g ON t.id IN (g.black_team, g.yellow_team) AND g.end_timestamp IS NOT NULL
+LEFT JOIN public.game_goals gg ON gg.game_id = g.id AND gg.player_id = p.id
+WHERE $1 = '' OR g.format = $1
+GROUP BY p.id, p.name, p.nickname
+ORDER BY 4 DESC, 5 DESC, 2`, format)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	standings := []standing{}
+	for rows.Next() {
+		var s standing
+		err := rows.Scan(&s.PlayerID, &s.Name, &s.Played, &s.Won, &s.Goals)
+		if err != nil {
+			return nil, err
+		}
+		standings = append(standings, s)
+	}
+	return standings, rows.Err()
+}
+
+const challengeColumns = `
+SELECT c.id, c.stakes, c.issued_by, c.status, c.created_timestamp, COALESCE(c.responded_timestamp, 0), COALESCE(c.game_id, 0),
+    a.id, a.city, a.name, b.id, b.city, b.name
+FROM public.challenge c
+JOIN public.team a ON a.id = c.challenger_team
+JOIN public.team b ON b.id = c.challenged_team`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanChallenge(row scanner) (challenge, error) {
+	var c challenge
+	err := row.Scan(&c.ID, &c.Stakes, &c.IssuedBy, &c.Status, &c.CreatedTimestamp, &c.RespondedTimestamp, &c.GameID,
+		&c.Challenger.ID, &c.Challenger.City, &c.Challenger.Name,
+		&c.Challenged.ID, &c.Challenged.City, &c.Challenged.Name)
+	return c, err
+}
+
+func (repo *postgresRepository) CreateChallenge(c challenge) (int, error) {
+	defer dbQueryLatency.since("create_challenge", time.Now())
+	var id int
+	err := repo.db.QueryRow(
+		"INSERT INTO public.challenge(challenger_team, challenged_team, stakes, issued_by) VALUES ($1, $2, $3, $4) RETURNING id",
+		c.Challenger.ID,
+		c.Challenged.ID,
+		c.Stakes,
+		c.IssuedBy).Scan(&id)
+	return id, err
+}
+
+func (repo *postgresRepository) GetChallenge(id int) (challenge, error) {
+	defer dbQueryLatency.since("get_challenge", time.Now())
+	c, err := scanChallenge(repo.db.QueryRow(challengeColumns+" WHERE c.id = $1", id))
+	if err == sql.ErrNoRows {
+		return challenge{}, errNotFound
+	}
+	return c, err
+}
+
+func (repo *postgresRepository) Challenges(status challengeStatus) ([]challenge, error) {
+	defer dbQueryLatency.since("challenges", time.Now())
+	rows, err := repo.db.Query(challengeColumns+" WHERE $1 = '' OR c.status = $1 ORDER BY c.id DESC", status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	challenges := []challenge{}
+	for rows.Next() {
+		c, err := scanChallenge(rows)
+		if err != nil {
+			return nil, err
+		}
+		challenges = append(challenges, c)
+	}
+	return challenges, rows.Err()
+}
+
+func (repo *postgresRepository) RespondToChallenge(id int, status challengeStatus) error {
+	defer dbQueryLatency.since("respond_to_challenge", time.Now())
+	res, err := repo.db.Exec(
+		"UPDATE public.challenge SET status = $1, responded_timestamp = EXTRACT(epoch FROM NOW()) * 1000 WHERE id = $2 AND status = $3",
+		status,
+		id,
+		challengePending)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (repo *postgresRepository) ChallengePlayed(id int, gameID int) error {
+	defer dbQueryLatency.since("challenge_played", time.Now())
+	_, err := repo.db.Exec("UPDATE public.challenge SET status = $1, game_id = $2 WHERE id = $3", challengePlayed, gameID, id)
+	return err
+}
+
+func (repo *postgresRepository) CreateRotation(s rotationSession) (int, error) {
+	defer dbQueryLatency.since("create_rotation", time.Now())
+	var id int
+	err := repo.db.QueryRow(
+		"INSERT INTO public.rotation(table_name, format, goals_to_win) VALUES ($1, $2, $3) RETURNING id",
+		s.Table,
+		s.Format,
+		s.GoalsToWin).Scan(&id)
+	return id, err
+}
+
+func (repo *postgresRepository) GetRotation(id int) (rotationSession, error) {
+	defer dbQueryLatency.since("get_rotation", time.Now())
+	var s rotationSession
+	err := repo.db.QueryRow(
+		"SELECT id, table_name, format, goals_to_win, started_timestamp, COALESCE(ended_timestamp, 0) FROM public.rotation WHERE id = $1",
+		id).Scan(&s.ID, &s.Table, &s.Format, &s.GoalsToWin, &s.StartedTimestamp, &s.EndedTimestamp)
+	if err == sql.ErrNoRows {
+		return rotationSession{}, errNotFound
+	}
+	return s, err
+}
+
+func (repo *postgresRepository) EndRotation(id int) error {
+	defer dbQueryLatency.since("end_rotation", time.Now())
+	_, err := repo.db.Exec(
+		"UPDATE public.rotation SET ended_timestamp = EXTRACT(epoch FROM NOW()) * 1000 WHERE id = $1 AND ended_timestamp IS NULL",
+		id)
+	return err
+}
+
+func (repo *postgresRepository) RotationGamePlayed(id int, gameID int) error {
+	defer dbQueryLatency.since("rotation_game_played", time.Now())
+	_, err := repo.db.Exec("UPDATE public.game SET rotation_id = $1 WHERE id = $2", id, gameID)
+	return err
+}
+
+func (repo *postgresRepository) RotationGames(id int) ([]rotationGame, error) {
+	defer dbQueryLatency.since("rotation_games", time.Now())
+	rows, err := repo.db.Query(`
+SELECT g.id, g.black_score > g.yellow_score, bt.player1, bt.player2, yt.player1, yt.player2
+FROM public.game g
+JOIN public.team bt ON bt.id = g.black_team
+JOIN public.team yt ON yt.id = g.yellow_team
+WHERE g.rotation_id = $1 AND g.end_timestamp IS NOT NULL
+ORDER BY g.end_timestamp, g.id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	games := []rotationGame{}
+	for rows.Next() {
+		var g rotationGame
+		var blackWon bool
+		var black1, black2, yellow1, yellow2 string
+		err := rows.Scan(&g.GameID, &blackWon, &black1, &black2, &yellow1, &yellow2)
+		if err != nil {
+			return nil, err
+		}
+		g.Winners, g.Losers = teamPlayers(black1, black2), teamPlayers(yellow1, yellow2)
+		if !blackWon {
+			g.Winners, g.Losers = g.Losers, g.Winners
+		}
+		games = append(games, g)
+	}
+	return games, rows.Err()
+}
+
+func (repo *postgresRepository) LinkChatUser(chatUserID string, playerID string) error {
+	defer dbQueryLatency.since("link_chat_user", time.Now())
+	_, err := repo.db.Exec(
+		"INSERT INTO public.chat_link(chat_user_id, player_id) VALUES ($1, $2) ON CONFLICT (chat_user_id) DO UPDATE SET player_id = EXCLUDED.player_id, linked_timestamp = EXTRACT(epoch FROM NOW()) * 1000",
+		chatUserID,
+		playerID)
+	return err
+}
+
+func (repo *postgresRepository) ChatPlayer(chatUserID string) (string, error) {
+	defer dbQueryLatency.since("chat_player", time.Now())
+	var playerID string
+	err := repo.db.QueryRow("SELECT player_id FROM public.chat_link WHERE chat_user_id = $1", chatUserID).Scan(&playerID)
+	if err == sql.ErrNoRows {
+		return "", errNotFound
+	}
+	return playerID, err
+}
+
+const sessionColumns = `
+SELECT id, player_id, refresh_hash, COALESCE(previous_refresh_hash, ''), user_agent, created_timestamp, refreshed_timestamp, expires_timestamp, COALESCE(revoked_timestamp, 0)
+FROM public.session`
+
+func scanSession(row scanner) (sessionRecord, error) {
+	var s sessionRecord
+	err := row.Scan(&s.ID, &s.PlayerID, &s.RefreshHash, &s.PreviousRefreshHash, &s.UserAgent, &s.CreatedTimestamp, &s.RefreshedTimestamp, &s.ExpiresTimestamp, &s.RevokedTimestamp)
+	return s, err
+}
+
+func (repo *postgresRepository) CreateSession(s sessionRecord) error {
+	defer dbQueryLatency.since("create_session", time.Now())
+	_, err := repo.db.Exec(
+		"INSERT INTO public.session(id, player_id, refresh_hash, user_agent, created_timestamp, refreshed_timestamp, expires_timestamp) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		s.ID,
+		s.PlayerID,
+		s.RefreshHash,
+		s.UserAgent,
+		s.CreatedTimestamp,
+		s.RefreshedTimestamp,
+		s.ExpiresTimestamp)
+	return err
+}
+
+func (repo *postgresRepository) GetSession(id string) (sessionRecord, error) {
+	defer dbQueryLatency.since("get_session", time.Now())
+	s, err := scanSession(repo.db.QueryRow(sessionColumns+" WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return sessionRecord{}, errNotFound
+	}
+	return s, err
+}
+
+func (repo *postgresRepository) RotateSession(id string, oldHash string, newHash string, expiresTimestamp int64) error {
+	defer dbQueryLatency.since("rotate_session", time.Now())
+	res, err := repo.db.Exec(
+		"UPDATE public.session SET previous_refresh_hash = refresh_hash, refresh_hash = $1, expires_timestamp = $2, refreshed_timestamp = EXTRACT(epoch FROM NOW()) * 1000 WHERE id = $3 AND refresh_hash = $4 AND revoked_timestamp IS NULL",
+		newHash,
+		expiresTimestamp,
+		id,
+		oldHash)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (repo *postgresRepository) RevokeSession(id string) error {
+	defer dbQueryLatency.since("revoke_session", time.Now())
+	_, err := repo.db.Exec("UPDATE public.session SET revoked_timestamp = EXTRACT(epoch FROM NOW()) * 1000 WHERE id = $1 AND revoked_timestamp IS NULL", id)
+	return err
+}
+
+func (repo *postgresRepository) RevokePlayerSessions(playerID string) error {
+	defer dbQueryLatency.since("revoke_player_sessions", time.Now())
+	_, err := repo.db.Exec("UPDATE public.session SET revoked_timestamp = EXTRACT(epoch FROM NOW()) * 1000 WHERE player_id = $1 AND revoked_timestamp IS NULL", playerID)
+	return err
+}
+
+func (repo *postgresRepository) PlayerSessions(playerID string) ([]sessionRecord, error) {
+	defer dbQueryLatency.since("player_sessions", time.Now())
+	rows, err := repo.db.Query(
+		sessionColumns+" WHERE player_id = $1 AND revoked_timestamp IS NULL AND expires_timestamp > EXTRACT(epoch FROM NOW()) * 1000 ORDER BY refreshed_timestamp DESC, created_timestamp DESC",
+		playerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []sessionRecord{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+func (repo *postgresRepository) SaveHubState(table string, state string) error {
+	defer dbQueryLatency.since("save_hub_state", time.Now())
+	_, err := repo.db.Exec(
+		"INSERT INTO public.hub_state(table_id, state) VALUES ($1, $2) ON CONFLICT (table_id) DO UPDATE SET state = $2, saved_timestamp = EXTRACT(epoch FROM NOW()) * 1000",
+		table,
+		state)
+	return err
+}
+
+func (repo *postgresRepository) LoadHubState(table string) (string, error) {
+	defer dbQueryLatency.since("load_hub_state", time.Now())
+	var state string
+	err := repo.db.QueryRow("SELECT state FROM public.hub_state WHERE table_id = $1", table).Scan(&state)
+	if err == sql.ErrNoRows {
+		return "", errNotFound
+	}
+	return state, err
+}
+
+func (repo *postgresRepository) DeleteHubState(table string) error {
+	defer dbQueryLatency.since("delete_hub_state", time.Now())
+	_, err := repo.db.Exec("DELETE FROM public.hub_state WHERE table_id = $1", table)
+	return err
+}
+
+func (repo *postgresRepository) RecordWebhookDelivery(d webhookDelivery) error {
+	defer dbQueryLatency.since("record_webhook_delivery", time.Now())
+	_, err := repo.db.Exec("INSERT INTO public.webhook_delivery(event_id, event_type, url, attempt, status_code, error, delivered, delivery_timestamp) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		d.EventID, d.EventType, d.URL, d.Attempt, d.StatusCode, d.Error, d.Delivered, d.Timestamp)
+	return err
+}
+
+func (repo *postgresRepository) WebhookDeliveries(limit int) ([]webhookDelivery, error) {
+	defer dbQueryLatency.since("webhook_deliveries", time.Now())
+	rows, err := repo.db.Query("SELECT event_id, event_type, url, attempt, status_code, error, delivered, delivery_timestamp FROM public.webhook_delivery ORDER BY id DESC LIMIT $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []webhookDelivery{}
+	for rows.Next() {
+		var d webhookDelivery
+		err := rows.Scan(&d.EventID, &d.EventType, &d.URL, &d.Attempt, &d.StatusCode, &d.Error, &d.Delivered, &d.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (repo *postgresRepository) Ping(ctx context.Context) error {
+	return repo.db.PingContext(ctx)
+}
+
+func (repo *postgresRepository) PendingMigrations() (int, error) {
+	planned, _, err := migrate.PlanMigration(repo.db, postgresDriver, repo.migrations(), migrate.Up, 0)
+	if err != nil {
+		return 0, err
+	}
+	return len(planned), nil
+}
+
+func (repo *postgresRepository) Close() error {
+	return repo.db.Close()
+}
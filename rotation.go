@@ -0,0 +1,439 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// A rotation is king-of-the-table play from a pool of players present at the
+// table. The hub seats players from the front of the line, games are played to
+// a shorter target, the winners keep their side and the losers rejoin the back
+// of the line. The games are recorded as usual and grouped into a session.
+
+// Seating actions the hub takes over while a rotation is running.
+var rotationSeating = map[string]bool{
+	"register game": true,
+	"unregister":    true,
+	"add guest":     true,
+	"set format":    true,
+}
+
+// rotation is the rotation session running on a table. Guarded by sideMx.
+type rotation struct {
+	ID         int `json:"id"`
+	GoalsToWin int `json:"goals_to_win"`
+	// Players waiting for a seat, next up first.
+	Line []string `json:"line"`
+
+	// The winners of the last game, waiting to be put back on their side.
+	stay     [2]player
+	staySide string
+}
+
+// rotationSession is a stored rotation session.
+type rotationSession struct {
+	ID               int         `json:"id"`
+	Table            string      `json:"table"`
+	Format           matchFormat `json:"format"`
+	GoalsToWin       int         `json:"goals_to_win"`
+	StartedTimestamp int64       `json:"started_timestamp"`
+	EndedTimestamp   int64       `json:"ended_timestamp,omitempty"`
+}
+
+// rotationGame is a finished game of a rotation session.
+type rotationGame struct {
+	GameID  int
+	Winners []string
+	Losers  []string
+}
+
+// rotationStanding is a player's record over the games of a rotation session.
+type rotationStanding struct {
+	PlayerID string `json:"player_id"`
+	Name     string `json:"name"`
+	Played   int    `json:"played"`
+	Won      int    `json:"won"`
+	// The most games won in a row.
+	BestStreak int `json:"best_streak"`
+}
+
+// teamPlayers returns the players of a team, once each.
+func teamPlayers(player1 string, player2 string) []string {
+	if player1 == player2 {
+		return []string{player1}
+	}
+	return []string{player1, player2}
+}
+
+// startRotation starts a rotation session of the requested format, or of the
+// table's format if none is given, with the player who started it first in
+// line.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func startRotation(h *hub, cm *dcflMsg) (string, bool) {
+	if h.rotation != nil {
+		h.reject(cm, "a rotation is already running")
+		return "", false
+	}
+	f, err := parseFormat(cm.Format)
+	if err != nil {
+		h.reject(cm, err.Error())
+		return "", false
+	}
+	if f == "" {
+		f = h.format
+	}
+	if h.blackSide != [2]player{} || h.yellowSide != [2]player{} {
+		h.reject(cm, "a rotation can only start while the table is empty")
+		return "", false
+	}
+	log := h.logFor(cm)
+	_, err = h.repo.GetPlayer(cm.Sub)
+	if err == errNotFound {
+		h.reject(cm, "unknown player")
+		return "", false
+	} else if err != nil {
+		log.Error("error getting player", "err", err)
+		return "", false
+	}
+
+	id, err := h.repo.CreateRotation(rotationSession{Table: h.table, Format: f, GoalsToWin: h.rules.RotationGoalsToWin})
+	if err != nil {
+		log.Error("error creating rotation", "err", err)
+		return "", false
+	}
+	log.Info("rotation started", "rotation", id, "format", f, "goals_to_win", h.rules.RotationGoalsToWin)
+	h.format = f
+	h.rotation = &rotation{ID: id, GoalsToWin: h.rules.RotationGoalsToWin, Line: []string{cm.Sub}}
+	h.unqueue(cm.Sub)
+	h.seatRotation()
+	return "Rotation started", true
+}
+
+// joinRotation adds the player to the back of the line.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func joinRotation(h *hub, cm *dcflMsg) (string, bool) {
+	if h.rotation == nil {
+		h.reject(cm, "no rotation is running")
+		return "", false
+	}
+	if h.inRotation(cm.Sub) {
+		h.reject(cm, "already in the rotation")
+		return "", false
+	}
+	_, err := h.repo.GetPlayer(cm.Sub)
+	if err == errNotFound {
+		h.reject(cm, "unknown player")
+		return "", false
+	} else if err != nil {
+		h.logFor(cm).Error("error getting player", "err", err)
+		return "", false
+	}
+	h.rotation.Line = append(h.rotation.Line, cm.Sub)
+	h.unqueue(cm.Sub)
+	h.logFor(cm).Info("joined rotation", "rotation", h.rotation.ID, "position", len(h.rotation.Line))
+	return h.seatRotation()
+}
+
+// leaveRotation takes the player out of the rotation. Leaving a game in play
+// abandons it.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func leaveRotation(h *hub, cm *dcflMsg) (string, bool) {
+	if !h.inRotation(cm.Sub) {
+		h.reject(cm, "not in the rotation")
+		return "", false
+	}
+	h.logFor(cm).Info("left rotation", "rotation", h.rotation.ID)
+	broadcast, reset := h.dropFromRotation(cm.Sub, cm.conn)
+	if b, r := h.settleRotation(); r {
+		return b, r
+	}
+	return broadcast, reset
+}
+
+// endRotation ends the session on behalf of one of its players and clears the
+// table.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func endRotation(h *hub, cm *dcflMsg) (string, bool) {
+	if !h.inRotation(cm.Sub) {
+		h.reject(cm, "only players in the rotation can end it")
+		return "", false
+	}
+	h.logFor(cm).Info("ending rotation", "rotation", h.rotation.ID)
+	return h.stopRotation()
+}
+
+// inRotation reports whether sub is waiting in line or seated in the running
+// rotation.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) inRotation(sub string) bool {
+	if h.rotation == nil {
+		return false
+	}
+	for _, s := range h.rotation.Line {
+		if s == sub {
+			return true
+		}
+	}
+	return h.seated(sub)
+}
+
+// dropFromRotation takes sub out of the line, and out of their seat if they
+// have one.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) dropFromRotation(sub string, conn *connection) (string, bool) {
+	r := h.rotation
+	for i, s := range r.Line {
+		if s == sub {
+			r.Line = append(r.Line[:i], r.Line[i+1:]...)
+			break
+		}
+	}
+	if side := h.sideOf(sub); side != "" {
+		return unregisterGame(h, &dcflMsg{Sub: sub, Side: side, conn: conn})
+	}
+	return "", false
+}
+
+// settleRotation ends the running rotation once nobody is left in it, and
+// fills the free seats otherwise.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) settleRotation() (string, bool) {
+	if h.rotation == nil {
+		return "", false
+	}
+	if len(h.rotation.Line) == 0 && h.blackSide == [2]player{} && h.yellowSide == [2]player{} {
+		return h.stopRotation()
+	}
+	return h.seatRotation()
+}
+
+// stopRotation ends the running rotation session and clears the table.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) stopRotation() (string, bool) {
+	r := h.rotation
+	h.rotation = nil
+	err := h.repo.EndRotation(r.ID)
+	if err != nil {
+		h.log().Error("error ending rotation", "rotation", r.ID, "err", err)
+	}
+	h.log().Info("rotation over", "rotation", r.ID)
+	h.scoreMx.Lock()
+	defer h.scoreMx.Unlock()
+	h.reset()
+	return "Rotation over", true
+}
+
+// seatRotation puts the winners of the last game back on their side and fills
+// the free seats from the front of the line. Newly seated players confirm as
+// usual, so a game is only started here when everyone was already seated.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) seatRotation() (string, bool) {
+	r := h.rotation
+	if r == nil || h.gameStarted() {
+		return "", false
+	}
+	if r.staySide == "black" {
+		h.blackSide = r.stay
+	} else if r.staySide == "yellow" {
+		h.yellowSide = r.stay
+	}
+	r.stay, r.staySide = [2]player{}, ""
+
+	for _, side := range []*[2]player{&h.blackSide, &h.yellowSide} {
+		for i := range side[:h.format.seats()] {
+			for side[i] == (player{}) && len(r.Line) > 0 {
+				sub := r.Line[0]
+				r.Line = r.Line[1:]
+				record, err := h.repo.GetPlayer(sub)
+				if err != nil {
+					h.log().Error("error seating player from rotation", "rotation", r.ID, "sub", sub, "err", err)
+					continue
+				}
+				side[i] = record.seat()
+				h.log().Info("seated from rotation", "rotation", r.ID, "sub", sub)
+			}
+		}
+	}
+
+	// Players who stayed on have confirmed already, so their team is looked up
+	// here rather than on confirmation.
+	for _, s := range []struct {
+		players [2]player
+		team    *team
+	}{{h.blackSide, &h.blackTeam}, {h.yellowSide, &h.yellowTeam}} {
+		if *s.team != (team{}) || !h.full(s.players) || !h.confirmed(s.players) {
+			continue
+		}
+		player1, player2 := h.format.pair(s.players)
+		t, err := getTeam(h.repo, player1, player2)
+		if err != nil {
+			h.log().Error("error getting team", "err", err)
+			continue
+		}
+		*s.team = t
+	}
+	return h.advance()
+}
+
+// rotate puts the players at the table back into the rotation before the seats
+// are cleared. After a finished game the winners stay on their side and the
+// losers rejoin the back of the line; otherwise the players still seated go
+// back to the front of the line in seat order.
+// This function assumes and requires the caller to have the sideMx and scoreMx locks acquired.
+func (h *hub) rotate() {
+	r := h.rotation
+	if r == nil {
+		return
+	}
+	if h.phase != phaseFinished {
+		var seated []string
+		for _, p := range h.lineup() {
+			if p.Sub != "" {
+				seated = append(seated, p.Sub)
+			}
+		}
+		r.Line = append(seated, r.Line...)
+		return
+	}
+
+	winners, losers, side := h.blackSide, h.yellowSide, "black"
+	if h.yellowScore > h.blackScore {
+		winners, losers, side = h.yellowSide, h.blackSide, "yellow"
+	}
+	for i := range winners {
+		winners[i].Goals = 0
+	}
+	r.stay, r.staySide = winners, side
+	for _, p := range losers[:h.format.seats()] {
+		if p.Sub != "" {
+			r.Line = append(r.Line, p.Sub)
+		}
+	}
+}
+
+// rotationGameStarted adds the game that just started to the running session.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) rotationGameStarted() {
+	if h.rotation == nil {
+		return
+	}
+	err := h.repo.RotationGamePlayed(h.rotation.ID, h.gameID)
+	if err != nil {
+		h.log().Error("error adding game to rotation", "rotation", h.rotation.ID, "err", err)
+	}
+}
+
+// currentRules returns the rules the current game is played by. Rotation games
+// are played to their own target.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) currentRules() matchRules {
+	rules := h.rules
+	if h.rotation != nil {
+		rules.GoalsToWin = h.rotation.GoalsToWin
+	}
+	return rules
+}
+
+// rotationLine returns the id of the running rotation and the players waiting
+// in it, next up first, or 0 if no rotation is running.
+func (h *hub) rotationLine() (int, []string) {
+	h.sideMx.RLock()
+	defer h.sideMx.RUnlock()
+	if h.rotation == nil {
+		return 0, nil
+	}
+	return h.rotation.ID, append([]string(nil), h.rotation.Line...)
+}
+
+// rotationLeaderboard ranks the players of a session by the most games they
+// won in a row, then by wins.
+func rotationLeaderboard(repo repository, games []rotationGame) ([]rotationStanding, error) {
+	byPlayer := map[string]*rotationStanding{}
+	streaks := map[string]int{}
+	get := func(sub string) *rotationStanding {
+		s, ok := byPlayer[sub]
+		if !ok {
+			s = &rotationStanding{PlayerID: sub}
+			byPlayer[sub] = s
+		}
+		return s
+	}
+	for _, g := range games {
+		for _, sub := range g.Winners {
+			s := get(sub)
+			s.Played++
+			s.Won++
+			streaks[sub]++
+			if streaks[sub] > s.BestStreak {
+				s.BestStreak = streaks[sub]
+			}
+		}
+		for _, sub := range g.Losers {
+			get(sub).Played++
+			streaks[sub] = 0
+		}
+	}
+
+	standings := []rotationStanding{}
+	for sub, s := range byPlayer {
+		p, err := repo.GetPlayer(sub)
+		if err != nil && err != errNotFound {
+			return nil, err
+		}
+		s.Name = p.displayName()
+		standings = append(standings, *s)
+	}
+	sort.Slice(standings, func(i, j int) bool {
+		a, b := standings[i], standings[j]
+		if a.BestStreak != b.BestStreak {
+			return a.BestStreak > b.BestStreak
+		}
+		if a.Won != b.Won {
+			return a.Won > b.Won
+		}
+		return a.Name < b.Name
+	})
+	return standings, nil
+}
+
+// rotationHandler returns a rotation session with its leaderboard, and the
+// line of players waiting while it is running.
+type rotationHandler struct {
+	h    *hub
+	repo repository
+}
+
+func (rh rotationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	s, err := rh.repo.GetRotation(id)
+	if err == errNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	games, err := rh.repo.RotationGames(id)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	leaderboard, err := rotationLeaderboard(rh.repo, games)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	var line []string
+	if running, waiting := rh.h.rotationLine(); running == id {
+		line = waiting
+	}
+	writeJSON(w, http.StatusOK, struct {
+		rotationSession
+		Games       int                `json:"games"`
+		Line        []string           `json:"line,omitempty"`
+		Leaderboard []rotationStanding `json:"leaderboard"`
+	}{s, len(games), line, leaderboard})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+type rotationReport struct {
+	rotationSession
+	Games       int                `json:"games"`
+	Line        []string           `json:"line"`
+	Leaderboard []rotationStanding `json:"leaderboard"`
+}
+
+// playRotationGame has scorer score until the rotation target is reached and
+// returns the state the table is left in.
+func playRotationGame(ts *testServer, scorer *testClient) matchState {
+	ts.t.Helper()
+	var state matchState
+	for i := 0; i < 3; i++ {
+		scorer.goal()
+		state = ts.expectState()
+	}
+	ts.expectMessage("Game Over")
+	return state
+}
+
+func TestRotation(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3")
+	clients := map[string]*testClient{}
+	for _, sub := range []string{"1", "2", "3"} {
+		clients[sub] = ts.connect(sub)
+		ts.repo.CreateTeam("City "+sub, "Solo "+sub, sub, sub)
+	}
+
+	clients["2"].send(dcflMsg{Action: "join rotation"})
+	clients["2"].expectRejection("no rotation is running")
+	clients["1"].send(dcflMsg{Action: "start rotation", Format: "singles"})
+	state := ts.expectState()
+	ts.expectMessage("Rotation started")
+	if state.RotationID != 1 || state.Format != formatSingles || state.BlackPlayer1.Sub != "1" || state.Phase != phaseOpen {
+		t.Fatalf("expected the starter to be seated, got %+v", state)
+	}
+	clients["2"].send(dcflMsg{Action: "start rotation"})
+	clients["2"].expectRejection("a rotation is already running")
+	clients["2"].send(dcflMsg{Action: "join rotation"})
+	if state := ts.expectState(); state.YellowPlayer1.Sub != "2" || state.Phase != phaseAwaitingConfirmations {
+		t.Fatalf("expected the next player to be seated, got %+v", state)
+	}
+	clients["3"].send(dcflMsg{Action: "join rotation"})
+	ts.expectState()
+	clients["3"].send(dcflMsg{Action: "join rotation"})
+	clients["3"].expectRejection("already in the rotation")
+	clients["3"].register("black")
+	clients["3"].expectRejection("seats are assigned by the rotation")
+
+	// 2 beats 1 and stays, 3 comes on.
+	clients["1"].confirm("black")
+	ts.expectState()
+	clients["2"].confirm("yellow")
+	if state := ts.expectState(); !state.GameStarted {
+		t.Fatalf("expected the game to start, got %+v", state)
+	}
+	state = playRotationGame(ts, clients["2"])
+	if state.Phase != phaseAwaitingConfirmations || state.YellowPlayer1.Sub != "2" || !state.YellowPlayer1.Confirmed ||
+		state.YellowPlayer1.Goals != 0 || state.YellowTeam.Name != "Solo 2" || state.BlackPlayer1.Sub != "3" || state.BlackPlayer1.Confirmed {
+		t.Fatalf("expected the winner to stay and the next player to come on, got %+v", state)
+	}
+
+	// 2 beats 3, then 1 beats 2.
+	clients["3"].confirm("black")
+	ts.expectState()
+	playRotationGame(ts, clients["2"])
+	clients["1"].confirm("black")
+	ts.expectState()
+	state = playRotationGame(ts, clients["1"])
+	if state.BlackPlayer1.Sub != "1" || state.YellowPlayer1.Sub != "3" {
+		t.Fatalf("expected 1 to stay on black against 3, got %+v", state)
+	}
+
+	var report rotationReport
+	if code := ts.get("/rotations/1", &report); code != http.StatusOK {
+		t.Fatalf("expected the rotation, got %d", code)
+	}
+	if report.Games != 3 || report.GoalsToWin != 3 || report.Format != formatSingles || len(report.Line) != 1 || report.Line[0] != "2" {
+		t.Fatalf("unexpected rotation %+v", report)
+	}
+	want := []rotationStanding{
+		{PlayerID: "2", Name: "Player 2", Played: 3, Won: 2, BestStreak: 2},
+		{PlayerID: "1", Name: "Player 1", Played: 2, Won: 1, BestStreak: 1},
+		{PlayerID: "3", Name: "Player 3", Played: 1, Won: 0, BestStreak: 0},
+	}
+	if len(report.Leaderboard) != len(want) {
+		t.Fatalf("expected %+v, got %+v", want, report.Leaderboard)
+	}
+	for i := range want {
+		if report.Leaderboard[i] != want[i] {
+			t.Fatalf("expected %+v, got %+v", want, report.Leaderboard)
+		}
+	}
+	games, _ := ts.repo.RecentGames(10)
+	if len(games) != 3 {
+		t.Fatalf("expected the rotation games to be recorded as games, got %+v", games)
+	}
+
+	// Leaving gives the seat to the next in line.
+	clients["3"].send(dcflMsg{Action: "leave rotation"})
+	if state := ts.expectState(); state.YellowPlayer1.Sub != "2" {
+		t.Fatalf("expected 2 to take the free seat, got %+v", state)
+	}
+	clients["3"].send(dcflMsg{Action: "end rotation"})
+	clients["3"].expectRejection("only players in the rotation can end it")
+	clients["1"].send(dcflMsg{Action: "end rotation"})
+	state = ts.expectState()
+	ts.expectMessage("Rotation over")
+	if state != (matchState{Phase: phaseOpen, Format: formatSingles}) {
+		t.Fatalf("expected the table to be cleared, got %+v", state)
+	}
+	report = rotationReport{}
+	ts.get("/rotations/1", &report)
+	if report.EndedTimestamp == 0 || len(report.Line) != 0 {
+		t.Fatalf("expected the rotation to be over, got %+v", report)
+	}
+	if code := ts.get("/rotations/2", nil); code != http.StatusNotFound {
+		t.Fatalf("expected an unknown rotation to be missing, got %d", code)
+	}
+}
+
+func TestRotationPlayersLeave(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4", "5")
+	clients := map[string]*testClient{}
+	for _, sub := range []string{"1", "2", "3", "4", "5"} {
+		clients[sub] = ts.connect(sub)
+	}
+	clients["1"].send(dcflMsg{Action: "start rotation"})
+	ts.expectState()
+	ts.expectMessage("Rotation started")
+	for _, sub := range []string{"2", "3", "4", "5"} {
+		clients[sub].send(dcflMsg{Action: "join rotation"})
+		ts.expectState()
+	}
+
+	// A seated player who disconnects is replaced from the line.
+	ts.disconnect(clients["4"])
+	state := ts.expectState()
+	if state.YellowPlayer2.Sub != "5" || state.Phase != phaseAwaitingConfirmations {
+		t.Fatalf("expected 5 to replace 4, got %+v", state)
+	}
+
+	// Abandoning a game puts the others back at the front of the line.
+	ts.repo.CreateTeam("Chicago", "Blackhawks", "1", "2")
+	ts.repo.CreateTeam("Boston", "Bruins", "3", "5")
+	for _, c := range []struct{ sub, side string }{{"1", "black"}, {"2", "black"}, {"3", "yellow"}, {"5", "yellow"}} {
+		clients[c.sub].confirm(c.side)
+		state = ts.expectState()
+	}
+	if !state.GameStarted {
+		t.Fatalf("expected the game to start, got %+v", state)
+	}
+	clients["3"].send(dcflMsg{Action: "leave rotation"})
+	state = ts.expectState()
+	ts.expectMessage("Player left mid-game")
+	if state.GameStarted || state.BlackPlayer1.Sub != "1" || state.BlackPlayer2.Sub != "2" || state.YellowPlayer1.Sub != "5" || state.YellowPlayer2.Sub != "" {
+		t.Fatalf("expected the remaining players to be seated again, got %+v", state)
+	}
+
+	// The rotation ends once everyone has left.
+	for _, sub := range []string{"1", "2"} {
+		clients[sub].send(dcflMsg{Action: "leave rotation"})
+		ts.expectState()
+	}
+	clients["5"].send(dcflMsg{Action: "leave rotation"})
+	state = ts.expectState()
+	ts.expectMessage("Rotation over")
+	if state.RotationID != 0 {
+		t.Fatalf("expected the rotation to be over, got %+v", state)
+	}
+	if s, _ := ts.repo.GetRotation(1); s.EndedTimestamp == 0 {
+		t.Fatalf("expected the session to be ended, got %+v", s)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// Finished games listed under the scoreboard.
+const recentResults = 5
+
+//go:embed scoreboard.html
+var scoreboardHTML string
+
+var scoreboardTemplate = template.Must(template.New("scoreboard").Funcs(template.FuncMap{
+	"clock":  matchClock,
+	"result": formatResultTime,
+}).Parse(scoreboardHTML))
+
+type scoreboardPage struct {
+	Table  string
+	State  matchState
+	Recent []gameResult
+	// Render time in milliseconds, used for the initial match clock.
+	Now int64
+}
+
+// matchClock formats the time played in a match as minutes and seconds.
+func matchClock(state matchState, now int64) string {
+	if state.StartedAt == 0 {
+		return "0:00"
+	}
+	end := now
+	if state.PausedAt != 0 {
+		end = state.PausedAt
+	}
+	elapsed := time.Duration(end-state.StartedAt-state.PausedMillis) * time.Millisecond
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return fmt.Sprintf("%d:%02d", int(elapsed.Minutes()), int(elapsed.Seconds())%60)
+}
+
+func formatResultTime(millis int64) string {
+	return time.Unix(0, millis*int64(time.Millisecond)).Format("Jan 2 15:04")
+}
+
+// scoreboardHandler renders a live scoreboard for a table, meant to be left
+// open on a TV. The page keeps itself up to date from the table's event
+// stream.
+type scoreboardHandler struct {
+	h    *hub
+	repo repository
+}
+
+func (sh scoreboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sh.h.sideMx.RLock()
+	state := sh.h.state()
+	sh.h.sideMx.RUnlock()
+
+	recent, err := sh.repo.RecentGames(recentResults)
+	if err != nil {
+		logger.Error("error loading recent games", "err", err)
+		recent = nil
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page := scoreboardPage{Table: sh.h.table, State: state, Recent: recent, Now: nowMillis()}
+	err = scoreboardTemplate.Execute(w, page)
+	if err != nil {
+		logger.Error("error rendering scoreboard", "err", err)
+	}
+}
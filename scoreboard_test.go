@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMatchClock(t *testing.T) {
+	cases := []struct {
+		state matchState
+		now   int64
+		want  string
+	}{
+		{matchState{}, 5000, "0:00"},
+		{matchState{StartedAt: 1000}, 66000, "1:05"},
+		{matchState{StartedAt: 1000, PausedMillis: 60000}, 66000, "0:05"},
+		{matchState{StartedAt: 1000, PausedAt: 31000, PausedMillis: 10000}, 99000, "0:20"},
+	}
+	for _, c := range cases {
+		if got := matchClock(c.state, c.now); got != c.want {
+			t.Errorf("matchClock(%+v, %d) = %s, want %s", c.state, c.now, got, c.want)
+		}
+	}
+}
+
+func scoreboard(t *testing.T, ts *testServer) string {
+	t.Helper()
+	resp, err := http.Get(ts.srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("unexpected scoreboard response %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestScoreboard(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	b1, _, _, _ := setUpMatch(ts)
+	b1.goal()
+	state := ts.expectState()
+	if state.StartedAt == 0 {
+		t.Fatalf("expected the match clock to be running: %+v", state)
+	}
+
+	page := scoreboard(t, ts)
+	for _, want := range []string{
+		`<div class="team" id="black-team">Blackhawks</div>`,
+		`<div class="team" id="yellow-team">Bruins</div>`,
+		`<span id="black-score">1</span>`,
+		`src="https://example.com/3.png"`,
+		`/tables/" + encodeURIComponent(table) + "/events"`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Fatalf("scoreboard is missing %q:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, `id="recent"`) {
+		t.Fatal("expected no recent results before a game has finished")
+	}
+
+	for i := 0; i < 4; i++ {
+		b1.goal()
+		ts.expectState()
+	}
+	ts.expectMessage("Game Over")
+	page = scoreboard(t, ts)
+	if !strings.Contains(page, `<td class="score-cell">5 - 0</td>`) || !strings.Contains(page, "Chicago Blackhawks") {
+		t.Fatalf("expected the finished game in recent results:\n%s", page)
+	}
+}
+
+func TestPauseStopsTheClock(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	b1, _, _, _ := setUpMatch(ts)
+	b1.send(dcflMsg{Action: "pause"})
+	state := ts.expectState()
+	if state.PausedAt == 0 || state.PausedAt < state.StartedAt {
+		t.Fatalf("expected pause time to be recorded: %+v", state)
+	}
+	b1.send(dcflMsg{Action: "resume"})
+	state = ts.expectState()
+	if state.PausedAt != 0 || state.PausedMillis < 0 || state.Phase != phaseInPlay {
+		t.Fatalf("expected the clock to resume: %+v", state)
+	}
+}
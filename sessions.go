@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sessionRecord is a player's sign-in on one device. The session token proves
+// the session to every REST route and WebSocket, and the refresh token trades
+// in for a new session token before it expires.
+type sessionRecord struct {
+	ID       string `json:"id"`
+	PlayerID string `json:"player_id"`
+	// Hash of the current refresh token; the token itself is never stored.
+	RefreshHash string `json:"-"`
+	// Hash of the refresh token the current one replaced, to spot replays.
+	PreviousRefreshHash string `json:"-"`
+	UserAgent           string `json:"user_agent"`
+	CreatedTimestamp    int64  `json:"created_timestamp"`
+	RefreshedTimestamp  int64  `json:"refreshed_timestamp"`
+	// When the session ends unless it is refreshed.
+	ExpiresTimestamp int64 `json:"expires_timestamp"`
+	RevokedTimestamp int64 `json:"revoked_timestamp,omitempty"`
+	// Set in listings on the session the request was made with.
+	Current bool `json:"current,omitempty"`
+}
+
+// live reports whether the session can still be used at now.
+func (s sessionRecord) live(now int64) bool {
+	return s.RevokedTimestamp == 0 && s.ExpiresTimestamp > now
+}
+
+// sessionClaims is the signed content of a session token.
+type sessionClaims struct {
+	SessionID string `json:"sid"`
+	Sub       string `json:"sub"`
+	// Expiry in milliseconds.
+	Exp int64 `json:"exp"`
+}
+
+// sessionTokens is what a client receives when it signs in or refreshes.
+type sessionTokens struct {
+	SessionID               string `json:"session_id"`
+	Token                   string `json:"session_token"`
+	TokenExpiresTimestamp   int64  `json:"session_token_expires_timestamp"`
+	RefreshToken            string `json:"refresh_token"`
+	RefreshExpiresTimestamp int64  `json:"refresh_token_expires_timestamp"`
+}
+
+// sessionIssuer signs and checks session tokens and keeps their sessions in
+// the repository.
+type sessionIssuer struct {
+	key        []byte
+	ttl        time.Duration
+	refreshTTL time.Duration
+	repo       repository
+}
+
+func newSessionIssuer(cfg authConfig, repo repository) *sessionIssuer {
+	key := []byte(cfg.SessionSecret)
+	if len(key) == 0 {
+		logger.Warn("no session secret configured, sessions will not survive a restart")
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &sessionIssuer{key: key, ttl: cfg.SessionTTL, refreshTTL: cfg.RefreshTTL, repo: repo}
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (si *sessionIssuer) sign(payload string) string {
+	mac := hmac.New(sha256.New, si.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issue starts a new session for a player who has just proven their identity.
+func (si *sessionIssuer) issue(sub string, userAgent string) (sessionTokens, error) {
+	now := nowMillis()
+	secret := randomToken(32)
+	s := sessionRecord{
+		ID:                 randomToken(16),
+		PlayerID:           sub,
+		RefreshHash:        hashToken(secret),
+		UserAgent:          userAgent,
+		CreatedTimestamp:   now,
+		RefreshedTimestamp: now,
+		ExpiresTimestamp:   now + si.refreshTTL.Milliseconds(),
+	}
+	err := si.repo.CreateSession(s)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+	return si.tokens(s, secret), nil
+}
+
+// tokens returns a fresh session token for s along with its refresh token.
+func (si *sessionIssuer) tokens(s sessionRecord, secret string) sessionTokens {
+	claims := sessionClaims{SessionID: s.ID, Sub: s.PlayerID, Exp: nowMillis() + si.ttl.Milliseconds()}
+	if claims.Exp > s.ExpiresTimestamp {
+		claims.Exp = s.ExpiresTimestamp
+	}
+	data, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return sessionTokens{
+		SessionID:               s.ID,
+		Token:                   payload + "." + si.sign(payload),
+		TokenExpiresTimestamp:   claims.Exp,
+		RefreshToken:            s.ID + "." + secret,
+		RefreshExpiresTimestamp: s.ExpiresTimestamp,
+	}
+}
+
+// verify checks a session token and that its session has not been revoked.
+func (si *sessionIssuer) verify(token string) (*sessionClaims, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, authFailure("malformed_session", nil)
+	}
+	if !hmac.Equal([]byte(sig), []byte(si.sign(payload))) {
+		return nil, authFailure("bad_signature", nil)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, authFailure("malformed_session", err)
+	}
+	claims := &sessionClaims{}
+	err = json.Unmarshal(data, claims)
+	if err != nil {
+		return nil, authFailure("malformed_session", err)
+	}
+	now := nowMillis()
+	if claims.Exp <= now {
+		return nil, authFailure("expired_session", nil)
+	}
+	s, err := si.repo.GetSession(claims.SessionID)
+	if err == errNotFound || (err == nil && !s.live(now)) {
+		return nil, authFailure("revoked_session", nil)
+	} else if err != nil {
+		return nil, authFailure("session_lookup_failed", err)
+	}
+	return claims, nil
+}
+
+// refresh trades a refresh token for a new session token and refresh token,
+// extending the session.
+func (si *sessionIssuer) refresh(refreshToken string) (sessionTokens, error) {
+	id, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok {
+		return sessionTokens{}, authFailure("malformed_refresh_token", nil)
+	}
+	s, err := si.repo.GetSession(id)
+	if err == errNotFound {
+		return sessionTokens{}, authFailure("unknown_session", nil)
+	} else if err != nil {
+		return sessionTokens{}, err
+	}
+	now := nowMillis()
+	if !s.live(now) {
+		return sessionTokens{}, authFailure("revoked_session", nil)
+	}
+
+	next := randomToken(32)
+	hash := hashToken(secret)
+	s.RefreshedTimestamp = now
+	s.ExpiresTimestamp = now + si.refreshTTL.Milliseconds()
+	err = si.repo.RotateSession(id, hash, hashToken(next), s.ExpiresTimestamp)
+	if err == errNotFound {
+		// The session id is not secret, so only the refresh token that was
+		// just replaced proves a replay. Anything else is simply refused.
+		s, err = si.repo.GetSession(id)
+		if err != nil && err != errNotFound {
+			return sessionTokens{}, err
+		}
+		if s.PreviousRefreshHash == "" || !hmac.Equal([]byte(hash), []byte(s.PreviousRefreshHash)) {
+			return sessionTokens{}, authFailure("bad_refresh_token", nil)
+		}
+		// Refresh tokens are single use. One presented again has been copied,
+		// so the session is no longer trusted.
+		logger.Warn("refresh token reused, revoking session", "sub", s.PlayerID, "session", id)
+		err = si.repo.RevokeSession(id)
+		if err != nil {
+			return sessionTokens{}, err
+		}
+		return sessionTokens{}, authFailure("reused_refresh_token", nil)
+	} else if err != nil {
+		return sessionTokens{}, err
+	}
+	return si.tokens(s, next), nil
+}
+
+// bearer returns the token of an Authorization header, with or without the
+// Bearer scheme.
+func bearer(header string) string {
+	return strings.TrimPrefix(header, "Bearer ")
+}
+
+// refreshHandler issues a new session token for a refresh token.
+type refreshHandler struct {
+	sessions *sessionIssuer
+}
+
+func (rh refreshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	tokens, err := rh.sessions.refresh(body.RefreshToken)
+	if err != nil {
+		authFailures.inc(failureReason(err))
+		logger.Info("refused session refresh", "remote", r.RemoteAddr, "err", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// logoutHandler revokes the session the request is made with, or every
+// session of the player with all=true, and closes their WebSockets.
+type logoutHandler struct {
+	auth authenticateHandler
+	h    *hub
+	repo repository
+}
+
+func (lh logoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := lh.auth.identify(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	session := token.SessionID
+	if r.URL.Query().Get("all") == "true" {
+		session = ""
+		err = lh.repo.RevokePlayerSessions(token.Sub)
+	} else {
+		err = lh.repo.RevokeSession(token.SessionID)
+	}
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	lh.h.signOut(token.Sub, session)
+	logger.Info("player signed out", "sub", token.Sub, "session", session)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionsHandler lists the live sessions of the caller.
+type sessionsHandler struct {
+	auth authenticateHandler
+	repo repository
+}
+
+func (sh sessionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := sh.auth.identify(w, r)
+	if !ok {
+		return
+	}
+	sessions, err := sh.repo.PlayerSessions(token.Sub)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == token.SessionID
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// sessionRevokeHandler revokes one of the caller's sessions, such as one left
+// signed in on a lost device.
+type sessionRevokeHandler struct {
+	auth authenticateHandler
+	h    *hub
+	repo repository
+}
+
+func (sh sessionRevokeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := sh.auth.identify(w, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	s, err := sh.repo.GetSession(id)
+	if err == errNotFound || (err == nil && s.PlayerID != token.Sub) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	err = sh.repo.RevokeSession(id)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	sh.h.signOut(token.Sub, id)
+	logger.Info("session revoked", "sub", token.Sub, "session", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// withToken makes a request with the given session token, or none if empty,
+// decoding a successful JSON response into out.
+func (ts *testServer) withToken(token string, method string, path string, body any, out any) int {
+	ts.t.Helper()
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, ts.srv.URL+path, bytes.NewReader(data))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+func TestAuthenticateStartsSession(t *testing.T) {
+	ts := newTestServer(t, "1", "2")
+
+	req, _ := http.NewRequest("POST", ts.srv.URL+"/authenticate", nil)
+	req.Header.Set("Authorization", "1")
+	req.Header.Set("User-Agent", "table tablet")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		validatedID
+		sessionTokens
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if body.Sub != "1" || body.Name != "Player 1" || body.Token == "" || body.RefreshToken == "" || body.TokenExpiresTimestamp > body.RefreshExpiresTimestamp {
+		t.Fatalf("expected the identity along with a session, got %+v", body)
+	}
+
+	// The identity provider's token is only good for signing in.
+	code, _ := ts.send("", "GET", "/sessions", "", nil, nil)
+	if code != http.StatusUnauthorized {
+		t.Fatalf("expected a request without a session to be refused, got %d", code)
+	}
+	req, _ = http.NewRequest("GET", ts.srv.URL+"/sessions", nil)
+	req.Header.Set("Authorization", "1")
+	resp, _ = http.DefaultClient.Do(req)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected an ID token to be refused outside sign-in, got %d", resp.StatusCode)
+	}
+
+	var sessions []sessionRecord
+	if code := ts.withToken(body.Token, "GET", "/sessions", nil, &sessions); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	current := 0
+	for _, s := range sessions {
+		if s.Current && s.UserAgent == "table tablet" && s.ID == body.SessionID {
+			current++
+		}
+	}
+	if len(sessions) != 2 || current != 1 {
+		t.Fatalf("expected both of player 1's sessions with this one marked, got %+v", sessions)
+	}
+	if code := ts.withToken(body.Token[:len(body.Token)-2], "GET", "/sessions", nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected a tampered token to be refused, got %d", code)
+	}
+}
+
+func TestSessionRefresh(t *testing.T) {
+	ts := newTestServer(t, "1")
+	first := ts.sessions["1"]
+
+	var second sessionTokens
+	if code := ts.withToken("", "POST", "/sessions/refresh", map[string]string{"refresh_token": first.RefreshToken}, &second); code != http.StatusOK {
+		t.Fatalf("expected the refresh to succeed, got %d", code)
+	}
+	if second.SessionID != first.SessionID || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("expected the same session with a new refresh token, got %+v", second)
+	}
+	if code := ts.withToken(second.Token, "GET", "/sessions", nil, nil); code != http.StatusOK {
+		t.Fatalf("expected the new session token to work, got %d", code)
+	}
+
+	// The session id is not secret, so a wrong secret is refused without
+	// ending the session.
+	if code := ts.withToken("", "POST", "/sessions/refresh", map[string]string{"refresh_token": second.SessionID + ".garbage"}, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected a forged refresh token to be refused, got %d", code)
+	}
+	if code := ts.withToken(second.Token, "GET", "/sessions", nil, nil); code != http.StatusOK {
+		t.Fatalf("expected a forged refresh token not to revoke the session, got %d", code)
+	}
+
+	// Replaying a used refresh token ends the session.
+	if code := ts.withToken("", "POST", "/sessions/refresh", map[string]string{"refresh_token": first.RefreshToken}, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected a reused refresh token to be refused, got %d", code)
+	}
+	if code := ts.withToken(second.Token, "GET", "/sessions", nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected the session to be revoked after reuse, got %d", code)
+	}
+	if code := ts.withToken("", "POST", "/sessions/refresh", map[string]string{"refresh_token": second.RefreshToken}, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected a revoked session not to refresh, got %d", code)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	ts := newTestServer(t, "1", "2")
+	phone := ts.sessions["1"]
+	laptop := ts.authenticate("1")
+	ts.connect("2")
+	ws, _, err := ts.dial("1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ts.expectState()
+
+	if code := ts.withToken(phone.Token, "DELETE", "/sessions/"+ts.sessions["2"].SessionID, nil, nil); code != http.StatusNotFound {
+		t.Fatalf("expected another player's session to be hidden, got %d", code)
+	}
+	if code := ts.withToken(phone.Token, "DELETE", "/sessions/"+laptop.SessionID, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("expected the laptop session to be revoked, got %d", code)
+	}
+	// The WebSocket was opened with the laptop's session.
+	expectClose(t, ws, websocket.ClosePolicyViolation)
+	if code := ts.withToken(laptop.Token, "GET", "/sessions", nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected the revoked session to be refused, got %d", code)
+	}
+
+	if code := ts.withToken(phone.Token, "POST", "/logout", nil, nil); code != http.StatusNoContent {
+		t.Fatalf("expected logout to succeed, got %d", code)
+	}
+	if code := ts.withToken(phone.Token, "GET", "/sessions", nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected the logged out session to be refused, got %d", code)
+	}
+	if code := ts.withToken(ts.sessions["2"].Token, "GET", "/sessions", nil, nil); code != http.StatusOK {
+		t.Fatalf("expected other players to stay signed in, got %d", code)
+	}
+
+	a, b := ts.authenticate("2"), ts.authenticate("2")
+	ts.withToken(a.Token, "POST", "/logout?all=true", nil, nil)
+	if code := ts.withToken(b.Token, "GET", "/sessions", nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected logging out everywhere to revoke every session, got %d", code)
+	}
+}
+
+func TestWebSocketNeedsSession(t *testing.T) {
+	ts := newTestServer(t, "1", "2")
+
+	ts.sessions["3"] = sessionTokens{Token: "forged"}
+	if _, resp, err := ts.dial("3", ""); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a WebSocket without a valid session to be refused, got %v", err)
+	}
+	ts.sessions["3"] = ts.sessions["1"]
+	if _, resp, err := ts.dial("3", ""); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a WebSocket for another player to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const restartReason = "server restarting, reconnect"
+
+// hubSnapshot is the state persisted across a restart. The badges of the last
+// finished game are not kept: they are stored with the game and were sent with
+// its Game Over message.
+type hubSnapshot struct {
+	State  matchState `json:"state"`
+	GameID int        `json:"game_id"`
+	Queue  []string   `json:"queue,omitempty"`
+	// The side that scored each goal, see hub.timeline.
+	Timeline []string `json:"timeline,omitempty"`
+	// The rotation session seating the table, if any.
+	Rotation *rotation `json:"rotation,omitempty"`
+	// The accepted challenge seated at the table and those waiting for it, by
+	// id. Their matches are rebuilt from the repository.
+	Challenge  int   `json:"challenge,omitempty"`
+	Challenges []int `json:"challenges,omitempty"`
+}
+
+// This function assumes and requires the caller to have the sideMx and scoreMx locks acquired.
+func (h *hub) saveState() error {
+	snapshot := hubSnapshot{State: h.state(), GameID: h.gameID, Queue: h.queue, Timeline: h.timeline, Rotation: h.rotation}
+	if h.challenge != nil {
+		snapshot.Challenge = h.challenge.id
+	}
+	for _, m := range h.challenges {
+		snapshot.Challenges = append(snapshot.Challenges, m.id)
+	}
+	state, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return h.repo.SaveHubState(h.table, string(state))
+}
+
+// restoreState loads the state saved by a previous shutdown, if any. It must be
+// called before the hub accepts connections.
+func (h *hub) restoreState() error {
+	state, err := h.repo.LoadHubState(h.table)
+	if err == errNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	snapshot := &hubSnapshot{}
+	err = json.Unmarshal([]byte(state), snapshot)
+	if err != nil {
+		return err
+	}
+	var seated *challengeMatch
+	var waiting []challengeMatch
+	for i, id := range append([]int{snapshot.Challenge}, snapshot.Challenges...) {
+		if id == 0 {
+			continue
+		}
+		m, err := loadChallengeMatch(h.repo, id)
+		if err != nil {
+			h.log().Error("error restoring challenge", "challenge", id, "err", err)
+			continue
+		}
+		if i == 0 {
+			seated = &m
+		} else {
+			waiting = append(waiting, m)
+		}
+	}
+
+	h.sideMx.Lock()
+	h.scoreMx.Lock()
+	h.blackSide = [2]player{snapshot.State.BlackPlayer1, snapshot.State.BlackPlayer2}
+	h.yellowSide = [2]player{snapshot.State.YellowPlayer1, snapshot.State.YellowPlayer2}
+	h.blackTeam = snapshot.State.BlackTeam
+	h.yellowTeam = snapshot.State.YellowTeam
+	h.blackScore = snapshot.State.BlackScore
+	h.yellowScore = snapshot.State.YellowScore
+	h.phase = snapshot.State.Phase
+	// Snapshots saved before formats were added are of doubles matches.
+	if snapshot.State.Format != "" {
+		h.format = snapshot.State.Format
+	}
+	h.gameID = snapshot.GameID
+	h.startedAt = snapshot.State.StartedAt
+	h.pausedAt = snapshot.State.PausedAt
+	h.pausedMillis = snapshot.State.PausedMillis
+	h.queue = snapshot.Queue
+	h.timeline = snapshot.Timeline
+	h.rotation = snapshot.Rotation
+	h.challenge = seated
+	h.challenges = waiting
+	if h.gameStarted() {
+		gamesActive.inc()
+	}
+	h.log().Info("restored match state", "black_score", h.blackScore, "yellow_score", h.yellowScore)
+	h.scoreMx.Unlock()
+	h.sideMx.Unlock()
+
+	return h.repo.DeleteHubState(h.table)
+}
+
+// shutdown stops processing requests, waits for the request being processed
+// to finish its database writes, persists the match and asks every client to
+// reconnect.
+func (h *hub) shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&h.closing, 1)
+	close(h.quit)
+	select {
+	case <-h.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	h.scoreMx.Lock()
+	h.sideMx.Lock()
+	err := h.saveState()
+	h.sideMx.Unlock()
+	h.scoreMx.Unlock()
+	if err != nil {
+		h.log().Error("error saving match state", "err", err)
+	} else {
+		h.log().Info("saved match state")
+	}
+
+	h.connectionsMx.RLock()
+	for c := range h.connections {
+		c.close(websocket.CloseServiceRestart, restartReason)
+	}
+	h.connectionsMx.RUnlock()
+	return err
+}
+
+// gracefulShutdown stops accepting connections, shuts the hub down, waits for
+// the webhook deliveries in flight, abandoning their retries, and closes the
+// repository, giving up once timeout has elapsed.
+func gracefulShutdown(srv *http.Server, h *hub, repo repository, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Shutdown does not track hijacked WebSocket connections, so it only waits
+	// for in-flight REST requests. Event streams never finish on their own, so
+	// they are ended first.
+	h.stopWatchers()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		return err
+	}
+	err = h.shutdown(ctx)
+	if err != nil {
+		return err
+	}
+	h.webhooks.stop()
+	err = h.webhooks.wait(ctx)
+	if err != nil {
+		return err
+	}
+	return repo.Close()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRestart(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4", "5", "6")
+	b1, _, y1, _ := setUpMatch(ts)
+	b1.goal()
+	ts.expectState()
+	b1.goal()
+	ts.expectState()
+	y1.goal()
+	before := ts.expectState()
+
+	// A challenge accepted mid-game waits for the table across the restart.
+	ts.repo.CreateTeam("Vancouver", "Canucks", "5", "6")
+	ts.post("5", "/challenges", challengeRequest{3, 2, ""}, nil)
+	ts.expectMessage("The Vancouver Canucks challenge the Boston Bruins!")
+	ts.post("3", "/challenges/1/accept", nil, nil)
+	ts.expectMessage("The Boston Bruins accepted the challenge from the Vancouver Canucks!")
+
+	// Shutdown waits for connections the client opened but never used.
+	http.DefaultClient.CloseIdleConnections()
+	if err := gracefulShutdown(ts.srv.Config, ts.hub, ts.repo, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ts.hub.running() {
+		t.Fatal("expected the hub to stop")
+	}
+	runningHubsMx.Lock()
+	_, sampled := runningHubs[ts.hub]
+	runningHubsMx.Unlock()
+	if sampled {
+		t.Fatal("expected a stopped hub to leave the queue depth metric")
+	}
+
+	h := newHub("test", ts.hub.rules, ts.repo)
+	if err := h.restoreState(); err != nil {
+		t.Fatal(err)
+	}
+	h.sideMx.Lock()
+	h.scoreMx.Lock()
+	after := h.state()
+	waiting := h.challenges
+	h.scoreMx.Unlock()
+	h.sideMx.Unlock()
+	if after != before {
+		t.Fatalf("expected %+v after the restart, got %+v", before, after)
+	}
+	if after.BlackScore != 2 || after.YellowScore != 1 || after.BlackTeam.Name != "Blackhawks" || after.YellowPlayer2.Sub != "4" {
+		t.Fatalf("expected the match in progress, got %+v", after)
+	}
+	if len(waiting) != 1 || waiting[0].id != 1 || waiting[0].blackTeam.Name != "Canucks" || waiting[0].yellowSide[0].Sub != "3" {
+		t.Fatalf("expected the accepted challenge to wait for the table, got %+v", waiting)
+	}
+	if _, err := ts.repo.LoadHubState("test"); err != errNotFound {
+		t.Fatalf("expected the snapshot to be used up, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	h.shutdown(ctx)
+}
+
+func TestRestartSeatedChallenge(t *testing.T) {
+	ts := newChallengeServer(t)
+	ts.post("1", "/challenges", challengeRequest{1, 2, ""}, nil)
+	ts.post("3", "/challenges/1/accept", nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ts.hub.shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	h := newHub("test", ts.hub.rules, ts.repo)
+	if err := h.restoreState(); err != nil {
+		t.Fatal(err)
+	}
+	h.sideMx.Lock()
+	state, seated := h.state(), h.challenge
+	h.sideMx.Unlock()
+	if seated == nil || seated.id != 1 || state.BlackTeam.Name != "Blackhawks" || state.YellowPlayer1.Sub != "3" {
+		t.Fatalf("expected the seated challenge to be restored, got %+v %+v", seated, state)
+	}
+	h.shutdown(ctx)
+}
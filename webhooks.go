@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Match events sent to webhooks.
+const (
+	eventGameStarted   = "game.started"
+	eventGoal          = "goal"
+	eventGameFinished  = "game.finished"
+	eventGameAbandoned = "game.abandoned"
+)
+
+const signatureHeader = "X-DCFL-Signature"
+const webhookTimeout = 10 * time.Second
+
+// matchEvent is the JSON payload of a webhook.
+type matchEvent struct {
+	ID        string     `json:"id"`
+	Type      string     `json:"type"`
+	Table     string     `json:"table"`
+	GameID    int        `json:"game_id"`
+	Timestamp int64      `json:"timestamp"`
+	State     matchState `json:"state"`
+	// The player who scored, for goal events.
+	Scorer string `json:"scorer,omitempty"`
+	Side   string `json:"side,omitempty"`
+}
+
+// webhookDelivery is one attempt at delivering an event to one URL.
+type webhookDelivery struct {
+	EventID    string `json:"event_id"`
+	EventType  string `json:"event_type"`
+	URL        string `json:"url"`
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error,omitempty"`
+	Delivered  bool   `json:"delivered"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// webhookDispatcher delivers match events to the configured URLs in the
+// background, retrying failed deliveries with exponential backoff until it is
+// stopped.
+type webhookDispatcher struct {
+	cfg    webhookConfig
+	repo   repository
+	client *http.Client
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newWebhookDispatcher(cfg webhookConfig, repo repository) *webhookDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhookDispatcher{cfg: cfg, repo: repo, client: &http.Client{Timeout: webhookTimeout}, ctx: ctx, cancel: cancel}
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sign returns the signature header value for body.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// fire queues event for delivery to every URL. It never blocks.
+func (wd *webhookDispatcher) fire(event matchEvent) {
+	if wd == nil || len(wd.cfg.URLs) == 0 {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("error encoding webhook event", "event", event.Type, "err", err)
+		return
+	}
+	for _, url := range wd.cfg.URLs {
+		wd.wg.Add(1)
+		go func(url string) {
+			defer wd.wg.Done()
+			wd.deliver(event, url, body)
+		}(url)
+	}
+}
+
+func (wd *webhookDispatcher) deliver(event matchEvent, url string, body []byte) {
+	log := logger.With("table", event.Table, "game_id", event.GameID, "event", event.Type, "event_id", event.ID, "url", url)
+	backoff := wd.cfg.Backoff
+	for attempt := 1; attempt <= wd.cfg.MaxAttempts; attempt++ {
+		d := webhookDelivery{
+			EventID:   event.ID,
+			EventType: event.Type,
+			URL:       url,
+			Attempt:   attempt,
+			Timestamp: nowMillis(),
+		}
+		status, err := wd.post(event, url, body)
+		d.StatusCode = status
+		if err != nil {
+			d.Error = err.Error()
+		} else {
+			d.Delivered = true
+		}
+		if err := wd.repo.RecordWebhookDelivery(d); err != nil {
+			log.Error("error recording webhook delivery", "err", err)
+		}
+
+		if d.Delivered {
+			webhookDeliveries.inc("delivered")
+			log.Debug("webhook delivered", "attempt", attempt)
+			return
+		}
+		log.Warn("webhook delivery failed", "attempt", attempt, "status", status, "err", err)
+		if attempt < wd.cfg.MaxAttempts {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-wd.ctx.Done():
+				timer.Stop()
+				webhookDeliveries.inc("failed")
+				log.Warn("stopped, giving up on webhook", "attempts", attempt)
+				return
+			}
+			backoff *= 2
+		}
+	}
+	webhookDeliveries.inc("failed")
+	log.Error("giving up on webhook", "attempts", wd.cfg.MaxAttempts)
+}
+
+func (wd *webhookDispatcher) post(event matchEvent, url string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-DCFL-Event", event.Type)
+	req.Header.Set("X-DCFL-Delivery", event.ID)
+	req.Header.Set(signatureHeader, sign(wd.cfg.Secret, body))
+
+	resp, err := wd.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// stop abandons the deliveries waiting to be retried. Attempts already being
+// made still finish.
+func (wd *webhookDispatcher) stop() {
+	if wd == nil {
+		return
+	}
+	wd.cancel()
+}
+
+// wait blocks until every queued delivery has finished or ctx is done.
+func (wd *webhookDispatcher) wait(ctx context.Context) error {
+	if wd == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		wd.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notify sends a match event for the current game to the webhooks.
+// This function assumes and requires the sideMx lock to be acquired by the caller.
+func (h *hub) notify(eventType string, scorer string) {
+	event := matchEvent{
+		ID:        newEventID(),
+		Type:      eventType,
+		Table:     h.table,
+		GameID:    h.gameID,
+		Timestamp: nowMillis(),
+		State:     h.state(),
+		Scorer:    scorer,
+	}
+	if scorer != "" {
+		event.Side = h.sideOf(scorer)
+	}
+	h.webhooks.fire(event)
+}
+
+// webhookDeliveriesHandler lists the most recent webhook delivery attempts to
+// admins.
+type webhookDeliveriesHandler struct {
+	auth authenticateHandler
+	repo repository
+}
+
+func (wh webhookDeliveriesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := wh.auth.admin(w, r); !ok {
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	deliveries, err := wh.repo.WebhookDeliveries(limit)
+	if err != nil {
+		logger.Error("error listing webhook deliveries", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
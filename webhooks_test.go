@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testWebhookSecret = "s3cret"
+
+// webhookReceiver records the events posted to it. It answers the first
+// failures requests for each event with a server error.
+type webhookReceiver struct {
+	t        *testing.T
+	srv      *httptest.Server
+	failures int
+
+	mx       sync.Mutex
+	attempts map[string]int
+	events   []matchEvent
+}
+
+func newWebhookReceiver(t *testing.T, failures int) *webhookReceiver {
+	wr := &webhookReceiver{t: t, failures: failures, attempts: make(map[string]int)}
+	wr.srv = httptest.NewServer(http.HandlerFunc(wr.serve))
+	t.Cleanup(wr.srv.Close)
+	return wr
+}
+
+func (wr *webhookReceiver) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if got := r.Header.Get(signatureHeader); got != sign(testWebhookSecret, body) {
+		wr.t.Errorf("bad signature %q", got)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var event matchEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		wr.t.Errorf("bad payload %s: %v", body, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("X-DCFL-Event") != event.Type || r.Header.Get("X-DCFL-Delivery") != event.ID {
+		wr.t.Errorf("headers do not match payload %+v: %v", event, r.Header)
+	}
+
+	wr.mx.Lock()
+	defer wr.mx.Unlock()
+	wr.attempts[event.ID]++
+	if wr.attempts[event.ID] <= wr.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	wr.events = append(wr.events, event)
+}
+
+// received returns the types of the events delivered so far, sorted.
+func (wr *webhookReceiver) received() []string {
+	wr.mx.Lock()
+	defer wr.mx.Unlock()
+	var types []string
+	for _, e := range wr.events {
+		types = append(types, e.Type)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func withWebhooks(ts *testServer, wr *webhookReceiver, maxAttempts int) {
+	ts.hub.webhooks = newWebhookDispatcher(webhookConfig{
+		URLs:        []string{wr.srv.URL},
+		Secret:      testWebhookSecret,
+		MaxAttempts: maxAttempts,
+		Backoff:     time.Millisecond,
+	}, ts.repo)
+}
+
+func waitForWebhooks(t *testing.T, h *hub) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.webhooks.wait(ctx); err != nil {
+		t.Fatalf("webhooks not delivered: %v", err)
+	}
+}
+
+func TestWebhooksFullMatch(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	wr := newWebhookReceiver(t, 0)
+	withWebhooks(ts, wr, 1)
+	b1, _, _, _ := setUpMatch(ts)
+	for i := 0; i < 5; i++ {
+		b1.goal()
+		ts.expectState()
+	}
+	ts.expectMessage("Game Over")
+	waitForWebhooks(t, ts.hub)
+
+	want := []string{"game.finished", "game.started", "goal", "goal", "goal", "goal", "goal"}
+	if got := wr.received(); !equalStrings(got, want) {
+		t.Fatalf("expected events %v, got %v", want, got)
+	}
+	for _, e := range wr.events {
+		if e.Table != "test" || e.GameID != ts.repo.games[0].id {
+			t.Fatalf("event for the wrong game: %+v", e)
+		}
+		switch e.Type {
+		case eventGoal:
+			if e.Scorer != "1" || e.Side != "black" {
+				t.Fatalf("wrong scorer: %+v", e)
+			}
+		case eventGameFinished:
+			if e.State.BlackScore != 5 || e.State.Phase != phaseFinished {
+				t.Fatalf("wrong final state: %+v", e.State)
+			}
+		}
+	}
+}
+
+func TestWebhooksAbandonedGame(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	wr := newWebhookReceiver(t, 0)
+	withWebhooks(ts, wr, 1)
+	_, _, y1, _ := setUpMatch(ts)
+
+	ts.disconnect(y1)
+	ts.expectState()
+	ts.expectMessage("Player left mid-game")
+	waitForWebhooks(t, ts.hub)
+
+	want := []string{"game.abandoned", "game.started"}
+	if got := wr.received(); !equalStrings(got, want) {
+		t.Fatalf("expected events %v, got %v", want, got)
+	}
+}
+
+func TestWebhooksRetry(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	wr := newWebhookReceiver(t, 2)
+	withWebhooks(ts, wr, 3)
+	setUpMatch(ts)
+	waitForWebhooks(t, ts.hub)
+
+	if got := wr.received(); !equalStrings(got, []string{"game.started"}) {
+		t.Fatalf("expected game.started after retries, got %v", got)
+	}
+
+	if code := ts.get("/webhooks/deliveries", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected the delivery log to require sign-in, got %d", code)
+	}
+	if code, _ := ts.send("2", "GET", "/webhooks/deliveries", "", nil, nil); code != http.StatusForbidden {
+		t.Fatalf("expected the delivery log to be admin-only, got %d", code)
+	}
+	var deliveries []webhookDelivery
+	ts.send("1", "GET", "/webhooks/deliveries", "", nil, &deliveries)
+	if len(deliveries) != 3 {
+		t.Fatalf("expected 3 delivery attempts, got %+v", deliveries)
+	}
+	for i, d := range deliveries {
+		attempt := 3 - i
+		if d.Attempt != attempt || d.Delivered != (attempt == 3) {
+			t.Fatalf("unexpected delivery log %+v", deliveries)
+		}
+		if !d.Delivered && d.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("expected failed attempts to record the status: %+v", d)
+		}
+	}
+}
+
+func TestWebhooksGiveUp(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	wr := newWebhookReceiver(t, 10)
+	withWebhooks(ts, wr, 2)
+	setUpMatch(ts)
+	waitForWebhooks(t, ts.hub)
+
+	if got := wr.received(); len(got) != 0 {
+		t.Fatalf("expected no deliveries, got %v", got)
+	}
+	deliveries, _ := ts.repo.WebhookDeliveries(10)
+	if len(deliveries) != 2 || deliveries[0].Delivered || deliveries[1].Delivered {
+		t.Fatalf("expected 2 failed attempts, got %+v", deliveries)
+	}
+}
+
+func TestWebhooksStop(t *testing.T) {
+	ts := newTestServer(t, "1", "2", "3", "4")
+	wr := newWebhookReceiver(t, 10)
+	ts.hub.webhooks = newWebhookDispatcher(webhookConfig{
+		URLs:        []string{wr.srv.URL},
+		Secret:      testWebhookSecret,
+		MaxAttempts: 3,
+		Backoff:     time.Hour,
+	}, ts.repo)
+	setUpMatch(ts)
+	ts.hub.webhooks.stop()
+	waitForWebhooks(t, ts.hub)
+
+	deliveries, _ := ts.repo.WebhookDeliveries(10)
+	if len(deliveries) != 1 || deliveries[0].Delivered {
+		t.Fatalf("expected the retry to be abandoned, got %+v", deliveries)
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}